@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// accessLogEnabled reports whether the websocket handshakes are logged, set
+// RANGO_ACCESS_LOG=true to log them.
+func accessLogEnabled() bool {
+	enabled, err := strconv.ParseBool(getEnv("RANGO_ACCESS_LOG", "false"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_ACCESS_LOG: %s", err.Error())
+		return false
+	}
+	return enabled
+}
+
+// accessRecorder records the status of a response, 101 once the connection
+// was hijacked to upgrade it.
+type accessRecorder struct {
+	http.ResponseWriter
+	status   int
+	upgraded bool
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.status, w.upgraded = http.StatusSwitchingProtocols, true
+	}
+	return conn, rw, err
+}
+
+// accessLogHandler logs the method, path, client IP, behind the trusted
+// proxies, status and UID of the requests handled by h, and whether their
+// connection was upgraded.
+func accessLogHandler(h httpHanlder, proxies []*net.IPNet) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &accessRecorder{ResponseWriter: w}
+		h(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		log.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("remote_addr", routing.ClientIP(r, proxies)).
+			Int("status", status).
+			Str("uid", r.Header.Get(uidHeader)).
+			Bool("upgraded", recorder.upgraded).
+			Msg("access")
+	}
+}
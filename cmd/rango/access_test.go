@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/auth"
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+func TestAccess_accessLogEnabled(t *testing.T) {
+	assert.False(t, accessLogEnabled())
+
+	t.Setenv("RANGO_ACCESS_LOG", "true")
+	assert.True(t, accessLogEnabled())
+}
+
+// syncBuffer is a buffer written by the handlers and read by the test.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestAccess_accessLogHandler(t *testing.T) {
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	var logs syncBuffer
+	log.Logger = zerolog.New(&logs)
+
+	hub := routing.NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		routing.NewClient(hub, w, r)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/private", accessLogHandler(authHandler(wsHandler, ks, true), nil))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	// entry returns the nth access log entry once logged.
+	entry := func(t *testing.T, n int) map[string]interface{} {
+		var entries []map[string]interface{}
+		require.Eventually(t, func() bool {
+			entries = nil
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				e := map[string]interface{}{}
+				if json.Unmarshal([]byte(line), &e) == nil && e["message"] == "access" {
+					entries = append(entries, e)
+				}
+			}
+			return len(entries) >= n
+		}, time.Second, 10*time.Millisecond, logs.String())
+		return entries[n-1]
+	}
+
+	t.Run("rejected private connection", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/private", nil)
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		e := entry(t, 1)
+		assert.Equal(t, "GET", e["method"])
+		assert.Equal(t, "/private", e["path"])
+		assert.NotEmpty(t, e["remote_addr"])
+		assert.Equal(t, float64(http.StatusUnauthorized), e["status"])
+		assert.Equal(t, "", e["uid"])
+		assert.Equal(t, false, e["upgraded"])
+	})
+
+	t.Run("upgraded connection", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":  time.Now().Add(time.Hour).Unix(),
+			"uid":  "UIDABC00001",
+			"role": "member",
+		}).SignedString([]byte("secret"))
+		require.NoError(t, err)
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/private", http.Header{
+			"Authorization": {"Bearer " + token},
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		e := entry(t, 2)
+		assert.Equal(t, float64(http.StatusSwitchingProtocols), e["status"])
+		assert.Equal(t, "UIDABC00001", e["uid"])
+		assert.Equal(t, true, e["upgraded"])
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// adminHandler only lets through authenticated requests with one of the given roles.
+func adminHandler(h httpHanlder, roles []string) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := r.Header.Get(roleHeader)
+
+		for _, allowed := range roles {
+			if role != "" && role == allowed {
+				h(w, r)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+func getAdminRoles() []string {
+	return strings.Split(getEnv("RANGO_ADMIN_ROLES", "admin"), ",")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// rbacHandler replaces the hub RBAC matrix with the JSON body of the request,
+// the body maps stream prefixes to the roles allowed to subscribe to them.
+func rbacHandler(hub *routing.Hub) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		rbac := make(map[string][]string)
+		if err := json.NewDecoder(r.Body).Decode(&rbac); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		hub.UpdateRBAC(rbac)
+		log.Info().Msgf("RBAC updated by %s: %v", r.Header.Get(uidHeader), rbac)
+
+		writeJSON(w, http.StatusOK, rbac)
+	}
+}
+
+// connectionsHandler returns the connected clients count and limit on GET,
+// and sets the limit from a {"max":n} body on POST, 0 removes the limit.
+func connectionsHandler(hub *routing.Hub) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body struct {
+				Max *int `json:"max"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if body.Max == nil || *body.Max < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "max must be zero or more"})
+				return
+			}
+
+			hub.SetMaxConnections(*body.Max)
+			log.Info().Msgf("Max connections updated by %s: %d", r.Header.Get(uidHeader), *body.Max)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]int{
+			"max":     hub.MaxConnections(),
+			"current": hub.ClientsCount(),
+		})
+	}
+}
+
+// streamsHandler pauses and resumes the dispatch of a stream on POST
+// /admin/streams/{name}/pause and /admin/streams/{name}/resume, the
+// subscriptions of paused streams are kept. POST /admin/streams/{name}/drain
+// notifies the subscribers of a deprecated stream and unsubscribes them from
+// it. GET /admin/streams lists the paused streams with the number of messages
+// dropped since.
+func streamsHandler(hub *routing.Hub) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/streams"), "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"paused": hub.PausedStreams()})
+			return
+		}
+
+		i := strings.LastIndex(path, "/")
+		if i <= 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		stream, action := path[:i], path[i+1:]
+		if action != "pause" && action != "resume" && action != "drain" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		uid := r.Header.Get(uidHeader)
+		if action == "drain" {
+			drained := hub.DrainStream(stream)
+			log.Info().Msgf("Stream %s drained by %s, %d subscribers unsubscribed", stream, uid, drained)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"stream": stream, "drained": drained})
+			return
+		}
+		if action == "pause" {
+			hub.PauseStream(stream)
+			log.Info().Msgf("Stream %s paused by %s", stream, uid)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"stream": stream, "paused": true})
+			return
+		}
+
+		dropped := hub.ResumeStream(stream)
+		log.Info().Msgf("Stream %s resumed by %s, %d messages dropped", stream, uid, dropped)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"stream": stream, "paused": false, "dropped": dropped})
+	}
+}
+
+// getInjectKeys returns the routing keys messages may be injected with,
+// RANGO_INJECT_KEYS enables /admin/inject when set.
+func getInjectKeys() []string {
+	return getEnvList("RANGO_INJECT_KEYS")
+}
+
+// injectHandler routes the message of a {"key":"public.probe.ticks","value":{}}
+// body on POST as if received upstream, for synthetic monitors to probe the
+// delivery to clients. Only the given keys may be injected so that real
+// streams are left untouched.
+func injectHandler(hub *routing.Hub, keys []string) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if len(body.Value) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "value is required"})
+			return
+		}
+		allowed := false
+		for _, key := range keys {
+			allowed = allowed || key == body.Key
+		}
+		if !allowed {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "key not allowed for injection"})
+			return
+		}
+
+		hub.InjectMsg(&routing.Message{Key: []byte(body.Key), Value: body.Value, Timestamp: time.Now()})
+		log.Debug().Msgf("Message injected into %s by %s", body.Key, r.Header.Get(uidHeader))
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": body.Key, "injected": true})
+	}
+}
+
+// Default and maximum number of streams and users listed by the stats.
+const (
+	defaultStatsLimit = 100
+	maxStatsLimit     = 1000
+)
+
+// statsLimit returns the limit of the query parameter name, bounded to maxStatsLimit.
+func statsLimit(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultStatsLimit, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be zero or more", name)
+	}
+	if n > maxStatsLimit {
+		n = maxStatsLimit
+	}
+	return n, nil
+}
+
+// statsHandler returns the connections count, the subscribers of the streams
+// and the users with the most connections, the streams and users listed being
+// limited by the streams and users query parameters.
+func statsHandler(hub *routing.Hub) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		streams, err := statsLimit(r, "streams")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		users, err := statsLimit(r, "users")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, hub.Stats(streams, users))
+	}
+}
+
+// debugVarsEnabled reports whether the hub counters are served on /debug/vars,
+// set RANGO_DEBUG_VARS=true to serve them.
+func debugVarsEnabled() bool {
+	enabled, err := strconv.ParseBool(getEnv("RANGO_DEBUG_VARS", "false"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_DEBUG_VARS: %s", err.Error())
+		return false
+	}
+	return enabled
+}
+
+// debugVarsHandler returns the live counters of the hub, the goroutines and
+// write loops running, the subscriptions of the shards, the inbound queue and
+// the messages dropped.
+func debugVarsHandler(hub *routing.Hub) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, hub.DebugVars())
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+func TestAdmin_adminHandler(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	h := adminHandler(ok, []string{"admin", "superadmin"})
+
+	for role, status := range map[string]int{
+		"admin":      http.StatusOK,
+		"superadmin": http.StatusOK,
+		"member":     http.StatusForbidden,
+		"":           http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		r.Header.Set("JwtRole", role)
+		w := httptest.NewRecorder()
+
+		h(w, r)
+		assert.Equal(t, status, w.Code, role)
+	}
+}
+
+func TestAdmin_rbacHandler(t *testing.T) {
+	hub := routing.NewHub(map[string][]string{"admin": {"admin"}})
+	h := rbacHandler(hub)
+
+	t.Run("updates RBAC", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/admin/rbac", strings.NewReader(`{"admin":["admin","operator"],"finex":["trader"]}`))
+		w := httptest.NewRecorder()
+
+		h(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string][]string{
+			"admin": {"admin", "operator"},
+			"finex": {"trader"},
+		}, hub.RBAC)
+	})
+
+	t.Run("rejects invalid body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/admin/rbac", strings.NewReader(`{"admin":`))
+		w := httptest.NewRecorder()
+
+		h(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, []string{"trader"}, hub.RBAC["finex"])
+	})
+
+	t.Run("rejects GET", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/admin/rbac", nil)
+		w := httptest.NewRecorder()
+
+		h(w, r)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestAdmin_connectionsHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	h := connectionsHandler(hub)
+
+	t.Run("returns the limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/admin/connections", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"max":0,"current":0}`, w.Body.String())
+	})
+
+	t.Run("updates the limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/admin/connections", strings.NewReader(`{"max":100}`)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"max":100,"current":0}`, w.Body.String())
+		assert.Equal(t, 100, hub.MaxConnections())
+	})
+
+	t.Run("rejects invalid limits", func(t *testing.T) {
+		for _, body := range []string{`{"max":-1}`, `{}`, `{"max":`} {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodPost, "/admin/connections", strings.NewReader(body)))
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+		assert.Equal(t, 100, hub.MaxConnections())
+	})
+
+	t.Run("rejects DELETE", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodDelete, "/admin/connections", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestAdmin_streamsHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	h := streamsHandler(hub)
+
+	t.Run("pauses a stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/admin/streams/eurusd.trades/pause", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"stream":"eurusd.trades","paused":true}`, w.Body.String())
+
+		hub.ReceiveMsg(&routing.Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/admin/streams", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"paused":{"eurusd.trades":1}}`, w.Body.String())
+	})
+
+	t.Run("resumes a stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/admin/streams/eurusd.trades/resume", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"stream":"eurusd.trades","paused":false,"dropped":1}`, w.Body.String())
+		assert.Empty(t, hub.PausedStreams())
+	})
+
+	t.Run("drains a stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/admin/streams/eurusd.trades/drain", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"stream":"eurusd.trades","drained":0}`, w.Body.String())
+	})
+
+	t.Run("rejects unknown actions", func(t *testing.T) {
+		for _, path := range []string{"/admin/streams/eurusd.trades/stop", "/admin/streams/pause", "/admin/streams/eurusd.trades"} {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodPost, path, nil))
+			assert.Equal(t, http.StatusNotFound, w.Code, path)
+		}
+		assert.Empty(t, hub.PausedStreams())
+	})
+
+	t.Run("rejects GET of actions", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/admin/streams/eurusd.trades/pause", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Empty(t, hub.PausedStreams())
+	})
+}
+
+func TestAdmin_statsHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	h := statsHandler(hub)
+
+	t.Run("returns the stats", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{
+			"connections":{"total":0,"public":0,"private":0},
+			"streams":{},
+			"streams_count":0,
+			"top_users":[]
+		}`, w.Body.String())
+	})
+
+	t.Run("rejects invalid limits", func(t *testing.T) {
+		for _, query := range []string{"streams=-1", "users=x"} {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/admin/stats?"+query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+
+	t.Run("rejects POST", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/admin/stats", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestAdmin_statsLimit(t *testing.T) {
+	for query, limit := range map[string]int{
+		"":               defaultStatsLimit,
+		"?streams=5":     5,
+		"?streams=0":     0,
+		"?streams=50000": maxStatsLimit,
+	} {
+		n, err := statsLimit(httptest.NewRequest(http.MethodGet, "/admin/stats"+query, nil), "streams")
+		assert.NoError(t, err, query)
+		assert.Equal(t, limit, n, query)
+	}
+}
+
+func TestAdmin_injectHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	h := adminHandler(injectHandler(hub, []string{"public.probe.ticks"}), []string{"admin"})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routing.NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	probe, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?stream=probe.ticks", nil)
+	require.NoError(t, err)
+	defer probe.Close()
+	for _, event := range []string{`"event":"hello"`, `"message":"subscribed"`} {
+		_, msg, err := probe.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), event)
+	}
+
+	inject := func(role, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/inject", strings.NewReader(body))
+		r.Header.Set("JwtRole", role)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	t.Run("injects a message", func(t *testing.T) {
+		w := inject("admin", `{"key":"public.probe.ticks","value":{"sent_at":1588000798}}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"key":"public.probe.ticks","injected":true}`, w.Body.String())
+
+		probe.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := probe.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"probe.ticks":{"sent_at":1588000798}}`, string(msg))
+	})
+
+	t.Run("rejects other keys", func(t *testing.T) {
+		w := inject("admin", `{"key":"public.eurusd.trades","value":{}}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("rejects invalid bodies", func(t *testing.T) {
+		for _, body := range []string{`{"key":"public.probe.ticks"}`, `{"key":"public.probe.ticks","value":{`} {
+			w := inject("admin", body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+	})
+
+	t.Run("rejects non admins", func(t *testing.T) {
+		w := inject("member", `{"key":"public.probe.ticks","value":{}}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("rejects GET", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/admin/inject", nil)
+		r.Header.Set("JwtRole", "admin")
+		w := httptest.NewRecorder()
+		h(w, r)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestAdmin_getInjectKeys(t *testing.T) {
+	assert.Empty(t, getInjectKeys())
+
+	t.Setenv("RANGO_INJECT_KEYS", "public.probe.ticks, private.UIDPROBE001.probe")
+	assert.Equal(t, []string{"public.probe.ticks", "private.UIDPROBE001.probe"}, getInjectKeys())
+}
+
+func TestAdmin_debugVarsEnabled(t *testing.T) {
+	assert.False(t, debugVarsEnabled())
+
+	t.Setenv("RANGO_DEBUG_VARS", "true")
+	assert.True(t, debugVarsEnabled())
+}
+
+func TestAdmin_debugVarsHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	h := adminHandler(debugVarsHandler(hub), []string{"admin"})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routing.NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	for _, query := range []string{"?stream=eurusd.trades", "?stream=eurusd.trades,usdjpy.trades"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/"+query, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	get := func(role string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		r.Header.Set("JwtRole", role)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	t.Run("returns the hub counters", func(t *testing.T) {
+		var vars routing.DebugVars
+		require.Eventually(t, func() bool {
+			w := get("admin")
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+			return vars.Clients == 2
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Positive(t, vars.Goroutines)
+		assert.GreaterOrEqual(t, vars.Writers, int64(2))
+		assert.NotEmpty(t, vars.Shards)
+		topics, subscriptions := 0, 0
+		for _, shard := range vars.Shards {
+			topics += shard.Topics
+			subscriptions += shard.Subscriptions
+		}
+		assert.Equal(t, 2, topics)
+		assert.Equal(t, 3, subscriptions)
+		assert.Equal(t, routing.InboundQueueVars{}, vars.InboundQueue)
+	})
+
+	t.Run("rejects other roles", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, get("member").Code)
+	})
+
+	t.Run("rejects POST", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/debug/vars", nil)
+		r.Header.Set("JwtRole", "admin")
+		w := httptest.NewRecorder()
+		h(w, r)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
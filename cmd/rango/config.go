@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func getEnvInt(name string, value int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return value
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Error().Msgf("Invalid %s: %s", name, err.Error())
+		return value
+	}
+	return i
+}
+
+func getEnvFloat(name string, value float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return value
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Error().Msgf("Invalid %s: %s", name, err.Error())
+		return value
+	}
+	return f
+}
+
+func getEnvDuration(name string, value time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return value
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Error().Msgf("Invalid %s: %s", name, err.Error())
+		return value
+	}
+	return d
+}
+
+func getEnvBool(name string, value bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return value
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Error().Msgf("Invalid %s: %s", name, err.Error())
+		return value
+	}
+	return b
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nusa-exchange/rango/pkg/auth"
+	"github.com/nusa-exchange/rango/pkg/routing"
+	"github.com/nusa-exchange/rango/pkg/source"
+)
+
+// healthzHandler reports the process is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the consumer is connected and the keys are
+// loaded, unless started public only without keys, responding 503 otherwise.
+func readyzHandler(hub *routing.Hub, src source.Source, ks *auth.KeyStore, publicOnly bool) httpHanlder {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consumer := src != nil && src.Healthy()
+		keys := ks != nil && ks.HasKeys()
+
+		var lastMessageAge interface{}
+		if at := hub.LastMessageAt(); !at.IsZero() {
+			lastMessageAge = time.Since(at).Seconds()
+		}
+
+		status := http.StatusOK
+		if !consumer || !keys && !publicOnly {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, map[string]interface{}{
+			"consumer":         consumer,
+			"public_key":       keys,
+			"clients":          hub.ClientsCount(),
+			"last_message_age": lastMessageAge,
+		})
+	}
+}
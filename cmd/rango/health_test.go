@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/auth"
+	"github.com/nusa-exchange/rango/pkg/routing"
+	"github.com/nusa-exchange/rango/pkg/source"
+)
+
+type fakeSource bool
+
+func (s fakeSource) Run(ctx context.Context, handle source.Handler) error { return nil }
+func (s fakeSource) Healthy() bool                                        { return bool(s) }
+
+func TestHealth_healthzHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealth_readyzHandler(t *testing.T) {
+	hub := routing.NewHub(nil)
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+
+	readyz := func(src source.Source, ks *auth.KeyStore, publicOnly bool) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		readyzHandler(hub, src, ks, publicOnly)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		code, body := readyz(fakeSource(true), ks, false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]interface{}{
+			"consumer":         true,
+			"public_key":       true,
+			"clients":          float64(0),
+			"last_message_age": nil,
+		}, body)
+	})
+
+	t.Run("consumer disconnected", func(t *testing.T) {
+		code, body := readyz(fakeSource(false), ks, false)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, false, body["consumer"])
+	})
+
+	t.Run("keys not loaded", func(t *testing.T) {
+		code, body := readyz(fakeSource(true), &auth.KeyStore{}, false)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, false, body["public_key"])
+	})
+
+	t.Run("public only without keys", func(t *testing.T) {
+		code, body := readyz(fakeSource(true), &auth.KeyStore{}, true)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, false, body["public_key"])
+	})
+
+	t.Run("reports last message age", func(t *testing.T) {
+		hub.ReceiveMsg(&routing.Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+
+		_, body := readyz(fakeSource(true), ks, false)
+		assert.IsType(t, float64(0), body["last_message_age"])
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Header carrying the shared secret of the trusted proxy.
+const proxySecretHeader = "X-Rango-Proxy-Secret"
+
+// trustedProxy authenticates the requests of a gateway having already
+// validated their token, which set the UID and role headers itself. Nil
+// unless RANGO_TRUST_PROXY_AUTH is enabled.
+var trustedProxy *proxyAuth
+
+// proxyAuth trusts the UID and role headers of the requests coming from one of
+// its networks or carrying its shared secret.
+type proxyAuth struct {
+	networks []*net.IPNet
+	secret   string
+}
+
+// getTrustedProxies returns the networks of the proxies in front of rango,
+// listed as comma separated IPs or CIDRs in RANGO_TRUSTED_PROXIES.
+func getTrustedProxies() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range getEnvList("RANGO_TRUSTED_PROXIES") {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RANGO_TRUSTED_PROXIES: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// getProxyAuth returns the trusted proxy when RANGO_TRUST_PROXY_AUTH is
+// enabled, nil otherwise. The proxy is trusted by its address, one of
+// RANGO_TRUSTED_PROXIES, or by the RANGO_PROXY_AUTH_SECRET it sends in the
+// X-Rango-Proxy-Secret header, at least one of them must be set.
+func getProxyAuth() (*proxyAuth, error) {
+	enabled, err := strconv.ParseBool(getEnv("RANGO_TRUST_PROXY_AUTH", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RANGO_TRUST_PROXY_AUTH: %w", err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	p := &proxyAuth{secret: os.Getenv("RANGO_PROXY_AUTH_SECRET")}
+	if p.networks, err = getTrustedProxies(); err != nil {
+		return nil, err
+	}
+	if len(p.networks) == 0 && p.secret == "" {
+		return nil, errors.New("RANGO_TRUST_PROXY_AUTH requires RANGO_TRUSTED_PROXIES or RANGO_PROXY_AUTH_SECRET")
+	}
+	return p, nil
+}
+
+// trusts reports whether the request comes from the proxy, by its remote
+// address or shared secret. Forwarded headers are ignored as any client can
+// set them.
+func (p *proxyAuth) trusts(r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+
+	if p.secret != "" {
+		secret := r.Header.Get(proxySecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(p.secret)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
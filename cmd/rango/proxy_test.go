@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/auth"
+)
+
+func TestProxy_getProxyAuth(t *testing.T) {
+	p, err := getProxyAuth()
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	t.Setenv("RANGO_TRUST_PROXY_AUTH", "true")
+	_, err = getProxyAuth()
+	assert.Error(t, err)
+
+	t.Setenv("RANGO_TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1, ::1")
+	p, err = getProxyAuth()
+	require.NoError(t, err)
+	require.Len(t, p.networks, 3)
+	assert.Equal(t, "192.0.2.1/32", p.networks[1].String())
+	assert.Equal(t, "::1/128", p.networks[2].String())
+
+	t.Setenv("RANGO_TRUSTED_PROXIES", "gateway")
+	_, err = getProxyAuth()
+	assert.Error(t, err)
+
+	t.Setenv("RANGO_TRUSTED_PROXIES", "")
+	t.Setenv("RANGO_PROXY_AUTH_SECRET", "secret")
+	p, err = getProxyAuth()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", p.secret)
+
+	t.Setenv("RANGO_TRUST_PROXY_AUTH", "maybe")
+	_, err = getProxyAuth()
+	assert.Error(t, err)
+}
+
+func TestProxy_getTrustedProxies(t *testing.T) {
+	networks, err := getTrustedProxies()
+	assert.NoError(t, err)
+	assert.Empty(t, networks)
+
+	t.Setenv("RANGO_TRUSTED_PROXIES", "10.0.0.0/8,192.0.2.1")
+	networks, err = getTrustedProxies()
+	require.NoError(t, err)
+	require.Len(t, networks, 2)
+	assert.Equal(t, "10.0.0.0/8", networks[0].String())
+	assert.Equal(t, "192.0.2.1/32", networks[1].String())
+}
+
+func TestProxy_authHandler(t *testing.T) {
+	defer func(p *proxyAuth) { trustedProxy = p }(trustedProxy)
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+
+	var handled http.Header
+	h := func(w http.ResponseWriter, r *http.Request) {
+		handled = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	request := func(remoteAddr, secret string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("JwtUID", "UIDABC00001")
+		r.Header.Set("JwtRole", "admin")
+		r.Header.Set("JwtError", auth.ReasonTokenExpired)
+		if secret != "" {
+			r.Header.Set(proxySecretHeader, secret)
+		}
+		return r
+	}
+
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	proxy := &proxyAuth{networks: []*net.IPNet{network}, secret: "shared"}
+
+	tests := map[string]struct {
+		proxy   *proxyAuth
+		request *http.Request
+		trusted bool
+	}{
+		"trusted address":   {proxy, request("10.1.2.3:4567", ""), true},
+		"trusted secret":    {proxy, request("192.0.2.1:4567", "shared"), true},
+		"untrusted address": {proxy, request("192.0.2.1:4567", ""), false},
+		"wrong secret":      {proxy, request("192.0.2.1:4567", "guess"), false},
+		"disabled":          {nil, request("10.1.2.3:4567", "shared"), false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			trustedProxy = tt.proxy
+			handled = nil
+			w := httptest.NewRecorder()
+			authHandler(h, ks, true)(w, tt.request)
+
+			if !tt.trusted {
+				assert.Nil(t, handled)
+				assert.Equal(t, http.StatusUnauthorized, w.Code)
+				return
+			}
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "UIDABC00001", handled.Get("JwtUID"))
+			assert.Equal(t, "admin", handled.Get("JwtRole"))
+			assert.Empty(t, handled.Get("JwtError"))
+			assert.Empty(t, handled.Get(proxySecretHeader))
+		})
+	}
+
+	t.Run("anonymous", func(t *testing.T) {
+		trustedProxy = proxy
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.1.2.3:4567"
+		r.Header.Set("JwtRole", "admin")
+		w := httptest.NewRecorder()
+		authHandler(h, ks, false)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, handled.Get("JwtUID"))
+		assert.Empty(t, handled.Get("JwtRole"))
+	})
+}
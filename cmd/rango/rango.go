@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -19,48 +27,190 @@ import (
 	"github.com/nusa-exchange/rango/pkg/auth"
 	"github.com/nusa-exchange/rango/pkg/metrics"
 	"github.com/nusa-exchange/rango/pkg/routing"
+	"github.com/nusa-exchange/rango/pkg/source"
 )
 
 var (
 	wsAddr = flag.String("ws-addr", "", "http service address")
 	pubKey = flag.String("pubKey", "config/rsa-key.pub", "Path to public key")
 	exName = flag.String("exchange", "rango.events", "Exchange name of upstream messages")
+
+	exNames = flag.String("exchanges", "", "Comma separated Kafka topics to consume instead of -exchange, as topic or topic=scope")
+
+	publicOnly = flag.Bool("public-only", false, "Start without private authentication when no public key is found")
 )
 
 const prefix = "Bearer "
 
+// Headers carrying the UID, role and level of authenticated requests to the
+// handlers.
+var (
+	uidHeader   = getEnv("RANGO_UID_HEADER", routing.DefaultUIDHeader)
+	roleHeader  = getEnv("RANGO_ROLE_HEADER", routing.DefaultRoleHeader)
+	levelHeader = getEnv("RANGO_LEVEL_HEADER", routing.DefaultLevelHeader)
+)
+
+// Subprotocol offered by browsers before their token, see
+// routing.SubprotocolToken, empty to refuse tokens as subprotocols.
+var authSubprotocol = getEnv("RANGO_AUTH_SUBPROTOCOL", "bearer")
+
 type httpHanlder func(w http.ResponseWriter, r *http.Request)
 
-func token(r *http.Request) string {
+// token returns the bearer token of the Authorization header, or the token
+// passed by browsers which can't set that header, as the token query
+// parameter when query is set or as a subprotocol.
+func token(r *http.Request, query bool) string {
 	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(string(authHeader), prefix) {
-		return ""
+	if strings.HasPrefix(string(authHeader), prefix) {
+		return authHeader[len(prefix):]
+	}
+	if t := r.URL.Query().Get("token"); query && t != "" {
+		return t
 	}
 
-	return authHeader[len(prefix):]
+	return routing.SubprotocolToken(r, authSubprotocol)
+}
+
+// queryTokenAllowed reports whether tokens are accepted as the token query
+// parameter, set RANGO_ALLOW_QUERY_TOKEN=true to accept them. They are
+// refused by default as URLs tend to be logged by proxies.
+func queryTokenAllowed() bool {
+	allowed, err := strconv.ParseBool(getEnv("RANGO_ALLOW_QUERY_TOKEN", "false"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_ALLOW_QUERY_TOKEN: %s", err.Error())
+		return false
+	}
+	return allowed
+}
+
+// firstFrameAuthEnabled reports whether websocket connections without a token
+// are accepted by the handlers requiring authentication, to authenticate with
+// an auth request as their first frame. Set RANGO_FIRST_FRAME_AUTH=true to
+// accept them.
+func firstFrameAuthEnabled() bool {
+	enabled, err := strconv.ParseBool(getEnv("RANGO_FIRST_FRAME_AUTH", "false"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_FIRST_FRAME_AUTH: %s", err.Error())
+		return false
+	}
+	return enabled
 }
 
-func authHandler(h httpHanlder, key *rsa.PublicKey, mustAuth bool) httpHanlder {
+// authHandler sets the UID, role and level headers, JwtUID, JwtRole and
+// JwtLevel unless configured otherwise, and the JwtExp header of requests with a valid bearer
+// token. Other requests are refused with the reason of the failure
+// when mustAuth, or handled anonymously with the reason in the JwtError
+// header when a token was given. When API keys are configured, requests
+// signed with an API key are authenticated with it instead of a token, and
+// refused if the signature is invalid. Requests of the trusted proxy setting
+// the UID header are authenticated by their UID, role and level headers
+// instead, those headers are dropped from any other request. With
+// RANGO_FIRST_FRAME_AUTH, websocket requests without a token are handled with
+// the JwtPending header when mustAuth, to authenticate with their first frame.
+// With RANGO_ALLOW_QUERY_TOKEN, the token query parameter is validated as a
+// bearer token.
+func authHandler(h httpHanlder, ks *auth.KeyStore, mustAuth bool) httpHanlder {
+	firstFrame := mustAuth && firstFrameAuthEnabled()
+	queryToken := queryTokenAllowed()
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth, err := auth.ParseAndValidate(token(r), key)
+		trusted := trustedProxy.trusts(r)
+		r.Header.Del(proxySecretHeader)
+		r.Header.Del("JwtPending")
+		if trusted && r.Header.Get(uidHeader) != "" {
+			r.Header.Del("JwtExp")
+			r.Header.Del("JwtError")
+			h(w, r)
+			return
+		}
+
+		r.Header.Del(uidHeader)
+		r.Header.Del(roleHeader)
+		r.Header.Del(levelHeader)
+		r.Header.Del("JwtExp")
+		r.Header.Del("JwtError")
+
+		if ks.APIKeys != nil && auth.HasAPIKey(r.Header) {
+			claims, err := ks.ValidateAPIKey(r.Header)
+			if err != nil {
+				unauthorized(w, auth.Reason(err))
+				return
+			}
+			r.Header.Set(uidHeader, claims.UID)
+			r.Header.Set(roleHeader, claims.Role)
+			h(w, r)
+			return
+		}
+
+		t := token(r, queryToken)
+		if t == "" {
+			if firstFrame && websocket.IsWebSocketUpgrade(r) {
+				r.Header.Set("JwtPending", "true")
+				h(w, r)
+				return
+			}
+			if mustAuth {
+				unauthorized(w, auth.ReasonMissingToken)
+				return
+			}
+			h(w, r)
+			return
+		}
 
-		if err != nil && mustAuth {
-			w.WriteHeader(http.StatusUnauthorized)
+		claims, err := ks.ParseAndValidate(t)
+		if err != nil {
+			reason := auth.Reason(err)
+			if mustAuth {
+				unauthorized(w, reason)
+				return
+			}
+			r.Header.Set("JwtError", reason)
+			h(w, r)
 			return
 		}
 
-		if err == nil {
-			r.Header.Set("JwtUID", auth.UID)
-			r.Header.Set("JwtRole", auth.Role)
-		} else {
-			r.Header.Del("JwtUID")
-			r.Header.Del("JwtRole")
+		r.Header.Set(uidHeader, claims.UID)
+		r.Header.Set(roleHeader, claims.Role)
+		r.Header.Set(levelHeader, strconv.Itoa(claimsLevel(claims)))
+		if claims.ExpiresAt != 0 {
+			r.Header.Set("JwtExp", strconv.FormatInt(claims.ExpiresAt, 10))
 		}
 		h(w, r)
-		return
 	}
 }
 
+// authenticator validates the tokens of auth requests sent over websocket
+// connections, the error being the reason of the failure.
+func authenticator(ks *auth.KeyStore) func(token string) (routing.Auth, error) {
+	return func(token string) (routing.Auth, error) {
+		claims, err := ks.ParseAndValidate(token)
+		if err != nil {
+			return routing.Auth{}, errors.New(auth.Reason(err))
+		}
+		a := routing.Auth{UID: claims.UID, Role: claims.Role, Level: claimsLevel(claims)}
+		if claims.ExpiresAt != 0 {
+			a.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+		return a, nil
+	}
+}
+
+// claimsLevel returns the level claim of the token, 0 if missing or invalid.
+func claimsLevel(claims auth.Auth) int {
+	level, err := claims.Level.Int64()
+	if err != nil {
+		return 0
+	}
+	return int(level)
+}
+
+// unauthorized responds 401 with the reason of the authentication failure.
+func unauthorized(w http.ResponseWriter, reason string) {
+	writeJSON(w, http.StatusUnauthorized, map[string]string{
+		"error":  "unauthorized",
+		"reason": reason,
+	})
+}
+
 func setupLogger() {
 	logLevel, ok := os.LookupEnv("LOG_LEVEL")
 	if ok {
@@ -76,22 +226,69 @@ func setupLogger() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 }
 
-func getPublicKey() (pub *rsa.PublicKey, err error) {
-	ks := auth.KeyStore{}
+// getKeyStore loads the public keys used to validate JWT, JWT_PUBLIC_KEY may
+// contain several comma or newline separated keys to support key rotation.
+// Setting JWT_HMAC_SECRET enables HS256 tokens in addition to RS256 ones.
+// JWT_AUDIENCE and JWT_ISSUER, when set, restrict the accepted tokens to
+// those issued for the audience and by the issuer. API_KEYS, a JSON object
+// of API keys by access key, enables API key authentication. JWT_JWKS_URL
+// loads the keys from a JWKS document, refreshed every JWT_JWKS_REFRESH.
+//
+// Without JWT_PUBLIC_KEY the keys are read from the -pubKey file, which may be
+// missing when other keys are configured. Otherwise the error wraps
+// os.ErrNotExist for a missing file, and tells the invalid keys apart.
+func getKeyStore() (ks *auth.KeyStore, err error) {
+	ks = &auth.KeyStore{
+		Audience: os.Getenv("JWT_AUDIENCE"),
+		Issuer:   os.Getenv("JWT_ISSUER"),
+	}
 	encPem := os.Getenv("JWT_PUBLIC_KEY")
 
+	if secret := os.Getenv("JWT_HMAC_SECRET"); secret != "" {
+		ks.HMACSecret = []byte(secret)
+	}
+
+	if keys := os.Getenv("API_KEYS"); keys != "" {
+		if ks.APIKeys, err = auth.ParseAPIKeys(keys); err != nil {
+			return nil, fmt.Errorf("invalid API_KEYS: %w", err)
+		}
+	}
+
+	if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+		if err = ks.LoadPublicKeyFromJWKS(url); err != nil {
+			return nil, fmt.Errorf("loading JWKS failed: %w", err)
+		}
+	}
+
 	if encPem != "" {
-		ks.LoadPublicKeyFromString(encPem)
-	} else {
-		ks.LoadPublicKeyFromFile(*pubKey)
+		if err = ks.LoadPublicKeysFromString(encPem); err != nil {
+			return nil, fmt.Errorf("invalid JWT_PUBLIC_KEY: %w", err)
+		}
+		return ks, nil
 	}
-	if err != nil {
-		return nil, err
+
+	err = ks.LoadPublicKeyFromFile(*pubKey)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && ks.HasKeys():
+		return ks, nil
+	case errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("no key configured, public key %s not found: %w", *pubKey, err)
+	case err != nil:
+		return nil, fmt.Errorf("invalid public key %s: %w", *pubKey, err)
 	}
-	if ks.PublicKey == nil {
-		return nil, fmt.Errorf("failed")
+	return ks, nil
+}
+
+// loadKeyStore returns the key store of getKeyStore. When no key is found and
+// public is set, the key store is empty for rango to only serve anonymous
+// connections, every token and API key being refused.
+func loadKeyStore(public bool) (*auth.KeyStore, error) {
+	ks, err := getKeyStore()
+	if errors.Is(err, os.ErrNotExist) && public {
+		log.Warn().Msgf("Starting without private authentication: %s", err.Error())
+		return &auth.KeyStore{}, nil
 	}
-	return ks.PublicKey, nil
+	return ks, err
 }
 
 func getEnv(name, value string) string {
@@ -102,15 +299,117 @@ func getEnv(name, value string) string {
 	return v
 }
 
+// getEnvList returns the comma separated values of the environment variable name.
+func getEnvList(name string) []string {
+	list := []string{}
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// getJWKSRefresh returns how often the JWKS keys are reloaded.
+func getJWKSRefresh() time.Duration {
+	d, err := time.ParseDuration(getEnv("JWT_JWKS_REFRESH", "5m"))
+	if err != nil || d <= 0 {
+		log.Warn().Msgf("Invalid JWT_JWKS_REFRESH: %s", getEnv("JWT_JWKS_REFRESH", ""))
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// getDrainTimeout returns how long to wait for clients to disconnect on shutdown.
+func getDrainTimeout() time.Duration {
+	d, err := time.ParseDuration(getEnv("RANGO_DRAIN_TIMEOUT", "10s"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_DRAIN_TIMEOUT: %s", err.Error())
+		return 10 * time.Second
+	}
+	return d
+}
+
+// getServerAddress returns the websocket server address, from the -ws-addr
+// flag, RANGO_ADDR or RANGER_HOST and RANGER_PORT in that order.
 func getServerAddress() string {
 	if *wsAddr != "" {
 		return *wsAddr
 	}
+	if addr := os.Getenv("RANGO_ADDR"); addr != "" {
+		return addr
+	}
 	host := getEnv("RANGER_HOST", "0.0.0.0")
 	port := getEnv("RANGER_PORT", "8080")
 	return fmt.Sprintf("%s:%s", host, port)
 }
 
+// getMetricsAddress returns the address of the prometheus metrics server.
+func getMetricsAddress() string {
+	return getEnv("RANGO_METRICS_ADDR", ":4242")
+}
+
+// metricsRequired reports whether rango must exit when the metrics server
+// can't bind, set RANGO_METRICS_REQUIRED=false to run without metrics instead.
+func metricsRequired() bool {
+	required, err := strconv.ParseBool(getEnv("RANGO_METRICS_REQUIRED", "true"))
+	if err != nil {
+		log.Warn().Msgf("Invalid RANGO_METRICS_REQUIRED: %s", err.Error())
+		return true
+	}
+	return required
+}
+
+// metricsAuthHandler guards h with token, given as a bearer token or as the
+// password of basic auth, any user name being accepted for scrapers only
+// supporting basic auth. h is served to anyone when token is empty.
+func metricsAuthHandler(h http.Handler, token string) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := ""
+		if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, prefix) {
+			given = authHeader[len(prefix):]
+		} else if _, password, ok := r.BasicAuth(); ok {
+			given = password
+		}
+
+		switch {
+		case given == "":
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			unauthorized(w, auth.ReasonMissingToken)
+		case subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1:
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			unauthorized(w, "invalid_token")
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// startMetricsServer binds the prometheus metrics server on addr and serves it
+// in the background, bind failures are logged and returned. The metrics are
+// guarded by RANGO_METRICS_TOKEN when set.
+func startMetricsServer(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Msgf("Failed to bind metrics server: %s", err.Error())
+		return nil, err
+	}
+	log.Info().Msgf("Metrics listening on %s", listener.Addr())
+
+	handler := metricsAuthHandler(promhttp.Handler(), os.Getenv("RANGO_METRICS_TOKEN"))
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Msgf("Metrics server failed: %s", err.Error())
+		}
+	}()
+	return server, nil
+}
+
 func getRBACConfig() map[string][]string {
 	envs := os.Environ()
 
@@ -119,6 +418,113 @@ func getRBACConfig() map[string][]string {
 	return envToMatrix(rbacEnv, "RANGO_RBAC_")
 }
 
+// getMinLevels returns the minimum user level of the prefixed streams by
+// prefix, set with RANGO_MIN_LEVEL_<prefix>, e.g. RANGO_MIN_LEVEL_FINEX=3.
+func getMinLevels() map[string]int {
+	levels := make(map[string]int)
+	for prefix, values := range envToMatrix(filterPrefixed("RANGO_MIN_LEVEL_", os.Environ()), "RANGO_MIN_LEVEL_") {
+		level, err := strconv.Atoi(values[0])
+		if err != nil {
+			log.Warn().Msgf("Invalid RANGO_MIN_LEVEL_%s: %s", strings.ToUpper(prefix), err.Error())
+			continue
+		}
+		levels[prefix] = level
+	}
+	return levels
+}
+
+// getHubOptions returns the options of the hub set by the environment, the
+// defaults otherwise, but for the transforms and trusted proxies which may fail
+// to load. The limits of anonymous connections default to the
+// authenticated ones.
+func getHubOptions() routing.HubOptions {
+	opts := routing.DefaultHubOptions()
+
+	opts.ClientBuffer = getEnvInt("RANGO_CLIENT_BUFFER", opts.ClientBuffer)
+	opts.ClientOverflow = getEnv("RANGO_CLIENT_OVERFLOW", opts.ClientOverflow)
+
+	opts.MaxConnections = getEnvInt("RANGO_MAX_CONNECTIONS", opts.MaxConnections)
+	opts.MaxConnectionsPerUser = getEnvInt("RANGO_MAX_CONNECTIONS_PER_USER", opts.MaxConnectionsPerUser)
+	opts.MaxConnectionsPerIP = getEnvInt("RANGO_MAX_CONNECTIONS_PER_IP", opts.MaxConnectionsPerIP)
+
+	opts.MessagesPerSec = getEnvFloat("RANGO_MAX_MESSAGES_PER_SEC", opts.MessagesPerSec)
+	opts.MaxSubscriptions = getEnvInt("RANGO_MAX_SUBSCRIPTIONS", opts.MaxSubscriptions)
+	opts.AnonymousMessagesPerSec = getEnvFloat("RANGO_ANONYMOUS_MAX_MESSAGES_PER_SEC", opts.MessagesPerSec)
+	opts.AnonymousMaxSubscriptions = getEnvInt("RANGO_ANONYMOUS_MAX_SUBSCRIPTIONS", opts.MaxSubscriptions)
+	opts.MaxRateViolations = getEnvInt("RANGO_MAX_RATE_VIOLATIONS", opts.MaxRateViolations)
+	opts.MaxInvalidMessages = getEnvInt("RANGO_MAX_INVALID_MESSAGES", opts.MaxInvalidMessages)
+
+	opts.InboundQueue = getEnvInt("RANGO_INBOUND_QUEUE", opts.InboundQueue)
+	opts.InboundDrop = getEnvBool("RANGO_INBOUND_DROP", opts.InboundDrop)
+
+	opts.TokenExpiryGrace = getEnvDuration("RANGO_TOKEN_EXPIRY_GRACE", opts.TokenExpiryGrace)
+	opts.SubscribeGrace = getEnvDuration("RANGO_SUBSCRIBE_GRACE", opts.SubscribeGrace)
+	opts.AuthTimeout = getEnvDuration("RANGO_AUTH_TIMEOUT", opts.AuthTimeout)
+	opts.MaxConnectionLifetime = getEnvDuration("RANGO_MAX_CONNECTION_LIFETIME", opts.MaxConnectionLifetime)
+	opts.ConnectionLifetimeJitter = getEnvFloat("RANGO_MAX_CONNECTION_LIFETIME_JITTER", opts.ConnectionLifetimeJitter)
+
+	opts.WriteTimeout = getEnvDuration("RANGO_WRITE_TIMEOUT", opts.WriteTimeout)
+	opts.PingInterval = getEnvDuration("RANGO_PING_INTERVAL", opts.PingInterval)
+	opts.MaxMissedPongs = getEnvInt("RANGO_MAX_MISSED_PONGS", opts.MaxMissedPongs)
+	opts.MaxFrameBytes = getEnvInt("RANGO_MAX_FRAME_BYTES", opts.MaxFrameBytes)
+	opts.ReadBufferSize = getEnvInt("RANGO_WS_READ_BUFFER", opts.ReadBufferSize)
+	opts.WriteBufferSize = getEnvInt("RANGO_WS_WRITE_BUFFER", opts.WriteBufferSize)
+	opts.WriteBufferPool = getEnvBool("RANGO_WS_WRITE_BUFFER_POOL", opts.WriteBufferPool)
+	opts.CompressionLevel = getEnvInt("RANGO_COMPRESSION_LEVEL", opts.CompressionLevel)
+	opts.CompressionMinBytes = getEnvInt("RANGO_COMPRESSION_MIN_BYTES", opts.CompressionMinBytes)
+	opts.Coalesce = getEnvBool("RANGO_COALESCE", opts.Coalesce)
+	opts.CoalesceMax = getEnvInt("RANGO_COALESCE_MAX", opts.CoalesceMax)
+	opts.AllowedOrigins = getAllowedOrigins()
+
+	opts.BackpressureInterval = getEnvDuration("RANGO_BACKPRESSURE_INTERVAL", opts.BackpressureInterval)
+	opts.MessageTTL = getEnvDuration("RANGO_MESSAGE_TTL", opts.MessageTTL)
+	opts.SessionTTL = getEnvDuration("RANGO_SESSION_TTL", opts.SessionTTL)
+	opts.PollTimeout = getEnvDuration("RANGO_POLL_TIMEOUT", opts.PollTimeout)
+	opts.PollSessionTTL = getEnvDuration("RANGO_POLL_SESSION_TTL", opts.PollSessionTTL)
+
+	opts.Shards = getEnvInt("RANGO_HUB_SHARDS", opts.Shards)
+	opts.HistoryDepth = getEnvInt("RANGO_HISTORY_DEPTH", opts.HistoryDepth)
+	opts.MaxSnapshotIncrements = getEnvInt("RANGO_SNAPSHOT_MAX_INCREMENTS", opts.MaxSnapshotIncrements)
+	opts.ActiveStreamsTTL = getEnvDuration("RANGO_ACTIVE_STREAMS_TTL", opts.ActiveStreamsTTL)
+	opts.MaxActiveStreams = getEnvInt("RANGO_MAX_ACTIVE_STREAMS", opts.MaxActiveStreams)
+	opts.MaxFilterConditions = getEnvInt("RANGO_MAX_FILTER_CONDITIONS", opts.MaxFilterConditions)
+	opts.AuditLog = getEnvBool("RANGO_AUDIT_LOG", opts.AuditLog)
+
+	opts.PublicPrefixes = getEnvList("RANGO_PUBLIC_STREAM_PREFIXES")
+	opts.PrivatePrefixes = getEnvList("RANGO_PRIVATE_STREAM_PREFIXES")
+	opts.MinLevels = getMinLevels()
+	opts.SnapshotSuffixes = strings.Split(os.Getenv("RANGO_SNAPSHOT_SUFFIXES"), ",")
+	if getEnv("RANGO_SOURCE", "kafka") == "kafka" {
+		opts.SourceTopics, opts.TopicScopes = getKafkaTopics()
+	}
+	opts.DefaultStreams = getDefaultStreams()
+
+	opts.UIDHeader, opts.RoleHeader, opts.LevelHeader = uidHeader, roleHeader, levelHeader
+	opts.AuthSubprotocol = authSubprotocol
+	opts.Version = version
+	return opts
+}
+
+// getAllowedOrigins returns RANGO_ALLOWED_ORIGINS, or the deprecated
+// API_CORS_ORIGINS.
+func getAllowedOrigins() []string {
+	if origins := getEnvList("RANGO_ALLOWED_ORIGINS"); len(origins) != 0 {
+		return origins
+	}
+	return getEnvList("API_CORS_ORIGINS")
+}
+
+// getDefaultStreams returns the streams subscribed on connect by role, set
+// with RANGO_DEFAULT_STREAMS_<role>, RANGO_DEFAULT_STREAMS_ANONYMOUS for
+// anonymous connections.
+func getDefaultStreams() map[string][]string {
+	envs := os.Environ()
+
+	streamsEnv := filterPrefixed("RANGO_DEFAULT_STREAMS_", envs)
+
+	return envToMatrix(streamsEnv, "RANGO_DEFAULT_STREAMS_")
+}
+
 func envToMatrix(env []string, trimPrefix string) map[string][]string {
 	matr := make(map[string][]string)
 
@@ -145,69 +551,334 @@ func filterPrefixed(prefix string, arr []string) []string {
 	return res
 }
 
+// getKafkaTopics returns the Kafka topics to consume from KAFKA_TOPICS, the
+// -exchanges flag or the -exchange flag, in that order, and the scopes the
+// topics are bound to.
+//
+// Topics are listed as topic or topic=scope. Message keys are routed as
+// scope.stream.type whatever their topic, e.g. public.eurusd.trades, but the
+// keys of a topic bound to a scope omit it, e.g. rango.private=private carries
+// UIDABC00001.balance routed as private.UIDABC00001.balance.
+func getKafkaTopics() ([]string, map[string]string) {
+	list := getEnv("KAFKA_TOPICS", *exNames)
+	if list == "" {
+		list = *exName
+	}
+
+	topics := []string{}
+	scopes := map[string]string{}
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if i := strings.Index(t, "="); i != -1 {
+			scopes[t[:i]] = t[i+1:]
+			t = t[:i]
+		}
+		topics = append(topics, t)
+	}
+
+	return topics, scopes
+}
+
+// getTransforms returns the transforms of the streams set with
+// RANGO_TRANSFORMS as stream=transform, e.g.
+// eurusd.ob-inc=ob-delta,usdjpy.ob-inc=ob-delta.
+func getTransforms() (map[string]routing.Transform, error) {
+	transforms := map[string]routing.Transform{}
+	for _, t := range getEnvList("RANGO_TRANSFORMS") {
+		i := strings.Index(t, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid RANGO_TRANSFORMS %s, expected stream=transform", t)
+		}
+		transform, err := routing.TransformNamed(t[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		transforms[t[:i]] = transform
+	}
+	return transforms, nil
+}
+
+// getKafkaStartOffset returns the offset the consumer starts from, set with
+// KAFKA_START_TIME as an RFC 3339 time or KAFKA_OFFSET_RESET, latest by
+// default, and its description.
+func getKafkaStartOffset() (kgo.Offset, string, error) {
+	reset, err := source.ParseOffsetReset(getEnv("KAFKA_OFFSET_RESET", string(source.OffsetLatest)))
+	if err != nil {
+		return kgo.Offset{}, "", err
+	}
+
+	var start time.Time
+	position := string(reset) + " offset"
+	if v := os.Getenv("KAFKA_START_TIME"); v != "" {
+		if start, err = time.Parse(time.RFC3339, v); err != nil {
+			return kgo.Offset{}, "", fmt.Errorf("invalid KAFKA_START_TIME %s", v)
+		}
+		position = "records produced since " + start.Format(time.RFC3339)
+	}
+
+	return source.StartOffset(reset, start), position, nil
+}
+
+// getKafkaGroupID returns the consumer group of KAFKA_GROUP_ID, a random group
+// by default so that every instance receives every message to broadcast it to
+// its clients. Instances sharing a stable group split the partitions between
+// them, each receiving only part of the feed unless relayed, see
+// getKafkaRelay, but commit their offsets to resume from on restart.
+func getKafkaGroupID() string {
+	return getEnv("KAFKA_GROUP_ID", fmt.Sprintf("rango-%s", uuid.NewString()))
+}
+
+// getKafkaRelay returns the relay of the messages consumed to every instance
+// when RANGO_RELAY_REDIS_URL is set, nil otherwise. The instances then share
+// the consumer group of KAFKA_GROUP_ID, required, and relay the messages of
+// their partitions over the RANGO_RELAY_CHANNEL Redis channel.
+func getKafkaRelay() (source.Relay, error) {
+	url := os.Getenv("RANGO_RELAY_REDIS_URL")
+	if url == "" {
+		return nil, nil
+	}
+	if os.Getenv("KAFKA_GROUP_ID") == "" {
+		return nil, errors.New("RANGO_RELAY_REDIS_URL requires a stable KAFKA_GROUP_ID")
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RANGO_RELAY_REDIS_URL: %w", err)
+	}
+	return source.NewRedisRelay(redis.NewClient(opts), getEnv("RANGO_RELAY_CHANNEL", "rango.relay")), nil
+}
+
+// getKafkaAuth returns how to connect to the Kafka brokers, over TLS when
+// KAFKA_TLS is true and authenticated with KAFKA_SASL_MECHANISM, PLAIN,
+// SCRAM-SHA-256 or SCRAM-SHA-512, as KAFKA_SASL_USER with KAFKA_SASL_PASS.
+func getKafkaAuth() (source.KafkaAuth, error) {
+	useTLS, err := strconv.ParseBool(getEnv("KAFKA_TLS", "false"))
+	if err != nil {
+		return source.KafkaAuth{}, fmt.Errorf("invalid KAFKA_TLS: %w", err)
+	}
+	return source.KafkaAuth{
+		TLS:       useTLS,
+		Mechanism: os.Getenv("KAFKA_SASL_MECHANISM"),
+		User:      os.Getenv("KAFKA_SASL_USER"),
+		Password:  os.Getenv("KAFKA_SASL_PASS"),
+	}, nil
+}
+
+// getSource creates the upstream source selected by RANGO_SOURCE: kafka, nats or redis.
+func getSource() (source.Source, error) {
+	switch getEnv("RANGO_SOURCE", "kafka") {
+	case "kafka":
+		topics, _ := getKafkaTopics()
+		mode, err := source.ParseCommitMode(getEnv("KAFKA_COMMIT_MODE", string(source.CommitBatched)))
+		if err != nil {
+			return nil, err
+		}
+		offset, position, err := getKafkaStartOffset()
+		if err != nil {
+			return nil, err
+		}
+		group := getKafkaGroupID()
+		log.Info().Strs("topics", topics).Str("group", group).Msgf("Consuming from the %s", position)
+
+		kafkaAuth, err := getKafkaAuth()
+		if err != nil {
+			return nil, err
+		}
+		authOpts, err := kafkaAuth.Opts()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kafka authentication: %w", err)
+		}
+		relay, err := getKafkaRelay()
+		if err != nil {
+			return nil, err
+		}
+
+		kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+		kgoClient, err := kgo.NewClient(append([]kgo.Opt{
+			kgo.SeedBrokers(kafkaBrokers...),
+			kgo.ConsumerGroup(group),
+			kgo.ConsumeTopics(topics...),
+			kgo.ConsumeResetOffset(offset),
+			kgo.DisableAutoCommit(),
+		}, authOpts...)...)
+		if err != nil {
+			return nil, err
+		}
+		if relay != nil {
+			log.Info().Msgf("Relaying the messages of group %s to every instance", group)
+			return source.Relayed(source.NewKafka(kgoClient, mode), relay), nil
+		}
+		return source.NewKafka(kgoClient, mode), nil
+
+	case "nats":
+		conn, err := nats.Connect(getEnv("NATS_URL", nats.DefaultURL))
+		if err != nil {
+			return nil, err
+		}
+		return source.NewNATS(conn, getEnv("NATS_SUBJECT", *exName+".>")), nil
+
+	case "redis":
+		opts, err := redis.ParseURL(getEnv("REDIS_URL", "redis://localhost:6379"))
+		if err != nil {
+			return nil, err
+		}
+		channels := strings.Split(getEnv("REDIS_CHANNELS", "public.*,private.*,global.*"), ",")
+		return source.NewRedis(redis.NewClient(opts), channels), nil
+
+	default:
+		return nil, fmt.Errorf("unknown RANGO_SOURCE %s", os.Getenv("RANGO_SOURCE"))
+	}
+}
+
 func main() {
 	flag.Parse()
 
 	setupLogger()
 
 	metrics.Enable()
+	metrics.RecordBuildInfo(version, commit, buildDate)
+
+	opts := getHubOptions()
+	var err error
+	if opts.Transforms, err = getTransforms(); err != nil {
+		log.Fatal().Msgf("Loading transforms failed: %s", err.Error())
+	}
+	if opts.TrustedProxies, err = getTrustedProxies(); err != nil {
+		log.Fatal().Msgf("Loading trusted proxies failed: %s", err.Error())
+	}
 
 	rbac := getRBACConfig()
-	hub := routing.NewHub(rbac)
-	pub, err := getPublicKey()
+	hub := routing.NewHub(rbac, opts)
+	ks, err := loadKeyStore(*publicOnly)
 	if err != nil {
-		log.Error().Msgf("Loading public key failed: %s", err.Error())
-		time.Sleep(2 * time.Second)
-		return
+		if errors.Is(err, os.ErrNotExist) {
+			log.Fatal().Msgf("Loading public key failed: %s, start with -public-only to only serve anonymous connections", err.Error())
+		}
+		log.Fatal().Msgf("Loading public key failed: %s", err.Error())
+	}
+
+	hub.Authenticate = authenticator(ks)
+
+	if trustedProxy, err = getProxyAuth(); err != nil {
+		log.Fatal().Msgf("Loading trusted proxy failed: %s", err.Error())
+	}
+	if trustedProxy != nil {
+		log.Warn().Msgf("Trusting the %s and %s headers of the proxy", uidHeader, roleHeader)
 	}
 
-	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
-	kgoClient, err := kgo.NewClient(
-		kgo.SeedBrokers(kafkaBrokers...),
-		kgo.ConsumerGroup(fmt.Sprintf("rango-%s", uuid.NewString())),
-		kgo.ConsumeTopics(*exName),
-		kgo.DisableAutoCommit(),
-	)
+	src, err := getSource()
 	if err != nil {
-		log.Error().Msgf("Failed to create consumer: %s", err.Error())
-		return
+		log.Fatal().Msgf("Failed to create consumer: %s", err.Error())
+	}
+
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		log.Fatal().Msgf("Loading TLS certificate failed: %s", err.Error())
 	}
 
-	log.Info().Msg("Starting rango...")
+	log.Info().Msgf("Starting rango %s (%s)...", version, commit)
 
-	go func() {
-		for {
-			fetches := kgoClient.PollFetches(context.Background())
-			for i, fe := range fetches.Errors() {
-				log.Error().Msgf("Fetch error %d: %v", i, fe.Err)
-			}
+	metricsServer, err := startMetricsServer(getMetricsAddress())
+	if err != nil && metricsRequired() {
+		os.Exit(1)
+	}
 
-			records := fetches.Records()
-			for _, r := range records {
-				hub.ReceiveMsg(r)
+	listener, err := net.Listen("tcp", getServerAddress())
+	if err != nil {
+		log.Fatal().Msgf("Failed to bind server: %s", err.Error())
+	}
+	if tlsConfig != nil {
+		log.Info().Msgf("Listening on %s with TLS", listener.Addr())
+	} else {
+		log.Info().Msgf("Listening on %s", listener.Addr())
+	}
 
-				kgoClient.CommitRecords(context.Background(), r)
-			}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+		go ks.RefreshJWKS(ctx, url, getJWKSRefresh())
+	}
+
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		if err := src.Run(ctx, hub.Publish); err != nil {
+			log.Error().Msgf("Consumer failed: %s", err.Error())
 		}
 	}()
 
-	defer kgoClient.Close()
+	hub.Start()
 
-	go hub.ListenWebsocketEvents()
+	// Connections are authenticated by authHandler.
+	wsHandler := httpHanlder(hub.WebsocketHandler(routing.HandlerOptions{}))
 
-	wsHandler := func(w http.ResponseWriter, r *http.Request) {
-		routing.NewClient(hub, w, r)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/readyz", readyzHandler(hub, src, ks, *publicOnly && !ks.HasKeys()))
+
+	adminRoles := getAdminRoles()
+	http.HandleFunc("/admin/rbac", authHandler(adminHandler(rbacHandler(hub), adminRoles), ks, true))
+	http.HandleFunc("/admin/connections", authHandler(adminHandler(connectionsHandler(hub), adminRoles), ks, true))
+	http.HandleFunc("/admin/stats", authHandler(adminHandler(statsHandler(hub), adminRoles), ks, true))
+	http.HandleFunc("/admin/streams", authHandler(adminHandler(streamsHandler(hub), adminRoles), ks, true))
+	http.HandleFunc("/admin/streams/", authHandler(adminHandler(streamsHandler(hub), adminRoles), ks, true))
+	if keys := getInjectKeys(); len(keys) != 0 {
+		http.HandleFunc("/admin/inject", authHandler(adminHandler(injectHandler(hub, keys), adminRoles), ks, true))
+	}
+	if debugVarsEnabled() {
+		http.HandleFunc("/debug/vars", authHandler(adminHandler(debugVarsHandler(hub), adminRoles), ks, true))
 	}
 
-	http.HandleFunc("/private", authHandler(wsHandler, pub, true))
-	http.HandleFunc("/public", authHandler(wsHandler, pub, false))
-	http.HandleFunc("/", authHandler(wsHandler, pub, false))
+	http.HandleFunc("/sse", authHandler(func(w http.ResponseWriter, r *http.Request) {
+		routing.NewSSEClient(hub, w, r)
+	}, ks, false))
 
-	go http.ListenAndServe(":4242", promhttp.Handler())
+	http.HandleFunc("/poll", authHandler(func(w http.ResponseWriter, r *http.Request) {
+		routing.NewPollClient(hub, w, r)
+	}, ks, false))
 
-	log.Printf("Listenning on %s", getServerAddress())
-	err = http.ListenAndServe(getServerAddress(), nil)
-	if err != nil {
-		log.Fatal().Msg("ListenAndServe failed: " + err.Error())
+	accessLog := func(h httpHanlder) httpHanlder { return h }
+	if accessLogEnabled() {
+		accessLog = func(h httpHanlder) httpHanlder { return accessLogHandler(h, opts.TrustedProxies) }
+	}
+	http.HandleFunc("/private", accessLog(authHandler(wsHandler, ks, true)))
+	http.HandleFunc("/public", accessLog(authHandler(wsHandler, ks, false)))
+	http.HandleFunc("/", accessLog(authHandler(wsHandler, ks, false)))
+
+	server := &http.Server{TLSConfig: tlsConfig}
+	go func() {
+		err := serve(server, listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Msg("Server failed: " + err.Error())
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info().Msg("Shutting down rango...")
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), getDrainTimeout())
+	defer cancel()
+
+	// Clients are drained while the server shuts down, event streams
+	// keeping their requests active until disconnected.
+	hubDone := make(chan error, 1)
+	server.RegisterOnShutdown(func() { hubDone <- hub.Shutdown(drainCtx) })
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Error().Msgf("Failed to stop the server: %s", err.Error())
+	}
+	if err := <-hubDone; err != nil {
+		log.Warn().Msgf("Clients drain interrupted: %s", err.Error())
+	}
+	<-consumerDone
+
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(drainCtx); err != nil {
+			log.Error().Msgf("Failed to stop the metrics server: %s", err.Error())
+		}
 	}
 }
@@ -1,9 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/nusa-exchange/rango/pkg/auth"
+	"github.com/nusa-exchange/rango/pkg/routing"
+	"github.com/nusa-exchange/rango/pkg/source"
 )
 
 func TestRango_envToMatrix(t *testing.T) {
@@ -20,3 +42,698 @@ func TestRango_envToMatrix(t *testing.T) {
 	assert.Equal(t, []string{"TWO", "three", "four"}, matrix["one"])
 	assert.Equal(t, "bar", matrix["foo"][0])
 }
+
+func TestRango_getHubOptions(t *testing.T) {
+	opts := getHubOptions()
+	defaults := routing.DefaultHubOptions()
+	assert.Equal(t, defaults.ClientBuffer, opts.ClientBuffer)
+	assert.Equal(t, defaults.WriteTimeout, opts.WriteTimeout)
+	assert.Empty(t, opts.AllowedOrigins)
+	assert.Empty(t, opts.PublicPrefixes)
+	assert.Empty(t, opts.PrivatePrefixes)
+	assert.Equal(t, version, opts.Version)
+	assert.Equal(t, routing.DefaultUIDHeader, opts.UIDHeader)
+
+	t.Setenv("RANGO_CLIENT_BUFFER", "16")
+	t.Setenv("RANGO_CLIENT_OVERFLOW", "drop_oldest")
+	t.Setenv("RANGO_MAX_MESSAGES_PER_SEC", "2.5")
+	t.Setenv("RANGO_MAX_SUBSCRIPTIONS", "20")
+	t.Setenv("RANGO_ANONYMOUS_MAX_SUBSCRIPTIONS", "5")
+	t.Setenv("RANGO_WRITE_TIMEOUT", "1s")
+	t.Setenv("RANGO_COALESCE", "true")
+	t.Setenv("RANGO_SESSION_TTL", "invalid")
+	t.Setenv("RANGO_PING_INTERVAL", "0")
+	t.Setenv("RANGO_PUBLIC_STREAM_PREFIXES", "market")
+	t.Setenv("RANGO_PRIVATE_STREAM_PREFIXES", "user,account")
+	opts = getHubOptions()
+	assert.Equal(t, 16, opts.ClientBuffer)
+	assert.Equal(t, "drop_oldest", opts.ClientOverflow)
+	assert.Equal(t, 2.5, opts.MessagesPerSec)
+	assert.Equal(t, 20, opts.MaxSubscriptions)
+	assert.Equal(t, 2.5, opts.AnonymousMessagesPerSec, "anonymous limits default to the authenticated ones")
+	assert.Equal(t, 5, opts.AnonymousMaxSubscriptions)
+	assert.Equal(t, time.Second, opts.WriteTimeout)
+	assert.True(t, opts.Coalesce)
+	assert.Equal(t, defaults.SessionTTL, opts.SessionTTL, "invalid values keep the default")
+	assert.Equal(t, []string{"market"}, opts.PublicPrefixes)
+	assert.Equal(t, []string{"user", "account"}, opts.PrivatePrefixes)
+
+	hub := routing.NewHub(nil, opts)
+	assert.Equal(t, []string{"user", "account"}, hub.Options().PrivatePrefixes)
+	assert.Equal(t, defaults.PingInterval, hub.Options().PingInterval, "zero durations take the default")
+}
+
+func TestRango_getAllowedOrigins(t *testing.T) {
+	t.Setenv("API_CORS_ORIGINS", "example.org")
+	assert.Equal(t, []string{"example.org"}, getAllowedOrigins())
+
+	t.Setenv("RANGO_ALLOWED_ORIGINS", "*.example.com, https://example.net")
+	assert.Equal(t, []string{"*.example.com", "https://example.net"}, getAllowedOrigins())
+}
+
+func TestRango_getDefaultStreams(t *testing.T) {
+	assert.Empty(t, getDefaultStreams())
+
+	t.Setenv("RANGO_DEFAULT_STREAMS_ADMIN", "global.tickers,finex.eurusd.orders")
+	t.Setenv("RANGO_DEFAULT_STREAMS_ANONYMOUS", "global.tickers")
+	assert.Equal(t, map[string][]string{
+		"admin":     {"global.tickers", "finex.eurusd.orders"},
+		"anonymous": {"global.tickers"},
+	}, getDefaultStreams())
+}
+
+func TestRango_getMinLevels(t *testing.T) {
+	assert.Empty(t, getMinLevels())
+
+	t.Setenv("RANGO_MIN_LEVEL_FINEX", "3")
+	t.Setenv("RANGO_MIN_LEVEL_ADMIN", "high")
+	assert.Equal(t, map[string]int{"finex": 3}, getMinLevels())
+}
+
+func TestRango_getTransforms(t *testing.T) {
+	transforms, err := getTransforms()
+	require.NoError(t, err)
+	assert.Empty(t, transforms)
+
+	t.Setenv("RANGO_TRANSFORMS", "eurusd.ob-inc=ob-delta, usdjpy.ob-inc=ob-delta")
+	transforms, err = getTransforms()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]routing.Transform{
+		"eurusd.ob-inc": routing.OrderbookDelta{},
+		"usdjpy.ob-inc": routing.OrderbookDelta{},
+	}, transforms)
+
+	t.Setenv("RANGO_TRANSFORMS", "eurusd.ob-inc=gzip")
+	_, err = getTransforms()
+	assert.EqualError(t, err, "unknown transform gzip")
+
+	t.Setenv("RANGO_TRANSFORMS", "eurusd.ob-inc")
+	_, err = getTransforms()
+	assert.Error(t, err)
+}
+
+func TestRango_getKeyStore(t *testing.T) {
+	defer func(path string) { *pubKey = path }(*pubKey)
+	dir := t.TempDir()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	valid := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "valid.pub"), valid, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "invalid.pub"), []byte("garbage"), 0600))
+
+	t.Run("loads the key file", func(t *testing.T) {
+		*pubKey = filepath.Join(dir, "valid.pub")
+		ks, err := getKeyStore()
+		require.NoError(t, err)
+		assert.Len(t, ks.PublicKeys, 1)
+	})
+
+	t.Run("missing key file", func(t *testing.T) {
+		*pubKey = filepath.Join(dir, "missing.pub")
+		_, err := getKeyStore()
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Contains(t, err.Error(), "missing.pub not found")
+	})
+
+	t.Run("missing key file with other keys", func(t *testing.T) {
+		t.Setenv("JWT_HMAC_SECRET", "secret")
+		*pubKey = filepath.Join(dir, "missing.pub")
+		ks, err := getKeyStore()
+		require.NoError(t, err)
+		assert.True(t, ks.HasKeys())
+	})
+
+	t.Run("invalid key file", func(t *testing.T) {
+		t.Setenv("JWT_HMAC_SECRET", "secret")
+		*pubKey = filepath.Join(dir, "invalid.pub")
+		_, err := getKeyStore()
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, os.ErrNotExist)
+		assert.ErrorIs(t, err, auth.ErrInvalidPEM)
+		assert.Contains(t, err.Error(), "invalid public key")
+	})
+
+	t.Run("invalid JWT_PUBLIC_KEY", func(t *testing.T) {
+		t.Setenv("JWT_PUBLIC_KEY", "not base64")
+		_, err := getKeyStore()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, auth.ErrInvalidPEM)
+		assert.Contains(t, err.Error(), "invalid JWT_PUBLIC_KEY")
+	})
+
+	t.Run("loads JWT_PUBLIC_KEY", func(t *testing.T) {
+		t.Setenv("JWT_PUBLIC_KEY", base64.StdEncoding.EncodeToString(valid))
+		*pubKey = filepath.Join(dir, "missing.pub")
+		ks, err := getKeyStore()
+		require.NoError(t, err)
+		assert.Len(t, ks.PublicKeys, 1)
+	})
+}
+
+func TestRango_loadKeyStore(t *testing.T) {
+	defer func(path string) { *pubKey = path }(*pubKey)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "invalid.pub"), []byte("garbage"), 0600))
+
+	t.Run("fails without keys", func(t *testing.T) {
+		*pubKey = filepath.Join(dir, "missing.pub")
+		_, err := loadKeyStore(false)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("starts public only without keys", func(t *testing.T) {
+		*pubKey = filepath.Join(dir, "missing.pub")
+		ks, err := loadKeyStore(true)
+		require.NoError(t, err)
+		assert.False(t, ks.HasKeys())
+
+		_, err = ks.ParseAndValidate("a.b.c")
+		assert.Error(t, err, "tokens are refused")
+	})
+
+	t.Run("fails public only with an invalid key", func(t *testing.T) {
+		*pubKey = filepath.Join(dir, "invalid.pub")
+		_, err := loadKeyStore(true)
+		assert.Error(t, err)
+	})
+}
+
+func TestRango_getServerAddress(t *testing.T) {
+	t.Setenv("RANGER_HOST", "127.0.0.1")
+	t.Setenv("RANGER_PORT", "9090")
+	assert.Equal(t, "127.0.0.1:9090", getServerAddress())
+
+	t.Setenv("RANGO_ADDR", ":8081")
+	assert.Equal(t, ":8081", getServerAddress())
+}
+
+func TestRango_getMetricsAddress(t *testing.T) {
+	assert.Equal(t, ":4242", getMetricsAddress())
+
+	t.Setenv("RANGO_METRICS_ADDR", "127.0.0.1:9100")
+	assert.Equal(t, "127.0.0.1:9100", getMetricsAddress())
+}
+
+func TestRango_startMetricsServer(t *testing.T) {
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	var logs bytes.Buffer
+	log.Logger = zerolog.New(&logs)
+
+	first, err := startMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer first.Close()
+
+	second, err := startMetricsServer(first.Addr)
+	assert.Error(t, err)
+	assert.Nil(t, second)
+	assert.Contains(t, logs.String(), `"level":"error"`)
+	assert.Contains(t, logs.String(), "Failed to bind metrics server")
+}
+
+func TestRango_metricsAuthHandler(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serve := func(handler http.Handler, setup func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		setup(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("open without token", func(t *testing.T) {
+		w := serve(metricsAuthHandler(h, ""), func(r *http.Request) {})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	guarded := metricsAuthHandler(h, "s3cret")
+	tests := map[string]struct {
+		setup  func(r *http.Request)
+		status int
+		reason string
+	}{
+		"missing":        {func(r *http.Request) {}, http.StatusUnauthorized, auth.ReasonMissingToken},
+		"wrong bearer":   {func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized, "invalid_token"},
+		"wrong password": {func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }, http.StatusUnauthorized, "invalid_token"},
+		"bearer":         {func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK, ""},
+		"basic auth":     {func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") }, http.StatusOK, ""},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := serve(guarded, tt.setup)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.reason != "" {
+				assert.JSONEq(t, `{"error":"unauthorized","reason":"`+tt.reason+`"}`, w.Body.String())
+				assert.Equal(t, `Basic realm="metrics"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	t.Run("metrics server", func(t *testing.T) {
+		t.Setenv("RANGO_METRICS_TOKEN", "s3cret")
+		server, err := startMetricsServer("127.0.0.1:0")
+		require.NoError(t, err)
+		defer server.Close()
+
+		resp, err := http.Get("http://" + server.Addr)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		r, err := http.NewRequest(http.MethodGet, "http://"+server.Addr, nil)
+		require.NoError(t, err)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		resp, err = http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestRango_metricsRequired(t *testing.T) {
+	assert.True(t, metricsRequired())
+
+	t.Setenv("RANGO_METRICS_REQUIRED", "false")
+	assert.False(t, metricsRequired())
+}
+
+func TestRango_getKafkaTopics(t *testing.T) {
+	topics, scopes := getKafkaTopics()
+	assert.Equal(t, []string{"rango.events"}, topics)
+	assert.Empty(t, scopes)
+
+	t.Setenv("KAFKA_TOPICS", "rango.public, rango.private=private,")
+	topics, scopes = getKafkaTopics()
+	assert.Equal(t, []string{"rango.public", "rango.private"}, topics)
+	assert.Equal(t, map[string]string{"rango.private": "private"}, scopes)
+}
+
+func TestRango_getKafkaStartOffset(t *testing.T) {
+	offset, position, err := getKafkaStartOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, kgo.NewOffset().AtEnd(), offset)
+	assert.Equal(t, "latest offset", position)
+
+	t.Setenv("KAFKA_OFFSET_RESET", "earliest")
+	offset, position, err = getKafkaStartOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, kgo.NewOffset().AtStart(), offset)
+	assert.Equal(t, "earliest offset", position)
+
+	t.Setenv("KAFKA_START_TIME", "2020-04-27T15:19:58Z")
+	offset, position, err = getKafkaStartOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, kgo.NewOffset().AfterMilli(1588000798000), offset)
+	assert.Equal(t, "records produced since 2020-04-27T15:19:58Z", position)
+
+	t.Setenv("KAFKA_START_TIME", "yesterday")
+	_, _, err = getKafkaStartOffset()
+	assert.Error(t, err)
+
+	t.Setenv("KAFKA_START_TIME", "")
+	t.Setenv("KAFKA_OFFSET_RESET", "middle")
+	_, _, err = getKafkaStartOffset()
+	assert.Error(t, err)
+}
+
+func TestRango_getKafkaGroupID(t *testing.T) {
+	group := getKafkaGroupID()
+	assert.True(t, strings.HasPrefix(group, "rango-"), group)
+	assert.NotEqual(t, group, getKafkaGroupID(), "random groups are unique")
+
+	t.Setenv("KAFKA_GROUP_ID", "rango-eu-west")
+	assert.Equal(t, "rango-eu-west", getKafkaGroupID())
+}
+
+func TestRango_getKafkaRelay(t *testing.T) {
+	relay, err := getKafkaRelay()
+	assert.NoError(t, err)
+	assert.Nil(t, relay)
+
+	t.Setenv("RANGO_RELAY_REDIS_URL", "redis://localhost:6379")
+	_, err = getKafkaRelay()
+	assert.Error(t, err, "a random group would relay every message from every instance")
+
+	t.Setenv("KAFKA_GROUP_ID", "rango")
+	relay, err = getKafkaRelay()
+	assert.NoError(t, err)
+	assert.NotNil(t, relay)
+
+	t.Setenv("RANGO_RELAY_REDIS_URL", "localhost:6379")
+	_, err = getKafkaRelay()
+	assert.Error(t, err)
+}
+
+func TestRango_getKafkaAuth(t *testing.T) {
+	ka, err := getKafkaAuth()
+	assert.NoError(t, err)
+	assert.Equal(t, source.KafkaAuth{}, ka)
+
+	t.Setenv("KAFKA_TLS", "true")
+	t.Setenv("KAFKA_SASL_MECHANISM", "SCRAM-SHA-512")
+	t.Setenv("KAFKA_SASL_USER", "rango")
+	t.Setenv("KAFKA_SASL_PASS", "secret")
+	ka, err = getKafkaAuth()
+	assert.NoError(t, err)
+	assert.Equal(t, source.KafkaAuth{TLS: true, Mechanism: "SCRAM-SHA-512", User: "rango", Password: "secret"}, ka)
+
+	t.Setenv("KAFKA_TLS", "yes please")
+	_, err = getKafkaAuth()
+	assert.Error(t, err)
+}
+
+func TestRango_getEnvList(t *testing.T) {
+	assert.Equal(t, []string{}, getEnvList("RANGO_PRIVATE_STREAM_PREFIXES"))
+
+	t.Setenv("RANGO_PRIVATE_STREAM_PREFIXES", "user, account,")
+	assert.Equal(t, []string{"user", "account"}, getEnvList("RANGO_PRIVATE_STREAM_PREFIXES"))
+}
+
+func TestRango_authHandler(t *testing.T) {
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+	sign := func(secret string, exp time.Time) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":   exp.Unix(),
+			"uid":   "UIDABC00001",
+			"role":  "member",
+			"level": 2,
+		}).SignedString([]byte(secret))
+		require.NoError(t, err)
+		return token
+	}
+
+	var handled http.Header
+	h := func(w http.ResponseWriter, r *http.Request) {
+		handled = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := map[string]struct {
+		token  string
+		reason string
+	}{
+		"missing":       {"", auth.ReasonMissingToken},
+		"expired":       {sign("secret", time.Now().Add(-time.Minute)), auth.ReasonTokenExpired},
+		"bad signature": {sign("wrong", time.Now().Add(time.Hour)), auth.ReasonInvalidSignature},
+		"malformed":     {"not.a.token", auth.ReasonMalformedToken},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.Header.Set("JwtUID", "UIDSPOOFED1")
+			r.Header.Set("JwtLevel", "9")
+
+			t.Run("private", func(t *testing.T) {
+				handled = nil
+				w := httptest.NewRecorder()
+				authHandler(h, ks, true)(w, r.Clone(r.Context()))
+
+				assert.Nil(t, handled)
+				assert.Equal(t, http.StatusUnauthorized, w.Code)
+				assert.JSONEq(t, `{"error":"unauthorized","reason":"`+tt.reason+`"}`, w.Body.String())
+			})
+
+			t.Run("public", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				authHandler(h, ks, false)(w, r.Clone(r.Context()))
+
+				require.Equal(t, http.StatusOK, w.Code)
+				assert.Empty(t, handled.Get("JwtUID"))
+				assert.Empty(t, handled.Get("JwtLevel"))
+				if tt.token == "" {
+					assert.Empty(t, handled.Get("JwtError"))
+				} else {
+					assert.Equal(t, tt.reason, handled.Get("JwtError"))
+				}
+			})
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+sign("secret", time.Now().Add(time.Hour)))
+		r.Header.Set("JwtError", auth.ReasonTokenExpired)
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "UIDABC00001", handled.Get("JwtUID"))
+		assert.Equal(t, "member", handled.Get("JwtRole"))
+		assert.Equal(t, "2", handled.Get("JwtLevel"))
+		assert.NotEmpty(t, handled.Get("JwtExp"))
+		assert.Empty(t, handled.Get("JwtError"))
+	})
+
+	t.Run("custom headers", func(t *testing.T) {
+		defer func(uid, role string) { uidHeader, roleHeader = uid, role }(uidHeader, roleHeader)
+		uidHeader, roleHeader = "X-User-Id", "X-User-Role"
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+sign("secret", time.Now().Add(time.Hour)))
+		r.Header.Set("X-User-Role", "admin")
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "UIDABC00001", handled.Get("X-User-Id"))
+		assert.Equal(t, "member", handled.Get("X-User-Role"))
+		assert.Empty(t, handled.Get("JwtUID"))
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User-Id", "UIDSPOOFED1")
+		authHandler(h, ks, false)(httptest.NewRecorder(), r)
+		assert.Empty(t, handled.Get("X-User-Id"))
+	})
+}
+
+func TestRango_queryTokenAllowed(t *testing.T) {
+	assert.False(t, queryTokenAllowed())
+
+	t.Setenv("RANGO_ALLOW_QUERY_TOKEN", "true")
+	assert.True(t, queryTokenAllowed())
+
+	t.Setenv("RANGO_ALLOW_QUERY_TOKEN", "yes")
+	assert.False(t, queryTokenAllowed())
+}
+
+func TestRango_authHandlerQueryToken(t *testing.T) {
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+	sign := func(uid string, exp time.Time) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":  exp.Unix(),
+			"uid":  uid,
+			"role": "member",
+		}).SignedString([]byte("secret"))
+		require.NoError(t, err)
+		return token
+	}
+
+	var handled http.Header
+	h := func(w http.ResponseWriter, r *http.Request) {
+		handled = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		handled = nil
+		r := httptest.NewRequest(http.MethodGet, "/private?token="+sign("UIDABC00001", time.Now().Add(time.Hour)), nil)
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		assert.Nil(t, handled)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.JSONEq(t, `{"error":"unauthorized","reason":"`+auth.ReasonMissingToken+`"}`, w.Body.String())
+	})
+
+	t.Setenv("RANGO_ALLOW_QUERY_TOKEN", "true")
+
+	t.Run("valid", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private?stream=balance&token="+sign("UIDABC00001", time.Now().Add(time.Hour)), nil)
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "UIDABC00001", handled.Get("JwtUID"))
+		assert.Equal(t, "member", handled.Get("JwtRole"))
+		assert.NotEmpty(t, handled.Get("JwtExp"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		handled = nil
+		r := httptest.NewRequest(http.MethodGet, "/private?token="+sign("UIDABC00001", time.Now().Add(-time.Minute)), nil)
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		assert.Nil(t, handled)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.JSONEq(t, `{"error":"unauthorized","reason":"`+auth.ReasonTokenExpired+`"}`, w.Body.String())
+	})
+
+	t.Run("authorization header prevails", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private?token="+sign("UIDQUERY001", time.Now().Add(time.Hour)), nil)
+		r.Header.Set("Authorization", "Bearer "+sign("UIDABC00001", time.Now().Add(time.Hour)))
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "UIDABC00001", handled.Get("JwtUID"))
+	})
+}
+
+func TestRango_firstFrameAuthEnabled(t *testing.T) {
+	assert.False(t, firstFrameAuthEnabled())
+
+	t.Setenv("RANGO_FIRST_FRAME_AUTH", "true")
+	assert.True(t, firstFrameAuthEnabled())
+}
+
+func TestRango_browserAuth(t *testing.T) {
+	t.Setenv("RANGO_FIRST_FRAME_AUTH", "true")
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"uid":  "UIDABC00001",
+		"role": "member",
+	}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	opts := routing.DefaultHubOptions()
+	opts.AuthSubprotocol = authSubprotocol
+	hub := routing.NewHub(nil, opts)
+	hub.Authenticate = authenticator(ks)
+	go hub.ListenWebsocketEvents()
+	s := httptest.NewServer(http.HandlerFunc(authHandler(func(w http.ResponseWriter, r *http.Request) {
+		routing.NewClient(hub, w, r)
+	}, ks, true)))
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/?stream=balance"
+
+	// read returns the next message of conn.
+	read := func(t *testing.T, conn *websocket.Conn) string {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	t.Run("subprotocol", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"bearer", token}}
+		conn, _, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "bearer", conn.Subprotocol())
+		assert.Contains(t, read(t, conn), `"event":"hello"`)
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["balance"]}}`, read(t, conn))
+	})
+
+	t.Run("invalid subprotocol token", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"bearer", "not.a.token"}}
+		_, resp, err := dialer.Dial(url, nil)
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("first frame", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Contains(t, read(t, conn), `"event":"hello"`)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"auth","token":"`+token+`"}`)))
+		assert.Equal(t, `{"success":{"message":"authenticated","streams":[]}}`, read(t, conn))
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["balance"]}}`, read(t, conn))
+	})
+
+	t.Run("first frame without token", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Contains(t, read(t, conn), `"event":"hello"`)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["balance"]}`)))
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, 4001), err)
+	})
+
+	t.Run("HTTP requests without token", func(t *testing.T) {
+		resp, err := http.Get(s.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestRango_authenticator(t *testing.T) {
+	ks := &auth.KeyStore{HMACSecret: []byte("secret")}
+	authenticate := authenticator(ks)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"uid":   "UIDABC00001",
+		"role":  "member",
+		"level": 3,
+	}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	a, err := authenticate(token)
+	require.NoError(t, err)
+	assert.Equal(t, "UIDABC00001", a.UID)
+	assert.Equal(t, "member", a.Role)
+	assert.Equal(t, 3, a.Level)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), a.ExpiresAt, time.Minute)
+
+	_, err = authenticate("not.a.token")
+	assert.EqualError(t, err, auth.ReasonMalformedToken)
+}
+
+func TestRango_authHandlerAPIKey(t *testing.T) {
+	ks := &auth.KeyStore{APIKeys: map[string]auth.APIKey{
+		"61d025b8573501c2": {Secret: "2d0b4979c7fe6986daa8e21d1dc0644f", UID: "UIDABC00001", Role: "admin"},
+	}}
+	key := auth.NewAPIKeyHMAC("61d025b8573501c2", "2d0b4979c7fe6986daa8e21d1dc0644f")
+	nonce := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var handled http.Header
+	h := func(w http.ResponseWriter, r *http.Request) {
+		handled = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	t.Run("valid signature", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private", nil)
+		for k, v := range key.GetSignedHeader(nonce) {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		authHandler(h, ks, true)(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "UIDABC00001", handled.Get("JwtUID"))
+		assert.Equal(t, "admin", handled.Get("JwtRole"))
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		handled = nil
+		r := httptest.NewRequest(http.MethodGet, "/public", nil)
+		for k, v := range key.GetSignedHeader(nonce) {
+			r.Header[k] = v
+		}
+		r.Header.Set("X-Auth-Signature", key.GetSignature(nonce+1))
+		w := httptest.NewRecorder()
+		authHandler(h, ks, false)(w, r)
+
+		assert.Nil(t, handled)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.JSONEq(t, `{"error":"unauthorized","reason":"invalid_signature"}`, w.Body.String())
+	})
+}
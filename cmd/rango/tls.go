@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// getTLSConfig returns the TLS configuration of the server from the
+// certificate and key files of RANGO_TLS_CERT and RANGO_TLS_KEY, nil to serve
+// plain HTTP when neither is set.
+func getTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("RANGO_TLS_CERT"), os.Getenv("RANGO_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("RANGO_TLS_CERT and RANGO_TLS_KEY must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS certificate %s or key %s: %w", certFile, keyFile, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Websocket upgrades require HTTP/1.1.
+		NextProtos: []string{"http/1.1"},
+	}, nil
+}
+
+// serve serves HTTP requests on listener, over TLS when the server has a TLS
+// configuration.
+func serve(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// selfSignedCert writes a self-signed certificate of 127.0.0.1 and its key to
+// dir, it returns their paths and the certificate.
+func selfSignedCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rango"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile, cert
+}
+
+func TestTLS_getTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := selfSignedCert(t, dir)
+
+	t.Run("plain HTTP by default", func(t *testing.T) {
+		config, err := getTLSConfig()
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("loads the certificate", func(t *testing.T) {
+		t.Setenv("RANGO_TLS_CERT", certFile)
+		t.Setenv("RANGO_TLS_KEY", keyFile)
+
+		config, err := getTLSConfig()
+		assert.NoError(t, err)
+		assert.Len(t, config.Certificates, 1)
+	})
+
+	t.Run("requires both files", func(t *testing.T) {
+		t.Setenv("RANGO_TLS_CERT", certFile)
+
+		_, err := getTLSConfig()
+		assert.EqualError(t, err, "RANGO_TLS_CERT and RANGO_TLS_KEY must be set together")
+	})
+
+	t.Run("rejects invalid files", func(t *testing.T) {
+		t.Setenv("RANGO_TLS_CERT", certFile)
+		t.Setenv("RANGO_TLS_KEY", certFile)
+
+		_, err := getTLSConfig()
+		assert.Error(t, err)
+
+		t.Setenv("RANGO_TLS_KEY", filepath.Join(dir, "missing.pem"))
+		_, err = getTLSConfig()
+		assert.Error(t, err)
+	})
+}
+
+func TestTLS_serve(t *testing.T) {
+	certFile, keyFile, cert := selfSignedCert(t, t.TempDir())
+	t.Setenv("RANGO_TLS_CERT", certFile)
+	t.Setenv("RANGO_TLS_KEY", keyFile)
+
+	config, err := getTLSConfig()
+	require.NoError(t, err)
+
+	hub := routing.NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{
+		TLSConfig: config,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routing.NewClient(hub, w, r)
+		}),
+	}
+	go serve(server, listener)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+
+	conn, _, err := dialer.Dial("wss://"+listener.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(msg), `"event":"hello"`)
+
+	_, _, err = websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/", nil)
+	assert.Error(t, err, "plain connections are refused")
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIKey is the secret of an API key and the user it authenticates.
+type APIKey struct {
+	Secret string `json:"secret"`
+	UID    string `json:"uid"`
+	Role   string `json:"role"`
+}
+
+// Maximum difference between the nonce of a signed request, in unix
+// milliseconds, and the server time.
+const apiKeyNonceWindow = 30 * time.Second
+
+var (
+	// ErrUnknownAPIKey is returned for API keys missing from the key store.
+	ErrUnknownAPIKey = errors.New("unknown API key")
+
+	// ErrInvalidAPISignature is returned for requests not signed with the API key secret.
+	ErrInvalidAPISignature = errors.New("invalid API key signature")
+
+	// ErrInvalidNonce is returned for requests with a missing or stale nonce.
+	ErrInvalidNonce = errors.New("invalid nonce")
+)
+
+// ParseAPIKeys parses a JSON object of API keys by access key, e.g.
+//
+//	{"61d025b8573501c2":{"secret":"2d0b4979c7fe6986","uid":"UIDABC00001","role":"admin"}}
+func ParseAPIKeys(s string) (map[string]APIKey, error) {
+	keys := map[string]APIKey{}
+	if err := json.Unmarshal([]byte(s), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// HasAPIKey returns true if the request carries API key credentials.
+func HasAPIKey(header http.Header) bool {
+	return header.Get("X-Auth-Apikey") != ""
+}
+
+// ValidateAPIKey authenticates a request signed with an API key, see
+// APIKeyHMAC.GetSignedHeader, with the API keys of the store.
+func (ks *KeyStore) ValidateAPIKey(header http.Header) (Auth, error) {
+	key, ok := ks.APIKeys[header.Get("X-Auth-Apikey")]
+	if !ok {
+		return Auth{}, ErrUnknownAPIKey
+	}
+
+	nonce, err := strconv.ParseInt(header.Get("X-Auth-Nonce"), 10, 64)
+	if err != nil {
+		return Auth{}, ErrInvalidNonce
+	}
+	if d := time.Since(time.Unix(0, nonce*int64(time.Millisecond))); d > apiKeyNonceWindow || d < -apiKeyNonceWindow {
+		return Auth{}, ErrInvalidNonce
+	}
+
+	expected := NewAPIKeyHMAC(header.Get("X-Auth-Apikey"), key.Secret).GetSignature(nonce)
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Auth-Signature"))) {
+		return Auth{}, ErrInvalidAPISignature
+	}
+
+	return Auth{UID: key.UID, Role: key.Role}, nil
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(`{"61d025b8573501c2":{"secret":"2d0b4979c7fe6986","uid":"UIDABC00001","role":"admin"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]APIKey{
+		"61d025b8573501c2": {Secret: "2d0b4979c7fe6986", UID: "UIDABC00001", Role: "admin"},
+	}, keys)
+
+	_, err = ParseAPIKeys(`61d025b8573501c2:2d0b4979c7fe6986`)
+	assert.Error(t, err)
+}
+
+func TestKeyStore_ValidateAPIKey(t *testing.T) {
+	ks := &KeyStore{APIKeys: map[string]APIKey{
+		"61d025b8573501c2": {Secret: "2d0b4979c7fe6986daa8e21d1dc0644f", UID: "UIDABC00001", Role: "admin"},
+	}}
+	key := NewAPIKeyHMAC("61d025b8573501c2", "2d0b4979c7fe6986daa8e21d1dc0644f")
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	t.Run("valid signature", func(t *testing.T) {
+		auth, err := ks.ValidateAPIKey(key.GetSignedHeader(now))
+		require.NoError(t, err)
+		assert.Equal(t, "UIDABC00001", auth.UID)
+		assert.Equal(t, "admin", auth.Role)
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		header := key.GetSignedHeader(now)
+		header.Set("X-Auth-Nonce", header.Get("X-Auth-Nonce")+"1")
+		_, err := ks.ValidateAPIKey(header)
+		assert.Equal(t, ErrInvalidNonce, err)
+
+		header = key.GetSignedHeader(now)
+		header.Set("X-Auth-Signature", NewAPIKeyHMAC("61d025b8573501c2", "wrong").GetSignature(now))
+		_, err = ks.ValidateAPIKey(header)
+		assert.Equal(t, ErrInvalidAPISignature, err)
+		assert.Equal(t, ReasonInvalidSignature, Reason(err))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := ks.ValidateAPIKey(NewAPIKeyHMAC("unknown", "secret").GetSignedHeader(now))
+		assert.Equal(t, ErrUnknownAPIKey, err)
+		assert.Equal(t, ReasonInvalidAPIKey, Reason(err))
+	})
+
+	t.Run("stale nonce", func(t *testing.T) {
+		_, err := ks.ValidateAPIKey(key.GetSignedHeader(1584524005143))
+		assert.Equal(t, ErrInvalidNonce, err)
+		assert.Equal(t, ReasonInvalidNonce, Reason(err))
+	})
+}
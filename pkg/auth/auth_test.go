@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/rsa"
 	"reflect"
 	"strconv"
 	"testing"
@@ -71,3 +72,246 @@ func TestAuth_JWT(t *testing.T) {
 		}
 	})
 }
+
+func TestAuth_KeyRotation(t *testing.T) {
+	a := &KeyStore{}
+	if err := a.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &KeyStore{}
+	if err := b.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ForgeToken("uid", "email", "role", 3, a.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &KeyStore{}
+	ks.AddPublicKey(a.PublicKey)
+
+	t.Run("validates with the original key", func(t *testing.T) {
+		if _, err := ks.ParseAndValidate(token); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("still validates after a new key is added", func(t *testing.T) {
+		ks.AddPublicKey(b.PublicKey)
+
+		auth, err := ks.ParseAndValidate(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.UID != "uid" {
+			t.Errorf("expected: uid actual: %s", auth.UID)
+		}
+	})
+
+	t.Run("validates a token signed by the new key", func(t *testing.T) {
+		token, err := ForgeToken("uid", "email", "role", 3, b.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ks.ParseAndValidate(token); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rejects a token signed by an unknown key", func(t *testing.T) {
+		c := &KeyStore{}
+		if err := c.GenerateKeys(); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := ForgeToken("uid", "email", "role", 3, c.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ks.ParseAndValidate(token); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("rejects any token without keys", func(t *testing.T) {
+		if _, err := ParseAndValidate(token); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestAuth_Algorithms(t *testing.T) {
+	ks := &KeyStore{HMACSecret: []byte("secret")}
+	if err := ks.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.MapClaims{
+		"exp": time.Now().UTC().Add(time.Hour).Unix(),
+		"uid": "uid",
+	}
+
+	t.Run("accepts RS256", func(t *testing.T) {
+		token, err := ForgeToken("uid", "email", "role", 3, ks.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ks.ParseAndValidate(token); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("accepts HS256", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auth, err := ks.ParseAndValidate(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.UID != "uid" {
+			t.Errorf("expected: uid actual: %s", auth.UID)
+		}
+	})
+
+	t.Run("rejects HS256 with a wrong secret", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("wrong"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ks.ParseAndValidate(token); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("rejects HS256 without secret", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsaOnly := &KeyStore{}
+		rsaOnly.AddPublicKey(ks.PublicKey)
+		if _, err := rsaOnly.ParseAndValidate(token); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("rejects alg none", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ks.ParseAndValidate(token); err != ErrAlgNone {
+			t.Errorf("expected: %v actual: %v", ErrAlgNone, err)
+		}
+	})
+}
+
+func TestAuth_Claims(t *testing.T) {
+	ks := &KeyStore{HMACSecret: []byte("secret")}
+	if err := ks.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	rsaToken, err := ForgeToken("uid", "email", "role", 3, ks.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp": time.Now().UTC().Add(time.Hour).Unix(),
+		"uid": "uid",
+		"iss": "barong",
+		"aud": []string{"peatio", "barong"},
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		audience string
+		issuer   string
+		err      error
+	}{
+		{"accepts any claims when not configured", "", "", nil},
+		{"accepts a matching audience", "peatio", "", nil},
+		{"accepts a matching issuer", "", "barong", nil},
+		{"accepts matching audience and issuer", "barong", "barong", nil},
+		{"rejects another audience", "applogic", "", ErrInvalidAudience},
+		{"rejects another issuer", "", "keycloak", ErrInvalidIssuer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks.Audience, ks.Issuer = tt.audience, tt.issuer
+
+			for _, token := range []string{rsaToken, hmacToken} {
+				auth, err := ks.ParseAndValidate(token)
+				if err != tt.err {
+					t.Fatalf("expected: %v actual: %v", tt.err, err)
+				}
+				if err == nil && auth.UID != "uid" {
+					t.Errorf("expected: uid actual: %s", auth.UID)
+				}
+			}
+		})
+	}
+}
+
+func TestAuth_Reason(t *testing.T) {
+	ks := &KeyStore{}
+	if err := ks.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	other := &KeyStore{}
+	if err := other.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	forge := func(key *rsa.PrivateKey, claims jwt.MapClaims) string {
+		token, err := ForgeToken("uid", "email", "role", 3, key, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := forge(ks.PrivateKey, nil)
+
+	tests := map[string]struct {
+		token  string
+		reason string
+	}{
+		"expired":           {forge(ks.PrivateKey, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), ReasonTokenExpired},
+		"bad signature":     {forge(other.PrivateKey, nil), ReasonInvalidSignature},
+		"tampered":          {valid[:len(valid)-4] + "AAAA", ReasonInvalidSignature},
+		"malformed":         {"not.a.token", ReasonMalformedToken},
+		"not yet valid":     {forge(ks.PrivateKey, jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}), ReasonInvalidClaims},
+		"expired and wrong": {forge(other.PrivateKey, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), ReasonInvalidSignature},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ks.ParseAndValidate(tt.token)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if reason := Reason(err); reason != tt.reason {
+				t.Errorf("expected: %s actual: %s (%v)", tt.reason, reason, err)
+			}
+		})
+	}
+
+	if reason := Reason(ErrInvalidAudience); reason != ReasonInvalidClaims {
+		t.Errorf("expected: %s actual: %s", ReasonInvalidClaims, reason)
+	}
+}
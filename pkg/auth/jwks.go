@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Time allowed to fetch a JWKS document.
+const jwksTimeout = 10 * time.Second
+
+// jwk is a JSON Web Key, only RSA signing keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// publicKey returns the RSA public key of k.
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus of key %s: %w", k.Kid, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent of key %s: %w", k.Kid, err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// fetchJWKS returns the RSA signing keys by kid of the JWKS document at url.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := http.Client{Timeout: jwksTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA signing key in %s", url)
+	}
+	return keys, nil
+}
+
+// LoadPublicKeyFromJWKS fetches the RSA signing keys of the JWKS document at
+// url, tokens are then validated with the key matching their kid header. The
+// previous keys are kept when the fetch fails.
+func (ks *KeyStore) LoadPublicKeyFromJWKS(url string) error {
+	keys, err := fetchJWKS(url)
+	if err != nil {
+		return err
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.jwks = keys
+	return nil
+}
+
+// RefreshJWKS reloads the keys of the JWKS document at url every interval
+// until ctx is done.
+func (ks *KeyStore) RefreshJWKS(ctx context.Context, url string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.LoadPublicKeyFromJWKS(url); err != nil {
+				log.Error().Msgf("Failed to refresh JWKS, keeping the previous keys: %s", err.Error())
+			}
+		}
+	}
+}
+
+// jwksKey returns the JWKS key of kid.
+func (ks *KeyStore) jwksKey(kid string) (*rsa.PublicKey, bool) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	key, ok := ks.jwks[kid]
+	return key, ok
+}
+
+// HasKeys returns true if the store can validate tokens or API keys.
+func (ks *KeyStore) HasKeys() bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	return len(ks.PublicKeys) != 0 || ks.HMACSecret != nil || ks.APIKeys != nil || len(ks.jwks) != 0
+}
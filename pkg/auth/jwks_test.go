@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwksServer serves the keys of a JWKS document, or an error while failing.
+type jwksServer struct {
+	mutex   sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	failing bool
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	doc := map[string][]map[string]string{"keys": {}}
+	for kid, key := range s.keys {
+		doc["keys"] = append(doc["keys"], map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (s *jwksServer) set(keys map[string]*rsa.PublicKey, failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys, s.failing = keys, failing
+}
+
+// signWithKid returns a token signed by key with the kid header.
+func signWithKid(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"uid": "UIDABC00001",
+	})
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestKeyStore_LoadPublicKeyFromJWKS(t *testing.T) {
+	a, b := generateKeyStore(t), generateKeyStore(t)
+	jwks := &jwksServer{keys: map[string]*rsa.PublicKey{"a": a.PublicKey}}
+	s := httptest.NewServer(jwks)
+	defer s.Close()
+
+	ks := &KeyStore{}
+	require.NoError(t, ks.LoadPublicKeyFromJWKS(s.URL))
+	assert.True(t, ks.HasKeys())
+
+	t.Run("selects the key by kid", func(t *testing.T) {
+		auth, err := ks.ParseAndValidate(signWithKid(t, a.PrivateKey, "a"))
+		require.NoError(t, err)
+		assert.Equal(t, "UIDABC00001", auth.UID)
+
+		_, err = ks.ParseAndValidate(signWithKid(t, b.PrivateKey, "a"))
+		assert.Error(t, err)
+
+		_, err = ks.ParseAndValidate(signWithKid(t, b.PrivateKey, "b"))
+		assert.Error(t, err, "unknown kid")
+	})
+
+	t.Run("loads rotated keys", func(t *testing.T) {
+		jwks.set(map[string]*rsa.PublicKey{"a": a.PublicKey, "b": b.PublicKey}, false)
+		require.NoError(t, ks.LoadPublicKeyFromJWKS(s.URL))
+
+		_, err := ks.ParseAndValidate(signWithKid(t, b.PrivateKey, "b"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("keeps the last known keys on failure", func(t *testing.T) {
+		jwks.set(nil, true)
+		assert.Error(t, ks.LoadPublicKeyFromJWKS(s.URL))
+
+		_, err := ks.ParseAndValidate(signWithKid(t, b.PrivateKey, "b"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("refreshes periodically", func(t *testing.T) {
+		c := generateKeyStore(t)
+		jwks.set(map[string]*rsa.PublicKey{"c": c.PublicKey}, false)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go ks.RefreshJWKS(ctx, s.URL, 10*time.Millisecond)
+
+		assert.Eventually(t, func() bool {
+			_, err := ks.ParseAndValidate(signWithKid(t, c.PrivateKey, "c"))
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("rejects documents without RSA keys", func(t *testing.T) {
+		empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"keys":[{"kty":"EC","kid":"ec"}]}`))
+		}))
+		defer empty.Close()
+
+		assert.Error(t, (&KeyStore{}).LoadPublicKeyFromJWKS(empty.URL))
+	})
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"time"
 
@@ -22,17 +23,121 @@ type Auth struct {
 	jwt.StandardClaims
 }
 
-// ParseAndValidate parses token and validates it's jwt signature with given key.
-func ParseAndValidate(token string, key *rsa.PublicKey) (Auth, error) {
+var hmacAlgs = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodHS384.Alg(),
+	jwt.SigningMethodHS512.Alg(),
+}
+
+// ErrAlgNone is returned for unsigned tokens.
+var ErrAlgNone = errors.New("unsigned tokens are not accepted")
+
+// ErrInvalidAudience is returned for tokens not issued for the expected audience.
+var ErrInvalidAudience = errors.New("token audience is not accepted")
+
+// ErrInvalidIssuer is returned for tokens not issued by the expected issuer.
+var ErrInvalidIssuer = errors.New("token issuer is not accepted")
+
+// ParseAndValidate parses token and validates it's jwt signature with given keys.
+// Keys are tried in order and the first one verifying the signature wins.
+func ParseAndValidate(token string, keys ...*rsa.PublicKey) (Auth, error) {
+	auth := Auth{}
+	err := errors.New("no public key configured")
+
+	for _, key := range keys {
+		auth = Auth{}
+		_, err = jwt.ParseWithClaims(token, &auth, func(t *jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+
+		if !isSignatureError(err) {
+			break
+		}
+	}
+
+	return auth, err
+}
+
+// ParseAndValidateHMAC parses token and validates it's HS256/HS384/HS512 signature with given secret.
+func ParseAndValidateHMAC(token string, secret []byte) (Auth, error) {
 	auth := Auth{}
 
-	_, err := jwt.ParseWithClaims(token, &auth, func(t *jwt.Token) (interface{}, error) {
-		return key, nil
+	if len(secret) == 0 {
+		return auth, errors.New("no HMAC secret configured")
+	}
+
+	parser := jwt.Parser{ValidMethods: hmacAlgs}
+	_, err := parser.ParseWithClaims(token, &auth, func(t *jwt.Token) (interface{}, error) {
+		return secret, nil
 	})
 
 	return auth, err
 }
 
+// tokenHeader returns the alg and kid headers of token without verifying it.
+func tokenHeader(token string) (string, string, error) {
+	t, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return "", "", err
+	}
+
+	alg, _ := t.Header["alg"].(string)
+	kid, _ := t.Header["kid"].(string)
+	return alg, kid, nil
+}
+
+// Reasons of token validation failures, see Reason.
+const (
+	ReasonMissingToken     = "missing_token"
+	ReasonTokenExpired     = "token_expired"
+	ReasonInvalidSignature = "invalid_signature"
+	ReasonMalformedToken   = "malformed_token"
+	ReasonInvalidClaims    = "invalid_claims"
+	ReasonInvalidAPIKey    = "invalid_api_key"
+	ReasonInvalidNonce     = "invalid_nonce"
+)
+
+// Reason returns the machine readable reason of a validation error returned
+// by ParseAndValidate or ValidateAPIKey, so clients can tell an expired
+// token, to be refreshed, from an invalid one.
+func Reason(err error) string {
+	switch err {
+	case ErrAlgNone, ErrInvalidAPISignature:
+		return ReasonInvalidSignature
+	case ErrInvalidAudience, ErrInvalidIssuer:
+		return ReasonInvalidClaims
+	case ErrUnknownAPIKey:
+		return ReasonInvalidAPIKey
+	case ErrInvalidNonce:
+		return ReasonInvalidNonce
+	}
+
+	var vErr *jwt.ValidationError
+	if !errors.As(err, &vErr) {
+		return ReasonInvalidSignature
+	}
+
+	switch {
+	case vErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return ReasonMalformedToken
+	case vErr.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return ReasonInvalidSignature
+	case vErr.Errors&jwt.ValidationErrorExpired != 0:
+		return ReasonTokenExpired
+	default:
+		return ReasonInvalidClaims
+	}
+}
+
+func isSignatureError(err error) bool {
+	var vErr *jwt.ValidationError
+	if !errors.As(err, &vErr) {
+		return false
+	}
+
+	return vErr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
 func appendClaims(defaultClaims, customClaims jwt.MapClaims) jwt.MapClaims {
 	if defaultClaims == nil {
 		return customClaims
@@ -6,15 +6,45 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/golang-jwt/jwt"
 )
 
+// ErrInvalidPEM is returned when no PEM encoded public key is found.
+var ErrInvalidPEM = errors.New("public key is not PEM encoded")
+
+// ErrInvalidKeyType is returned when a PEM block holds something else than an
+// RSA public key.
+var ErrInvalidKeyType = errors.New("public key is not an RSA public key")
+
 type KeyStore struct {
 	PublicKey  *rsa.PublicKey
 	PrivateKey *rsa.PrivateKey
+
+	// PublicKeys holds every key accepted for validation, PublicKey is the first one.
+	PublicKeys []*rsa.PublicKey
+
+	// HMACSecret enables validation of HS256 tokens when set.
+	HMACSecret []byte
+
+	// Audience, when set, must be one of the aud claims of the tokens.
+	Audience string
+
+	// Issuer, when set, must be the iss claim of the tokens.
+	Issuer string
+
+	// APIKeys by access key, enabling API key authentication when set.
+	APIKeys map[string]APIKey
+
+	// Keys by kid loaded from a JWKS document, see LoadPublicKeyFromJWKS.
+	jwks  map[string]*rsa.PublicKey
+	mutex sync.RWMutex
 }
 
 func fileExist(path string) bool {
@@ -43,7 +73,7 @@ func LoadOrGenerateKeys(privPath, pubPath string) (*KeyStore, error) {
 		}
 	} else {
 		if ks.PublicKey == nil {
-			ks.PublicKey = &ks.PrivateKey.PublicKey
+			ks.AddPublicKey(&ks.PrivateKey.PublicKey)
 		}
 
 		if err = ks.SavePublicKey(pubPath); err != nil {
@@ -54,37 +84,172 @@ func LoadOrGenerateKeys(privPath, pubPath string) (*KeyStore, error) {
 	return ks, nil
 }
 
+// AddPublicKey appends key to the set of keys accepted for validation.
+func (ks *KeyStore) AddPublicKey(key *rsa.PublicKey) {
+	if ks.PublicKey == nil {
+		ks.PublicKey = key
+	}
+	ks.PublicKeys = append(ks.PublicKeys, key)
+}
+
+// ParseAndValidate validates token with the key matching its alg header:
+// HMAC tokens use the HMAC secret, tokens with the kid of a JWKS key that key,
+// other tokens every public key of the store. The audience and issuer of the
+// token are checked when configured.
+func (ks *KeyStore) ParseAndValidate(token string) (Auth, error) {
+	alg, kid, err := tokenHeader(token)
+	if err != nil {
+		return Auth{}, err
+	}
+
+	var auth Auth
+	switch {
+	case alg == jwt.SigningMethodNone.Alg():
+		return Auth{}, ErrAlgNone
+	case contains(hmacAlgs, alg):
+		auth, err = ParseAndValidateHMAC(token, ks.HMACSecret)
+	default:
+		keys := ks.PublicKeys
+		if key, ok := ks.jwksKey(kid); ok {
+			keys = []*rsa.PublicKey{key}
+		}
+		auth, err = ParseAndValidate(token, keys...)
+	}
+	if err != nil {
+		return auth, err
+	}
+
+	if ks.Audience != "" && !contains(auth.Audience, ks.Audience) {
+		return Auth{}, ErrInvalidAudience
+	}
+	if ks.Issuer != "" && auth.Issuer != ks.Issuer {
+		return Auth{}, ErrInvalidIssuer
+	}
+	return auth, nil
+}
+
+func contains(list []string, el string) bool {
+	for _, l := range list {
+		if l == el {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPublicKeyFromFile loads every PEM encoded public key found in the file.
 func (ks *KeyStore) LoadPublicKeyFromFile(path string) error {
 	pem, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("unreadable public key file: %w", err)
 	}
 
-	key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+	keys, err := parsePublicKeys(pem)
 	if err != nil {
 		return err
 	}
 
-	ks.PublicKey = key
+	for _, key := range keys {
+		ks.AddPublicKey(key)
+	}
 
 	return nil
 }
 
+// LoadPublicKeyFromString loads the first public key of a base64 encoded PEM.
 func (ks *KeyStore) LoadPublicKeyFromString(str string) error {
 	pem, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: invalid base64: %v", ErrInvalidPEM, err)
 	}
 
-	key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+	keys, err := parsePublicKeys(pem)
 	if err != nil {
 		return err
 	}
 
-	ks.PublicKey = key
+	ks.AddPublicKey(keys[0])
 	return nil
 }
 
+// LoadPublicKeysFromString loads a bundle of base64 encoded PEM public keys
+// separated by commas or newlines. A single entry may hold several PEM blocks.
+func (ks *KeyStore) LoadPublicKeysFromString(str string) error {
+	entries := strings.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	for i, entry := range entries {
+		pem, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry))
+		if err != nil {
+			return fmt.Errorf("key %d: %w: invalid base64: %v", i+1, ErrInvalidPEM, err)
+		}
+
+		keys, err := parsePublicKeys(pem)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", i+1, err)
+		}
+
+		for _, key := range keys {
+			ks.AddPublicKey(key)
+		}
+	}
+
+	return nil
+}
+
+// parsePublicKeys parses every PEM block of data, failing on the first block
+// which is not an RSA public key.
+func parsePublicKeys(data []byte) ([]*rsa.PublicKey, error) {
+	var keys []*rsa.PublicKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := parsePublicKey(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrInvalidPEM
+	}
+
+	return keys, nil
+}
+
+// parsePublicKey parses a PKIX or PKCS1 public key or a certificate, whatever
+// the type of the block says.
+func parsePublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	if strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("%w: found a %s", ErrInvalidKeyType, block.Type)
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if key, pkcs1Err := x509.ParsePKCS1PublicKey(block.Bytes); pkcs1Err == nil {
+			return key, nil
+		}
+		cert, certErr := x509.ParseCertificate(block.Bytes)
+		if certErr != nil {
+			return nil, fmt.Errorf("invalid %s PEM block: %w", block.Type, err)
+		}
+		parsed = cert.PublicKey
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: found a %T", ErrInvalidKeyType, parsed)
+	}
+	return key, nil
+}
+
 func (ks *KeyStore) LoadPrivateKey(path string) error {
 	pem, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -110,7 +275,7 @@ func (ks *KeyStore) GenerateKeys() error {
 	}
 
 	ks.PrivateKey = key
-	ks.PublicKey = &key.PublicKey
+	ks.AddPublicKey(&key.PublicKey)
 
 	return nil
 }
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodePublicKey(t *testing.T, ks *KeyStore) []byte {
+	bytes, err := x509.MarshalPKIXPublicKey(ks.PublicKey)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bytes})
+}
+
+func generateKeyStore(t *testing.T) *KeyStore {
+	ks := &KeyStore{}
+	require.NoError(t, ks.GenerateKeys())
+
+	return ks
+}
+
+func TestKeyStore_LoadPublicKeysFromString(t *testing.T) {
+	a := encodePublicKey(t, generateKeyStore(t))
+	b := encodePublicKey(t, generateKeyStore(t))
+
+	t.Run("single key", func(t *testing.T) {
+		ks := &KeyStore{}
+		require.NoError(t, ks.LoadPublicKeysFromString(base64.StdEncoding.EncodeToString(a)))
+		assert.Len(t, ks.PublicKeys, 1)
+		assert.Equal(t, ks.PublicKeys[0], ks.PublicKey)
+	})
+
+	t.Run("comma separated keys", func(t *testing.T) {
+		ks := &KeyStore{}
+		bundle := base64.StdEncoding.EncodeToString(a) + "," + base64.StdEncoding.EncodeToString(b)
+		require.NoError(t, ks.LoadPublicKeysFromString(bundle))
+		assert.Len(t, ks.PublicKeys, 2)
+	})
+
+	t.Run("newline separated keys", func(t *testing.T) {
+		ks := &KeyStore{}
+		bundle := base64.StdEncoding.EncodeToString(a) + "\n" + base64.StdEncoding.EncodeToString(b) + "\n"
+		require.NoError(t, ks.LoadPublicKeysFromString(bundle))
+		assert.Len(t, ks.PublicKeys, 2)
+	})
+
+	t.Run("concatenated PEM blocks", func(t *testing.T) {
+		ks := &KeyStore{}
+		bundle := base64.StdEncoding.EncodeToString(append(a, b...))
+		require.NoError(t, ks.LoadPublicKeysFromString(bundle))
+		assert.Len(t, ks.PublicKeys, 2)
+	})
+
+	t.Run("invalid PEM", func(t *testing.T) {
+		ks := &KeyStore{}
+		assert.ErrorIs(t, ks.LoadPublicKeysFromString(base64.StdEncoding.EncodeToString([]byte("garbage"))), ErrInvalidPEM)
+		assert.Empty(t, ks.PublicKeys)
+	})
+
+	t.Run("invalid base64", func(t *testing.T) {
+		ks := &KeyStore{}
+		err := ks.LoadPublicKeysFromString(base64.StdEncoding.EncodeToString(a) + ",not base64!")
+		assert.ErrorIs(t, err, ErrInvalidPEM)
+		assert.Contains(t, err.Error(), "key 2: public key is not PEM encoded: invalid base64")
+	})
+}
+
+func TestKeyStore_LoadPublicKeyFromFile(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecBytes, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+	rsaKey := generateKeyStore(t)
+
+	tests := map[string]struct {
+		pem []byte
+		err string
+	}{
+		"not PEM": {
+			[]byte("garbage"), "public key is not PEM encoded",
+		},
+		"corrupted PEM block": {
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}), "invalid PUBLIC KEY PEM block",
+		},
+		"ECDSA key": {
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecBytes}), "public key is not an RSA public key: found a *ecdsa.PublicKey",
+		},
+		"private key": {
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.PrivateKey)}), "public key is not an RSA public key: found a RSA PRIVATE KEY",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rango.pub")
+			require.NoError(t, os.WriteFile(path, tt.pem, 0600))
+
+			ks := &KeyStore{}
+			err := ks.LoadPublicKeyFromFile(path)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+			assert.Empty(t, ks.PublicKeys)
+		})
+	}
+
+	t.Run("PKCS1 key", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rango.pub")
+		block := &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(rsaKey.PublicKey)}
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+		ks := &KeyStore{}
+		require.NoError(t, ks.LoadPublicKeyFromFile(path))
+		assert.Equal(t, rsaKey.PublicKey, ks.PublicKey)
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		ks := &KeyStore{}
+		err := ks.LoadPublicKeyFromFile(filepath.Join(t.TempDir(), "missing.pub"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Contains(t, err.Error(), "unreadable public key file")
+	})
+}
+
+func TestKeyStore_LoadPublicKeyFromString(t *testing.T) {
+	ks := &KeyStore{}
+	assert.ErrorIs(t, ks.LoadPublicKeyFromString("not base64!"), ErrInvalidPEM)
+	assert.ErrorIs(t, ks.LoadPublicKeyFromString(base64.StdEncoding.EncodeToString([]byte("garbage"))), ErrInvalidPEM)
+
+	key := generateKeyStore(t)
+	require.NoError(t, ks.LoadPublicKeyFromString(base64.StdEncoding.EncodeToString(encodePublicKey(t, key))))
+	assert.Equal(t, key.PublicKey, ks.PublicKey)
+}
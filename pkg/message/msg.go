@@ -7,6 +7,31 @@ import (
 type Request struct {
 	Method  string
 	Streams []string
+
+	// Filters of the subscribed streams by stream name.
+	Filters map[string]json.RawMessage
+
+	// Subscribed streams delivering only their latest message to slow clients.
+	Conflate []string
+
+	// Maximum messages per second of each subscribed stream, the latest
+	// message being delivered, 0 for no limit.
+	MaxUpdatesPerSec float64
+
+	// Sequence of the first message of the subscribed streams replayed from
+	// their history, nil to only receive new messages.
+	FromSeq *uint64
+
+	// Token of auth requests.
+	Token string
+
+	// Session of resume requests.
+	Session string
+
+	// RPC is set for JSON-RPC requests, with their ID and Params.
+	RPC    bool
+	ID     json.RawMessage
+	Params json.RawMessage
 }
 
 func PackOutgoingResponse(err error, message interface{}) ([]byte, error) {
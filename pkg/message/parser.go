@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"reflect"
 )
 
+// ErrInvalidMessage is returned for messages that aren't JSON objects or
+// whose fields have invalid types.
+var ErrInvalidMessage = errors.New("invalid message")
+
 func ParseRequest(msg []byte) (Request, error) {
 	request, err := Parse(msg)
 	if err != nil {
@@ -20,8 +23,13 @@ func Parse(msg []byte) (Request, error) {
 	var v map[string]interface{}
 	var parsed Request
 
-	if err := json.Unmarshal(msg, &v); err != nil {
-		return parsed, fmt.Errorf("Could not parse message: %w", err)
+	err := json.Unmarshal(msg, &v)
+	if err != nil {
+		return parsed, fmt.Errorf("%w: %s", ErrInvalidMessage, err.Error())
+	}
+
+	if _, ok := v["jsonrpc"]; ok {
+		return parseRPC(msg)
 	}
 
 	switch v["event"] {
@@ -31,12 +39,47 @@ func Parse(msg []byte) (Request, error) {
 		if !ok {
 			return parsed, fmt.Errorf("No streams provided")
 		}
-		switch reflect.TypeOf(streams).Kind() {
-		case reflect.Slice:
-			streams := reflect.ValueOf(v["streams"])
-			for i := 0; i < streams.Len(); i++ {
-				parsed.Streams = append(parsed.Streams, streams.Index(i).Interface().(string))
+		if parsed.Streams, err = parseStreams(streams); err != nil {
+			return parsed, err
+		}
+		if _, ok := v["filters"]; ok {
+			var f struct {
+				Filters map[string]json.RawMessage `json:"filters"`
+			}
+			if err := json.Unmarshal(msg, &f); err != nil {
+				return parsed, fmt.Errorf("Could not parse filters: %w", err)
+			}
+			parsed.Filters = f.Filters
+		}
+		if _, ok := v["conflate"]; ok {
+			var c struct {
+				Conflate []string `json:"conflate"`
+			}
+			if err := json.Unmarshal(msg, &c); err != nil {
+				return parsed, fmt.Errorf("Could not parse conflate: %w", err)
+			}
+			parsed.Conflate = c.Conflate
+		}
+		if _, ok := v["max_updates_per_sec"]; ok {
+			var m struct {
+				MaxUpdatesPerSec float64 `json:"max_updates_per_sec"`
+			}
+			if err := json.Unmarshal(msg, &m); err != nil {
+				return parsed, fmt.Errorf("Could not parse max_updates_per_sec: %w", err)
+			}
+			if m.MaxUpdatesPerSec < 0 {
+				return parsed, errors.New("max_updates_per_sec must not be negative")
+			}
+			parsed.MaxUpdatesPerSec = m.MaxUpdatesPerSec
+		}
+		if _, ok := v["from_seq"]; ok {
+			var f struct {
+				FromSeq uint64 `json:"from_seq"`
 			}
+			if err := json.Unmarshal(msg, &f); err != nil {
+				return parsed, fmt.Errorf("Could not parse from_seq: %w", err)
+			}
+			parsed.FromSeq = &f.FromSeq
 		}
 	case "unsubscribe":
 		parsed.Method = "unsubscribe"
@@ -44,16 +87,46 @@ func Parse(msg []byte) (Request, error) {
 		if !ok {
 			return parsed, fmt.Errorf("No streams provided")
 		}
-		switch reflect.TypeOf(streams).Kind() {
-		case reflect.Slice:
-			streams := reflect.ValueOf(v["streams"])
-			for i := 0; i < streams.Len(); i++ {
-				parsed.Streams = append(parsed.Streams, streams.Index(i).Interface().(string))
-			}
+		if parsed.Streams, err = parseStreams(streams); err != nil {
+			return parsed, err
 		}
+	case "streams":
+		parsed.Method = "streams"
+	case "auth":
+		parsed.Method = "auth"
+		token, ok := v["token"].(string)
+		if !ok || token == "" {
+			return parsed, fmt.Errorf("No token provided")
+		}
+		parsed.Token = token
+	case "resume":
+		parsed.Method = "resume"
+		session, ok := v["session"].(string)
+		if !ok || session == "" {
+			return parsed, fmt.Errorf("No session provided")
+		}
+		parsed.Session = session
 	default:
 		return parsed, errors.New("Could not parse Type: Invalid event")
 	}
 
 	return parsed, nil
 }
+
+// parseStreams returns the names of the streams field of a message.
+func parseStreams(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: streams must be a list", ErrInvalidMessage)
+	}
+
+	var streams []string
+	for _, s := range list {
+		stream, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: streams must be strings", ErrInvalidMessage)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
@@ -0,0 +1,101 @@
+package message
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse_Filters(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"],"filters":{"eurusd.trades":{"side":"buy"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"eurusd.trades"}, req.Streams)
+	assert.Equal(t, map[string]json.RawMessage{"eurusd.trades": json.RawMessage(`{"side":"buy"}`)}, req.Filters)
+
+	req, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"]}`))
+	assert.NoError(t, err)
+	assert.Nil(t, req.Filters)
+
+	_, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"],"filters":["side"]}`))
+	assert.Error(t, err)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, m := range []string{
+		`garbage`,
+		`{"event":"subscribe"`,
+		`["subscribe"]`,
+		`{"event":"subscribe","streams":[1]}`,
+		`{"event":"subscribe","streams":null}`,
+		`{"event":"unsubscribe","streams":"eurusd.trades"}`,
+	} {
+		_, err := Parse([]byte(m))
+		assert.ErrorIs(t, err, ErrInvalidMessage, m)
+	}
+
+	_, err := Parse([]byte(`{"event":"unknown"}`))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidMessage)
+}
+
+func TestParse_Auth(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"auth","token":"eyJhbGciOiJSUzI1NiJ9"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "auth", req.Method)
+	assert.Equal(t, "eyJhbGciOiJSUzI1NiJ9", req.Token)
+
+	_, err = Parse([]byte(`{"event":"auth"}`))
+	assert.Error(t, err)
+
+	_, err = Parse([]byte(`{"event":"auth","token":42}`))
+	assert.Error(t, err)
+}
+
+func TestParse_Conflate(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers","eurusd.trades"],"conflate":["eurusd.tickers"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"eurusd.tickers"}, req.Conflate)
+
+	_, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers"],"conflate":true}`))
+	assert.Error(t, err)
+}
+
+func TestParse_MaxUpdatesPerSec(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers"],"max_updates_per_sec":2.5}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, req.MaxUpdatesPerSec)
+
+	req, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers"]}`))
+	assert.NoError(t, err)
+	assert.Zero(t, req.MaxUpdatesPerSec)
+
+	_, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers"],"max_updates_per_sec":"10"}`))
+	assert.Error(t, err)
+
+	_, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.tickers"],"max_updates_per_sec":-1}`))
+	assert.Error(t, err)
+}
+
+func TestParse_Resume(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"resume","session":"5f0c1b3e"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "resume", req.Method)
+	assert.Equal(t, "5f0c1b3e", req.Session)
+
+	_, err = Parse([]byte(`{"event":"resume"}`))
+	assert.Error(t, err)
+}
+
+func TestParse_FromSeq(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"],"from_seq":42}`))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), *req.FromSeq)
+
+	req, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"]}`))
+	assert.NoError(t, err)
+	assert.Nil(t, req.FromSeq)
+
+	_, err = Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"],"from_seq":-1}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package message
+
+import (
+	"encoding/json"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+// RPCError is a JSON-RPC 2.0 error object.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// parseRPC parses a JSON-RPC 2.0 request, requests without id are notifications.
+func parseRPC(msg []byte) (Request, error) {
+	var r rpcRequest
+	parsed := Request{RPC: true}
+
+	if err := json.Unmarshal(msg, &r); err != nil {
+		return parsed, &RPCError{Code: RPCInvalidRequest, Message: "Invalid Request"}
+	}
+	parsed.ID = r.ID
+
+	if r.JSONRPC != "2.0" || r.Method == "" {
+		return parsed, &RPCError{Code: RPCInvalidRequest, Message: "Invalid Request"}
+	}
+	parsed.Method = r.Method
+	parsed.Params = r.Params
+
+	return parsed, nil
+}
+
+// PackRPCResponse returns the JSON-RPC response to the request with id, the
+// result is ignored when err is set.
+func PackRPCResponse(id json.RawMessage, result interface{}, err error) ([]byte, error) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	res := rpcResponse{JSONRPC: "2.0", ID: id}
+
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{Code: RPCInternalError, Message: err.Error()}
+		}
+		res.Error = rpcErr
+	} else {
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+		res.Result = result
+	}
+
+	return json.Marshal(res)
+}
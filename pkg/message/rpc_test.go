@@ -0,0 +1,50 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRPC_Parse(t *testing.T) {
+	req, err := ParseRequest([]byte(`{"jsonrpc":"2.0","id":7,"method":"list_subscriptions","params":{"a":1}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, Request{
+		Method: "list_subscriptions",
+		RPC:    true,
+		ID:     json.RawMessage(`7`),
+		Params: json.RawMessage(`{"a":1}`),
+	}, req)
+
+	req, err = ParseRequest([]byte(`{"jsonrpc":"2.0","method":"list_subscriptions"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, req.ID, "notification")
+
+	req, err = ParseRequest([]byte(`{"jsonrpc":"1.0","id":"a","method":"list_subscriptions"}`))
+	assert.Equal(t, &RPCError{Code: RPCInvalidRequest, Message: "Invalid Request"}, err)
+	assert.True(t, req.RPC)
+	assert.Equal(t, json.RawMessage(`"a"`), req.ID)
+
+	_, err = ParseRequest([]byte(`{"jsonrpc":"2.0","id":1,"method":42}`))
+	assert.Equal(t, &RPCError{Code: RPCInvalidRequest, Message: "Invalid Request"}, err)
+}
+
+func TestRPC_Response(t *testing.T) {
+	res, err := PackRPCResponse(json.RawMessage(`1`), []string{"eurusd.trades"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":1,"result":["eurusd.trades"]}`, string(res))
+
+	res, err = PackRPCResponse(json.RawMessage(`"a"`), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":"a","result":null}`, string(res))
+
+	res, err = PackRPCResponse(json.RawMessage(`2`), nil, &RPCError{Code: RPCMethodNotFound, Message: "Method not found"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"Method not found"}}`, string(res))
+
+	res, err = PackRPCResponse(nil, nil, errors.New("boom"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":null,"error":{"code":-32603,"message":"boom"}}`, string(res))
+}
@@ -1,6 +1,10 @@
 package metrics
 
 import (
+	"runtime"
+	"strconv"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -8,8 +12,28 @@ import (
 var defaultMetrics *Metrics
 
 type Metrics struct {
-	clients prometheus.Gauge
-	subs    *prometheus.GaugeVec
+	clients    prometheus.Gauge
+	subs       *prometheus.GaugeVec
+	activeSubs *prometheus.GaugeVec
+	dispatched *prometheus.CounterVec
+	fanout     *prometheus.HistogramVec
+	dispatch   *prometheus.HistogramVec
+	dropped    *prometheus.CounterVec
+	paused     *prometheus.CounterVec
+	unroutable *prometheus.CounterVec
+	inbound    prometheus.Gauge
+	inDropped  prometheus.Counter
+	stale      prometheus.Counter
+	slow       *prometheus.CounterVec
+	idle       prometheus.Counter
+	disconnect *prometheus.CounterVec
+	maxClients prometheus.Gauge
+	refused    *prometheus.CounterVec
+	upgrades   *prometheus.CounterVec
+	compressed *prometheus.CounterVec
+	lastMsg    *prometheus.GaugeVec
+	lag        *prometheus.GaugeVec
+	buildInfo  *prometheus.GaugeVec
 }
 
 func Enable() {
@@ -17,6 +41,11 @@ func Enable() {
 	registerMetrics()
 }
 
+// Enabled returns true if metrics are recorded, to skip measuring them otherwise.
+func Enabled() bool {
+	return defaultMetrics != nil
+}
+
 func registerMetrics() {
 	defaultMetrics.clients = promauto.NewGauge(
 		prometheus.GaugeOpts{
@@ -32,6 +61,163 @@ func registerMetrics() {
 		},
 		[]string{"type", "topic"},
 	)
+
+	defaultMetrics.activeSubs = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rango_hub_active_subscriptions",
+			Help: "Number of active subscriptions by type",
+		},
+		[]string{"type"},
+	)
+
+	defaultMetrics.dispatched = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_messages_dispatched_total",
+			Help: "Number of upstream messages dispatched by the hub",
+		},
+		[]string{"scope", "topic"},
+	)
+
+	defaultMetrics.fanout = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rango_hub_message_fanout",
+			Help:    "Number of clients a message was sent to",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"scope"},
+	)
+
+	defaultMetrics.dispatch = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rango_hub_dispatch_duration_seconds",
+			Help:    "Time taken by the hub to send an upstream message to its subscribers",
+			Buckets: prometheus.ExponentialBuckets(0.00005, 2, 11),
+		},
+		[]string{"scope"},
+	)
+
+	defaultMetrics.dropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_dropped_messages_total",
+			Help: "Number of messages dropped because a client send buffer was full",
+		},
+		[]string{"stream"},
+	)
+
+	defaultMetrics.inbound = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rango_inbound_queue_depth",
+			Help: "Number of upstream messages queued for the hub",
+		},
+	)
+
+	defaultMetrics.inDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rango_inbound_dropped_total",
+			Help: "Number of upstream messages dropped because the inbound queue was full",
+		},
+	)
+
+	defaultMetrics.stale = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rango_stale_messages_total",
+			Help: "Number of messages dropped because they stayed queued for a client longer than their TTL",
+		},
+	)
+
+	defaultMetrics.slow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_slow_disconnects_total",
+			Help: "Number of clients disconnected for not keeping up with their messages",
+		},
+		[]string{"reason"},
+	)
+
+	defaultMetrics.idle = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rango_idle_disconnects_total",
+			Help: "Number of clients disconnected for staying without subscriptions",
+		},
+	)
+
+	defaultMetrics.disconnect = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_disconnects_total",
+			Help: "Number of clients disconnected by reason",
+		},
+		[]string{"reason"},
+	)
+
+	defaultMetrics.paused = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_paused_messages_total",
+			Help: "Number of messages dropped because their stream was paused",
+		},
+		[]string{"stream"},
+	)
+
+	defaultMetrics.unroutable = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_unroutable_messages_total",
+			Help: "Number of upstream messages dropped because they could not be routed",
+		},
+		[]string{"reason"},
+	)
+
+	defaultMetrics.maxClients = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rango_hub_max_clients",
+			Help: "Maximum number of clients allowed to connect, 0 if unlimited",
+		},
+	)
+
+	defaultMetrics.refused = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_refused_connections_total",
+			Help: "Number of connections refused",
+		},
+		[]string{"reason"},
+	)
+
+	defaultMetrics.upgrades = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_upgrade_failures_total",
+			Help: "Number of websocket handshakes failed",
+		},
+		[]string{"reason"},
+	)
+
+	defaultMetrics.compressed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_compression_connections_total",
+			Help: "Number of websocket connections by negotiation of permessage-deflate",
+		},
+		[]string{"negotiated"},
+	)
+
+	defaultMetrics.lastMsg = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rango_last_message_timestamp_seconds",
+			Help: "Unix time the last upstream message of a topic was received",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.lag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rango_message_lag_seconds",
+			Help: "Delay between the production and the reception of the last upstream message of a topic",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.buildInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rango_build_info",
+			Help: "Build information of the running binary, always 1",
+		},
+		[]string{"version", "commit", "build_date", "goversion"},
+	)
 }
 
 func RecordHubClientNew() {
@@ -53,6 +239,7 @@ func RecordHubSubscription(typ, topic string) {
 		return
 	}
 	defaultMetrics.subs.WithLabelValues(typ, topic).Inc()
+	defaultMetrics.activeSubs.WithLabelValues(typ).Inc()
 }
 
 func RecordHubUnsubscription(typ, topic string) {
@@ -60,4 +247,154 @@ func RecordHubUnsubscription(typ, topic string) {
 		return
 	}
 	defaultMetrics.subs.WithLabelValues(typ, topic).Dec()
+	defaultMetrics.activeSubs.WithLabelValues(typ).Dec()
+}
+
+// RecordHubDispatch records a message of scope and topic dispatched to fanout
+// clients. Private topics must not contain the user UID to keep cardinality bounded.
+func RecordHubDispatch(scope, topic string, fanout int) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.dispatched.WithLabelValues(scope, topic).Inc()
+	defaultMetrics.fanout.WithLabelValues(scope).Observe(float64(fanout))
+}
+
+// RecordHubDispatchDuration records the time taken to dispatch a message of scope.
+func RecordHubDispatchDuration(scope string, d time.Duration) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.dispatch.WithLabelValues(scope).Observe(d.Seconds())
+}
+
+// RecordDroppedMessage records a message of stream dropped for a slow client.
+func RecordDroppedMessage(stream string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.dropped.WithLabelValues(stream).Inc()
+}
+
+// RecordInboundQueueDepth records the number of upstream messages queued.
+func RecordInboundQueueDepth(depth int) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.inbound.Set(float64(depth))
+}
+
+// RecordInboundDropped records an upstream message dropped as the inbound
+// queue was full.
+func RecordInboundDropped() {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.inDropped.Inc()
+}
+
+// RecordStaleMessage records a message dropped as it stayed queued for a
+// client past its TTL.
+func RecordStaleMessage() {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.stale.Inc()
+}
+
+// RecordSlowClientDisconnect records a slow client disconnected for reason,
+// overflow of its send buffer or write_timeout.
+func RecordSlowClientDisconnect(reason string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.slow.WithLabelValues(reason).Inc()
+}
+
+// RecordDisconnect records a client disconnected for reason, e.g.
+// client_closed or idle.
+func RecordDisconnect(reason string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.disconnect.WithLabelValues(reason).Inc()
+}
+
+// RecordIdleDisconnect records a client disconnected for staying without subscriptions.
+func RecordIdleDisconnect() {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.idle.Inc()
+}
+
+// RecordPausedMessage records a message of stream dropped while paused.
+func RecordPausedMessage(stream string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.paused.WithLabelValues(stream).Inc()
+}
+
+// RecordUnroutableMessage records an upstream message dropped for reason,
+// unknown_topic or malformed_key.
+func RecordUnroutableMessage(reason string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.unroutable.WithLabelValues(reason).Inc()
+}
+
+// RecordHubMaxConnections records the maximum number of clients allowed.
+func RecordHubMaxConnections(max int) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.maxClients.Set(float64(max))
+}
+
+// RecordHubConnectionRefused records a connection refused for reason.
+func RecordHubConnectionRefused(reason string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.refused.WithLabelValues(reason).Inc()
+}
+
+// RecordUpgradeFailure records a websocket handshake failed for reason,
+// origin, protocol or upgrade_error.
+func RecordUpgradeFailure(reason string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.upgrades.WithLabelValues(reason).Inc()
+}
+
+// RecordConnectionCompression records a websocket connection established
+// with or without compression negotiated.
+func RecordConnectionCompression(negotiated bool) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.compressed.WithLabelValues(strconv.FormatBool(negotiated)).Inc()
+}
+
+// RecordSourceMessage records an upstream message of topic received at
+// received, produced at produced if known.
+func RecordSourceMessage(topic string, received, produced time.Time) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.lastMsg.WithLabelValues(topic).Set(float64(received.UnixNano()) / float64(time.Second))
+	if !produced.IsZero() {
+		defaultMetrics.lag.WithLabelValues(topic).Set(received.Sub(produced).Seconds())
+	}
+}
+
+// RecordBuildInfo records the build information of the binary.
+func RecordBuildInfo(version, commit, buildDate string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
 }
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	assert.NotPanics(t, func() { RecordHubDispatch("public", "eurusd.trades", 1) }, "disabled metrics are ignored")
+	assert.False(t, Enabled())
+
+	Enable()
+	assert.True(t, Enabled())
+
+	RecordHubSubscription("public", "eurusd.trades")
+	RecordHubSubscription("public", "usdjpy.trades")
+	RecordHubSubscription("private", "balance")
+	RecordHubUnsubscription("public", "usdjpy.trades")
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.activeSubs.WithLabelValues("public")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.activeSubs.WithLabelValues("private")))
+
+	RecordHubDispatch("public", "eurusd.trades", 3)
+	RecordHubDispatch("public", "eurusd.trades", 0)
+	RecordHubDispatch("private", "balance", 1)
+	assert.Equal(t, float64(2), testutil.ToFloat64(defaultMetrics.dispatched.WithLabelValues("public", "eurusd.trades")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.dispatched.WithLabelValues("private", "balance")))
+	assert.Equal(t, 2, testutil.CollectAndCount(defaultMetrics.fanout))
+
+	RecordHubDispatchDuration("public", 200*time.Microsecond)
+	RecordHubDispatchDuration("private", 3*time.Millisecond)
+	assert.Equal(t, 2, testutil.CollectAndCount(defaultMetrics.dispatch))
+
+	RecordSlowClientDisconnect("write_timeout")
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.slow.WithLabelValues("write_timeout")))
+
+	RecordIdleDisconnect()
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.idle))
+
+	RecordPausedMessage("eurusd.trades")
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.paused.WithLabelValues("eurusd.trades")))
+
+	received := time.Unix(1600000000, 500000000)
+	RecordSourceMessage("rango.events", received, received.Add(-2*time.Second))
+	RecordSourceMessage("rango.private", received, time.Time{})
+	assert.Equal(t, 1600000000.5, testutil.ToFloat64(defaultMetrics.lastMsg.WithLabelValues("rango.events")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(defaultMetrics.lag.WithLabelValues("rango.events")))
+	assert.Equal(t, 1600000000.5, testutil.ToFloat64(defaultMetrics.lastMsg.WithLabelValues("rango.private")))
+	assert.Equal(t, 1, testutil.CollectAndCount(defaultMetrics.lag), "lag is unknown without production time")
+
+	RecordBuildInfo("3.0.0", "abc1234", "2022-05-01T00:00:00Z")
+	assert.Equal(t, float64(1), testutil.ToFloat64(defaultMetrics.buildInfo.WithLabelValues("3.0.0", "abc1234", "2022-05-01T00:00:00Z", runtime.Version())))
+}
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"time"
+
+	"github.com/nusa-exchange/rango/pkg/metrics"
+)
+
+// remoteAddresser is implemented by clients knowing their peer address.
+type remoteAddresser interface {
+	RemoteAddr() string
+}
+
+// audit logs the subscribe or unsubscribe action of client on stream.
+func audit(client IClient, action, stream string) {
+
+	addr := ""
+	if c, ok := client.(remoteAddresser); ok {
+		addr = c.RemoteAddr()
+	}
+
+	auth := client.GetAuth()
+	loggerOf(client).Info().
+		Str("uid", auth.UID).
+		Str("role", auth.Role).
+		Str("stream", stream).
+		Str("action", action).
+		Str("remote_addr", addr).
+		Time("ts", time.Now()).
+		Msg("audit")
+}
+
+// recordSubscription records the subscription of client to stream of typ,
+// audited with the AuditLog option.
+func recordSubscription(client IClient, typ, stream string, audited bool) {
+	metrics.RecordHubSubscription(typ, stream)
+	if audited {
+		audit(client, "subscribe", stream)
+	}
+}
+
+// recordUnsubscription records the unsubscription of client from stream of
+// typ, audited with the AuditLog option.
+func recordUnsubscription(client IClient, typ, stream string, audited bool) {
+	metrics.RecordHubUnsubscription(typ, stream)
+	if audited {
+		audit(client, "unsubscribe", stream)
+	}
+}
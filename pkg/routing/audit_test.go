@@ -0,0 +1,82 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// auditedClient is a recorderClient with a remote address.
+type auditedClient struct {
+	recorderClient
+}
+
+func (c *auditedClient) RemoteAddr() string {
+	return "10.0.0.1:5000"
+}
+
+func TestAudit(t *testing.T) {
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+
+	var logs bytes.Buffer
+	log.Logger = zerolog.New(&logs)
+
+	entries := func() []map[string]interface{} {
+		var res []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			if entry["message"] == "audit" {
+				delete(entry, "ts")
+				res = append(res, entry)
+			}
+		}
+		logs.Reset()
+		return res
+	}
+
+	rbac := map[string][]string{"admin": {"admin"}}
+	opts := DefaultHubOptions()
+	opts.AuditLog = true
+	h := NewHub(rbac, opts)
+
+	t.Run("disabled by default", func(t *testing.T) {
+		NewHub(rbac).handleSubscribe(&Request{client: &recorderClient{}, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+		assert.Empty(t, entries())
+	})
+
+	t.Run("logs subscription changes", func(t *testing.T) {
+		c := &auditedClient{recorderClient{auth: Auth{UID: "UIDABC00001", Role: "admin"}}}
+
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "admin.eurusd.events"}}})
+		h.handleUnsubscribe(&Request{client: c, Request: message.Request{Streams: []string{"admin.eurusd.events"}}})
+		assert.Equal(t, []string{"eurusd.trades"}, c.GetSubscriptions())
+		h.unsubscribeAll(c)
+
+		assert.Equal(t, []map[string]interface{}{
+			{"level": "info", "uid": "UIDABC00001", "role": "admin", "stream": "eurusd.trades", "action": "subscribe", "remote_addr": "10.0.0.1:5000", "message": "audit"},
+			{"level": "info", "uid": "UIDABC00001", "role": "admin", "stream": "admin.eurusd.events", "action": "subscribe", "remote_addr": "10.0.0.1:5000", "message": "audit"},
+			{"level": "info", "uid": "UIDABC00001", "role": "admin", "stream": "admin.eurusd.events", "action": "unsubscribe", "remote_addr": "10.0.0.1:5000", "message": "audit"},
+			{"level": "info", "uid": "UIDABC00001", "role": "admin", "stream": "eurusd.trades", "action": "unsubscribe", "remote_addr": "10.0.0.1:5000", "message": "audit"},
+		}, entries())
+	})
+
+	t.Run("logs anonymous uid as empty", func(t *testing.T) {
+		h.handleSubscribe(&Request{client: &recorderClient{}, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+
+		assert.Equal(t, []map[string]interface{}{
+			{"level": "info", "uid": "", "role": "", "stream": "eurusd.trades", "action": "subscribe", "remote_addr": "", "message": "audit"},
+		}, entries())
+	})
+}
@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	msg "github.com/nusa-exchange/rango/pkg/message"
+)
+
+// reauthenticator is implemented by clients whose credentials can be replaced
+// over the connection.
+type reauthenticator interface {
+	SetAuth(Auth)
+}
+
+// authenticate validates token with the Authenticate func of the hub.
+func (h *Hub) authenticate(token string) (Auth, error) {
+	if h.Authenticate == nil {
+		return Auth{}, errors.New("unsupported")
+	}
+	return h.Authenticate(token)
+}
+
+// authError returns the error event sent to clients whose token was refused
+// for reason, their session being kept as is.
+func authError(reason string) string {
+	return errorEvent(codeUnauthorized, "authentication failed", map[string]interface{}{
+		"reason": reason,
+	})
+}
+
+// handleAuth replaces the credentials of the client with the ones validated
+// by its read loop. Private streams are unsubscribed when the user changes,
+// and prefixed streams when the new role isn't permitted by RBAC.
+func (h *Hub) handleAuth(req *Request) {
+	c, ok := req.client.(reauthenticator)
+	if !ok || req.auth == nil {
+		reply(req.client, errorEvent(codeInvalidRequest, "unsupported method", nil))
+		return
+	}
+
+	auth := *req.auth
+	previous := req.client.GetAuth()
+	dropped := []string{}
+	for _, t := range req.client.GetSubscriptions() {
+		switch {
+		case isPrivateStream(t) && previous.UID != auth.UID:
+		case isPrefixedStream(t) && !h.premittedRBAC(prefixOf(t), auth):
+		default:
+			continue
+		}
+		dropped = append(dropped, t)
+	}
+
+	unlock := h.lockStreams(dropped, req.client)
+	for _, t := range dropped {
+		if isPrivateStream(t) {
+			h.unsubscribePrivate(t, req)
+		} else {
+			h.unsubscribePrefixed(t, req)
+		}
+	}
+	c.SetAuth(auth)
+	unlock()
+
+	loggerOf(req.client).Info().Msgf("Authenticated connection: %s (was %s)", auth.UID, previous.UID)
+
+	res := map[string]interface{}{
+		"message": "authenticated",
+		"streams": req.client.GetSubscriptions(),
+	}
+	if len(dropped) != 0 {
+		res["unsubscribed"] = dropped
+	}
+	reply(req.client, responseMust(nil, res))
+}
+
+// SubprotocolToken returns the token offered by browsers, which can't set the
+// Authorization header of websocket requests, as the subprotocol following
+// name, e.g. Sec-WebSocket-Protocol: bearer, <token>. It returns "" if name is
+// empty or not offered.
+func SubprotocolToken(r *http.Request, name string) string {
+	if name == "" {
+		return ""
+	}
+	protocols := websocket.Subprotocols(r)
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == name {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// authenticatesFirst returns true if the connection of r must authenticate
+// with its first frame, the JwtPending header being set by the HTTP handler.
+func authenticatesFirst(r *http.Request) bool {
+	return r.Header.Get("JwtPending") != ""
+}
+
+// closeUnauthenticated closes the connection which didn't authenticate in
+// time.
+func (c *Client) closeUnauthenticated() {
+	c.Logger().Info().Msgf("Closing connection not authenticated within %s", c.hub.Options().AuthTimeout)
+	c.Disconnect(int(codeUnauthorized), "authentication timeout")
+}
+
+// authenticateFirst authenticates the connection with its first request,
+// which must be an auth request with a valid token, and subscribes the
+// streams of its URI once authenticated. The connection is closed otherwise
+// and false returned.
+func (c *Client) authenticateFirst(req msg.Request, err error) bool {
+	c.pendingAuth.Stop()
+	c.pendingAuth = nil
+
+	if err != nil || req.RPC || req.Method != "auth" {
+		c.Logger().Info().Msg("Closing connection not authenticating with its first frame")
+		c.Disconnect(int(codeUnauthorized), "authentication required")
+		return false
+	}
+
+	auth, err := c.hub.authenticate(req.Token)
+	if err != nil {
+		c.Logger().Info().Msgf("Refused authentication: %s", err.Error())
+		c.Disconnect(int(codeUnauthorized), "authentication failed: "+err.Error())
+		return false
+	}
+
+	c.hub.Requests <- Request{client: c, Request: req, auth: &auth}
+	c.hub.Requests <- Request{client: c, Request: msg.Request{
+		Method:  "subscribe",
+		Streams: c.hub.defaultStreams(auth, c.pendingStreams),
+	}}
+	c.pendingStreams = nil
+	return true
+}
+
+// prefixOf returns the RBAC prefix of the prefixed stream.
+func prefixOf(prefixed string) string {
+	prefix, _ := splitPrefixedTopic(prefixed)
+	return prefix
+}
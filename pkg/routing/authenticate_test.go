@@ -0,0 +1,284 @@
+package routing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// fakeAuthenticate accepts the token "valid" as member UIDABC00001.
+func fakeAuthenticate(token string) (Auth, error) {
+	if token != "valid" {
+		return Auth{}, errors.New("token_expired")
+	}
+	return Auth{UID: "UIDABC00001", Role: "member"}, nil
+}
+
+func TestClientAuth(t *testing.T) {
+	hub := NewHub(nil)
+	hub.Authenticate = fakeAuthenticate
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+	defer teardown()
+
+	send := func(msg string) string {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(msg)))
+		_, res, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(res)
+	}
+
+	t.Run("keeps the session on failure", func(t *testing.T) {
+		assert.Equal(t,
+			`{"error":{"code":4001,"message":"authentication failed","name":"unauthorized","reason":"token_expired"}}`,
+			send(`{"event":"auth","token":"expired"}`),
+		)
+	})
+
+	t.Run("upgrades an anonymous connection", func(t *testing.T) {
+		assert.Equal(t,
+			`{"success":{"message":"authenticated","streams":["eurusd.trades"]}}`,
+			send(`{"event":"auth","token":"valid"}`),
+		)
+		assert.Equal(t,
+			`{"success":{"message":"subscribed","streams":["eurusd.trades","balance"]}}`,
+			send(`{"event":"subscribe","streams":["balance"]}`),
+		)
+
+		hub.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.balance"), Value: []byte(`{"eur":"1"}`)})
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"balance":{"eur":"1"}}`, string(msg))
+	})
+}
+
+func TestHubAuth(t *testing.T) {
+	hub := NewHub(map[string][]string{"finex": {"admin"}})
+	client := &Client{
+		send:    make(chan string, 16),
+		Auth:    Auth{UID: "UIDABC00001", Role: "admin"},
+		pubSub:  []string{},
+		privSub: []string{},
+	}
+	hub.handleSubscribe(&Request{client: client, Request: message.Request{Streams: []string{"eurusd.trades", "balance", "finex.eurusd.orders"}}})
+	<-client.send
+
+	auth := func(a Auth) string {
+		hub.handleRequest(&Request{client: client, Request: message.Request{Method: "auth"}, auth: &a})
+		return <-client.send
+	}
+
+	t.Run("keeps the streams of the same user", func(t *testing.T) {
+		assert.Equal(t,
+			`{"success":{"message":"authenticated","streams":["eurusd.trades","finex.eurusd.orders","balance"]}}`,
+			auth(Auth{UID: "UIDABC00001", Role: "admin"}),
+		)
+	})
+
+	t.Run("drops streams no longer permitted", func(t *testing.T) {
+		assert.Equal(t,
+			`{"success":{"message":"authenticated","streams":["eurusd.trades"],"unsubscribed":["finex.eurusd.orders","balance"]}}`,
+			auth(Auth{UID: "UIDABC00002", Role: "member"}),
+		)
+		assert.Equal(t, Auth{UID: "UIDABC00002", Role: "member"}, client.GetAuth())
+		assert.Empty(t, hub.privateTopics()["UIDABC00001"])
+		assert.Empty(t, hub.prefixedTopics()["finex"])
+	})
+
+	t.Run("is refused by other clients", func(t *testing.T) {
+		c := &recorderClient{}
+		hub.handleRequest(&Request{client: c, Request: message.Request{Method: "auth"}, auth: &Auth{UID: "UIDABC00001"}})
+		assert.Equal(t, []string{`{"error":{"code":4005,"message":"unsupported method","name":"invalid_request"}}`}, c.Messages())
+	})
+}
+
+func TestClientAuthUnsupported(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/")
+	defer teardown()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"auth","token":"valid"}`)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"error":{"code":4001,"message":"authentication failed","name":"unauthorized","reason":"unsupported"}}`, string(msg))
+}
+
+func TestClientTokenExpiry(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.TokenExpiryGrace = 0
+
+	hub := NewHub(nil, opts)
+	hub.Authenticate = fakeAuthenticate
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("JwtUID", "UIDABC00001")
+		r.Header.Set("JwtExp", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, websocket.IsCloseError(err, int(codeTokenExpired)), err)
+	assert.Contains(t, err.Error(), "token expired; re-authenticate")
+}
+
+func TestClientSetAuth(t *testing.T) {
+	client := &Client{}
+
+	client.SetAuth(Auth{UID: "UIDABC00001", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NotNil(t, client.expiry)
+
+	client.SetAuth(Auth{UID: "UIDABC00001"})
+	assert.Nil(t, client.expiry, "credentials without expiry never expire")
+}
+
+func TestSubprotocolToken(t *testing.T) {
+	request := func(protocols string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if protocols != "" {
+			r.Header.Set("Sec-Websocket-Protocol", protocols)
+		}
+		return r
+	}
+
+	assert.Equal(t, "valid", SubprotocolToken(request("bearer, valid"), "bearer"))
+	assert.Equal(t, "valid", SubprotocolToken(request("rango.json.v0, bearer, valid"), "bearer"))
+	assert.Equal(t, "", SubprotocolToken(request("bearer"), "bearer"))
+	assert.Equal(t, "", SubprotocolToken(request("rango.json.v0"), "bearer"))
+	assert.Equal(t, "", SubprotocolToken(request(""), "bearer"))
+	assert.Equal(t, "", SubprotocolToken(request("bearer, valid"), ""))
+}
+
+func TestClientAuthSubprotocol(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.AuthSubprotocol = "bearer"
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	t.Run("selects the auth subprotocol", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"bearer", "valid"}}
+		conn, resp, teardown := dialWith(t, dialer, hub, "/")
+		defer teardown()
+
+		assert.Equal(t, "bearer", conn.Subprotocol())
+		assert.Equal(t, "bearer", resp.Header.Get("Sec-Websocket-Protocol"))
+	})
+
+	t.Run("prefers a supported subprotocol", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"bearer", "valid", "rango.json.v0"}}
+		conn, _, teardown := dialWith(t, dialer, hub, "/")
+		defer teardown()
+
+		assert.Equal(t, "rango.json.v0", conn.Subprotocol())
+	})
+}
+
+func TestClientFirstFrameAuth(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.AuthTimeout = 100 * time.Millisecond
+
+	hub := NewHub(nil, opts)
+	hub.Authenticate = fakeAuthenticate
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("JwtPending", "true")
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	// connect returns a connection pending authentication, its hello read.
+	connect := func(t *testing.T) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?stream=eurusd.trades", nil)
+		require.NoError(t, err)
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), `"event":"hello"`)
+		return conn
+	}
+
+	closeCode := func(t *testing.T, conn *websocket.Conn) (int, string) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		return closeErr.Code, closeErr.Text
+	}
+
+	t.Run("subscribes once authenticated", func(t *testing.T) {
+		conn := connect(t)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"auth","token":"valid"}`)))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"success":{"message":"authenticated","streams":[]}}`, string(msg))
+
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["eurusd.trades"]}}`, string(msg))
+
+		time.Sleep(2 * opts.AuthTimeout)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["balance"]}`)))
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["eurusd.trades","balance"]}}`, string(msg))
+	})
+
+	t.Run("closes connections subscribing first", func(t *testing.T) {
+		conn := connect(t)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["eurusd.trades"]}`)))
+		code, text := closeCode(t, conn)
+		assert.Equal(t, int(codeUnauthorized), code)
+		assert.Equal(t, "authentication required", text)
+	})
+
+	t.Run("closes connections with an invalid token", func(t *testing.T) {
+		conn := connect(t)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"auth","token":"expired"}`)))
+		code, text := closeCode(t, conn)
+		assert.Equal(t, int(codeUnauthorized), code)
+		assert.Equal(t, "authentication failed: token_expired", text)
+	})
+
+	t.Run("closes connections not authenticating in time", func(t *testing.T) {
+		disconnects := counterValue(t, "rango_disconnects_total", "reason", reasonUnauthenticated)
+		conn := connect(t)
+		defer conn.Close()
+
+		code, text := closeCode(t, conn)
+		assert.Equal(t, int(codeUnauthorized), code)
+		assert.Equal(t, "authentication timeout", text)
+		require.Eventually(t, func() bool {
+			return counterValue(t, "rango_disconnects_total", "reason", reasonUnauthenticated) == disconnects+1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// backpressure notifies a client that messages of stream were dropped because
+// it didn't keep up with them, so that it can resync or reduce its
+// subscriptions.
+type backpressure struct {
+	Event   string `json:"event"`
+	Dropped int    `json:"dropped"`
+	Stream  string `json:"stream"`
+}
+
+// backpressureClient is implemented by clients notified of the messages
+// dropped for them.
+type backpressureClient interface {
+	Dropped(stream string)
+}
+
+// Dropped records a message of stream dropped for the client, notified in
+// the next backpressure event of the stream.
+func (c *Client) Dropped(stream string) {
+	interval := c.hub.Options().BackpressureInterval
+	if interval <= 0 {
+		return
+	}
+
+	c.droppedMutex.Lock()
+	defer c.droppedMutex.Unlock()
+
+	if len(c.dropped) == 0 {
+		c.dropped = make(map[string]int)
+		time.AfterFunc(interval, func() {
+			select {
+			case c.backpressure <- struct{}{}:
+			default:
+			}
+		})
+	}
+	c.dropped[stream]++
+}
+
+// backpressureNotices returns the backpressure events of the messages dropped
+// since the last notices, sorted by stream.
+func (c *Client) backpressureNotices() []string {
+	c.droppedMutex.Lock()
+	dropped := c.dropped
+	c.dropped = nil
+	c.droppedMutex.Unlock()
+
+	streams := make([]string, 0, len(dropped))
+	for stream := range dropped {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	notices := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		b, err := json.Marshal(backpressure{Event: "backpressure", Dropped: dropped[stream], Stream: stream})
+		if err != nil {
+			continue
+		}
+		notices = append(notices, encodeFor(c, string(b)))
+	}
+	return notices
+}
@@ -0,0 +1,58 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestClientBackpressure(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.ClientOverflow, opts.BackpressureInterval = string(overflowDropNewest), 10*time.Millisecond
+	hub := NewHub(nil, opts)
+
+	client, conn, teardown := stalledClient(t, 1)
+	defer teardown()
+	client.hub = hub
+	client.backpressure = make(chan struct{}, 1)
+
+	hub.handleSubscribe(&Request{client: client, Request: message.Request{Streams: []string{"eurusd.trades", "usdjpy.trades"}}})
+	for i := 0; i < 3; i++ {
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	}
+	hub.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{"price":"150.0"}`)})
+
+	// The notices are batched until the write loop catches up.
+	time.Sleep(2 * opts.BackpressureInterval)
+	go client.write()
+
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+	assert.ElementsMatch(t, []string{
+		subscribed(`"eurusd.trades","usdjpy.trades"`),
+		`{"event":"backpressure","dropped":3,"stream":"eurusd.trades"}`,
+		`{"event":"backpressure","dropped":1,"stream":"usdjpy.trades"}`,
+	}, []string{read(), read(), read()})
+
+	t.Run("notifies the next drops again", func(t *testing.T) {
+		client.Dropped("eurusd.trades")
+		assert.Equal(t, `{"event":"backpressure","dropped":1,"stream":"eurusd.trades"}`, read())
+	})
+}
+
+func TestClientBackpressureDisabled(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.BackpressureInterval = 0
+
+	client := &Client{hub: NewHub(nil, opts), backpressure: make(chan struct{}, 1)}
+	client.Dropped("eurusd.trades")
+	assert.Empty(t, client.backpressureNotices())
+}
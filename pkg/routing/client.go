@@ -2,54 +2,143 @@ package routing
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	msg "github.com/nusa-exchange/rango/pkg/message"
 	"github.com/nusa-exchange/rango/pkg/metrics"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+var (
+	newline = []byte{'\n'}
+	space   = []byte{' '}
+)
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+// Prefix of the queued messages standing for the latest message of a conflated
+// stream, never starting a JSON or msgpack message.
+const conflatedMarker = "\x00"
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+// newUpgrader returns the upgrader of the websocket connections of a hub
+// configured with opts.
+func newUpgrader(opts HubOptions) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		WriteBufferPool:   newWriteBufferPool(opts.WriteBufferPool),
+		CheckOrigin:       checkSameOrigin(opts.AllowedOrigins),
+		EnableCompression: opts.CompressionLevel != 0,
+	}
+}
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
+// newWriteBufferPool returns the pool of the write buffers when enabled, nil
+// otherwise.
+func newWriteBufferPool(enabled bool) websocket.BufferPool {
+	if !enabled {
+		return nil
+	}
+	return &sync.Pool{}
+}
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
+// Buckets counting the connections, of a user or of an anonymous IP address.
+const (
+	bucketUser = "user"
+	bucketIP   = "ip"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     checkSameOrigin(os.Getenv("API_CORS_ORIGINS")),
+// connectionKey returns the key counting connections of auth, by UID when
+// authenticated, by client IP otherwise, its bucket and its connections limit.
+func (h *Hub) connectionKey(auth Auth, ip string) (string, string, int) {
+	if auth.UID != "" {
+		return "uid:" + auth.UID, bucketUser, h.Options().MaxConnectionsPerUser
+	}
+	return "ip:" + ip, bucketIP, h.Options().MaxConnectionsPerIP
+}
+
+// acquireClientConnection counts a new connection of auth from ip, it returns
+// its key. Connections exceeding the limit of their bucket are logged,
+// recorded and refused with refuse, and false returned.
+func (h *Hub) acquireClientConnection(auth Auth, ip string, logger *zerolog.Logger, refuse func()) (string, bool) {
+	key, bucket, max := h.connectionKey(auth, ip)
+	if !h.acquireConnection(key, max) {
+		logger.Warn().Msgf("Refusing connection exceeding %d connections of %s", max, key)
+		metrics.RecordHubConnectionRefused("max_connections_per_" + bucket)
+		refuse()
+		return key, false
+	}
+	return key, true
+}
+
+// refuseHTTP returns the refusal of the requests exceeding a connections
+// limit.
+func refuseHTTP(w http.ResponseWriter) func() {
+	return func() {
+		w.Header().Set("Retry-After", strconv.Itoa(connectionsRetryAfter))
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+	}
 }
 
-var maxBufferedMessages = 256
+// Seconds clients are asked to wait before reconnecting when the hub is full.
+const connectionsRetryAfter = 5
+
+// overflowPolicy is applied when a message is sent to a client with a full buffer.
+type overflowPolicy string
+
+const (
+	// Drop the oldest buffered message to make room for the new one.
+	overflowDropOldest overflowPolicy = "drop_oldest"
+	// Drop the new message.
+	overflowDropNewest overflowPolicy = "drop_newest"
+	// Drop the new message and close the connection.
+	overflowDisconnect overflowPolicy = "disconnect"
+)
+
+// clientLimits are the limits applied to a connection.
+type clientLimits struct {
+	// Maximum subscribe/unsubscribe messages per second allowed from peer, 0 disables the limit.
+	messagesPerSec float64
+	// Maximum streams subscribed at once, 0 disables the limit.
+	maxSubscriptions int
+}
 
 type Auth struct {
 	UID  string
 	Role string
+
+	// Level of the user, e.g. its KYC level, from the level claim.
+	Level int
+
+	// Expiry of the token, zero if unknown.
+	ExpiresAt time.Time
+}
+
+// tokenExpiry returns the expiry of the token set by the auth handler in the
+// JwtExp header as unix time, zero if none.
+func tokenExpiry(r *http.Request) time.Time {
+	exp, err := strconv.ParseInt(r.Header.Get("JwtExp"), 10, 64)
+	if err != nil || exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
 }
 
 // FIXME: IClient looks very wrong.
 type IClient interface {
-	Send(string)
+	// Send queues a message for the client, it returns false when the message was dropped.
+	Send(string) bool
 	Close()
+	Disconnect(code int, reason string)
 	GetAuth() Auth
 	GetSubscriptions() []string
 	SubscribePublic(string)
@@ -58,12 +147,51 @@ type IClient interface {
 	UnsubscribePrivate(string)
 }
 
+// loggerClient is implemented by clients logging with their own logger.
+type loggerClient interface {
+	Logger() *zerolog.Logger
+}
+
+// loggerOf returns the logger of the client, the global logger by default.
+func loggerOf(c IClient) *zerolog.Logger {
+	if l, ok := c.(loggerClient); ok {
+		return l.Logger()
+	}
+	return &log.Logger
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub *Hub
 
-	// User ID if authorized
-	Auth Auth
+	// User ID if authorized, replaced by auth requests.
+	Auth      Auth
+	authMutex sync.RWMutex
+
+	// Disconnects the client once its token expired.
+	expiry *time.Timer
+
+	// Disconnects the client staying without subscriptions, and the number of
+	// subscriptions accessed atomically.
+	idle          *time.Timer
+	idleMutex     sync.Mutex
+	subscriptions int32
+
+	// Disconnects the client once its connection lifetime elapsed.
+	lifetime *time.Timer
+
+	// Disconnects the client not authenticating with its first frame in time,
+	// the streams of its URI being subscribed once authenticated. Only used
+	// by the read loop.
+	pendingAuth    *time.Timer
+	pendingStreams []string
+
+	// Token of the session, resumed by the next connection.
+	session string
+
+	// Random ID of the connection, logged with every message of the client.
+	id     string
+	logger *zerolog.Logger
 
 	pubSub  []string
 	privSub []string
@@ -71,25 +199,74 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
-}
+	// IP address of the client, behind the trusted proxies.
+	remoteAddr string
 
-func checkSameOrigin(origins string) func(r *http.Request) bool {
-	if origins == "" {
-		return func(r *http.Request) bool {
-			return true
-		}
-	}
+	// Buffered channel of outbound messages, shared by every recipient and
+	// immutable as strings.
+	send chan string
 
+	// Latest undelivered message of the conflated streams, queued in send as
+	// conflatedMarker followed by the stream.
+	latest      map[string]string
+	latestMutex sync.Mutex
+
+	// Minimum interval between the messages of the throttled streams, guarded
+	// by latestMutex, and the messages held back by the write loop.
+	intervals map[string]time.Duration
+	throttle  throttle
+
+	// Messages dropped by stream since the last backpressure notices, sent by
+	// the write loop once signaled.
+	dropped      map[string]int
+	droppedMutex sync.Mutex
+	backpressure chan struct{}
+
+	// Limits of the connection.
+	limits clientLimits
+
+	// Key counting the connections of the user, see connectionKey.
+	connKey string
+
+	// Protocol version of the events sent.
+	protocol int
+
+	// Events are sent as combined stream messages.
+	combined bool
+
+	// Encoding of the messages sent.
+	encoding encoding
+
+	// Rate limiter of inbound messages.
+	limiter    *rateLimiter
+	violations int
+
+	// Consecutive invalid messages received.
+	invalidMessages int
+
+	// Pings sent since the last pong received, accessed atomically.
+	missedPongs int32
+
+	// Reason the connection is closed for.
+	closeReason closeReason
+}
+
+// checkSameOrigin returns an origin check allowing the origins, given as hosts
+// or URLs, "*.example.com" allows any subdomain of example.com
+// and "*" any origin. Without origins only same origin requests are allowed.
+// Requests without Origin header, from non browser clients, are always allowed.
+func checkSameOrigin(origins []string) func(r *http.Request) bool {
 	hosts := []string{}
 
-	for _, o := range strings.Split(origins, ",") {
+	for _, o := range origins {
 		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
 		if strings.HasPrefix(o, "http://") || strings.HasPrefix(o, "https://") {
 			u, err := url.Parse(o)
 			if err != nil || u.Host == "" {
-				panic("Failed to parse url in API_CORS_ORIGINS: " + o)
+				panic("Failed to parse url in allowed origins: " + o)
 			}
 			hosts = append(hosts, u.Host)
 		} else {
@@ -107,8 +284,11 @@ func checkSameOrigin(origins string) func(r *http.Request) bool {
 			return false
 		}
 
+		if len(hosts) == 0 {
+			return strings.EqualFold(u.Host, r.Host)
+		}
 		for _, host := range hosts {
-			if strings.EqualFold(u.Host, host) {
+			if matchOrigin(host, u.Host) {
 				return true
 			}
 		}
@@ -116,38 +296,164 @@ func checkSameOrigin(origins string) func(r *http.Request) bool {
 	}
 }
 
+// matchOrigin reports whether host matches pattern, case insensitively.
+func matchOrigin(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
+
+// negotiatesCompression returns true if permessage-deflate is negotiated by
+// upgrader with the peer, when enabled and offered by the peer.
+func negotiatesCompression(upgrader *websocket.Upgrader, r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			if name := strings.Split(ext, ";")[0]; strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // NewClient handles websocket requests from the peer.
 func NewClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if !hub.reserveConnection() {
+		log.Warn().Msgf("Refusing connection, %d clients connected", hub.ClientsCount())
+		metrics.RecordHubConnectionRefused("max_connections")
+		w.Header().Set("Retry-After", strconv.Itoa(connectionsRetryAfter))
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer hub.releaseReservation()
+
+	protocol, err := parseProtocol(r)
+	if err != nil {
+		metrics.RecordUpgradeFailure("protocol")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	combined, err := parseCombined(r)
+	if err != nil {
+		metrics.RecordUpgradeFailure("protocol")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	enc, err := parseEncoding(r)
+	if err != nil {
+		metrics.RecordUpgradeFailure("protocol")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The subprotocol is negotiated here rather than by the upgrader so that
+	// the preference of the client prevails.
+	header := http.Header{}
+	if name := negotiateSubprotocol(r); name != "" {
+		sp := subprotocols[name]
+		enc = sp.encoding
+		if !sp.encodingOnly {
+			protocol, combined = sp.protocol, sp.combined
+		}
+		header.Set("Sec-Websocket-Protocol", name)
+	} else if SubprotocolToken(r, hub.options.AuthSubprotocol) != "" {
+		// Browsers fail the connection unless one of their subprotocols is
+		// selected.
+		header.Set("Sec-Websocket-Protocol", hub.options.AuthSubprotocol)
+	}
+
+	conn, err := hub.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Error().Msg("Websocket upgrade failed: " + err.Error())
+		if hub.upgrader.CheckOrigin(r) {
+			metrics.RecordUpgradeFailure("upgrade_error")
+		} else {
+			metrics.RecordUpgradeFailure("origin")
+		}
+		return
+	}
+	metrics.RecordConnectionCompression(negotiatesCompression(hub.upgrader, r))
+	if level := hub.options.CompressionLevel; level != 0 {
+		if err := conn.SetCompressionLevel(level); err != nil {
+			log.Error().Msgf("Invalid compression level %d: %s", level, err.Error())
+		}
+	}
+	auth := hub.requestAuth(r)
+	auth.ExpiresAt = tokenExpiry(r)
+
+	id := uuid.NewString()
+	ip := hub.clientIP(r)
+	logger := log.With().Str("connection_id", id).Logger()
+
+	key, ok := hub.acquireClientConnection(auth, ip, &logger, func() {
+		closeMsg := websocket.FormatCloseMessage(int(codeTooManyConnections), "too many connections")
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(hub.options.WriteTimeout))
+		conn.Close()
+	})
+	if !ok {
 		return
 	}
+
+	limits := hub.options.limitsFor(auth)
 	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, maxBufferedMessages),
-		Auth: Auth{
-			UID:  r.Header.Get("JwtUID"),
-			Role: r.Header.Get("JwtRole"),
-		},
-		pubSub:  []string{},
-		privSub: []string{},
+		hub:          hub,
+		id:           id,
+		logger:       &logger,
+		conn:         conn,
+		remoteAddr:   ip,
+		send:         make(chan string, hub.options.ClientBuffer),
+		latest:       make(map[string]string),
+		backpressure: make(chan struct{}, 1),
+		Auth:         auth,
+		pubSub:       []string{},
+		privSub:      []string{},
+		limits:       limits,
+		connKey:      key,
+		limiter:      newRateLimiter(limits.messagesPerSec),
+		protocol:     protocol,
+		combined:     combined,
+		encoding:     enc,
 	}
 
 	if client.Auth.UID == "" {
-		log.Info().Msgf("New anonymous connection")
+		logger.Info().Str("remote_addr", ip).Msgf("New anonymous connection")
 	} else {
-		log.Info().Msgf("New authenticated connection: %s", client.Auth.UID)
+		logger.Info().Str("remote_addr", ip).Msgf("New authenticated connection: %s", client.Auth.UID)
+	}
+	client.session = hub.sessions.open(client)
+	client.Send(client.hello())
+	client.SetAuth(auth)
+	if reason := r.Header.Get("JwtError"); reason != "" {
+		// The token was refused, the client is connected anonymously.
+		reply(client, authError(reason))
 	}
 
-	hub.handleSubscribe(&Request{
-		client: client,
-		Request: msg.Request{
-			Streams: parseStreamsFromURI(r.RequestURI),
-		},
-	})
+	if authenticatesFirst(r) {
+		client.pendingStreams = parseStreamsFromURI(r.RequestURI)
+		client.pendingAuth = time.AfterFunc(hub.options.AuthTimeout, client.closeUnauthenticated)
+	} else {
+		hub.handleSubscribe(&Request{
+			client: client,
+			Request: msg.Request{
+				Streams: hub.defaultStreams(client.GetAuth(), parseStreamsFromURI(r.RequestURI)),
+			},
+		})
+	}
+	client.updateIdle()
+	if lifetime := hub.options.connectionLifetime(); lifetime > 0 {
+		client.lifetime = time.AfterFunc(lifetime, client.closeLifetime)
+	}
 
+	hub.register(client)
 	metrics.RecordHubClientNew()
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -156,37 +462,264 @@ func NewClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.read()
 }
 
-func (c *Client) Send(s string) {
-	if len(c.send) == maxBufferedMessages {
-		log.Warn().Msg("Closing slow websocket connection")
+// Send queues s for the write loop without blocking. When the send buffer is
+// full the client is too slow to keep up and a message is dropped according to
+// the ClientOverflow option of the hub, the connection is closed with the disconnect policy.
+func (c *Client) Send(s string) bool {
+	queued, dropped := c.queue(s)
+	return queued && !dropped
+}
+
+// queue queues s as Send does, it returns whether s was queued and whether a
+// message was dropped for it.
+func (c *Client) queue(s string) (queued, dropped bool) {
+	select {
+	case c.send <- s:
+		return true, false
+	default:
+	}
+
+	switch c.hub.Options().overflow() {
+	case overflowDropOldest:
+		select {
+		case m := <-c.send:
+			c.takeLatest(m)
+		default:
+		}
+		select {
+		case c.send <- s:
+			return true, true
+		default:
+		}
+	case overflowDropNewest:
+	default:
+		c.Logger().Warn().Msg("Closing slow websocket connection")
+		metrics.RecordSlowClientDisconnect("overflow")
+		c.closeReason.set(reasonSlow)
 		c.conn.Close()
-	} else {
-		c.send <- []byte(s)
 	}
+	return false, true
+}
+
+// SendExpiring queues s as Send does, stamped with the current time for the
+// write loop to drop it once older than the MessageTTL option of the hub.
+func (c *Client) SendExpiring(s string) bool {
+	if c.hub.Options().MessageTTL > 0 {
+		s = stamp(s, time.Now())
+	}
+	return c.Send(s)
+}
+
+// fresh returns the queued message m without its stamp, "" if it went stale.
+func (c *Client) fresh(m string) string {
+	m, ok := unstamp(m, time.Now(), c.hub.Options().MessageTTL)
+	if !ok {
+		atomic.AddInt64(&dropCounts.stale, 1)
+		metrics.RecordStaleMessage()
+		return ""
+	}
+	return m
+}
+
+// SendLatest queues s as the latest message of stream, replacing the message
+// of stream still queued so that slow clients only receive the latest.
+func (c *Client) SendLatest(stream, s string) bool {
+	c.latestMutex.Lock()
+	_, queued := c.latest[stream]
+	c.latest[stream] = s
+	c.latestMutex.Unlock()
+
+	if queued {
+		return true
+	}
+
+	queued, dropped := c.queue(conflatedMarker + stream)
+	if !queued {
+		c.latestMutex.Lock()
+		delete(c.latest, stream)
+		c.latestMutex.Unlock()
+	}
+	return queued && !dropped
+}
+
+// takeLatest returns the message to write for the queued message m, the
+// latest message of the stream for conflated streams, "" if already taken.
+func (c *Client) takeLatest(m string) string {
+	if !strings.HasPrefix(m, conflatedMarker) {
+		return m
+	}
+
+	stream := strings.TrimPrefix(m, conflatedMarker)
+	c.latestMutex.Lock()
+	defer c.latestMutex.Unlock()
+
+	latest := c.latest[stream]
+	delete(c.latest, stream)
+	return latest
 }
 
 func (c *Client) Close() {
 	close(c.send)
 }
 
+// Disconnect sends a close frame to the peer, the client is unregistered
+// once the read loop receives the peer close frame back.
+func (c *Client) Disconnect(code int, reason string) {
+	c.closeReason.set(disconnectReason(code))
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.hub.Options().WriteTimeout)); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *Client) Session() string {
+	return c.session
+}
+
+func (c *Client) Logger() *zerolog.Logger {
+	if c.logger == nil {
+		return &log.Logger
+	}
+	return c.logger
+}
+
 func (c *Client) GetAuth() Auth {
+	c.authMutex.RLock()
+	defer c.authMutex.RUnlock()
 	return c.Auth
 }
 
+// SetAuth replaces the credentials of the client and the limits applying to them.
+func (c *Client) SetAuth(auth Auth) {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	c.Auth = auth
+	c.limits.maxSubscriptions = c.hub.Options().limitsFor(auth).maxSubscriptions
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if !auth.ExpiresAt.IsZero() {
+		c.expiry = time.AfterFunc(time.Until(auth.ExpiresAt)+c.hub.Options().TokenExpiryGrace, c.expire)
+	}
+}
+
+// expire disconnects the client when its token expired, unless it was
+// authenticated again meanwhile.
+func (c *Client) expire() {
+	if exp := c.GetAuth().ExpiresAt; exp.IsZero() || time.Until(exp)+c.hub.Options().TokenExpiryGrace > 0 {
+		return
+	}
+
+	c.Logger().Info().Msgf("Closing connection with expired token (%s)", c.GetAuth().UID)
+	c.Disconnect(int(codeTokenExpired), "token expired; re-authenticate")
+}
+
+// stopExpiry stops the expiry of the client token.
+func (c *Client) stopExpiry() {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+}
+
+// updateIdle arms the idle timer of the client when it has no subscriptions,
+// and stops it otherwise.
+func (c *Client) updateIdle() {
+	subscriptions := len(c.pubSub) + len(c.privSub)
+	atomic.StoreInt32(&c.subscriptions, int32(subscriptions))
+	grace := c.hub.Options().SubscribeGrace
+	if grace <= 0 {
+		return
+	}
+
+	c.idleMutex.Lock()
+	defer c.idleMutex.Unlock()
+
+	if subscriptions != 0 {
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		return
+	}
+	if c.idle == nil {
+		c.idle = time.AfterFunc(grace, c.closeIdle)
+	}
+}
+
+// closeIdle disconnects the client still without subscriptions.
+func (c *Client) closeIdle() {
+	if atomic.LoadInt32(&c.subscriptions) != 0 {
+		return
+	}
+
+	c.Logger().Info().Msgf("Closing connection without subscription for %s (%s)", c.hub.Options().SubscribeGrace, c.GetAuth().UID)
+	metrics.RecordIdleDisconnect()
+	c.Disconnect(int(codeNoSubscription), "no subscription")
+}
+
+// closeLifetime asks the client to reconnect once its connection lifetime
+// elapsed.
+func (c *Client) closeLifetime() {
+	c.Logger().Info().Msgf("Closing connection past its lifetime (%s)", c.GetAuth().UID)
+	c.Disconnect(int(codeReconnect), "connection lifetime exceeded; please reconnect")
+}
+
+// stopIdle stops the idle timer of the client.
+func (c *Client) stopIdle() {
+	c.idleMutex.Lock()
+	defer c.idleMutex.Unlock()
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+}
+
+func (c *Client) RemoteAddr() string {
+	if c.remoteAddr != "" {
+		return c.remoteAddr
+	}
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Client) MaxSubscriptions() int {
+	return c.limits.maxSubscriptions
+}
+
+func (c *Client) Protocol() int {
+	return c.protocol
+}
+
+func (c *Client) Combined() bool {
+	return c.combined
+}
+
+func (c *Client) Encoding() encoding {
+	return c.encoding
+}
+
 func (c *Client) GetSubscriptions() []string {
-	return append(c.pubSub, c.privSub...)
+	subs := make([]string, 0, len(c.pubSub)+len(c.privSub))
+	return append(append(subs, c.pubSub...), c.privSub...)
 }
 
 func (c *Client) SubscribePublic(s string) {
 	if !contains(c.pubSub, s) {
 		c.pubSub = append(c.pubSub, s)
 	}
+	c.updateIdle()
 }
 
 func (c *Client) SubscribePrivate(s string) {
 	if !contains(c.privSub, s) {
 		c.privSub = append(c.privSub, s)
 	}
+	c.updateIdle()
 }
 
 func (c *Client) UnsubscribePublic(s string) {
@@ -199,6 +732,8 @@ func (c *Client) UnsubscribePublic(s string) {
 		}
 	}
 	c.pubSub = l
+	c.SetThrottle(s, 0)
+	c.updateIdle()
 }
 
 func (c *Client) UnsubscribePrivate(s string) {
@@ -211,6 +746,8 @@ func (c *Client) UnsubscribePrivate(s string) {
 		}
 	}
 	c.privSub = l
+	c.SetThrottle(s, 0)
+	c.updateIdle()
 }
 
 func parseStreamsFromURI(uri string) []string {
@@ -237,24 +774,44 @@ func parseStreamsFromURI(uri string) []string {
 // reads from this goroutine.
 func (c *Client) read() {
 	defer func() {
-		log.Debug().Msgf("Closing client read (%s)", c.GetAuth().UID)
+		reason := c.closeReason.get()
+		c.Logger().Debug().Str("reason", reason).Msgf("Closing client read (%s)", c.GetAuth().UID)
+		c.stopExpiry()
+		c.stopIdle()
+		if c.lifetime != nil {
+			c.lifetime.Stop()
+		}
+		if c.pendingAuth != nil {
+			c.pendingAuth.Stop()
+		}
 		c.hub.Unregister <- c
+		c.hub.releaseConnection(c.connKey)
 		metrics.RecordHubClientClose()
+		metrics.RecordDisconnect(reason)
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	opts := c.hub.Options()
+	c.conn.SetReadLimit(int64(opts.MaxFrameBytes))
+	c.conn.SetReadDeadline(time.Now().Add(opts.pongWait()))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		atomic.StoreInt32(&c.missedPongs, 0)
+		c.conn.SetReadDeadline(time.Now().Add(opts.pongWait()))
 		return nil
 	})
 
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Info().Msgf("error: %v", err)
+			var netErr net.Error
+			if err == websocket.ErrReadLimit {
+				c.closeReason.set(reasonFrameTooLarge)
+				c.Logger().Warn().Msgf("Closing connection exceeding %d bytes frame limit (%s)", opts.MaxFrameBytes, c.GetAuth().UID)
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				// No pong was received before the read deadline.
+				c.closeReason.set(reasonPingTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.Logger().Info().Msgf("error: %v", err)
 			}
 			break
 		}
@@ -263,22 +820,69 @@ func (c *Client) read() {
 			continue
 		}
 		if isDebug() {
-			log.Debug().Msgf("Received message %s", message)
+			c.Logger().Debug().Msgf("Received message %s", message)
 		}
 
 		// handle ping
 		if string(message) == "ping" {
-			c.send <- []byte("pong")
+			reply(c, "pong")
+			continue
+		}
+
+		if !c.limiter.Allow() {
+			c.violations++
+			reply(c, errorEvent(codeRateLimited, "rate limit exceeded", nil))
+
+			if opts.MaxRateViolations > 0 && c.violations >= opts.MaxRateViolations {
+				c.Logger().Warn().Msgf("Closing connection exceeding rate limit (%s)", c.GetAuth().UID)
+				c.Disconnect(int(codeRateLimited), "rate limit exceeded")
+				break
+			}
 			continue
 		}
 
 		req, err := msg.ParseRequest(message)
+		if c.pendingAuth != nil {
+			if !c.authenticateFirst(req, err) {
+				break
+			}
+			continue
+		}
+		if errors.Is(err, msg.ErrInvalidMessage) {
+			c.invalidMessages++
+			c.Logger().Debug().Msgf("Invalid message: %s", err.Error())
+			reply(c, errorEvent(codeInvalidMessage, "invalid message", nil))
+
+			if opts.MaxInvalidMessages > 0 && c.invalidMessages >= opts.MaxInvalidMessages {
+				c.Logger().Warn().Msgf("Closing connection sending %d invalid messages (%s)", c.invalidMessages, c.GetAuth().UID)
+				c.Disconnect(int(codeInvalidMessage), "too many invalid messages")
+				break
+			}
+			continue
+		}
+		c.invalidMessages = 0
+
 		if err != nil {
-			c.send <- []byte(responseMust(err, nil))
+			if req.RPC {
+				reply(c, rpcResponseMust(req.ID, nil, err))
+			} else {
+				reply(c, errorEvent(codeInvalidRequest, err.Error(), nil))
+			}
 			continue
 		}
 
-		c.hub.Requests <- Request{c, req}
+		if req.Method == "auth" {
+			auth, err := c.hub.authenticate(req.Token)
+			if err != nil {
+				c.Logger().Info().Msgf("Refused authentication: %s", err.Error())
+				reply(c, authError(err.Error()))
+				continue
+			}
+			c.hub.Requests <- Request{client: c, Request: req, auth: &auth}
+			continue
+		}
+
+		c.hub.Requests <- Request{client: c, Request: req}
 	}
 }
 
@@ -288,9 +892,12 @@ func (c *Client) read() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) write() {
-	ticker := time.NewTicker(pingPeriod)
+	atomic.AddInt64(&runningWriters, 1)
+	opts := c.hub.Options()
+	ticker := time.NewTicker(opts.PingInterval)
 	defer func() {
-		log.Debug().Msgf("Closing client write (%s)", c.GetAuth().UID)
+		atomic.AddInt64(&runningWriters, -1)
+		c.Logger().Debug().Msgf("Closing client write (%s)", c.GetAuth().UID)
 		ticker.Stop()
 		c.conn.Close()
 	}()
@@ -298,26 +905,150 @@ func (c *Client) write() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
+				c.conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+			message = c.deliver(c.fresh(message), time.Now())
+			if message == "" {
+				continue
 			}
-			w.Write(message)
-			if err := w.Close(); err != nil {
+
+			frames := []string{message}
+			if opts.Coalesce && c.encoding == encodingJSON {
+				frames, ok = c.drain(message, opts.CoalesceMax)
+			}
+			for _, frame := range frames {
+				if err := c.writeFrame(frame); err != nil {
+					c.writeFailed(err)
+					return
+				}
+			}
+			if !ok {
+				c.conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+		case now := <-c.throttle.C():
+			for _, stream := range c.throttle.due(now) {
+				message := c.takeLatest(conflatedMarker + stream)
+				if message == "" {
+					continue
+				}
+				if err := c.writeFrame(message); err != nil {
+					c.writeFailed(err)
+					return
+				}
+			}
+		case <-c.backpressure:
+			for _, notice := range c.backpressureNotices() {
+				if err := c.writeFrame(notice); err != nil {
+					c.writeFailed(err)
+					return
+				}
+			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if atomic.AddInt32(&c.missedPongs, 1) > int32(opts.MaxMissedPongs) {
+				c.Logger().Info().Msgf("Closing connection missing %d pongs (%s)", opts.MaxMissedPongs, c.GetAuth().UID)
+				c.closeReason.set(reasonPingTimeout)
+				return
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.writeFailed(err)
 				return
 			}
 		}
 	}
 }
+
+// writeFrame writes message to the websocket connection in a single frame.
+func (c *Client) writeFrame(message string) error {
+	opts := c.hub.Options()
+	c.conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+
+	// Compression only applies when negotiated with the peer.
+	c.conn.EnableWriteCompression(len(message) >= opts.CompressionMinBytes)
+	frame := websocket.TextMessage
+	if c.encoding == encodingMsgpack {
+		frame = websocket.BinaryMessage
+	}
+	w, err := c.conn.NextWriter(frame)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, message); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeFailed logs the error closing the write loop, recording timeouts as
+// disconnects of a client not reading its messages.
+func (c *Client) writeFailed(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.Logger().Warn().Msgf("Closing stuck websocket connection, write timed out after %s", c.hub.Options().WriteTimeout)
+		metrics.RecordSlowClientDisconnect("write_timeout")
+		c.closeReason.set(reasonSlow)
+		return
+	}
+	c.Logger().Debug().Msgf("Write failed: %s", err.Error())
+	c.closeReason.set(reasonWriteError)
+}
+
+// drain takes the messages queued after message, up to max messages, and
+// returns the frames to write them with. It returns false once the hub closed
+// the send channel.
+func (c *Client) drain(message string, max int) ([]string, bool) {
+	messages := []string{message}
+	for len(messages) < max {
+		select {
+		case m, ok := <-c.send:
+			if !ok {
+				return coalesce(messages), false
+			}
+			if m = c.deliver(c.fresh(m), time.Now()); m != "" {
+				messages = append(messages, m)
+			}
+		default:
+			return coalesce(messages), true
+		}
+	}
+	return coalesce(messages), true
+}
+
+// coalesce joins consecutive JSON objects of messages into JSON arrays, other
+// messages, as the "pong" reply, are kept in frames of their own.
+func coalesce(messages []string) []string {
+	frames := make([]string, 0, 1)
+	objects := []string{}
+
+	flush := func() {
+		switch len(objects) {
+		case 0:
+		case 1:
+			frames = append(frames, objects[0])
+		default:
+			frames = append(frames, "["+strings.Join(objects, ",")+"]")
+		}
+		objects = objects[:0]
+	}
+
+	for _, m := range messages {
+		if strings.HasPrefix(m, "{") {
+			objects = append(objects, m)
+			continue
+		}
+		flush()
+		frames = append(frames, m)
+	}
+	flush()
+
+	return frames
+}
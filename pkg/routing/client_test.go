@@ -1,17 +1,39 @@
 package routing
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+	"github.com/nusa-exchange/rango/pkg/metrics"
 )
 
 func TestClient(t *testing.T) {
 	hub := NewHub(nil)
 	client := &Client{
 		hub:     hub,
-		send:    make(chan []byte, 256),
+		send:    make(chan string, 256),
 		Auth:    Auth{UID: "UIDABC001", Role: "admin"},
 		pubSub:  []string{},
 		privSub: []string{},
@@ -80,7 +102,7 @@ func TestCheckSameOriginEmpty(t *testing.T) {
 	}
 
 	for _, tt := range checkSameOriginTests {
-		ok := checkSameOrigin("")(tt.r)
+		ok := checkSameOrigin(nil)(tt.r)
 		if tt.ok != ok {
 			t.Errorf("checkSameOrigin(%+v) returned %v, want %v", tt.r, ok, tt.ok)
 		}
@@ -100,7 +122,7 @@ func TestCheckSameOriginDomainsSetup(t *testing.T) {
 		{true, &http.Request{Host: "whatever.org", Header: map[string][]string{"Origin": {}}}},
 	}
 
-	checker := checkSameOrigin("example.org,example.com")
+	checker := checkSameOrigin([]string{"example.org", "example.com"})
 	for _, tt := range checkSameOriginTests {
 		ok := checker(tt.r)
 		if tt.ok != ok {
@@ -108,32 +130,1126 @@ func TestCheckSameOriginDomainsSetup(t *testing.T) {
 		}
 	}
 
-	checker = checkSameOrigin("example.org, example.com")
+	checker = checkSameOrigin([]string{"https://example.org", "https://example.com"})
 	for _, tt := range checkSameOriginTests {
 		ok := checker(tt.r)
 		if tt.ok != ok {
 			t.Errorf("checkSameOrigin(%+v) returned %v, want %v", tt.r, ok, tt.ok)
 		}
 	}
+}
 
-	checker = checkSameOrigin("https://example.org,https://example.com")
-	for _, tt := range checkSameOriginTests {
-		ok := checker(tt.r)
-		if tt.ok != ok {
-			t.Errorf("checkSameOrigin(%+v) returned %v, want %v", tt.r, ok, tt.ok)
-		}
+func TestCheckSameOriginWildcard(t *testing.T) {
+	var checkSameOriginTests = []struct {
+		ok bool
+		r  *http.Request
+	}{
+		{true, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://app.example.com"}}}},
+		{true, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://a.b.Example.com"}}}},
+		{true, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://exchange.org"}}}},
+		{false, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://example.com"}}}},
+		{false, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://evilexample.com"}}}},
+		{false, &http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://app.example.com.evil.org"}}}},
+		{false, &http.Request{Host: "rango.io", Header: map[string][]string{"Origin": {"https://rango.io"}}}},
+		{true, &http.Request{Host: "ws.example.com", Header: map[string][]string{}}},
 	}
 
-	checker = checkSameOrigin("https://example.org, https://example.com")
-	for _, tt := range checkSameOriginTests {
-		ok := checker(tt.r)
-		if tt.ok != ok {
-			t.Errorf("checkSameOrigin(%+v) returned %v, want %v", tt.r, ok, tt.ok)
+	for _, origins := range [][]string{{"*.example.com", "exchange.org"}, {"https://*.example.com", "https://exchange.org"}} {
+		checker := checkSameOrigin(origins)
+		for _, tt := range checkSameOriginTests {
+			ok := checker(tt.r)
+			if tt.ok != ok {
+				t.Errorf("checkSameOrigin(%q)(%+v) returned %v, want %v", origins, tt.r, ok, tt.ok)
+			}
 		}
 	}
+
+	assert.True(t, checkSameOrigin([]string{"*"})(&http.Request{Host: "ws.example.com", Header: map[string][]string{"Origin": {"https://other.org"}}}))
 }
 
 func TestCheckSameOriginBadConfiguration(t *testing.T) {
-	assert.Panics(t, func() { checkSameOrigin("https://ex ample.org") })
-	assert.Panics(t, func() { checkSameOrigin("https://ex:ample.org") })
+	assert.Panics(t, func() { checkSameOrigin([]string{"https://ex ample.org"}) })
+	assert.Panics(t, func() { checkSameOrigin([]string{"https://ex:ample.org"}) })
+}
+
+func TestClientUpgradeFailures(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.AllowedOrigins = []string{"www.example.com"}
+
+	hub := NewHub(nil, opts)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	failures := func(reason string) float64 {
+		return counterValue(t, "rango_upgrade_failures_total", "reason", reason)
+	}
+
+	t.Run("origin", func(t *testing.T) {
+		before := failures("origin")
+		_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+		assert.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, before+1, failures("origin"))
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		before := failures("protocol")
+		_, _, err := websocket.DefaultDialer.Dial(url+"/?protocol=9", nil)
+		assert.Error(t, err)
+		assert.Equal(t, before+1, failures("protocol"))
+	})
+
+	t.Run("upgrade_error", func(t *testing.T) {
+		before := failures("upgrade_error")
+		resp, err := http.Get(s.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, before+1, failures("upgrade_error"))
+	})
+}
+
+// dial connects a websocket client to a test server running hub, and reads
+// the hello message and the subscription response.
+func dial(t *testing.T, hub *Hub, uri string) (*websocket.Conn, func()) {
+	conn, _, teardown := dialWith(t, websocket.DefaultDialer, hub, uri)
+	return conn, teardown
+}
+
+// dialWith is like dial using dialer, it also returns the handshake response.
+func dialWith(t *testing.T, dialer *websocket.Dialer, hub *Hub, uri string) (*websocket.Conn, *http.Response, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+uri, nil)
+	require.NoError(t, err)
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), `"event":"hello"`)
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), `"message":"subscribed"`)
+
+	return conn, resp, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/")
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- hub.Shutdown(ctx) }()
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 0, hub.ClientsCount())
+}
+
+func TestClientRateLimit(t *testing.T) {
+	// listen returns a hub closing the connections after violations.
+	listen := func(violations int) *Hub {
+		opts := DefaultHubOptions()
+		opts.AnonymousMessagesPerSec, opts.MaxRateViolations = 3, violations
+		hub := NewHub(nil, opts)
+		go hub.ListenWebsocketEvents()
+		return hub
+	}
+
+	subscribe := []byte(`{"event":"subscribe","streams":["eurusd.trades"]}`)
+	subscribed := `{"success":{"message":"subscribed","streams":["eurusd.trades"]}}`
+	limited := `{"error":{"code":4003,"message":"rate limit exceeded","name":"rate_limited"}}`
+
+	t.Run("replies with an error when the limit trips", func(t *testing.T) {
+		conn, teardown := dial(t, listen(0), "/")
+		defer teardown()
+
+		for i := 0; i < 5; i++ {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, subscribe))
+		}
+
+		received := map[string]int{}
+		for i := 0; i < 5; i++ {
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			received[string(msg)]++
+		}
+		assert.Equal(t, map[string]int{subscribed: 3, limited: 2}, received)
+	})
+
+	t.Run("closes the connection after repeated violations", func(t *testing.T) {
+		conn, teardown := dial(t, listen(2), "/")
+		defer teardown()
+
+		for i := 0; i < 5; i++ {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, subscribe))
+		}
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				assert.True(t, websocket.IsCloseError(err, int(codeRateLimited)), err)
+				break
+			}
+			assert.Contains(t, []string{subscribed, limited}, string(msg))
+		}
+	})
+}
+
+func TestClientInvalidMessages(t *testing.T) {
+	// listen returns a hub closing the connections after max invalid messages.
+	listen := func(max int) *Hub {
+		opts := DefaultHubOptions()
+		opts.MaxInvalidMessages = max
+		hub := NewHub(nil, opts)
+		go hub.ListenWebsocketEvents()
+		return hub
+	}
+
+	invalid := `{"error":{"code":4004,"message":"invalid message","name":"invalid_message"}}`
+
+	t.Run("replies with an error", func(t *testing.T) {
+		conn, teardown := dial(t, listen(2), "/")
+		defer teardown()
+
+		for _, m := range []string{`garbage`, `{"event":"subscribe","streams":["eurusd.trades"]}`, `{"event":"subscribe","streams":[1]}`} {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(m)))
+		}
+
+		received := map[string]int{}
+		for i := 0; i < 3; i++ {
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			received[string(msg)]++
+		}
+		assert.Equal(t, map[string]int{invalid: 2, subscribed(`"eurusd.trades"`): 1}, received, "the connection stays open")
+	})
+
+	t.Run("closes the connection after consecutive errors", func(t *testing.T) {
+		conn, teardown := dial(t, listen(3), "/")
+		defer teardown()
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":`)))
+		}
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				assert.True(t, websocket.IsCloseError(err, int(codeInvalidMessage)), err)
+				break
+			}
+			assert.Equal(t, invalid, string(msg))
+		}
+	})
+}
+
+func TestClientMaxFrameBytes(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MaxFrameBytes = 1024
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/")
+	defer teardown()
+
+	streams := strings.Repeat(`"eurusd.trades",`, 100)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":[`+streams+`"eurusd.trades"]}`)))
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+	assert.Eventually(t, func() bool { return hub.ClientsCount() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.PingInterval, opts.MaxMissedPongs = 20*time.Millisecond, 2
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	t.Run("keeps connections answering pings", func(t *testing.T) {
+		conn, teardown := dial(t, hub, "/")
+		defer teardown()
+
+		pings := 0
+		conn.SetPingHandler(func(data string) error {
+			pings++
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		require.True(t, errors.As(err, &netErr) && netErr.Timeout(), err)
+		assert.Greater(t, pings, 3)
+	})
+
+	t.Run("closes connections missing pongs", func(t *testing.T) {
+		conn, teardown := dial(t, hub, "/")
+		defer teardown()
+
+		pings := 0
+		conn.SetPingHandler(func(string) error {
+			pings++
+			return nil
+		})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		require.Error(t, err)
+		assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should be closed by the server")
+		assert.Equal(t, 2, pings)
+	})
+}
+
+func TestMain(m *testing.M) {
+	metrics.Enable()
+	os.Exit(m.Run())
+}
+
+// droppedMessages returns the rango_dropped_messages_total counter of stream.
+func droppedMessages(t *testing.T, stream string) float64 {
+	return counterValue(t, "rango_dropped_messages_total", "stream", stream)
+}
+
+// counterValue returns the counter name with the label set to value, label
+// being empty for counters without labels.
+func counterValue(t *testing.T, name, label, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if label == "" {
+				return m.GetCounter().GetValue()
+			}
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label && l.GetValue() == value {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// refusedConnections returns the rango_hub_refused_connections_total counter
+// of reason.
+func refusedConnections(t *testing.T, reason string) float64 {
+	return counterValue(t, "rango_hub_refused_connections_total", "reason", reason)
+}
+
+// stalledClient returns a client with a send buffer of size that is never
+// drained, and its peer connection.
+func stalledClient(t *testing.T, size int) (*Client, *websocket.Conn, func()) {
+	clients := make(chan *Client, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := newUpgrader(DefaultHubOptions()).Upgrade(w, r, nil)
+		require.NoError(t, err)
+		// The write loop is not started so the buffer is never drained.
+		clients <- &Client{conn: conn, send: make(chan string, size), latest: make(map[string]string)}
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+
+	return <-clients, conn, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestClientDroppedMessages(t *testing.T) {
+	client, conn, teardown := stalledClient(t, 1)
+	defer teardown()
+
+	hub := NewHub(nil)
+	hub.handleSubscribe(&Request{client: client, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	assert.Len(t, client.send, 1, "the subscription response fills the buffer")
+
+	dropped := droppedMessages(t, "eurusd.trades")
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	assert.Equal(t, dropped+1, droppedMessages(t, "eurusd.trades"))
+
+	_, _, err := conn.ReadMessage()
+	assert.Error(t, err, "slow connections are closed")
+}
+
+func TestClientReplyOverflow(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	// The write loop is gone, e.g. after a write timeout, and the buffer full.
+	client, conn, teardown := stalledClient(t, 1)
+	defer teardown()
+	client.hub = hub
+	hub.register(client)
+	require.True(t, client.Send(`{"eurusd.trades":{"price":"1"}}`))
+	go client.read()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	require.Eventually(t, func() bool { return hub.ClientsCount() == 0 }, time.Second, 10*time.Millisecond,
+		"replies apply the overflow policy rather than blocking the read loop")
+	assert.Equal(t, reasonSlow, client.closeReason.get())
+}
+
+// overflowHub returns a hub applying policy to its clients with a full buffer.
+func overflowHub(policy overflowPolicy) *Hub {
+	opts := DefaultHubOptions()
+	opts.ClientOverflow = string(policy)
+	return NewHub(nil, opts)
+}
+
+func TestClientOverflow(t *testing.T) {
+	buffered := func(c *Client) []string {
+		var msgs []string
+		for len(c.send) != 0 {
+			msgs = append(msgs, <-c.send)
+		}
+		return msgs
+	}
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		client, conn, teardown := stalledClient(t, 2)
+		defer teardown()
+		client.hub = overflowHub(overflowDropOldest)
+
+		assert.True(t, client.Send("1"))
+		assert.True(t, client.Send("2"))
+		assert.False(t, client.Send("3"))
+		assert.Equal(t, []string{"2", "3"}, buffered(client))
+
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should stay open")
+	})
+
+	t.Run("drop_newest", func(t *testing.T) {
+		client, conn, teardown := stalledClient(t, 2)
+		defer teardown()
+		client.hub = overflowHub(overflowDropNewest)
+
+		assert.True(t, client.Send("1"))
+		assert.True(t, client.Send("2"))
+		assert.False(t, client.Send("3"))
+		assert.Equal(t, []string{"1", "2"}, buffered(client))
+
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should stay open")
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		client, conn, teardown := stalledClient(t, 2)
+		defer teardown()
+		client.hub = overflowHub(overflowDisconnect)
+
+		assert.True(t, client.Send("1"))
+		assert.True(t, client.Send("2"))
+		assert.False(t, client.Send("3"))
+		assert.Equal(t, []string{"1", "2"}, buffered(client))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		require.Error(t, err)
+		assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should be closed by the server")
+	})
+}
+
+func TestClientConflate(t *testing.T) {
+	// delivered returns the messages the write loop would write.
+	delivered := func(c *Client) []string {
+		var msgs []string
+		for len(c.send) != 0 {
+			if m := c.takeLatest(<-c.send); m != "" {
+				msgs = append(msgs, m)
+			}
+		}
+		return msgs
+	}
+
+	t.Run("delivers the latest message under backpressure", func(t *testing.T) {
+		client, _, teardown := stalledClient(t, 10)
+		defer teardown()
+
+		hub := NewHub(nil)
+		hub.handleSubscribe(&Request{client: client, Request: message.Request{
+			Streams:  []string{"eurusd.tickers", "eurusd.trades"},
+			Conflate: []string{"eurusd.tickers"},
+		}})
+
+		for i := 0; i < 100; i++ {
+			hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.tickers"), Value: []byte(fmt.Sprintf(`{"last":"%d"}`, i))})
+			if i%50 == 0 {
+				hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(fmt.Sprintf(`{"id":%d}`, i))})
+			}
+		}
+		assert.Len(t, client.send, 4, "a single ticker is queued")
+
+		assert.Equal(t, []string{
+			subscribed(`"eurusd.tickers","eurusd.trades"`),
+			`{"eurusd.tickers":{"last":"99"}}`,
+			`{"eurusd.trades":{"id":0}}`,
+			`{"eurusd.trades":{"id":50}}`,
+		}, delivered(client))
+
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.tickers"), Value: []byte(`{"last":"100"}`)})
+		assert.Equal(t, []string{`{"eurusd.tickers":{"last":"100"}}`}, delivered(client))
+	})
+
+	t.Run("releases dropped messages", func(t *testing.T) {
+		client, _, teardown := stalledClient(t, 1)
+		defer teardown()
+		client.hub = overflowHub(overflowDropOldest)
+
+		assert.True(t, client.SendLatest("eurusd.tickers", "1"))
+		assert.False(t, client.Send("2"), "the queued ticker is dropped")
+		assert.Equal(t, []string{"2"}, delivered(client))
+
+		assert.True(t, client.SendLatest("eurusd.tickers", "3"))
+		assert.True(t, client.SendLatest("eurusd.tickers", "4"))
+		assert.Equal(t, []string{"4"}, delivered(client))
+	})
+
+	t.Run("writes conflated messages", func(t *testing.T) {
+		hub := NewHub(nil)
+		conn, teardown := dial(t, hub, "/")
+		defer teardown()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["eurusd.tickers"],"conflate":["eurusd.tickers"]}`)))
+		go hub.ListenWebsocketEvents()
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, subscribed(`"eurusd.tickers"`), string(msg))
+
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.tickers"), Value: []byte(`{"last":"1"}`)})
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"eurusd.tickers":{"last":"1"}}`, string(msg))
+	})
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.WriteTimeout = 100 * time.Millisecond
+	// Only the write timeout closes the connection.
+	opts.ClientOverflow = string(overflowDropNewest)
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+	_, teardown := dial(t, hub, "/?stream=eurusd.trades")
+	defer teardown()
+	require.Eventually(t, func() bool { return hub.ClientsCount() == 1 }, time.Second, time.Millisecond)
+
+	disconnects := counterValue(t, "rango_slow_disconnects_total", "reason", "write_timeout")
+
+	// The peer stops reading, the socket buffers fill up until writes block.
+	value := []byte(`"` + strings.Repeat("a", 64<<10) + `"`)
+	assert.Eventually(t, func() bool {
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: value})
+		return hub.ClientsCount() == 0
+	}, 10*time.Second, 10*time.Millisecond, "stuck clients are disconnected")
+	assert.Equal(t, disconnects+1, counterValue(t, "rango_slow_disconnects_total", "reason", "write_timeout"))
+}
+
+func TestClientAuthHeaders(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.UIDHeader, opts.RoleHeader = "X-User-Id", "X-User-Role"
+	hub := NewHub(map[string][]string{"finex": {"trader"}}, opts)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	header := http.Header{
+		"X-User-Id":   {"UIDABC00001"},
+		"X-User-Role": {"trader"},
+		"JwtUID":      {"UIDSPOOFED1"},
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?stream=order&stream=finex.eurusd.orders", header)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	read := func() string {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+	assert.Contains(t, read(), `"event":"hello"`)
+	assert.Equal(t, subscribed(`"finex.eurusd.orders","order"`), read())
+
+	hub.ReceiveMsg(&Message{Key: []byte("private.UIDSPOOFED1.order"), Value: []byte(`{"id":1}`)})
+	hub.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":2}`)})
+	assert.Equal(t, `{"order":{"id":2}}`, read())
+}
+
+func TestClientDefaultStreams(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.DefaultStreams = map[string][]string{
+		"admin":       {"finex.eurusd.orders", "global.tickers"},
+		anonymousRole: {"global.tickers"},
+	}
+	hub := NewHub(map[string][]string{"finex": {"admin"}}, opts)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	connect := func(header http.Header, uri string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url+uri, header)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), `"event":"hello"`)
+		return conn
+	}
+	read := func(conn *websocket.Conn) string {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	admin := connect(http.Header{"JwtUID": {"UIDABC00001"}, "JwtRole": {"admin"}}, "/?stream=eurusd.trades")
+	assert.Equal(t, subscribed(`"eurusd.trades","finex.eurusd.orders","global.tickers"`), read(admin))
+
+	anonymous := connect(nil, "/")
+	assert.Equal(t, subscribed(`"global.tickers"`), read(anonymous))
+
+	hub.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{"id":1}`)})
+	hub.ReceiveMsg(&Message{Key: []byte("global.global.tickers"), Value: []byte(`{"eurusd":{}}`)})
+
+	assert.Equal(t, `{"eurusd.orders":{"id":1}}`, read(admin))
+	assert.Equal(t, `{"global.tickers":{"eurusd":{}}}`, read(admin))
+	assert.Equal(t, `{"global.tickers":{"eurusd":{}}}`, read(anonymous))
+
+	t.Run("unsubscribes from default streams", func(t *testing.T) {
+		require.NoError(t, anonymous.WriteMessage(websocket.TextMessage, []byte(`{"event":"unsubscribe","streams":["global.tickers"]}`)))
+		assert.Equal(t, `{"success":{"message":"unsubscribed","streams":[]}}`, read(anonymous))
+	})
+}
+
+func TestClientIdle(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.SubscribeGrace = 100 * time.Millisecond
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	closed := func(t *testing.T, conn *websocket.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, int(codeNoSubscription)), err)
+		assert.Contains(t, err.Error(), "no subscription")
+	}
+
+	t.Run("closes connections without subscription", func(t *testing.T) {
+		disconnects := counterValue(t, "rango_idle_disconnects_total", "", "")
+
+		conn, teardown := dial(t, hub, "/")
+		defer teardown()
+
+		closed(t, conn)
+		assert.Equal(t, disconnects+1, counterValue(t, "rango_idle_disconnects_total", "", ""))
+	})
+
+	t.Run("keeps connections with subscriptions", func(t *testing.T) {
+		conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+		defer teardown()
+
+		conn.SetReadDeadline(time.Now().Add(3 * opts.SubscribeGrace))
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should stay open")
+	})
+
+	t.Run("closes connections unsubscribed from every stream", func(t *testing.T) {
+		conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+		defer teardown()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"unsubscribe","streams":["eurusd.trades"]}`)))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"success":{"message":"unsubscribed","streams":[]}}`, string(msg))
+
+		closed(t, conn)
+	})
+}
+
+func TestClientLifetime(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MaxConnectionLifetime, opts.ConnectionLifetimeJitter = 200*time.Millisecond, 0.5
+
+	t.Run("jitters the lifetime", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			lifetime := opts.connectionLifetime()
+			assert.True(t, lifetime > 100*time.Millisecond && lifetime <= 200*time.Millisecond, lifetime)
+		}
+	})
+
+	t.Run("closes connections past their lifetime", func(t *testing.T) {
+		hub := NewHub(nil, opts)
+		go hub.ListenWebsocketEvents()
+		disconnects := counterValue(t, "rango_disconnects_total", "reason", reasonLifetime)
+
+		conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+		defer teardown()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, int(codeReconnect)), err)
+		assert.Contains(t, err.Error(), "please reconnect")
+
+		require.Eventually(t, func() bool {
+			return counterValue(t, "rango_disconnects_total", "reason", reasonLifetime) == disconnects+1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+// countingConn counts the bytes read from the network.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestClientCompression(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	body := `{"data":"` + strings.Repeat("a", 4096) + `"}`
+	expected := `{"eurusd.trades":` + body + `}`
+
+	receive := func(t *testing.T, compress bool) (string, int64) {
+		var counter *countingConn
+		dialer := &websocket.Dialer{
+			EnableCompression: compress,
+			NetDial: func(network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				counter = &countingConn{Conn: conn}
+				return counter, err
+			},
+		}
+
+		negotiated := strconv.FormatBool(compress)
+		connections := counterValue(t, "rango_compression_connections_total", "negotiated", negotiated)
+		conn, resp, teardown := dialWith(t, dialer, hub, "/?stream=eurusd.trades")
+		defer teardown()
+		assert.Equal(t, compress, strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"))
+		assert.Equal(t, connections+1, counterValue(t, "rango_compression_connections_total", "negotiated", negotiated))
+
+		before := atomic.LoadInt64(&counter.read)
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(body)})
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg), atomic.LoadInt64(&counter.read) - before
+	}
+
+	t.Run("compresses frames when negotiated", func(t *testing.T) {
+		msg, read := receive(t, true)
+		assert.Equal(t, expected, msg)
+		assert.Less(t, read, int64(len(expected)/10))
+	})
+
+	t.Run("sends uncompressed frames otherwise", func(t *testing.T) {
+		msg, read := receive(t, false)
+		assert.Equal(t, expected, msg)
+		assert.GreaterOrEqual(t, read, int64(len(expected)))
+	})
+}
+
+func TestNegotiatesCompression(t *testing.T) {
+	opts := DefaultHubOptions()
+	upgrader := newUpgrader(opts)
+
+	for header, negotiated := range map[string]bool{
+		"":                   false,
+		"permessage-deflate": true,
+		"permessage-deflate; client_max_window_bits": true,
+		"x-webkit-deflate-frame, permessage-deflate": true,
+		"x-webkit-deflate-frame":                     false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Sec-Websocket-Extensions", header)
+		}
+		assert.Equal(t, negotiated, negotiatesCompression(upgrader, r), header)
+	}
+
+	opts.CompressionLevel = 0
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+	assert.False(t, negotiatesCompression(newUpgrader(opts), r))
+}
+
+func TestClientBufferSizes(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pooled %t", pooled), func(t *testing.T) {
+			opts := DefaultHubOptions()
+			opts.ReadBufferSize, opts.WriteBufferSize, opts.WriteBufferPool = 16, 16, pooled
+
+			hub := NewHub(nil, opts)
+			go hub.ListenWebsocketEvents()
+
+			conn, teardown := dial(t, hub, "/")
+			defer teardown()
+
+			streams := `["eurusd.trades","eurusd.ob-inc","usdjpy.trades","usdjpy.ob-inc"]`
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":`+streams+`}`)))
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, `{"success":{"message":"subscribed","streams":`+streams+`}}`, string(msg))
+
+			price := strings.Repeat("1", 100)
+			hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"` + price + `"}`)})
+			_, msg, err = conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, `{"eurusd.trades":{"price":"`+price+`"}}`, string(msg))
+		})
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.AnonymousMessagesPerSec, opts.AnonymousMaxSubscriptions = 1, 2
+	opts.MessagesPerSec, opts.MaxSubscriptions = 10, 3
+
+	assert.Equal(t, clientLimits{messagesPerSec: 1, maxSubscriptions: 2}, opts.limitsFor(Auth{}))
+	assert.Equal(t, clientLimits{messagesPerSec: 10, maxSubscriptions: 3}, opts.limitsFor(Auth{UID: "UIDABC00001", Role: "member"}))
+
+	hub := NewHub(nil, opts)
+	streams := []string{"eurusd.trades", "eurusd.ob-inc", "usdjpy.trades", "usdjpy.ob-inc"}
+
+	t.Run("anonymous", func(t *testing.T) {
+		c := &Client{hub: hub, Auth: Auth{}, limits: opts.limitsFor(Auth{}), send: make(chan string, 10)}
+		hub.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+
+		assert.Equal(t, []string{"eurusd.trades", "eurusd.ob-inc"}, c.GetSubscriptions())
+		assert.Equal(t, `{"error":{"code":4006,"message":"subscriptions limit exceeded","name":"subscriptions_limit","stream":"usdjpy.trades"}}`, <-c.send)
+		assert.Equal(t, `{"error":{"code":4006,"message":"subscriptions limit exceeded","name":"subscriptions_limit","stream":"usdjpy.ob-inc"}}`, <-c.send)
+		assert.Equal(t, `{"success":{"message":"subscribed","rejected":["usdjpy.trades","usdjpy.ob-inc"],"streams":["eurusd.trades","eurusd.ob-inc"]}}`, <-c.send)
+
+		hub.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["eurusd.trades","eurusd.ob-inc"]}}`, <-c.send, "resubscribing is not limited")
+	})
+
+	t.Run("authenticated", func(t *testing.T) {
+		auth := Auth{UID: "UIDABC00001", Role: "member"}
+		c := &Client{hub: hub, Auth: auth, limits: opts.limitsFor(auth), send: make(chan string, 10)}
+		hub.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+
+		assert.Equal(t, []string{"eurusd.trades", "eurusd.ob-inc", "usdjpy.trades"}, c.GetSubscriptions())
+	})
+}
+
+func TestClientMaxConnections(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	hub.SetMaxConnections(1)
+
+	conn, teardown := dial(t, hub, "/")
+	defer teardown()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+	conn.Close()
+	require.Eventually(t, func() bool { return hub.ClientsCount() == 0 }, time.Second, 10*time.Millisecond)
+
+	second, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err, "connections are accepted again below the limit")
+	second.Close()
+}
+
+func TestClientMaxConnectionsConcurrent(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+	hub.SetMaxConnections(5)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	var connected int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?stream=eurusd.trades", nil)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&connected, 1)
+			t.Cleanup(func() { conn.Close() })
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(5), connected, "handshakes in progress count against the limit")
+	assert.Eventually(t, func() bool { return hub.ClientsCount() == 5 }, time.Second, 10*time.Millisecond)
+}
+
+func TestHubReserveConnection(t *testing.T) {
+	hub := NewHub(nil)
+	hub.SetMaxConnections(2)
+
+	require.True(t, hub.reserveConnection())
+	require.True(t, hub.reserveConnection())
+	assert.False(t, hub.reserveConnection())
+
+	hub.register(&MockedClient{})
+	hub.releaseReservation()
+	assert.False(t, hub.reserveConnection(), "reserved slots count with the clients")
+
+	hub.releaseReservation()
+	assert.True(t, hub.reserveConnection())
+}
+
+func TestClientMaxConnectionsPerUser(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MaxConnectionsPerUser, opts.MaxConnectionsPerIP = 3, 1
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	connect := func(uid string) (*websocket.Conn, []byte, error) {
+		header := http.Header{}
+		if uid != "" {
+			header.Set("JwtUID", uid)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, msg, err := conn.ReadMessage()
+		if err == nil {
+			require.Contains(t, string(msg), `"event":"hello"`)
+			_, msg, err = conn.ReadMessage()
+		}
+		return conn, msg, err
+	}
+
+	t.Run("refuses connections beyond the user limit", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, msg, err := connect("UIDABC00001")
+			require.NoError(t, err)
+			assert.Contains(t, string(msg), `"message":"subscribed"`)
+		}
+
+		refused := refusedConnections(t, "max_connections_per_user")
+		_, _, err := connect("UIDABC00001")
+		assert.True(t, websocket.IsCloseError(err, int(codeTooManyConnections)), err)
+		assert.Contains(t, err.Error(), "too many connections")
+		assert.Equal(t, refused+1, refusedConnections(t, "max_connections_per_user"))
+
+		_, _, err = connect("UIDABC00002")
+		assert.NoError(t, err, "other users are not limited")
+	})
+
+	t.Run("limits anonymous connections by IP", func(t *testing.T) {
+		conn, _, err := connect("")
+		require.NoError(t, err)
+
+		refused := refusedConnections(t, "max_connections_per_ip")
+		_, _, err = connect("")
+		assert.True(t, websocket.IsCloseError(err, int(codeTooManyConnections)), err)
+		assert.Equal(t, refused+1, refusedConnections(t, "max_connections_per_ip"))
+
+		conn.Close()
+		require.Eventually(t, func() bool {
+			hub.mutex.Lock()
+			defer hub.mutex.Unlock()
+			return hub.connections["ip:127.0.0.1"] == 0
+		}, time.Second, 10*time.Millisecond)
+
+		_, _, err = connect("")
+		assert.NoError(t, err, "released connections are not counted")
+	})
+}
+
+func TestCoalesce(t *testing.T) {
+	assert.Equal(t, []string{`{"a":1}`}, coalesce([]string{`{"a":1}`}))
+	assert.Equal(t, []string{`[{"a":1},{"b":2}]`}, coalesce([]string{`{"a":1}`, `{"b":2}`}))
+	assert.Equal(t,
+		[]string{`[{"a":1},{"b":2}]`, "pong", `{"c":3}`},
+		coalesce([]string{`{"a":1}`, `{"b":2}`, "pong", `{"c":3}`}),
+	)
+}
+
+func TestClientConcurrentSend(t *testing.T) {
+	const publishers, messages = 8, 100
+
+	for _, coalesce := range []bool{false, true} {
+		opts := DefaultHubOptions()
+		opts.Coalesce = coalesce
+
+		client, conn, teardown := stalledClient(t, publishers*messages)
+		client.hub = NewHub(nil, opts)
+		go client.write()
+
+		var wg sync.WaitGroup
+		for p := 0; p < publishers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := 0; i < messages; i++ {
+					client.Send(fmt.Sprintf(`{"p":%d,"i":%d}`, p, i))
+				}
+			}(p)
+		}
+		wg.Wait()
+		client.Close()
+
+		received := 0
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if frame[0] == '[' {
+				var batch []json.RawMessage
+				require.NoError(t, json.Unmarshal(frame, &batch))
+				received += len(batch)
+			} else {
+				received++
+			}
+		}
+		assert.Equal(t, publishers*messages, received, "coalesce: %v", coalesce)
+		teardown()
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// messages returns the messages logged with the connection ID id.
+func (b *syncBuffer) messages(t *testing.T, id string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	msgs := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["connection_id"] == id {
+			msgs = append(msgs, entry["message"].(string))
+		}
+	}
+	return msgs
+}
+
+func TestClientConnectionID(t *testing.T) {
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	logs := &syncBuffer{}
+	log.Logger = zerolog.New(logs).Level(zerolog.DebugLevel)
+
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+
+	hello := map[string]interface{}{}
+	require.NoError(t, conn.ReadJSON(&hello))
+	assert.Equal(t, "hello", hello["event"])
+	id, _ := hello["connection_id"].(string)
+	_, err = uuid.Parse(id)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["eurusd.trades"]}`)))
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return contains(logs.messages(t, id), "Unregistering client ()")
+	}, time.Second, 10*time.Millisecond)
+	assert.Subset(t, logs.messages(t, id), []string{"New anonymous connection", "Subscribing", "Unregistering client ()"})
+}
+
+func TestClientAuthenticationError(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	header := http.Header{}
+	header.Set("JwtError", "token_expired")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), header)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), `"event":"hello"`)
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"error":{"code":4001,"message":"authentication failed","name":"unauthorized","reason":"token_expired"}}`, string(msg))
 }
@@ -0,0 +1,62 @@
+package routing
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client of r. Requests of the trusted
+// proxies are resolved to the last address of X-Forwarded-For not of a
+// trusted proxy, or to X-Real-IP, as clients may set these headers
+// themselves the addresses before the last untrusted one are ignored. Without
+// trusted proxies the headers are ignored and the peer address returned.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedIP(ip, trusted) {
+		return ip
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) != 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !trustedIP(hop, trusted) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// trustedIP returns true if ip belongs to one of the trusted networks.
+func trustedIP(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of r behind the trusted
+// proxies of the hub.
+func (h *Hub) clientIP(r *http.Request) string {
+	return ClientIP(r, h.options.TrustedProxies)
+}
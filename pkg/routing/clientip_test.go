@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	_, lb, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	trusted := []*net.IPNet{lb}
+
+	request := func(remoteAddr string, headers map[string][]string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header[k] = v
+		}
+		return r
+	}
+
+	tests := map[string]struct {
+		request *http.Request
+		trusted []*net.IPNet
+		ip      string
+	}{
+		"direct": {
+			request("203.0.113.7:4567", nil), trusted, "203.0.113.7",
+		},
+		"headers ignored by default": {
+			request("10.1.2.3:4567", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}), nil, "10.1.2.3",
+		},
+		"single proxy": {
+			request("10.1.2.3:4567", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}), trusted, "203.0.113.7",
+		},
+		"proxies chain": {
+			request("10.1.2.3:4567", map[string][]string{"X-Forwarded-For": {"203.0.113.7, 10.4.5.6", "10.7.8.9"}}), trusted, "203.0.113.7",
+		},
+		"real ip": {
+			request("10.1.2.3:4567", map[string][]string{"X-Real-Ip": {"203.0.113.7"}}), trusted, "203.0.113.7",
+		},
+		"spoofed by a client": {
+			request("198.51.100.1:4567", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Real-Ip": {"203.0.113.7"}}), trusted, "198.51.100.1",
+		},
+		"spoofed behind a proxy": {
+			request("10.1.2.3:4567", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1"}}), trusted, "198.51.100.1",
+		},
+		"malformed forwarded address": {
+			request("10.1.2.3:4567", map[string][]string{"X-Forwarded-For": {"unknown"}}), trusted, "10.1.2.3",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.ip, ClientIP(tt.request, tt.trusted))
+		})
+	}
+}
+
+func TestConnectionKey(t *testing.T) {
+	hub := NewHub(nil, HubOptions{MaxConnectionsPerUser: 3, MaxConnectionsPerIP: 1})
+
+	key, bucket, max := hub.connectionKey(Auth{UID: "UIDABC00001"}, "203.0.113.7")
+	assert.Equal(t, "uid:UIDABC00001", key)
+	assert.Equal(t, bucketUser, bucket)
+	assert.Equal(t, 3, max)
+
+	key, bucket, max = hub.connectionKey(Auth{}, "203.0.113.7")
+	assert.Equal(t, "ip:203.0.113.7", key)
+	assert.Equal(t, bucketIP, bucket)
+	assert.Equal(t, 1, max)
+}
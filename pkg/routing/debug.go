@@ -0,0 +1,92 @@
+package routing
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// Number of running write loops of the websocket clients.
+var runningWriters int64
+
+// Messages dropped since the start of the process, reported in the debug vars
+// along the metrics recording them.
+var dropCounts struct {
+	// Messages of clients with a full send buffer.
+	buffer int64
+	// Messages queued longer than the MessageTTL option.
+	stale int64
+	// Upstream messages of a full inbound queue.
+	inbound int64
+}
+
+// DebugVars are the live counters of the hub, dumped for ad-hoc debugging.
+type DebugVars struct {
+	Goroutines   int              `json:"goroutines"`
+	Writers      int64            `json:"writers"`
+	Clients      int              `json:"clients"`
+	Shards       []ShardVars      `json:"shards"`
+	InboundQueue InboundQueueVars `json:"inbound_queue"`
+	Dropped      DroppedMessages  `json:"dropped"`
+}
+
+// ShardVars counts the topics of a shard and their subscriptions.
+type ShardVars struct {
+	Topics        int `json:"topics"`
+	Subscriptions int `json:"subscriptions"`
+}
+
+// InboundQueueVars are the queued upstream messages and the queue size, 0
+// without queue.
+type InboundQueueVars struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// DroppedMessages counts the messages dropped since the start by reason.
+type DroppedMessages struct {
+	Buffer  int64 `json:"buffer"`
+	Stale   int64 `json:"stale"`
+	Inbound int64 `json:"inbound"`
+}
+
+// DebugVars returns the live counters of the hub.
+func (h *Hub) DebugVars() DebugVars {
+	vars := DebugVars{
+		Goroutines: runtime.NumGoroutine(),
+		Writers:    atomic.LoadInt64(&runningWriters),
+		Shards:     make([]ShardVars, len(h.shards)),
+		InboundQueue: InboundQueueVars{
+			Depth:    len(h.inbound),
+			Capacity: cap(h.inbound),
+		},
+		Dropped: DroppedMessages{
+			Buffer:  atomic.LoadInt64(&dropCounts.buffer),
+			Stale:   atomic.LoadInt64(&dropCounts.stale),
+			Inbound: atomic.LoadInt64(&dropCounts.inbound),
+		},
+	}
+
+	h.mutex.Lock()
+	vars.Clients = len(h.clients)
+	h.mutex.Unlock()
+
+	for i, s := range h.shards {
+		s.mutex.Lock()
+		count := func(topics map[string]*Topic) {
+			for _, topic := range topics {
+				vars.Shards[i].Topics++
+				vars.Shards[i].Subscriptions += topic.len()
+			}
+		}
+		count(s.public)
+		for _, topics := range s.private {
+			count(topics)
+		}
+		for _, topics := range s.prefixed {
+			count(topics)
+		}
+		s.mutex.Unlock()
+	}
+
+	return vars
+}
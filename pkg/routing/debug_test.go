@@ -0,0 +1,32 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestDebugVars(t *testing.T) {
+	h, _ := inboundHub(4, true)
+	alice := &recorderClient{auth: Auth{UID: "UIDALICE001"}}
+	h.handleSubscribe(&Request{client: alice, Request: message.Request{Streams: []string{"eurusd.trades", "balance"}}})
+
+	dropped := h.DebugVars().Dropped.Inbound
+	for price := 1; price <= 5; price++ {
+		h.Enqueue(trade(price))
+	}
+
+	vars := h.DebugVars()
+	assert.Len(t, vars.Shards, len(h.shards))
+	topics, subscriptions := 0, 0
+	for _, shard := range vars.Shards {
+		topics += shard.Topics
+		subscriptions += shard.Subscriptions
+	}
+	assert.Equal(t, 2, topics)
+	assert.Equal(t, 3, subscriptions)
+	assert.Equal(t, InboundQueueVars{Depth: 4, Capacity: 4}, vars.InboundQueue)
+	assert.Equal(t, dropped+1, vars.Dropped.Inbound)
+}
@@ -0,0 +1,62 @@
+package routing
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons of the disconnects, labelling rango_disconnects_total.
+const (
+	reasonClientClosed    = "client_closed"
+	reasonIdle            = "idle"
+	reasonSlow            = "slow"
+	reasonRateLimited     = "rate_limited"
+	reasonInvalidMessages = "invalid_messages"
+	reasonTokenExpired    = "token_expired"
+	reasonPingTimeout     = "ping_timeout"
+	reasonFrameTooLarge   = "frame_too_large"
+	reasonShutdown        = "shutdown"
+	reasonWriteError      = "write_error"
+	reasonServerClosed    = "server_closed"
+	reasonLifetime        = "lifetime"
+	reasonUnauthenticated = "unauthenticated"
+)
+
+// disconnectReasons are the reasons of the connections closed with a code.
+var disconnectReasons = map[int]string{
+	int(codeNoSubscription):  reasonIdle,
+	int(codeRateLimited):     reasonRateLimited,
+	int(codeInvalidMessage):  reasonInvalidMessages,
+	int(codeTokenExpired):    reasonTokenExpired,
+	int(codeReconnect):       reasonLifetime,
+	int(codeUnauthorized):    reasonUnauthenticated,
+	websocket.CloseGoingAway: reasonShutdown,
+}
+
+// disconnectReason returns the reason of a connection closed with code.
+func disconnectReason(code int) string {
+	if reason, ok := disconnectReasons[code]; ok {
+		return reason
+	}
+	return reasonServerClosed
+}
+
+// closeReason is the reason a connection is closed for, the first reason set
+// is kept as closing the connection fails its loops with other errors.
+type closeReason struct {
+	reason atomic.Value
+}
+
+// set records the reason unless another one was already set.
+func (r *closeReason) set(reason string) {
+	r.reason.CompareAndSwap(nil, reason)
+}
+
+// get returns the reason set, the client closing the connection by default.
+func (r *closeReason) get() string {
+	if reason, ok := r.reason.Load().(string); ok {
+		return reason
+	}
+	return reasonClientClosed
+}
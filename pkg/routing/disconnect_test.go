@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	assert.Equal(t, reasonIdle, disconnectReason(int(codeNoSubscription)))
+	assert.Equal(t, reasonTokenExpired, disconnectReason(int(codeTokenExpired)))
+	assert.Equal(t, reasonShutdown, disconnectReason(websocket.CloseGoingAway))
+	assert.Equal(t, reasonServerClosed, disconnectReason(websocket.CloseNormalClosure))
+
+	var r closeReason
+	assert.Equal(t, reasonClientClosed, r.get())
+	r.set(reasonSlow)
+	r.set(reasonWriteError)
+	assert.Equal(t, reasonSlow, r.get(), "the first reason is kept")
+}
+
+func TestClientDisconnectReasons(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.SubscribeGrace = 100 * time.Millisecond
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	disconnected := func(t *testing.T, reason string, disconnects float64) {
+		require.Eventually(t, func() bool {
+			return counterValue(t, "rango_disconnects_total", "reason", reason) == disconnects+1
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		disconnects := counterValue(t, "rango_disconnects_total", "reason", reasonIdle)
+
+		conn, teardown := dial(t, hub, "/")
+		defer teardown()
+
+		_, _, err := conn.ReadMessage()
+		require.True(t, websocket.IsCloseError(err, int(codeNoSubscription)), err)
+		disconnected(t, reasonIdle, disconnects)
+	})
+
+	t.Run("client closed", func(t *testing.T) {
+		disconnects := counterValue(t, "rango_disconnects_total", "reason", reasonClientClosed)
+
+		conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+		defer teardown()
+
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+		require.NoError(t, conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)))
+		disconnected(t, reasonClientClosed, disconnects)
+	})
+}
@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"encoding/json"
+
+	"github.com/rs/zerolog/log"
+
+	msg "github.com/nusa-exchange/rango/pkg/message"
+)
+
+// deprecated notifies a client that stream is deprecated, the client is
+// unsubscribed from it right after.
+type deprecated struct {
+	Event  string `json:"event"`
+	Stream string `json:"stream"`
+}
+
+// drainRequest asks the hub loop to drain stream, the number of subscribers
+// drained being sent to done.
+type drainRequest struct {
+	stream string
+	done   chan int
+}
+
+// DrainStream sends a deprecation notice to the subscribers of stream and
+// unsubscribes them from it, keeping their other subscriptions. It returns
+// the number of subscribers drained.
+//
+// The subscribers are drained by ListenWebsocketEvents, the only goroutine
+// changing the subscriptions of the clients, it must be running.
+func (h *Hub) DrainStream(stream string) int {
+	done := make(chan int, 1)
+	h.drains <- drainRequest{stream: stream, done: done}
+	return <-done
+}
+
+// drainStream drains stream, see DrainStream, from the hub loop.
+func (h *Hub) drainStream(stream string) int {
+	notice, err := json.Marshal(deprecated{Event: "deprecated", Stream: stream})
+	if err != nil {
+		log.Panic().Msg(err.Error())
+	}
+
+	drained := 0
+	for _, client := range h.clientsOf(stream) {
+		reply(client, string(notice))
+		h.handleUnsubscribe(&Request{
+			client:  client,
+			Request: msg.Request{Method: "unsubscribe", Streams: []string{stream}},
+		})
+		drained++
+	}
+	return drained
+}
+
+// clientsOf returns the clients subscribed to stream.
+func (h *Hub) clientsOf(stream string) []IClient {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	clients := []IClient{}
+	for client := range h.clients {
+		if contains(client.GetSubscriptions(), stream) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
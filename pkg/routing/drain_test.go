@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestDrainStream(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"trader"}})
+
+	alice := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+	bob := &recorderClient{auth: Auth{UID: "UIDBOB00001", Role: "trader"}}
+	h.handleSubscribe(&Request{client: alice, Request: message.Request{Streams: []string{"eurusd.trades", "usdjpy.trades"}}})
+	h.handleSubscribe(&Request{client: bob, Request: message.Request{Streams: []string{"usdjpy.trades"}}})
+	h.register(alice)
+	h.register(bob)
+
+	assert.Equal(t, 1, h.drainStream("eurusd.trades"))
+	assert.Equal(t, []string{
+		subscribed(`"eurusd.trades","usdjpy.trades"`),
+		`{"event":"deprecated","stream":"eurusd.trades"}`,
+		`{"success":{"message":"unsubscribed","streams":["usdjpy.trades"]}}`,
+	}, alice.Messages())
+	assert.Equal(t, []string{"usdjpy.trades"}, alice.GetSubscriptions())
+	assert.NotContains(t, h.publicTopics(), "eurusd.trades")
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{"price":"150.0"}`)})
+	assert.Equal(t, `{"usdjpy.trades":{"price":"150.0"}}`, alice.Messages()[3])
+	assert.Len(t, alice.Messages(), 4)
+	assert.Equal(t, []string{subscribed(`"usdjpy.trades"`), `{"usdjpy.trades":{"price":"150.0"}}`}, bob.Messages())
+
+	t.Run("drains private and prefixed streams", func(t *testing.T) {
+		h.handleSubscribe(&Request{client: alice, Request: message.Request{Streams: []string{"order", "finex.eurusd.orders"}}})
+		h.handleSubscribe(&Request{client: bob, Request: message.Request{Streams: []string{"order"}}})
+
+		assert.Equal(t, 2, h.drainStream("order"))
+		assert.Equal(t, 1, h.drainStream("finex.eurusd.orders"))
+		assert.Equal(t, []string{"usdjpy.trades"}, alice.GetSubscriptions())
+		assert.Equal(t, []string{"usdjpy.trades"}, bob.GetSubscriptions())
+		assert.Empty(t, h.privateTopics())
+		assert.Empty(t, h.prefixedTopics())
+	})
+
+	assert.Zero(t, h.drainStream("unknown.stream"))
+}
+
+func TestDrainStreamWhileSubscribing(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MessagesPerSec = 0
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+	defer teardown()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["eurusd.trades"]}`)))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		hub.DrainStream("eurusd.trades")
+	}
+	<-done
+
+	assert.Eventually(t, func() bool {
+		return hub.DrainStream("eurusd.trades") == 0
+	}, time.Second, 10*time.Millisecond)
+}
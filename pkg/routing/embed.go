@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// HandlerOptions configure the websocket handler of the hub, see
+// WebsocketHandler.
+type HandlerOptions struct {
+	// Authenticate returns the user of the request, the error being the
+	// reason of the failure. Without Authenticate the user is read from the
+	// UIDHeader, RoleHeader and LevelHeader set by the caller, as cmd/rango
+	// does.
+	Authenticate func(r *http.Request) (Auth, error)
+
+	// MustAuthenticate refuses the requests failing Authenticate with 401
+	// instead of connecting them anonymously.
+	MustAuthenticate bool
+}
+
+// WebsocketHandler returns the handler upgrading requests to connections of
+// the hub, to embed the hub in another HTTP server. The hub must be started,
+// see Start.
+func (h *Hub) WebsocketHandler(opts HandlerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.Authenticate != nil && !h.authenticateRequest(w, r, opts) {
+			return
+		}
+		NewClient(h, w, r)
+	}
+}
+
+// authenticateRequest sets the headers read by NewClient from the user
+// returned by opts.Authenticate, dropping the ones set by the client. It
+// returns false if the request was refused.
+func (h *Hub) authenticateRequest(w http.ResponseWriter, r *http.Request, opts HandlerOptions) bool {
+	for _, header := range []string{h.options.UIDHeader, h.options.RoleHeader, h.options.LevelHeader, "JwtExp", "JwtError", "JwtPending"} {
+		r.Header.Del(header)
+	}
+
+	auth, err := opts.Authenticate(r)
+	switch {
+	case err != nil && opts.MustAuthenticate:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	case err != nil:
+		// The client is connected anonymously and told the reason.
+		r.Header.Set("JwtError", err.Error())
+		return true
+	}
+
+	r.Header.Set(h.options.UIDHeader, auth.UID)
+	r.Header.Set(h.options.RoleHeader, auth.Role)
+	r.Header.Set(h.options.LevelHeader, strconv.Itoa(auth.Level))
+	if !auth.ExpiresAt.IsZero() {
+		r.Header.Set("JwtExp", strconv.FormatInt(auth.ExpiresAt.Unix(), 10))
+	}
+	return true
+}
+
+// Publish routes msg to the subscribed clients as a message of the upstream
+// source, for embedders consuming the source themselves. Like Enqueue it
+// blocks while the inbound queue is full, unless HubOptions.InboundDrop is set.
+func (h *Hub) Publish(msg *Message) {
+	h.Enqueue(msg)
+}
+
+// Start runs the loops handling the requests of the clients and the upstream
+// messages in the background.
+func (h *Hub) Start() {
+	go h.ListenWebsocketEvents()
+	go h.ListenInbound()
+}
@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketHandler(t *testing.T) {
+	hub := NewHub(nil)
+	hub.Start()
+
+	// connected receives the user of the connections, as read by NewClient.
+	connected := make(chan Auth, 1)
+	handler := func(opts HandlerOptions) *httptest.Server {
+		handle := hub.WebsocketHandler(opts)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handle(w, r)
+			auth := hub.requestAuth(r)
+			auth.ExpiresAt = tokenExpiry(r)
+			connected <- auth
+		}))
+	}
+	authenticate := func(r *http.Request) (Auth, error) {
+		if r.Header.Get("X-Api-User") == "" {
+			return Auth{}, errors.New("missing_user")
+		}
+		return Auth{UID: r.Header.Get("X-Api-User"), Role: "member", Level: 2, ExpiresAt: time.Unix(4102444800, 0)}, nil
+	}
+	dial := func(t *testing.T, s *httptest.Server, header http.Header) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), header)
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		s := handler(HandlerOptions{Authenticate: authenticate, MustAuthenticate: true})
+		defer s.Close()
+
+		conn, _, err := dial(t, s, http.Header{"X-Api-User": {"UIDABC00001"}, "Jwtuid": {"UIDSPOOFED1"}})
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, Auth{UID: "UIDABC00001", Role: "member", Level: 2, ExpiresAt: time.Unix(4102444800, 0)}, <-connected)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		s := handler(HandlerOptions{Authenticate: authenticate, MustAuthenticate: true})
+		defer s.Close()
+
+		_, resp, err := dial(t, s, nil)
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		<-connected
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		s := handler(HandlerOptions{Authenticate: authenticate})
+		defer s.Close()
+
+		conn, _, err := dial(t, s, http.Header{"Jwtuid": {"UIDSPOOFED1"}})
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, Auth{}, <-connected)
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(msg), `"event":"hello"`)
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(msg), `"reason":"missing_user"`)
+	})
+}
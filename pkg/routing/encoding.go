@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encoding of the messages sent to a client, negotiated at connect time with
+// the encoding query parameter or a subprotocol.
+type encoding int
+
+const (
+	// encodingJSON sends JSON text frames, the default.
+	encodingJSON encoding = iota
+
+	// encodingMsgpack sends MessagePack binary frames.
+	encodingMsgpack
+
+	encodingsCount = 2
+)
+
+// Subprotocol negotiating encodingMsgpack, the format of the events being
+// requested with the query parameters.
+const msgpackSubprotocol = "msgpack"
+
+// subprotocol is the encoding and format of the events selected by a
+// websocket subprotocol.
+type subprotocol struct {
+	encoding encoding
+	protocol int
+	combined bool
+
+	// The format of the events is requested with the query parameters.
+	encodingOnly bool
+}
+
+// Subprotocols clients may request at connect time, named
+// rango.<encoding>.<format>, in place of the query parameters.
+var subprotocols = map[string]subprotocol{
+	"rango.json.v0":          {encoding: encodingJSON, protocol: protocolV0},
+	"rango.json.v1":          {encoding: encodingJSON, protocol: protocolV1},
+	"rango.json.combined":    {encoding: encodingJSON, protocol: protocolV0, combined: true},
+	"rango.msgpack.v0":       {encoding: encodingMsgpack, protocol: protocolV0},
+	"rango.msgpack.v1":       {encoding: encodingMsgpack, protocol: protocolV1},
+	"rango.msgpack.combined": {encoding: encodingMsgpack, protocol: protocolV0, combined: true},
+	msgpackSubprotocol:       {encoding: encodingMsgpack, encodingOnly: true},
+}
+
+// negotiateSubprotocol returns the first subprotocol offered by the client
+// that is supported, "" if none is.
+func negotiateSubprotocol(r *http.Request) string {
+	for _, name := range websocket.Subprotocols(r) {
+		if _, ok := subprotocols[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+var encodingNames = map[string]encoding{
+	"json":    encodingJSON,
+	"msgpack": encodingMsgpack,
+}
+
+// encodingClient is implemented by clients negotiating an encoding.
+type encodingClient interface {
+	Encoding() encoding
+}
+
+// encodingOf returns the encoding of the messages sent to the client.
+func encodingOf(c IClient) encoding {
+	if e, ok := c.(encodingClient); ok {
+		return e.Encoding()
+	}
+	return encodingJSON
+}
+
+// parseEncoding returns the encoding requested with the encoding query
+// parameter, encodingJSON if none.
+func parseEncoding(r *http.Request) (encoding, error) {
+	v := r.URL.Query().Get("encoding")
+	if v == "" {
+		return encodingJSON, nil
+	}
+
+	e, ok := encodingNames[v]
+	if !ok {
+		return encodingJSON, fmt.Errorf("unsupported encoding %s", v)
+	}
+	return e, nil
+}
+
+// marshal encodes v, MessagePack maps have sorted keys like JSON objects and
+// structs use their json tags.
+func (e encoding) marshal(v interface{}) ([]byte, error) {
+	if e != encodingMsgpack {
+		return json.Marshal(v)
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeFor returns the JSON message s, e.g. a response to a request, in the
+// encoding of the client. Messages that aren't JSON, like pong, are encoded
+// as strings.
+func encodeFor(c IClient, s string) string {
+	e := encodingOf(c)
+	if e == encodingJSON {
+		return s
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		v = s
+	}
+	b, err := e.marshal(v)
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// reply sends the JSON message s to the client in its encoding.
+func reply(c IClient, s string) bool {
+	return c.Send(encodeFor(c, s))
+}
@@ -0,0 +1,215 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// readMsgpack reads a binary frame and decodes it.
+func readMsgpack(t *testing.T, conn *websocket.Conn) interface{} {
+	typ, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, typ)
+
+	var v interface{}
+	require.NoError(t, msgpack.Unmarshal(msg, &v))
+	return v
+}
+
+func TestClientMsgpack(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+	url := "ws" + s.URL[len("http"):]
+
+	msgpackDialer := &websocket.Dialer{Subprotocols: []string{msgpackSubprotocol}}
+	for name, dial := range map[string]func() (*websocket.Conn, *http.Response, error){
+		"query parameter": func() (*websocket.Conn, *http.Response, error) {
+			return websocket.DefaultDialer.Dial(url+"/?stream=eurusd.trades&encoding=msgpack&protocol=1", nil)
+		},
+		"subprotocol": func() (*websocket.Conn, *http.Response, error) {
+			return msgpackDialer.Dial(url+"/?stream=eurusd.trades&protocol=1", nil)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, _, err := dial()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			assert.Equal(t, "hello", readMsgpack(t, conn).(map[string]interface{})["event"])
+			assert.Equal(t, map[string]interface{}{
+				"success": map[string]interface{}{
+					"message": "subscribed",
+					"streams": []interface{}{"eurusd.trades"},
+				},
+			}, readMsgpack(t, conn))
+
+			hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1","amount":2}`)})
+
+			// The sequence depends on the order of the subtests.
+			event := readMsgpack(t, conn).(map[string]interface{})
+			assert.NotNil(t, event["seq"])
+			delete(event, "seq")
+			assert.Equal(t, map[string]interface{}{
+				"stream": "eurusd.trades",
+				"type":   "trades",
+				"data":   map[string]interface{}{"price": "1.1", "amount": float64(2)},
+			}, event)
+
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+			assert.Equal(t, "pong", readMsgpack(t, conn))
+		})
+	}
+
+	t.Run("keeps JSON by default", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"/?stream=eurusd.trades", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		typ, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.TextMessage, typ)
+		assert.Contains(t, string(msg), `"event":"hello"`)
+
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, subscribed(`"eurusd.trades"`), string(msg))
+	})
+
+	t.Run("refuses unsupported encodings", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"/?encoding=xml", nil)
+		assert.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestClientSubprotocols(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+	url := "ws" + s.URL[len("http"):]
+
+	t.Run("selects the first supported protocol offered", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"rango.xml.v1", "rango.msgpack.v1", "rango.json.v1"}}
+		conn, _, err := dialer.Dial(url+"/?stream=eurusd.trades", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "rango.msgpack.v1", conn.Subprotocol())
+
+		assert.Equal(t, "hello", readMsgpack(t, conn).(map[string]interface{})["event"])
+		readMsgpack(t, conn)
+
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+		assert.Equal(t, map[string]interface{}{
+			"stream": "eurusd.trades",
+			"type":   "trades",
+			"data":   map[string]interface{}{"price": "1.1"},
+			"seq":    uint64(1),
+		}, readMsgpack(t, conn))
+	})
+
+	t.Run("overrides the query parameters", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"rango.json.v0"}}
+		conn, _, err := dialer.Dial(url+"/?stream=eurusd.trades&encoding=msgpack&protocol=1", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "rango.json.v0", conn.Subprotocol())
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(msg), `"event":"hello"`)
+		conn.ReadMessage()
+
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"eurusd.trades":{"price":"1.1"}}`, string(msg))
+	})
+
+	t.Run("falls back to JSON", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"rango.xml.v1"}}
+		conn, _, err := dialer.Dial(url+"/?stream=eurusd.trades", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "", conn.Subprotocol())
+
+		typ, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.TextMessage, typ)
+		assert.Contains(t, string(msg), `"event":"hello"`)
+	})
+}
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"rango.xml.v1"}, ""},
+		{[]string{"rango.json.v1", "rango.msgpack.v1"}, "rango.json.v1"},
+		{[]string{"rango.xml.v1", "rango.msgpack.combined"}, "rango.msgpack.combined"},
+		{[]string{msgpackSubprotocol}, msgpackSubprotocol},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Sec-Websocket-Protocol", strings.Join(tt.offered, ", "))
+		assert.Equal(t, tt.expected, negotiateSubprotocol(r), tt.offered)
+	}
+}
+
+func TestEnvelopesCache(t *testing.T) {
+	env, err := newEnvelopes(&Event{Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades", Body: []byte(`{"price":"1.1"}`)})
+	require.NoError(t, err)
+
+	json := &recorderClient{}
+	binary := &Client{encoding: encodingMsgpack}
+	first := env.of(binary)
+	assert.Equal(t, `{"eurusd.trades":{"price":"1.1"}}`, env.of(json))
+
+	var v interface{}
+	require.NoError(t, msgpack.Unmarshal([]byte(first), &v))
+	assert.Equal(t, map[string]interface{}{"eurusd.trades": map[string]interface{}{"price": "1.1"}}, v)
+
+	// The encoded message is shared by the clients of the same encoding.
+	env.event.Body = []byte(`{"price":"2.2"}`)
+	assert.Equal(t, first, env.of(&Client{encoding: encodingMsgpack}))
+}
+
+func BenchmarkEnvelope(b *testing.B) {
+	e := &Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   "trades",
+		Topic:  "eurusd.trades",
+		Body:   []byte(`{"trades":[{"tid":1,"taker_type":"buy","date":1588000798,"price":"1.0825","amount":"0.5"}]}`),
+	}
+
+	for name, enc := range map[string]encoding{"json": encodingJSON, "msgpack": encodingMsgpack} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := envelope(protocolV1, enc, e); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
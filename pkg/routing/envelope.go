@@ -0,0 +1,180 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Protocol versions of the events sent to clients, requested with the
+// protocol query parameter at connect time. Responses to requests, like
+// subscription acknowledgements and errors, are the same in every version.
+const (
+	// protocolV0, the default, sends events as {"<name>":<payload>}, name
+	// being the stream and type of public events, e.g. eurusd.trades, and the
+	// type of private events, e.g. order. Snapshots keep their own type, e.g.
+	// eurusd.ob-snap, and prefixed events omit their prefix.
+	protocolV0 = 0
+
+	// protocolV1 sends events as
+	//
+	//	{"stream":"eurusd.ob-inc","type":"ob-snap","data":<payload>,"snapshot":true,"seq":42}
+	//
+	// stream being the stream subscribed to, e.g. eurusd.trades, order or
+	// finex.eurusd.orders, type the event type and data the payload as
+	// published. snapshot is only set for snapshots. seq is the sequence of
+	// the event in its stream, increasing by one with each event so that
+	// clients can detect the events they missed, e.g. to resubscribe.
+	protocolV1 = 1
+
+	latestProtocol = protocolV1
+)
+
+// Formats of the events sent to clients, the protocol versions and
+// combinedV0, for clients connected with combined=true.
+const (
+	// combinedV0 wraps the payload of protocolV0 events as
+	//
+	//	{"stream":"eurusd.trades","data":<payload>,"seq":42}
+	//
+	// so clients can demultiplex the events by stream. protocolV1 events
+	// already carry their stream and are sent as is to combined clients.
+	combinedV0 = latestProtocol + 1
+
+	formatsCount = combinedV0 + 1
+)
+
+// protocolClient is implemented by clients requesting a protocol version.
+type protocolClient interface {
+	Protocol() int
+}
+
+// protocolOf returns the protocol version of the client.
+func protocolOf(c IClient) int {
+	if p, ok := c.(protocolClient); ok {
+		return p.Protocol()
+	}
+	return protocolV0
+}
+
+// combinedClient is implemented by clients requesting combined stream messages.
+type combinedClient interface {
+	Combined() bool
+}
+
+// formatOf returns the format of the events sent to the client.
+func formatOf(c IClient) int {
+	version := protocolOf(c)
+	if cc, ok := c.(combinedClient); ok && cc.Combined() && version == protocolV0 {
+		return combinedV0
+	}
+	return version
+}
+
+// parseCombined returns true if combined stream messages are requested with
+// the combined query parameter.
+func parseCombined(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("combined")
+	if v == "" {
+		return false, nil
+	}
+
+	combined, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid combined %s", v)
+	}
+	return combined, nil
+}
+
+// parseProtocol returns the protocol version requested with the protocol
+// query parameter, protocolV0 if none.
+func parseProtocol(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("protocol")
+	if v == "" {
+		return protocolV0, nil
+	}
+
+	p, err := strconv.Atoi(v)
+	if err != nil || p < protocolV0 || p > latestProtocol {
+		return 0, fmt.Errorf("unsupported protocol %s", v)
+	}
+	return p, nil
+}
+
+// envelopeV1 is an event of protocolV1.
+type envelopeV1 struct {
+	Stream   string      `json:"stream"`
+	Type     string      `json:"type"`
+	Data     interface{} `json:"data"`
+	Snapshot bool        `json:"snapshot,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+}
+
+// envelopeCombined is an event of combinedV0.
+type envelopeCombined struct {
+	Stream string      `json:"stream"`
+	Data   interface{} `json:"data"`
+	Seq    uint64      `json:"seq,omitempty"`
+}
+
+// envelope returns the message sent for the event to clients of the format,
+// a protocol version or combinedV0, and encoding, every format is built here.
+func envelope(format int, enc encoding, e *Event) ([]byte, error) {
+	var body interface{}
+	if err := json.Unmarshal(e.Body, &body); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case combinedV0:
+		return enc.marshal(envelopeCombined{
+			Stream: e.stream(),
+			Data:   body,
+			Seq:    e.Seq,
+		})
+	case protocolV1:
+		return enc.marshal(envelopeV1{
+			Stream:   e.stream(),
+			Type:     e.Type,
+			Data:     body,
+			Snapshot: e.Snapshot,
+			Seq:      e.Seq,
+		})
+	default:
+		return enc.marshal(map[string]interface{}{
+			e.name(): body,
+		})
+	}
+}
+
+// envelopes builds the messages of an event once per format and encoding, as
+// needed by the clients it is sent to.
+type envelopes struct {
+	event  *Event
+	bodies [formatsCount][encodingsCount]string
+}
+
+// newEnvelopes returns the envelopes of the event, it fails if the event
+// payload isn't valid JSON.
+func newEnvelopes(e *Event) (*envelopes, error) {
+	body, err := envelope(protocolV0, encodingJSON, e)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &envelopes{event: e}
+	env.bodies[protocolV0][encodingJSON] = string(body)
+	return env, nil
+}
+
+// of returns the message for the client.
+func (env *envelopes) of(c IClient) string {
+	format, enc := formatOf(c), encodingOf(c)
+	if env.bodies[format][enc] == "" {
+		// The payload is valid JSON, checked by newEnvelopes.
+		body, _ := envelope(format, enc, env.event)
+		env.bodies[format][enc] = string(body)
+	}
+	return env.bodies[format][enc]
+}
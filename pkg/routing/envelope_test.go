@@ -0,0 +1,287 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// protocolRecorder is a recorderClient requesting a protocol version.
+type protocolRecorder struct {
+	recorderClient
+	protocol int
+}
+
+func (c *protocolRecorder) Protocol() int { return c.protocol }
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		stream string
+		key    string
+		v0     string
+		v1     string
+	}{
+		{
+			"eurusd.trades",
+			"public.eurusd.trades",
+			`{"eurusd.trades":{"price":"1.1"}}`,
+			`{"stream":"eurusd.trades","type":"trades","data":{"price":"1.1"},"seq":1}`,
+		},
+		{
+			"eurusd.ob-inc",
+			"public.eurusd.ob-snap",
+			`{"eurusd.ob-snap":{"price":"1.1"}}`,
+			`{"stream":"eurusd.ob-inc","type":"ob-snap","data":{"price":"1.1"},"snapshot":true,"seq":1}`,
+		},
+		{
+			"order",
+			"private.UIDABC00001.order",
+			`{"order":{"price":"1.1"}}`,
+			`{"stream":"order","type":"order","data":{"price":"1.1"},"seq":1}`,
+		},
+		{
+			"global.tickers",
+			"global.global.tickers",
+			`{"global.tickers":{"price":"1.1"}}`,
+			`{"stream":"global.tickers","type":"tickers","data":{"price":"1.1"},"seq":1}`,
+		},
+		{
+			"finex.eurusd.orders",
+			"finex.eurusd.orders",
+			`{"eurusd.orders":{"price":"1.1"}}`,
+			`{"stream":"finex.eurusd.orders","type":"orders","data":{"price":"1.1"},"seq":1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			h := NewHub(map[string][]string{"finex": {"member"}})
+			auth := Auth{UID: "UIDABC00001", Role: "member"}
+			v0 := &protocolRecorder{recorderClient{auth: auth}, protocolV0}
+			v1 := &protocolRecorder{recorderClient{auth: auth}, protocolV1}
+			for _, c := range []IClient{v0, v1} {
+				h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{tt.stream}}})
+			}
+
+			h.ReceiveMsg(&Message{Key: []byte(tt.key), Value: []byte(`{"price": "1.1"}`)})
+
+			require.Len(t, v0.Messages(), 2)
+			require.Len(t, v1.Messages(), 2)
+			assert.Equal(t, tt.v0, v0.Messages()[1])
+			assert.Equal(t, tt.v1, v1.Messages()[1])
+		})
+	}
+
+	t.Run("replays snapshots in the client version", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.SnapshotSuffixes = []string{"ob-inc"}
+		h := NewHub(nil, opts)
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"seq":1}`)})
+
+		c := &protocolRecorder{protocol: protocolV1}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.ob-inc"}}})
+		assert.Equal(t, `{"stream":"eurusd.ob-inc","type":"ob-snap","data":{"seq":1},"snapshot":true,"seq":1}`, c.Messages()[1])
+	})
+
+	t.Run("fails on invalid payloads", func(t *testing.T) {
+		_, err := newEnvelopes(&Event{Topic: "eurusd.trades", Body: []byte(`{`)})
+		assert.Error(t, err)
+	})
+}
+
+func TestParseProtocol(t *testing.T) {
+	for uri, version := range map[string]int{"/": protocolV0, "/?protocol=0": protocolV0, "/?protocol=1": protocolV1} {
+		p, err := parseProtocol(httptest.NewRequest(http.MethodGet, uri, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, version, p)
+	}
+
+	for _, uri := range []string{"/?protocol=2", "/?protocol=-1", "/?protocol=v1"} {
+		_, err := parseProtocol(httptest.NewRequest(http.MethodGet, uri, nil))
+		assert.Error(t, err)
+	}
+}
+
+func TestClientProtocol(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/?stream=eurusd.trades&protocol=1")
+	defer teardown()
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"stream":"eurusd.trades","type":"trades","data":{"price":"1.1"},"seq":1}`, string(msg))
+
+	t.Run("refuses unsupported versions", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			NewClient(hub, w, r)
+		}))
+		defer s.Close()
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+s.URL[len("http"):]+"/?protocol=9", nil)
+		assert.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+// combinedRecorder is a protocolRecorder requesting combined stream messages.
+type combinedRecorder struct {
+	protocolRecorder
+}
+
+func (c *combinedRecorder) Combined() bool { return true }
+
+func TestEnvelopeCombined(t *testing.T) {
+	tests := map[string]struct {
+		stream   string
+		key      string
+		bare     string
+		combined string
+	}{
+		"public": {
+			"eurusd.trades",
+			"public.eurusd.trades",
+			`{"eurusd.trades":{"price":"1.1"}}`,
+			`{"stream":"eurusd.trades","data":{"price":"1.1"},"seq":1}`,
+		},
+		"private": {
+			"order",
+			"private.UIDABC00001.order",
+			`{"order":{"price":"1.1"}}`,
+			`{"stream":"order","data":{"price":"1.1"},"seq":1}`,
+		},
+		"prefixed": {
+			"finex.eurusd.orders",
+			"finex.eurusd.orders",
+			`{"eurusd.orders":{"price":"1.1"}}`,
+			`{"stream":"finex.eurusd.orders","data":{"price":"1.1"},"seq":1}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := NewHub(map[string][]string{"finex": {"member"}})
+			auth := Auth{UID: "UIDABC00001", Role: "member"}
+			bare := &protocolRecorder{recorderClient{auth: auth}, protocolV0}
+			combined := &combinedRecorder{protocolRecorder{recorderClient{auth: auth}, protocolV0}}
+			for _, c := range []IClient{bare, combined} {
+				h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{tt.stream}}})
+			}
+
+			h.ReceiveMsg(&Message{Key: []byte(tt.key), Value: []byte(`{"price": "1.1"}`)})
+
+			require.Len(t, bare.Messages(), 2)
+			require.Len(t, combined.Messages(), 2)
+			assert.Equal(t, tt.bare, bare.Messages()[1])
+			assert.Equal(t, tt.combined, combined.Messages()[1])
+		})
+	}
+
+	t.Run("keeps protocol v1 events", func(t *testing.T) {
+		c := &combinedRecorder{protocolRecorder{protocol: protocolV1}}
+		assert.Equal(t, protocolV1, formatOf(c))
+	})
+}
+
+func TestParseCombined(t *testing.T) {
+	for uri, combined := range map[string]bool{"/": false, "/?combined=false": false, "/?combined=true": true, "/?combined=1": true} {
+		c, err := parseCombined(httptest.NewRequest(http.MethodGet, uri, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, combined, c, uri)
+	}
+
+	_, err := parseCombined(httptest.NewRequest(http.MethodGet, "/?combined=yes", nil))
+	assert.Error(t, err)
+}
+
+func TestEnvelopeSequence(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"member"}})
+	auth := Auth{UID: "UIDABC00001", Role: "member"}
+	streams := []string{"eurusd.trades", "usdjpy.trades", "order", "finex.eurusd.orders"}
+	clients := []*protocolRecorder{
+		{recorderClient{auth: auth}, protocolV1},
+		{recorderClient{auth: auth}, protocolV1},
+	}
+	for _, c := range clients {
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"public.eurusd.trades", "public.usdjpy.trades", "private.UIDABC00001.order", "finex.eurusd.orders"} {
+			h.ReceiveMsg(&Message{Key: []byte(key), Value: []byte(`{}`)})
+		}
+	}
+
+	for _, c := range clients {
+		seqs := map[string][]uint64{}
+		for _, m := range c.Messages()[1:] {
+			var e struct {
+				Stream string `json:"stream"`
+				Seq    uint64 `json:"seq"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(m), &e))
+			seqs[e.Stream] = append(seqs[e.Stream], e.Seq)
+		}
+
+		assert.Equal(t, map[string][]uint64{
+			"eurusd.trades":       {1, 2, 3},
+			"usdjpy.trades":       {1, 2, 3},
+			"order":               {1, 2, 3},
+			"finex.eurusd.orders": {1, 2, 3},
+		}, seqs)
+	}
+}
+
+func TestClientCombined(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/?stream=eurusd.trades&stream=usdjpy.trades&combined=true")
+	defer teardown()
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+	hub.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{"price":"150.1"}`)})
+
+	for _, expected := range []string{
+		`{"stream":"eurusd.trades","data":{"price":"1.1"},"seq":1}`,
+		`{"stream":"usdjpy.trades","data":{"price":"150.1"},"seq":1}`,
+	} {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+}
+
+func BenchmarkBroadcastSubscribers(b *testing.B) {
+	h := NewHub(nil)
+	topic := NewTopic(h)
+	clients := make([]*Client, 10000)
+	for i := range clients {
+		clients[i] = &Client{send: make(chan string, 1)}
+		topic.subscribe(clients[i])
+	}
+	msg := &Event{Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades", Body: []byte(`{"price":"1.0825","amount":"0.5"}`)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic.broadcast(msg)
+
+		b.StopTimer()
+		for _, c := range clients {
+			<-c.send
+		}
+		b.StartTimer()
+	}
+}
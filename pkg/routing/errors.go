@@ -0,0 +1,71 @@
+package routing
+
+// errorCode identifies the errors reported to clients in error events, e.g.
+// {"error":{"code":4003,"name":"rate_limited","message":"rate limit exceeded"}},
+// and as the close code of the connections closed for them. Codes and names
+// are stable, messages are meant for humans and may change.
+//
+//	4001 unauthorized          the token or API key was refused
+//	4002 restricted_stream     the stream isn't permitted to the user
+//	4003 rate_limited          too many messages were sent
+//	4004 invalid_message       the message isn't a valid JSON request
+//	4005 invalid_request       the request event or its fields are invalid
+//	4006 subscriptions_limit   too many streams are subscribed
+//	4007 invalid_filter        the filter of the stream is invalid
+//	4008 unknown_session       the session to resume is unknown or expired
+//	4009 token_expired         the token expired without re-authentication
+//	4010 too_many_connections  the user holds too many connections
+//	4011 no_subscription       the connection stayed without subscriptions
+//	4012 cursor_evicted        messages since from_seq were evicted from the history
+//	4013 reconnect             the connection reached its lifetime, reconnect
+type errorCode int
+
+const (
+	codeUnauthorized       errorCode = 4001
+	codeRestrictedStream   errorCode = 4002
+	codeRateLimited        errorCode = 4003
+	codeInvalidMessage     errorCode = 4004
+	codeInvalidRequest     errorCode = 4005
+	codeSubscriptionsLimit errorCode = 4006
+	codeInvalidFilter      errorCode = 4007
+	codeUnknownSession     errorCode = 4008
+	codeTokenExpired       errorCode = 4009
+	codeTooManyConnections errorCode = 4010
+	codeNoSubscription     errorCode = 4011
+	codeCursorEvicted      errorCode = 4012
+	codeReconnect          errorCode = 4013
+)
+
+var errorNames = map[errorCode]string{
+	codeUnauthorized:       "unauthorized",
+	codeRestrictedStream:   "restricted_stream",
+	codeRateLimited:        "rate_limited",
+	codeInvalidMessage:     "invalid_message",
+	codeInvalidRequest:     "invalid_request",
+	codeSubscriptionsLimit: "subscriptions_limit",
+	codeInvalidFilter:      "invalid_filter",
+	codeUnknownSession:     "unknown_session",
+	codeTokenExpired:       "token_expired",
+	codeTooManyConnections: "too_many_connections",
+	codeNoSubscription:     "no_subscription",
+	codeCursorEvicted:      "cursor_evicted",
+	codeReconnect:          "reconnect",
+}
+
+func (c errorCode) String() string {
+	return errorNames[c]
+}
+
+// errorEvent returns the error event of code with its message and the fields
+// detailing it, e.g. the stream refused.
+func errorEvent(code errorCode, message string, fields map[string]interface{}) string {
+	e := map[string]interface{}{
+		"code":    int(code),
+		"name":    code.String(),
+		"message": message,
+	}
+	for k, v := range fields {
+		e[k] = v
+	}
+	return string(eventMust("error", e))
+}
@@ -0,0 +1,29 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodes(t *testing.T) {
+	names := map[string]errorCode{}
+	for code := codeUnauthorized; code <= codeReconnect; code++ {
+		name := code.String()
+		assert.NotEmpty(t, name, "code %d has no name", code)
+		assert.NotContains(t, names, name, "name %s is shared by codes %d and %d", name, names[name], code)
+		names[name] = code
+	}
+	assert.Len(t, errorNames, len(names))
+}
+
+func TestErrorEvent(t *testing.T) {
+	assert.Equal(t,
+		`{"error":{"code":4003,"message":"rate limit exceeded","name":"rate_limited"}}`,
+		errorEvent(codeRateLimited, "rate limit exceeded", nil),
+	)
+	assert.Equal(t,
+		`{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"admin.eurusd.events"}}`,
+		errorEvent(codeRestrictedStream, "restricted", map[string]interface{}{"stream": "admin.eurusd.events"}),
+	)
+}
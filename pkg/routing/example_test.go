@@ -0,0 +1,59 @@
+package routing_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// The hub embedded in another service, authenticating the connections with a
+// header and fed by its own consumer.
+func Example() {
+	hub := routing.NewHub(nil)
+	hub.Start()
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", hub.WebsocketHandler(routing.HandlerOptions{
+		Authenticate: func(r *http.Request) (routing.Auth, error) {
+			if r.Header.Get("X-Api-User") == "" {
+				return routing.Auth{}, fmt.Errorf("missing_user")
+			}
+			return routing.Auth{UID: r.Header.Get("X-Api-User"), Role: "member"}, nil
+		},
+		MustAuthenticate: true,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?stream=eurusd.trades,balance"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Api-User": {"UIDABC00001"}})
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	read := func() string {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			panic(err)
+		}
+		return string(msg)
+	}
+	read() // hello
+	fmt.Println(read())
+
+	hub.Publish(&routing.Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+	fmt.Println(read())
+	hub.Publish(&routing.Message{Key: []byte("private.UIDABC00001.balance"), Value: []byte(`{"eur":"1"}`)})
+	fmt.Println(read())
+
+	// Output:
+	// {"success":{"message":"subscribed","streams":["eurusd.trades","balance"]}}
+	// {"eurusd.trades":{"price":"1.1"}}
+	// {"balance":{"eur":"1"}}
+}
@@ -0,0 +1,146 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// condition compares a top level field of message payloads to a value.
+type condition struct {
+	field string
+	op    string
+	value interface{}
+
+	// Value of numbers and numeric strings, numeric is false for others.
+	number  float64
+	numeric bool
+}
+
+// filter selects the messages of a stream sent to a client, messages must
+// match every condition.
+type filter []condition
+
+// parseFilter parses a filter object mapping payload fields to a value they
+// must equal, or to operators, e.g. {"side":"buy","amount":{"gte":"1"}}.
+// Operators are eq, ne and the numeric gt, gte, lt and lte, comparing numbers
+// or numeric strings, at most max conditions are allowed. It returns nil
+// without filter.
+func parseFilter(raw json.RawMessage, max int) (filter, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, errors.New("filter must be an object")
+	}
+
+	f := filter{}
+	for field, v := range fields {
+		ops, ok := v.(map[string]interface{})
+		if !ok {
+			ops = map[string]interface{}{"eq": v}
+		}
+
+		for op, value := range ops {
+			switch value.(type) {
+			case string, float64, bool:
+			default:
+				return nil, fmt.Errorf("invalid value of %s", field)
+			}
+
+			number, numeric := toNumber(value)
+			switch op {
+			case "eq", "ne":
+			case "gt", "gte", "lt", "lte":
+				if !numeric {
+					return nil, fmt.Errorf("%s of %s must be a number", op, field)
+				}
+			default:
+				return nil, fmt.Errorf("unknown operator %s", op)
+			}
+			f = append(f, condition{field: field, op: op, value: value, number: number, numeric: numeric})
+		}
+	}
+
+	if len(f) > max {
+		return nil, fmt.Errorf("more than %d conditions", max)
+	}
+	if len(f) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// decodeFields returns the top level fields of a message payload, nil if it
+// isn't an object.
+func decodeFields(body []byte) map[string]interface{} {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// match returns true if the payload fields match every condition.
+func (f filter) match(fields map[string]interface{}) bool {
+	for _, c := range f {
+		v, ok := fields[c.field]
+		if !ok || !c.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) match(v interface{}) bool {
+	switch c.op {
+	case "eq":
+		return c.equal(v)
+	case "ne":
+		return !c.equal(v)
+	}
+
+	a, ok := toNumber(v)
+	if !ok {
+		return false
+	}
+	b := c.number
+
+	switch c.op {
+	case "gt":
+		return a > b
+	case "gte":
+		return a >= b
+	case "lt":
+		return a < b
+	default:
+		return a <= b
+	}
+}
+
+// equal compares numbers and numeric strings by value, other values strictly.
+func (c condition) equal(v interface{}) bool {
+	if c.numeric {
+		if n, ok := toNumber(v); ok {
+			return n == c.number
+		}
+	}
+	return v == c.value
+}
+
+// toNumber returns the value of numbers and numeric strings, decimals being
+// sent as strings.
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
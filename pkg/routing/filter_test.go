@@ -0,0 +1,137 @@
+package routing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := parseFilter(nil, 8)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = parseFilter(json.RawMessage(`{"side":"buy","amount":{"gte":"1","lt":100}}`), 8)
+	assert.NoError(t, err)
+	assert.Len(t, f, 3)
+
+	for raw, msg := range map[string]string{
+		`["side"]`:                  "filter must be an object",
+		`{"side":{"like":"b"}}`:     "unknown operator like",
+		`{"amount":{"gt":"many"}}`:  "gt of amount must be a number",
+		`{"side":{"eq":["buy"]}}`:   "invalid value of side",
+		`{"a":1,"b":2,"c":3,"d":4}`: "more than 3 conditions",
+	} {
+		t.Run(raw, func(t *testing.T) {
+			_, err := parseFilter(json.RawMessage(raw), 3)
+			assert.EqualError(t, err, msg)
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter  string
+		payload string
+		match   bool
+	}{
+		{`{"side":"buy"}`, `{"side":"buy"}`, true},
+		{`{"side":"buy"}`, `{"side":"sell"}`, false},
+		{`{"side":"buy"}`, `{"price":"1"}`, false},
+		{`{"side":{"ne":"buy"}}`, `{"side":"sell"}`, true},
+		{`{"price":"1.10"}`, `{"price":1.1}`, true},
+		{`{"maker":true}`, `{"maker":true}`, true},
+		{`{"amount":{"gte":"1"}}`, `{"amount":"1.0"}`, true},
+		{`{"amount":{"gt":1}}`, `{"amount":"1.0"}`, false},
+		{`{"amount":{"gt":"1","lte":"10"}}`, `{"amount":"10"}`, true},
+		{`{"amount":{"lt":10}}`, `{"amount":"ten"}`, false},
+		{`{"side":"buy","amount":{"gte":5}}`, `{"side":"buy","amount":4}`, false},
+		{`{"side":"buy"}`, `[{"side":"buy"}]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.payload, func(t *testing.T) {
+			f, err := parseFilter(json.RawMessage(tt.filter), 8)
+			require.NoError(t, err)
+			assert.Equal(t, tt.match, f.match(decodeFields([]byte(tt.payload))))
+		})
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	h := NewHub(nil)
+	all := &recorderClient{}
+	large := &recorderClient{}
+	h.handleSubscribe(&Request{client: all, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	h.handleSubscribe(&Request{client: large, Request: message.Request{
+		Streams: []string{"eurusd.trades", "eurusd.*"},
+		Filters: map[string]json.RawMessage{
+			"eurusd.trades": json.RawMessage(`{"amount":{"gte":"10"}}`),
+			"eurusd.*":      json.RawMessage(`{"side":"sell"}`),
+		},
+	}})
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"side":"buy","amount":"1"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"side":"buy","amount":"20"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"side":"buy"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"side":"sell"}`)})
+
+	assert.Len(t, all.Messages(), 3)
+	assert.Equal(t, []string{
+		`{"eurusd.trades":{"amount":"20","side":"buy"}}`,
+		`{"eurusd.ob-inc":{"side":"sell"}}`,
+	}, large.Messages()[1:])
+
+	t.Run("rejects invalid filters", func(t *testing.T) {
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{
+			Streams: []string{"eurusd.trades"},
+			Filters: map[string]json.RawMessage{"eurusd.trades": json.RawMessage(`{"amount":{"gt":"x"}}`)},
+		}})
+		assert.Equal(t, `{"error":{"code":4007,"message":"invalid filter: gt of amount must be a number","name":"invalid_filter","stream":"eurusd.trades"}}`, c.Messages()[0])
+		assert.Len(t, h.publicTopics()["eurusd.trades"].clients, 2)
+	})
+
+	t.Run("removes the filter when subscribing again without", func(t *testing.T) {
+		h.handleSubscribe(&Request{client: large, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"side":"buy","amount":"1"}`)})
+		assert.Equal(t, `{"eurusd.trades":{"amount":"1","side":"buy"}}`, large.Messages()[len(large.Messages())-1])
+	})
+}
+
+// benchClient is a distinct nopClient, pointers to zero sized values may be equal.
+type benchClient struct {
+	nopClient
+	id int
+}
+
+func benchmarkTopicBroadcast(b *testing.B, raw json.RawMessage) {
+	h := NewHub(nil)
+	f, err := parseFilter(raw, 8)
+	require.NoError(b, err)
+
+	topic := NewTopic(h)
+	for i := 0; i < 1000; i++ {
+		c := &benchClient{id: i}
+		topic.subscribe(c)
+		topic.setFilter(c, f)
+	}
+	msg := &Event{Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades", Body: []byte(`{"side":"buy","amount":"20"}`)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic.broadcast(msg)
+	}
+}
+
+func BenchmarkTopicBroadcast(b *testing.B) {
+	for name, raw := range map[string]json.RawMessage{
+		"no filter": nil,
+		"filter":    json.RawMessage(`{"side":"buy","amount":{"gte":"10"}}`),
+	} {
+		b.Run(name, func(b *testing.B) { benchmarkTopicBroadcast(b, raw) })
+	}
+}
@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hello is the first message sent to websocket clients, describing the
+// connection and the server so that clients can adapt to optional features.
+type hello struct {
+	Event        string   `json:"event"`
+	ConnectionID string   `json:"connection_id"`
+	Session      string   `json:"session"`
+	Version      string   `json:"version"`
+	Protocol     int      `json:"protocol"`
+	ServerTime   int64    `json:"server_time"`
+	Features     []string `json:"features"`
+}
+
+// buildVersion returns the version of the main module from the build info,
+// "dev" when unknown.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return info.Main.Version
+}
+
+// features returns the optional features enabled on the hub.
+func (h *Hub) features() []string {
+	opts := h.Options()
+	features := []string{"combined", "conflate", "filters", "msgpack", "rpc"}
+	if opts.CompressionLevel != 0 {
+		features = append(features, "compression")
+	}
+	if opts.Coalesce {
+		features = append(features, "coalesce")
+	}
+	if len(h.options.SnapshotSuffixes) != 0 {
+		features = append(features, "snapshots")
+	}
+	if opts.HistoryDepth > 0 {
+		features = append(features, "history")
+	}
+	return features
+}
+
+// hello returns the hello message of the client, server_time being in unix
+// milliseconds.
+func (c *Client) hello() string {
+	b, err := json.Marshal(hello{
+		Event:        "hello",
+		ConnectionID: c.id,
+		Session:      c.session,
+		Version:      c.hub.options.Version,
+		Protocol:     c.protocol,
+		ServerTime:   time.Now().UnixNano() / int64(time.Millisecond),
+		Features:     c.hub.features(),
+	})
+	if err != nil {
+		log.Panic().Msg(err.Error())
+	}
+	return encodeFor(c, string(b))
+}
@@ -0,0 +1,53 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientHello(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.Version = "3.0.0"
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(hub, w, r)
+	}))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?stream=eurusd.trades&protocol=1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var msg hello
+	require.NoError(t, conn.ReadJSON(&msg), "the hello message is the first frame")
+	assert.Equal(t, "hello", msg.Event)
+	assert.NotEmpty(t, msg.ConnectionID)
+	assert.Equal(t, "3.0.0", msg.Version)
+	assert.Equal(t, protocolV1, msg.Protocol)
+	assert.WithinDuration(t, time.Now(), time.Unix(0, msg.ServerTime*int64(time.Millisecond)), time.Minute)
+	assert.Equal(t, hub.features(), msg.Features)
+
+	_, subscribed, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(subscribed), `"message":"subscribed"`)
+}
+
+func TestHubFeatures(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.CompressionLevel, opts.Coalesce, opts.HistoryDepth = 0, false, 0
+	assert.Equal(t, []string{"combined", "conflate", "filters", "msgpack", "rpc"}, NewHub(nil, opts).features())
+
+	opts.CompressionLevel, opts.Coalesce, opts.HistoryDepth = 1, true, 100
+	opts.SnapshotSuffixes = []string{"ob-inc"}
+	hub := NewHub(nil, opts)
+	assert.Equal(t, []string{"combined", "conflate", "filters", "msgpack", "rpc", "compression", "coalesce", "snapshots", "history"}, hub.features())
+}
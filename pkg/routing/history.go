@@ -0,0 +1,93 @@
+package routing
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// history is a ring buffer of the last messages of a stream, indexed by their
+// sequence in the stream.
+type history struct {
+	// Sequence of the last message, the first message being 1.
+	seq     uint64
+	entries []*envelopes
+}
+
+func newHistory(depth int) *history {
+	return &history{entries: make([]*envelopes, depth)}
+}
+
+// add retains the numbered event, evicting the oldest message when full.
+func (hi *history) add(msg *Event) {
+	hi.seq = msg.Seq
+
+	body, err := newEnvelopes(msg)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		body = nil
+	}
+	hi.entries[hi.index(hi.seq)] = body
+}
+
+func (hi *history) index(seq uint64) uint64 {
+	return (seq - 1) % uint64(len(hi.entries))
+}
+
+// first returns the sequence of the oldest message retained.
+func (hi *history) first() uint64 {
+	if depth := uint64(len(hi.entries)); hi.seq > depth {
+		return hi.seq - depth + 1
+	}
+	return 1
+}
+
+// since returns the messages retained from seq on, from the oldest one if seq
+// was evicted.
+func (hi *history) since(seq uint64) []*envelopes {
+	if seq < hi.first() {
+		seq = hi.first()
+	}
+
+	bodies := []*envelopes{}
+	for ; seq <= hi.seq; seq++ {
+		if body := hi.entries[hi.index(seq)]; body != nil {
+			bodies = append(bodies, body)
+		}
+	}
+	return bodies
+}
+
+// record retains the numbered message of a public or prefixed stream in the
+// history of the stream. The shard of the stream must be locked.
+func (s *shard) record(msg *Event) {
+	if s.historyDepth <= 0 {
+		return
+	}
+
+	stream := msg.stream()
+	hi, ok := s.histories[stream]
+	if !ok {
+		hi = newHistory(s.historyDepth)
+		s.histories[stream] = hi
+	}
+	hi.add(msg)
+}
+
+// replayHistory sends the messages of stream retained from seq on to client,
+// preceded by an error event reporting the first message retained if some of
+// them were already evicted. The shard of the stream must be locked.
+func (s *shard) replayHistory(stream string, seq uint64, client IClient) {
+	hi, ok := s.histories[stream]
+	if !ok {
+		return
+	}
+
+	if first := hi.first(); seq < first && first > 1 {
+		reply(client, errorEvent(codeCursorEvicted, "messages evicted from the history", map[string]interface{}{
+			"stream":    stream,
+			"first_seq": first,
+		}))
+	}
+	for _, body := range hi.since(seq) {
+		send(client, stream, body.of(client))
+	}
+}
@@ -0,0 +1,91 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestHistory(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.HistoryDepth = 3
+
+	seq := func(n uint64) *uint64 { return &n }
+	receive := func(h *Hub, n int) {
+		for i := 1; i <= n; i++ {
+			h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(fmt.Sprintf(`{"id":%d}`, i))})
+		}
+	}
+
+	t.Run("catches up from the cursor before live messages", func(t *testing.T) {
+		h := NewHub(nil, opts)
+		receive(h, 3)
+
+		c := &protocolRecorder{protocol: protocolV1}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}, FromSeq: seq(2)}})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"id":4}`)})
+
+		assert.Equal(t, []string{
+			subscribed(`"eurusd.trades"`),
+			`{"stream":"eurusd.trades","type":"trades","data":{"id":2},"seq":2}`,
+			`{"stream":"eurusd.trades","type":"trades","data":{"id":3},"seq":3}`,
+			`{"stream":"eurusd.trades","type":"trades","data":{"id":4},"seq":4}`,
+		}, c.Messages())
+	})
+
+	t.Run("reports a cursor already evicted", func(t *testing.T) {
+		h := NewHub(nil, opts)
+		receive(h, 5)
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}, FromSeq: seq(1)}})
+
+		assert.Equal(t, []string{
+			subscribed(`"eurusd.trades"`),
+			`{"error":{"code":4012,"first_seq":3,"message":"messages evicted from the history","name":"cursor_evicted","stream":"eurusd.trades"}}`,
+			`{"eurusd.trades":{"id":3}}`,
+			`{"eurusd.trades":{"id":4}}`,
+			`{"eurusd.trades":{"id":5}}`,
+		}, c.Messages())
+	})
+
+	t.Run("replays nothing without cursor", func(t *testing.T) {
+		h := NewHub(nil, opts)
+		receive(h, 2)
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+		assert.Equal(t, []string{subscribed(`"eurusd.trades"`)}, c.Messages())
+	})
+
+	t.Run("is disabled by default", func(t *testing.T) {
+		h := NewHub(nil)
+		receive(h, 2)
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}, FromSeq: seq(1)}})
+		assert.Equal(t, []string{subscribed(`"eurusd.trades"`)}, c.Messages())
+	})
+}
+
+func TestHistorySince(t *testing.T) {
+	hi := newHistory(2)
+	assert.Empty(t, hi.since(1))
+
+	for i := 1; i <= 3; i++ {
+		hi.add(&Event{Topic: "eurusd.trades", Seq: uint64(i), Body: []byte(fmt.Sprintf(`{"id":%d}`, i))})
+	}
+	assert.Equal(t, uint64(3), hi.seq)
+	assert.Equal(t, uint64(2), hi.first())
+
+	bodies := []uint64{}
+	for _, b := range hi.since(0) {
+		bodies = append(bodies, b.event.Seq)
+	}
+	assert.Equal(t, []uint64{2, 3}, bodies)
+	assert.Len(t, hi.since(3), 1)
+	assert.Empty(t, hi.since(4))
+}
@@ -1,13 +1,17 @@
 package routing
 
 import (
-	"errors"
+	"context"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/twmb/franz-go/pkg/kgo"
 
 	msg "github.com/nusa-exchange/rango/pkg/message"
 	"github.com/nusa-exchange/rango/pkg/metrics"
@@ -16,6 +20,12 @@ import (
 type Request struct {
 	client IClient
 	msg.Request
+
+	// Parsed filters of the subscribed streams.
+	filters map[string]filter
+
+	// Credentials of auth requests, validated by the client.
+	auth *Auth
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the
@@ -27,37 +37,152 @@ type Hub struct {
 	// Unregister requests from clients.
 	Unregister chan IClient
 
-	// List of clients registered to public topics
-	PublicTopics map[string]*Topic
+	// Drain requests of streams, see DrainStream.
+	drains chan drainRequest
 
-	// List of clients registered to private topics
-	PrivateTopics map[string]map[string]*Topic
+	// map[prefix -> allowed roles], replaced at runtime with UpdateRBAC.
+	RBAC map[string][]string
 
-	// map[prefix -> map[topic -> *Topic]]
-	PrefixedTopics map[string]map[string]*Topic
+	// Authenticate validates the token of auth requests, the error being the
+	// reason of the failure, e.g. token_expired. Auth requests are refused
+	// when nil.
+	Authenticate func(token string) (Auth, error)
 
-	// map[prefix -> allowed roles]
-	RBAC map[string][]string
+	// Subscriptions and snapshots, sharded by stream.
+	shards []*shard
+
+	// List of clients registered to public wildcard topics, e.g. ethusd.*
+	wildcardTopics map[string]*Topic
+	wildcardMutex  sync.RWMutex
+
+	// Connected clients
+	clients map[IClient]struct{}
+
+	// Streams with recent traffic
+	activeStreams map[string]activeStream
+	streamsMutex  sync.Mutex
+
+	// Time the last upstream message was received, in unix nanoseconds, accessed atomically.
+	lastMessageAt int64
+
+	// Upstream messages queued by Enqueue, nil without inbound queue, and
+	// whether they are dropped rather than blocking the source when full.
+	inbound     chan *Message
+	inboundDrop bool
+
+	// Options the hub was created with.
+	options HubOptions
+
+	// Upgrader of the websocket connections.
+	upgrader *websocket.Upgrader
+
+	// Maximum connected clients, 0 for no limit, accessed atomically.
+	maxConnections int64
+
+	// Connection slots reserved by the clients being connected, counted with
+	// the clients against maxConnections.
+	reserved int
+
+	// Connections count by user or IP, see connectionKey.
+	connections map[string]int
+
+	// Long polling sessions by id
+	polls map[string]*pollClient
+
+	// Resumable sessions of websocket clients
+	sessions *sessionStore
 
+	// Count of messages dropped by paused stream, accessed atomically.
+	paused      map[string]*int64
+	pausedMutex sync.RWMutex
+
+	// Guards the clients, reserved, connections, polls and RBAC.
 	mutex sync.Mutex
 }
 
 type Event struct {
-	Scope  string // global, public, private
-	Stream string // channel routing key
-	Type   string // event type
-	Topic  string // topic routing key (stream.type)
-	Body   []byte // event json body
+	Scope    string // global, public, private
+	Stream   string // channel routing key
+	Type     string // event type
+	Topic    string // topic routing key (stream.type)
+	Body     []byte // event json body
+	Snapshot bool   // event is a snapshot of an incremental topic
+	Seq      uint64 // sequence of the event in its stream, increasing by one with each event
+}
+
+// name returns the key of the event in messages sent to clients, snapshots
+// keep their own type while being routed to the incremental topic.
+func (e *Event) name() string {
+	if e.Type == "" {
+		return e.Topic
+	}
+	if e.Scope == "private" {
+		return e.Type
+	}
+	return e.Stream + "." + e.Type
 }
 
-func NewHub(rbac map[string][]string) *Hub {
+// stream returns the stream clients subscribe to for the event.
+func (e *Event) stream() string {
+	switch e.Scope {
+	case "public", "global", "private":
+		return e.Topic
+	default:
+		return e.Scope + "." + e.Topic
+	}
+}
+
+// NewHub returns a hub authorizing the prefixed streams with rbac, configured
+// with the options given, DefaultHubOptions otherwise.
+func NewHub(rbac map[string][]string, options ...HubOptions) *Hub {
+	opts := DefaultHubOptions()
+	if len(options) != 0 {
+		opts = options[0].withDefaults()
+	}
+	opts.validate()
+	metrics.RecordHubMaxConnections(opts.MaxConnections)
+
+	var inbound chan *Message
+	if opts.InboundQueue > 0 {
+		inbound = make(chan *Message, opts.InboundQueue)
+	}
+
 	return &Hub{
 		Requests:       make(chan Request),
 		Unregister:     make(chan IClient),
-		PublicTopics:   make(map[string]*Topic, 100),
-		PrivateTopics:  make(map[string]map[string]*Topic, 1000),
-		PrefixedTopics: make(map[string]map[string]*Topic, 100),
+		drains:         make(chan drainRequest),
 		RBAC:           rbac,
+		shards:         newShards(opts),
+		wildcardTopics: make(map[string]*Topic, 10),
+		clients:        make(map[IClient]struct{}, 1000),
+		activeStreams:  make(map[string]activeStream, 100),
+		maxConnections: int64(opts.MaxConnections),
+		connections:    make(map[string]int, 1000),
+		polls:          make(map[string]*pollClient, 100),
+		sessions:       newSessionStore(opts.SessionTTL),
+		inbound:        inbound,
+		inboundDrop:    opts.InboundDrop,
+		paused:         make(map[string]*int64),
+		options:        opts,
+		upgrader:       newUpgrader(opts),
+	}
+}
+
+// Default headers carrying the UID, role and level of authenticated requests.
+const (
+	DefaultUIDHeader   = "JwtUID"
+	DefaultRoleHeader  = "JwtRole"
+	DefaultLevelHeader = "JwtLevel"
+)
+
+// requestAuth returns the user the request was authenticated as, anonymous
+// if none. An invalid level header is read as level 0.
+func (h *Hub) requestAuth(r *http.Request) Auth {
+	level, _ := strconv.Atoi(r.Header.Get(h.options.LevelHeader))
+	return Auth{
+		UID:   r.Header.Get(h.options.UIDHeader),
+		Role:  r.Header.Get(h.options.RoleHeader),
+		Level: level,
 	}
 }
 
@@ -73,9 +198,17 @@ func getTopic(scope, stream, typ string) string {
 	if scope == "private" {
 		return typ
 	}
+	if isSnapshotType(typ) {
+		typ = strings.TrimSuffix(typ, "-snap") + "-inc"
+	}
 	return stream + "." + typ
 }
 
+func isSnapshotMessage(msg *Message) bool {
+	v, ok := msg.Header("snapshot")
+	return ok && string(v) == "true"
+}
+
 func (h *Hub) ListenWebsocketEvents() {
 	for {
 		select {
@@ -83,129 +216,411 @@ func (h *Hub) ListenWebsocketEvents() {
 			h.handleRequest(&req)
 
 		case client := <-h.Unregister:
-			log.Info().Msgf("Unregistering client (%s)", client.GetAuth().UID)
+			loggerOf(client).Info().Msgf("Unregistering client (%s)", client.GetAuth().UID)
+			if c, ok := client.(sessionClient); ok {
+				h.sessions.close(c.Session())
+			}
 			h.unsubscribeAll(client)
+			h.unregister(client)
 			client.Close()
+
+		case req := <-h.drains:
+			req.done <- h.drainStream(req.stream)
 		}
 	}
 }
 
-// ReceiveMsg handles AMQP messages
-func (h *Hub) ReceiveMsg(msg *kgo.Record) {
-	key_arr := strings.Split(string(msg.Key), ".") // public.ethusdt.depth | private.UIDABC00001.balance
-	scope := key_arr[0]
+func (h *Hub) register(client IClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	h.routeMessage(&Event{
-		Scope:  scope,
-		Stream: key_arr[1],
-		Type:   key_arr[2],
-		Topic:  getTopic(scope, key_arr[1], key_arr[2]),
-		Body:   msg.Value,
-	})
+	h.clients[client] = struct{}{}
 }
 
-func (h *Hub) routeMessage(msg *Event) {
-	if isTrace() {
-		log.Trace().Msgf("Routing message %v", msg)
+func (h *Hub) unregister(client IClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.clients, client)
+}
+
+// LastMessageAt returns the time the last upstream message was received,
+// zero if none was.
+func (h *Hub) LastMessageAt() time.Time {
+	ns := atomic.LoadInt64(&h.lastMessageAt)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// MaxConnections returns the maximum number of connected clients, 0 if unlimited.
+func (h *Hub) MaxConnections() int {
+	return int(atomic.LoadInt64(&h.maxConnections))
+}
+
+// SetMaxConnections changes the maximum number of connected clients, 0
+// removes the limit. Clients already connected are kept.
+func (h *Hub) SetMaxConnections(max int) {
+	atomic.StoreInt64(&h.maxConnections, int64(max))
+	metrics.RecordHubMaxConnections(max)
+}
+
+// reserveConnection reserves a connection slot for a client being
+// connected, it returns false without reserving it when the clients and the
+// slots reserved reach the maximum number of clients. The slot must be
+// released with releaseReservation once the client is registered or failed to
+// connect.
+func (h *Hub) reserveConnection() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if max := h.MaxConnections(); max > 0 && len(h.clients)+h.reserved >= max {
+		return false
+	}
+	h.reserved++
+	return true
+}
+
+// releaseReservation releases a slot reserved with reserveConnection.
+func (h *Hub) releaseReservation() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.reserved--
+}
+
+// acquireConnection counts a new connection of key, it returns false without
+// counting it when key already holds max connections, 0 meaning no limit.
+func (h *Hub) acquireConnection(key string, max int) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if max > 0 && h.connections[key] >= max {
+		return false
 	}
+	h.connections[key]++
+	return true
+}
+
+// releaseConnection uncounts a connection of key.
+func (h *Hub) releaseConnection(key string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	if h.connections[key] <= 1 {
+		delete(h.connections, key)
+		return
+	}
+	h.connections[key]--
+}
+
+// ClientsCount returns the number of connected clients.
+func (h *Hub) ClientsCount() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return len(h.clients)
+}
+
+// Shutdown sends a going away close frame to every client and waits for all
+// of them to unregister, or for ctx to be done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mutex.Lock()
+	clients := make([]IClient, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mutex.Unlock()
+
+	log.Info().Msgf("Disconnecting %d clients", len(clients))
+	for _, client := range clients {
+		client.Disconnect(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for h.ClientsCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// ReceiveMsg handles upstream messages
+func (h *Hub) ReceiveMsg(msg *Message) {
+	now := time.Now()
+	atomic.StoreInt64(&h.lastMessageAt, now.UnixNano())
+	metrics.RecordSourceMessage(h.sourceTopic(msg.Topic), now, msg.Timestamp)
+
+	key := string(msg.Key)
+	if scope, ok := h.options.TopicScopes[msg.Topic]; ok {
+		key = scope + "." + key
+	}
+
+	// Messages of topics no longer configured may still be received from an
+	// assigned consumer group.
+	if len(h.options.SourceTopics) != 0 && !contains(h.options.SourceTopics, msg.Topic) {
+		dropUnroutable(msg, key, "unknown_topic")
+		return
+	}
+	h.dispatch(msg, key, now)
+}
+
+// InjectMsg routes a synthetic message keyed like upstream messages to the
+// subscribers of its stream, e.g. to probe the delivery to clients. It isn't
+// accounted as a message of the source, whose topic scopes don't apply.
+func (h *Hub) InjectMsg(msg *Message) {
+	h.dispatch(msg, string(msg.Key), time.Now())
+}
+
+// dispatch routes the message keyed with key, received at now, to the
+// subscribers of its stream.
+func (h *Hub) dispatch(msg *Message, key string, now time.Time) {
+	key_arr := strings.Split(key, ".") // public.ethusdt.depth | private.UIDABC00001.balance
+	if malformedKey(key_arr) {
+		dropUnroutable(msg, key, "malformed_key")
+		return
+	}
+	scope := h.scopeOf(key_arr[0])
+
+	event := &Event{
+		Scope:    scope,
+		Stream:   key_arr[1],
+		Type:     key_arr[2],
+		Topic:    getTopic(scope, key_arr[1], key_arr[2]),
+		Body:     msg.Value,
+		Snapshot: isSnapshotType(key_arr[2]) || isSnapshotMessage(msg),
+	}
+	if h.dropPaused(event) {
+		return
+	}
+	h.transform(event)
+	h.routeMessage(event)
+
+	if metrics.Enabled() {
+		metrics.RecordHubDispatchDuration(scope, time.Since(now))
+	}
+}
+
+// malformedKey returns true if the routing key split in key_arr hasn't a scope,
+// a stream and a type.
+func malformedKey(key_arr []string) bool {
+	if len(key_arr) < 3 {
+		return true
+	}
+	for _, part := range key_arr {
+		if part == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// dropUnroutable drops the message keyed with key that can't be routed for
+// reason.
+func dropUnroutable(msg *Message, key, reason string) {
+	log.Debug().Str("topic", msg.Topic).Str("key", key).Msgf("Dropping unroutable message: %s", reason)
+	metrics.RecordUnroutableMessage(reason)
+}
+
+// Role of anonymous connections in DefaultStreams.
+const anonymousRole = "anonymous"
+
+// defaultStreams returns the streams subscribed on connect with auth, in
+// addition to the requested streams.
+func (h *Hub) defaultStreams(auth Auth, requested []string) []string {
+	role := auth.Role
+	if auth.UID == "" {
+		role = anonymousRole
+	}
+
+	streams := requested
+	for _, s := range h.options.DefaultStreams[role] {
+		if s != "" && !contains(streams, s) {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// scopeOf returns the routing scope of the messages keyed with prefix.
+func (h *Hub) scopeOf(prefix string) string {
+	switch {
+	case contains(h.options.PrivatePrefixes, prefix):
+		return "private"
+	case contains(h.options.PublicPrefixes, prefix):
+		return "public"
+	}
+	return prefix
+}
+
+// sourceTopic returns the metrics label of the upstream topic.
+func (h *Hub) sourceTopic(topic string) string {
+	if len(h.options.SourceTopics) == 0 || contains(h.options.SourceTopics, topic) {
+		return topic
+	}
+	return "other"
+}
+
+func (h *Hub) routeMessage(msg *Event) {
+	if isTrace() {
+		log.Trace().Msgf("Routing message %v", msg)
+	}
+	fanout := 0
 	switch msg.Scope {
 	case "public", "global":
-		topic, ok := h.PublicTopics[msg.Topic]
-		if ok {
-			topic.broadcast(msg)
+		h.touchStream(msg.Topic, "")
+
+		s := h.shardOf(msg.Topic)
+		s.mutex.Lock()
+		s.number(msg)
+		s.record(msg)
+		if h.retainsSnapshot(msg.Topic) {
+			s.retain(msg)
 		}
 
-		if !ok {
-			if isTrace() {
-				log.Trace().Msgf("No public registration to %s", msg.Topic)
-				log.Trace().Msgf("Public topics: %v", h.PublicTopics)
-			}
+		topic, ok := s.public[msg.Topic]
+		h.wildcardMutex.RLock()
+		if wildcards := h.wildcardsOf(msg.Topic); len(wildcards) != 0 {
+			fanout = h.broadcastWildcard(msg, topic, wildcards)
+		} else if ok {
+			fanout = topic.broadcast(msg)
 		}
+		h.wildcardMutex.RUnlock()
+		s.mutex.Unlock()
+
+		if fanout == 0 && isTrace() {
+			log.Trace().Msgf("No public registration to %s", msg.Topic)
+		}
+		metrics.RecordHubDispatch(msg.Scope, msg.Topic, fanout)
 
 	case "private":
+		// The stream of private messages is the UID of the recipient.
 		uid := msg.Stream
-		uTopic, ok := h.PrivateTopics[uid]
-		if ok {
-			topic, ok := uTopic[msg.Topic]
-			if ok {
-				topic.broadcast(msg)
-				break
-			}
+		s := h.shardOf(uid)
+		s.mutex.Lock()
+		if topic, ok := s.private[uid][msg.Topic]; ok {
+			topic.seq++
+			msg.Seq = topic.seq
+			fanout = topic.broadcastPrivate(uid, msg)
 		}
-		if isTrace() {
+		s.mutex.Unlock()
+
+		if fanout == 0 && isTrace() {
 			log.Trace().Msgf("No private registration to %s", msg.Topic)
-			log.Trace().Msgf("Private topics: %v", h.PrivateTopics)
 		}
+		// Private streams are labeled by type only, never by user.
+		metrics.RecordHubDispatch(msg.Scope, msg.Topic, fanout)
 
 	default:
-		scope, ok := h.PrefixedTopics[msg.Scope]
-		if !ok {
-			return
-		}
+		h.touchStream(msg.Scope+"."+msg.Topic, msg.Scope)
+
+		s := h.shardOf(msg.Scope + "." + msg.Topic)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.number(msg)
+		s.record(msg)
 
-		topic, ok := scope[msg.Topic]
+		scope, ok := s.prefixed[msg.Scope]
 		if !ok {
 			return
 		}
 
-		topic.broadcast(msg)
-
-		log.Trace().Msgf("Broadcasted message scope %s", msg.Scope)
+		if topic, ok := scope[msg.Topic]; ok {
+			fanout = topic.broadcast(msg)
+			log.Trace().Msgf("Broadcasted message scope %s", msg.Scope)
+		}
+		metrics.RecordHubDispatch(msg.Scope, msg.Topic, fanout)
 	}
-
 }
 
-func (h *Hub) unsubscribeAll(client IClient) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	for t, topic := range h.PublicTopics {
-		if topic.unsubscribe(client) {
-			metrics.RecordHubUnsubscription("public", t)
-		}
-		if topic.len() == 0 {
-			delete(h.PublicTopics, t)
+// wildcardsOf returns the wildcard topics matching topic, none for most
+// topics. The wildcard topics must be locked.
+func (h *Hub) wildcardsOf(topic string) []*Topic {
+	var wildcards []*Topic
+	for pattern, t := range h.wildcardTopics {
+		if matchWildcard(pattern, topic) {
+			wildcards = append(wildcards, t)
 		}
 	}
+	return wildcards
+}
 
-	for k, scope := range h.PrefixedTopics {
-		for t, topic := range scope {
-			if topic.unsubscribe(client) {
-				metrics.RecordHubUnsubscription("prefixed", t)
+// broadcastWildcard sends msg once to every client subscribed to topic or
+// to the wildcard topics matching it, it returns the number of clients
+// reached. The shard of topic and the wildcard topics must be locked.
+func (h *Hub) broadcastWildcard(msg *Event, topic *Topic, wildcards []*Topic) int {
+	var fields map[string]interface{}
+	decoded := false
+	// Clients reached, conflated if conflated by any of their topics.
+	add := func(clients map[IClient]bool, t *Topic) {
+		for client := range t.clients {
+			if _, ok := t.filters[client]; ok && !decoded {
+				fields, decoded = decodeFields(msg.Body), true
 			}
-
-			if topic.len() == 0 {
-				delete(scope, t)
+			if t.accepts(client, fields) {
+				clients[client] = clients[client] || t.conflates(client)
 			}
 		}
+	}
 
-		if len(scope) == 0 {
-			delete(h.PrefixedTopics, k)
-		}
+	clients := make(map[IClient]bool)
+	if topic != nil {
+		add(clients, topic)
 	}
 
-	uid := client.GetAuth().UID
-	topics, ok := h.PrivateTopics[uid]
-	if !ok {
-		return
+	for _, t := range wildcards {
+		add(clients, t)
+	}
+
+	if len(clients) == 0 {
+		return 0
+	}
+
+	env, err := newEnvelopes(msg)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		return 0
 	}
 
-	for t, topic := range topics {
+	for client, conflated := range clients {
+		if conflated {
+			sendLatest(client, msg.Topic, env.of(client))
+		} else {
+			send(client, msg.Topic, env.of(client))
+		}
+	}
+
+	return len(clients)
+}
+
+func matchWildcard(pattern, topic string) bool {
+	return strings.HasPrefix(topic, strings.TrimSuffix(pattern, "*"))
+}
+
+func (h *Hub) unsubscribeAll(client IClient) {
+	h.wildcardMutex.Lock()
+	for t, topic := range h.wildcardTopics {
 		if topic.unsubscribe(client) {
-			metrics.RecordHubUnsubscription("private", t)
+			recordUnsubscription(client, "wildcard", t, h.options.AuditLog)
 		}
 		if topic.len() == 0 {
-			delete(topics, t)
+			delete(h.wildcardTopics, t)
 		}
 	}
+	h.wildcardMutex.Unlock()
 
-	if len(topics) == 0 {
-		delete(h.PrivateTopics, uid)
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		s.unsubscribeAll(client)
+		s.mutex.Unlock()
 	}
-
 }
 
 func responseMust(e error, r interface{}) string {
@@ -218,6 +633,11 @@ func responseMust(e error, r interface{}) string {
 	return string(res)
 }
 
+// isWildcardStream returns true for public streams ending with *, e.g. ethusd.*
+func isWildcardStream(s string) bool {
+	return strings.HasSuffix(s, "*") && strings.Contains(s, ".")
+}
+
 func isPrivateStream(s string) bool {
 	return strings.Count(s, ".") == 0
 }
@@ -226,27 +646,41 @@ func isPrefixedStream(s string) bool {
 }
 
 func (h *Hub) handleRequest(req *Request) {
+	if req.RPC {
+		h.handleRPC(req)
+		return
+	}
+
 	switch req.Method {
 	case "subscribe":
 		h.handleSubscribe(req)
 	case "unsubscribe":
 		h.handleUnsubscribe(req)
+	case "streams":
+		h.handleStreams(req)
+	case "auth":
+		h.handleAuth(req)
+	case "resume":
+		h.handleResume(req)
 	default:
-		req.client.Send(responseMust(errors.New("unsupported method"), nil))
+		reply(req.client, errorEvent(codeInvalidRequest, "unsupported method", nil))
 	}
 }
 
-func (h *Hub) subscribePrivate(t string, req *Request) {
+// subscribePrivate subscribes the client to its private stream t, it returns
+// false if the client is anonymous.
+func (h *Hub) subscribePrivate(t string, req *Request) bool {
 	uid := req.client.GetAuth().UID
 	if uid == "" {
-		log.Error().Msgf("Anonymous user tried to subscribe to private stream %s", t)
-		return
+		loggerOf(req.client).Error().Msgf("Anonymous user tried to subscribe to private stream %s", t)
+		return false
 	}
 
-	uTopics, ok := h.PrivateTopics[uid]
+	s := h.shardOf(uid)
+	uTopics, ok := s.private[uid]
 	if !ok {
 		uTopics = make(map[string]*Topic, 3)
-		h.PrivateTopics[uid] = uTopics
+		s.private[uid] = uTopics
 	}
 
 	topic, ok := uTopics[t]
@@ -256,27 +690,66 @@ func (h *Hub) subscribePrivate(t string, req *Request) {
 	}
 
 	if topic.subscribe(req.client) {
-		metrics.RecordHubSubscription("private", t)
+		recordSubscription(req.client, "private", t, h.options.AuditLog)
 		req.client.SubscribePrivate(t)
 	}
+	topic.setFilter(req.client, req.filters[t])
+	setConflation(topic, t, req)
+	return true
+}
+
+func (h *Hub) subscribePublic(t string, req *Request) bool {
+	s := h.shardOf(t)
+	topic, ok := s.public[t]
+	if !ok {
+		topic = NewTopic(h)
+		s.public[t] = topic
+	}
+
+	topic.setFilter(req.client, req.filters[t])
+	setConflation(topic, t, req)
+	if topic.subscribe(req.client) {
+		recordSubscription(req.client, "public", t, h.options.AuditLog)
+		req.client.SubscribePublic(t)
+		return true
+	}
+	return false
+}
+
+// UpdateRBAC replaces the RBAC matrix, it applies to the next subscriptions.
+func (h *Hub) UpdateRBAC(rbac map[string][]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.RBAC = rbac
 }
 
-func (h *Hub) subscribePublic(t string, req *Request) {
-	topic, ok := h.PublicTopics[t]
+func (h *Hub) subscribeWildcard(t string, req *Request) {
+	topic, ok := h.wildcardTopics[t]
 	if !ok {
 		topic = NewTopic(h)
-		h.PublicTopics[t] = topic
+		h.wildcardTopics[t] = topic
 	}
 
 	if topic.subscribe(req.client) {
-		metrics.RecordHubSubscription("public", t)
+		recordSubscription(req.client, "wildcard", t, h.options.AuditLog)
 		req.client.SubscribePublic(t)
 	}
+	topic.setFilter(req.client, req.filters[t])
+	setConflation(topic, t, req)
 }
 
+// premittedRBAC returns true if the role of auth is allowed the prefixed
+// streams of prefix and its level reaches their minimum level.
 func (h *Hub) premittedRBAC(prefix string, auth Auth) bool {
+	h.mutex.Lock()
 	rbac := h.RBAC[prefix]
+	minLevel := h.options.MinLevels[prefix]
+	h.mutex.Unlock()
 
+	if auth.Level < minLevel {
+		return false
+	}
 	for _, role := range rbac {
 		if role == auth.Role {
 			return true
@@ -294,54 +767,131 @@ func splitPrefixedTopic(prefixed string) (string, string) {
 	return prefix, t
 }
 
-func (h *Hub) subscribePrefixed(prefixed string, req *Request) {
+// subscribePrefixed subscribes the client to the prefixed stream, it returns
+// false if denied by RBAC.
+func (h *Hub) subscribePrefixed(prefixed string, req *Request) bool {
 	prefix, t := splitPrefixedTopic(prefixed)
 
 	if !h.premittedRBAC(prefix, req.client.GetAuth()) {
-		req.client.Send(responseMust(nil, map[string]interface{}{
-			"message": "cannot subscribe to " + prefixed,
-		}))
-
-		return
+		return false
 	}
 
-	topics, ok := h.PrefixedTopics[prefix]
+	s := h.shardOf(prefixed)
+	topics, ok := s.prefixed[prefix]
 	if !ok {
-		topics := make(map[string]*Topic, 0)
-		h.PrefixedTopics[prefix] = topics
+		topics = make(map[string]*Topic)
+		s.prefixed[prefix] = topics
 	}
 
 	topic, ok := topics[t]
 	if !ok {
 		topic = NewTopic(h)
-		h.PrefixedTopics[prefix][t] = topic
+		topics[t] = topic
 	}
 
 	if topic.subscribe(req.client) {
-		metrics.RecordHubSubscription("prefixed", prefixed)
+		recordSubscription(req.client, "prefixed", prefixed, h.options.AuditLog)
 		req.client.SubscribePublic(prefixed)
 	}
+	topic.setFilter(req.client, req.filters[prefixed])
+	setConflation(topic, prefixed, req)
+	return true
+}
+
+// subscriptionLimiter is implemented by clients limiting the number of streams
+// they may subscribe to at once, 0 means no limit.
+type subscriptionLimiter interface {
+	MaxSubscriptions() int
+}
+
+// exceedsSubscriptions returns true if subscribing the client to t would
+// exceed its subscriptions limit.
+func exceedsSubscriptions(client IClient, t string) bool {
+	l, ok := client.(subscriptionLimiter)
+	if !ok || l.MaxSubscriptions() <= 0 {
+		return false
+	}
+
+	subs := client.GetSubscriptions()
+	return !contains(subs, t) && len(subs) >= l.MaxSubscriptions()
 }
 
+// handleSubscribe subscribes the client to the requested streams, the shards
+// of the streams are locked until the snapshots, or the history of the streams
+// when requested with from_seq, are replayed so that no message is dispatched
+// to the client before. Subscribing again to a stream is a no-op, the client
+// stays subscribed once.
 func (h *Hub) handleSubscribe(req *Request) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	req.Streams = unique(req.Streams)
+	defer h.lockStreams(req.Streams, req.client)()
 
+	loggerOf(req.client).Debug().Strs("streams", req.Streams).Msg("Subscribing")
+
+	replay := []string{}
+	catchUp := []string{}
+	rejected := []string{}
+	denials := []string{}
+	reject := func(t string, code errorCode, message string) {
+		rejected = append(rejected, t)
+		denials = append(denials, errorEvent(code, message, map[string]interface{}{"stream": t}))
+	}
+
+	req.filters = make(map[string]filter, len(req.Filters))
 	for _, t := range req.Streams {
+		if exceedsSubscriptions(req.client, t) {
+			reject(t, codeSubscriptionsLimit, "subscriptions limit exceeded")
+			continue
+		}
+
+		f, err := parseFilter(req.Filters[t], h.options.MaxFilterConditions)
+		if err != nil {
+			reject(t, codeInvalidFilter, "invalid filter: "+err.Error())
+			continue
+		}
+		req.filters[t] = f
+
 		switch {
+		case isWildcardStream(t):
+			h.subscribeWildcard(t, req)
 		case isPrivateStream(t):
-			h.subscribePrivate(t, req)
+			if !h.subscribePrivate(t, req) {
+				reject(t, codeRestrictedStream, "restricted")
+			}
 		case isPrefixedStream(t):
-			h.subscribePrefixed(t, req)
+			if !h.subscribePrefixed(t, req) {
+				reject(t, codeRestrictedStream, "restricted")
+				continue
+			}
+			catchUp = append(catchUp, t)
 		default:
-			h.subscribePublic(t, req)
+			if h.subscribePublic(t, req) {
+				replay = append(replay, t)
+			}
+			catchUp = append(catchUp, t)
 		}
 	}
 
-	req.client.Send(responseMust(nil, map[string]interface{}{
+	res := map[string]interface{}{
 		"message": "subscribed",
 		"streams": req.client.GetSubscriptions(),
-	}))
+	}
+	for _, d := range denials {
+		reply(req.client, d)
+	}
+	if len(rejected) != 0 {
+		res["rejected"] = rejected
+	}
+	reply(req.client, responseMust(nil, res))
+
+	if req.FromSeq != nil {
+		for _, t := range catchUp {
+			h.shardOf(t).replayHistory(t, *req.FromSeq, req.client)
+		}
+		return
+	}
+	for _, t := range replay {
+		h.shardOf(t).replaySnapshot(t, req.client)
+	}
 }
 
 func (h *Hub) unsubscribePrivate(t string, req *Request) {
@@ -349,7 +899,8 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 	if uid == "" {
 		return
 	}
-	uTopics, ok := h.PrivateTopics[uid]
+	s := h.shardOf(uid)
+	uTopics, ok := s.private[uid]
 	if !ok {
 		return
 	}
@@ -357,7 +908,7 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 	topic, ok := uTopics[t]
 	if ok {
 		if topic.unsubscribe(req.client) {
-			metrics.RecordHubUnsubscription("private", t)
+			recordUnsubscription(req.client, "private", t, h.options.AuditLog)
 			req.client.UnsubscribePrivate(t)
 		}
 
@@ -366,15 +917,15 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 		}
 	}
 
-	uTopics, ok = h.PrivateTopics[uid]
-	if ok && len(uTopics) == 0 {
-		delete(h.PrivateTopics, uid)
+	if len(uTopics) == 0 {
+		delete(s.private, uid)
 	}
 }
 
 func (h *Hub) unsubscribePrefixed(prefixed string, req *Request) {
 	scope, t := splitPrefixedTopic(prefixed)
-	topics, ok := h.PrefixedTopics[scope]
+	s := h.shardOf(prefixed)
+	topics, ok := s.prefixed[scope]
 	if !ok {
 		return
 	}
@@ -382,37 +933,63 @@ func (h *Hub) unsubscribePrefixed(prefixed string, req *Request) {
 	topic, ok := topics[t]
 	if ok {
 		if topic.unsubscribe(req.client) {
-			metrics.RecordHubUnsubscription("prefixed", t)
-			req.client.UnsubscribePublic(t)
+			recordUnsubscription(req.client, "prefixed", prefixed, h.options.AuditLog)
+			req.client.UnsubscribePublic(prefixed)
 		}
 
 		if topic.len() == 0 {
 			delete(topics, t)
-			h.PrefixedTopics[scope] = topics
+		}
+		if len(topics) == 0 {
+			delete(s.prefixed, scope)
 		}
 	}
 }
 
 func (h *Hub) unsubscribePublic(t string, req *Request) {
-	topic, ok := h.PublicTopics[t]
+	s := h.shardOf(t)
+	topic, ok := s.public[t]
 	if ok {
 		if topic.unsubscribe(req.client) {
-			metrics.RecordHubUnsubscription("public", t)
+			recordUnsubscription(req.client, "public", t, h.options.AuditLog)
 			req.client.UnsubscribePublic(t)
 		}
 
 		if topic.len() == 0 {
-			delete(h.PublicTopics, t)
+			delete(s.public, t)
 		}
 	}
 }
 
+func (h *Hub) unsubscribeWildcard(t string, req *Request) {
+	topic, ok := h.wildcardTopics[t]
+	if ok {
+		if topic.unsubscribe(req.client) {
+			recordUnsubscription(req.client, "wildcard", t, h.options.AuditLog)
+			req.client.UnsubscribePublic(t)
+		}
+
+		if topic.len() == 0 {
+			delete(h.wildcardTopics, t)
+		}
+	}
+}
+
+// Stream of unsubscribe requests standing for every subscribed stream.
+const allStreams = "*"
+
 func (h *Hub) handleUnsubscribe(req *Request) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	if contains(req.Streams, allStreams) {
+		req.Streams = req.client.GetSubscriptions()
+	}
+	defer h.lockStreams(req.Streams, req.client)()
+
+	loggerOf(req.client).Debug().Strs("streams", req.Streams).Msg("Unsubscribing")
 
 	for _, t := range req.Streams {
 		switch {
+		case isWildcardStream(t):
+			h.unsubscribeWildcard(t, req)
 		case isPrivateStream(t):
 			h.unsubscribePrivate(t, req)
 		case isPrefixedStream(t):
@@ -422,7 +999,7 @@ func (h *Hub) handleUnsubscribe(req *Request) {
 		}
 	}
 
-	req.client.Send(responseMust(nil, map[string]interface{}{
+	reply(req.client, responseMust(nil, map[string]interface{}{
 		"message": "unsubscribed",
 		"streams": req.client.GetSubscriptions(),
 	}))
@@ -1,9 +1,15 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -14,13 +20,18 @@ type MockedClient struct {
 	mock.Mock
 }
 
-func (c *MockedClient) Send(m string) {
+func (c *MockedClient) Send(m string) bool {
 	c.Called(m)
+	return true
 }
 
 func (c *MockedClient) Close() {
 }
 
+func (c *MockedClient) Disconnect(code int, reason string) {
+	c.Called(code, reason)
+}
+
 func (c *MockedClient) GetAuth() Auth {
 	args := c.Called()
 	return args.Get(0).(Auth)
@@ -81,16 +92,16 @@ func TestAnonymous(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["`+streams[0]+`"]}}`).Return()
 
 		h := setup(c, streams)
-		assert.Equal(t, 1, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 1, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 
 		c.On("UnsubscribePublic", streams[0]).Return()
 		c.On("GetSubscriptions").Return([]string{}).Once()
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, streams)
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 	})
 
 	t.Run("subscribe to multiple public streams", func(t *testing.T) {
@@ -111,8 +122,8 @@ func TestAnonymous(t *testing.T) {
 			"eurusd.updates",
 		})
 
-		assert.Equal(t, 2, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 2, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 
 		c.On("UnsubscribePublic", streams[0]).Return().Once()
 		c.On("UnsubscribePublic", streams[1]).Return().Once()
@@ -120,8 +131,8 @@ func TestAnonymous(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, streams)
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 
 	})
 
@@ -131,14 +142,15 @@ func TestAnonymous(t *testing.T) {
 		c.On("GetAuth").Return(Auth{})
 		c.On("GetSubscriptions").Return([]string{})
 		c.On("SubscribePrivate", "trades").Return()
-		c.On("Send", `{"success":{"message":"subscribed","streams":[]}}`).Return()
+		c.On("Send", `{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"trades"}}`).Return().Once()
+		c.On("Send", `{"success":{"message":"subscribed","rejected":["trades"],"streams":[]}}`).Return()
 
 		h := setup(&c, []string{
 			"trades",
 		})
 
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 	})
 }
 func TestAuthenticated(t *testing.T) {
@@ -153,16 +165,16 @@ func TestAuthenticated(t *testing.T) {
 		h := setup(c, []string{
 			"trades",
 		})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 1, len(h.privateTopics()))
 
 		c.On("UnsubscribePrivate", "trades").Return().Once()
 		c.On("GetSubscriptions").Return([]string{}).Once()
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 	})
 
 	t.Run("subscribe to multiple private streams", func(t *testing.T) {
@@ -175,10 +187,10 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["trades","orders"]}}`).Return()
 
 		h := setup(c, []string{"trades", "orders"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 1, len(h.privateTopics()))
 
-		uTopics, ok := h.PrivateTopics["UIDABC00001"]
+		uTopics, ok := h.privateTopics()["UIDABC00001"]
 		require.True(t, ok)
 		assert.Equal(t, 2, len(uTopics))
 
@@ -188,8 +200,8 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades", "orders"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 
 	})
 
@@ -204,10 +216,10 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["trades","orders","eurusd.updates"]}}`).Return()
 
 		h := setup(c, []string{"trades", "orders", "eurusd.updates"})
-		assert.Equal(t, 1, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 1, len(h.publicTopics()))
+		assert.Equal(t, 1, len(h.privateTopics()))
 
-		uTopics, ok := h.PrivateTopics["UIDABC00001"]
+		uTopics, ok := h.privateTopics()["UIDABC00001"]
 		require.True(t, ok)
 		assert.Equal(t, 2, len(uTopics))
 
@@ -218,8 +230,8 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades", "orders", "eurusd.updates"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, len(h.publicTopics()))
+		assert.Equal(t, 0, len(h.privateTopics()))
 	})
 }
 
@@ -254,3 +266,573 @@ func TestHandleMessage(t *testing.T) {
 
 	c.AssertExpectations(t)
 }
+
+func TestUpdateRBAC(t *testing.T) {
+	h := NewHub(nil)
+	c := &MockedClient{}
+	stream := "admin.eurusd.ob-inc"
+
+	c.On("GetAuth").Return(Auth{UID: "UIDABC00001", Role: "admin"})
+	c.On("GetSubscriptions").Return([]string{}).Once()
+	c.On("Send", `{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"`+stream+`"}}`).Return().Once()
+	c.On("Send", `{"success":{"message":"subscribed","rejected":["`+stream+`"],"streams":[]}}`).Return().Once()
+
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{stream}}})
+	assert.Equal(t, 0, len(h.prefixedTopics()))
+
+	h.UpdateRBAC(map[string][]string{"admin": {"admin"}})
+
+	c.On("SubscribePublic", stream).Return().Once()
+	c.On("GetSubscriptions").Return([]string{stream}).Once()
+	c.On("Send", `{"success":{"message":"subscribed","streams":["`+stream+`"]}}`).Return().Once()
+
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{stream}}})
+	assert.Equal(t, 1, len(h.prefixedTopics()["admin"]))
+
+	c.AssertExpectations(t)
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("disconnects every client", func(t *testing.T) {
+		h := NewHub(nil)
+		go h.ListenWebsocketEvents()
+
+		for i := 0; i < 3; i++ {
+			c := &MockedClient{}
+			c.On("GetAuth").Return(Auth{})
+			c.On("Disconnect", websocket.CloseGoingAway, "server shutting down").Return().Run(func(args mock.Arguments) {
+				go func() { h.Unregister <- c }()
+			}).Once()
+			h.register(c)
+		}
+		assert.Equal(t, 3, h.ClientsCount())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, h.Shutdown(ctx))
+		assert.Equal(t, 0, h.ClientsCount())
+	})
+
+	t.Run("gives up after the drain timeout", func(t *testing.T) {
+		h := NewHub(nil)
+		c := &MockedClient{}
+		c.On("Disconnect", websocket.CloseGoingAway, "server shutting down").Return().Once()
+		h.register(c)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		assert.Equal(t, context.DeadlineExceeded, h.Shutdown(ctx))
+		c.AssertExpectations(t)
+	})
+}
+
+func TestWildcard(t *testing.T) {
+	h := NewHub(nil)
+	body := []byte(`{"some":"data"}`)
+	event := `{"abc.ticker":{"some":"data"}}`
+
+	wildcard := &MockedClient{}
+	wildcard.On("SubscribePublic", "abc.*").Return()
+	wildcard.On("Send", event).Return().Once()
+
+	exact := &MockedClient{}
+	exact.On("SubscribePublic", "abc.ticker").Return()
+	exact.On("Send", event).Return().Once()
+
+	both := &MockedClient{}
+	both.On("SubscribePublic", "abc.*").Return()
+	both.On("SubscribePublic", "abc.ticker").Return()
+	both.On("Send", event).Return().Once()
+
+	h.subscribeWildcard("abc.*", &Request{client: wildcard})
+	h.subscribePublic("abc.ticker", &Request{client: exact})
+	h.subscribeWildcard("abc.*", &Request{client: both})
+	h.subscribePublic("abc.ticker", &Request{client: both})
+	assert.Equal(t, 1, len(h.wildcardTopics))
+
+	h.routeMessage(&Event{Scope: "public", Stream: "abc", Type: "ticker", Topic: "abc.ticker", Body: body})
+	h.routeMessage(&Event{Scope: "public", Stream: "xyz", Type: "ticker", Topic: "xyz.ticker", Body: body})
+	assert.Len(t, h.wildcardsOf("abc.ticker"), 1)
+	assert.Empty(t, h.wildcardsOf("xyz.ticker"), "other topics are broadcast without merging the wildcard topics")
+
+	wildcard.AssertExpectations(t)
+	exact.AssertExpectations(t)
+	both.AssertExpectations(t)
+
+	for _, c := range []*MockedClient{wildcard, both} {
+		c.On("UnsubscribePublic", "abc.*").Return().Once()
+		c.On("GetSubscriptions").Return([]string{}).Once()
+		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return().Once()
+		teardown(h, c, []string{"abc.*"})
+	}
+	assert.Equal(t, 0, len(h.wildcardTopics))
+	assert.Equal(t, 1, len(h.publicTopics()))
+}
+
+func TestIsWildcardStream(t *testing.T) {
+	assert.True(t, isWildcardStream("abc.*"))
+	assert.True(t, isWildcardStream("abc.ob-*"))
+	assert.False(t, isWildcardStream("abc.ticker"))
+	assert.False(t, isWildcardStream("*"))
+}
+
+type nopClient struct{}
+
+func (c *nopClient) Send(string) bool                   { return true }
+func (c *nopClient) Close()                             {}
+func (c *nopClient) Disconnect(code int, reason string) {}
+func (c *nopClient) GetAuth() Auth                      { return Auth{} }
+func (c *nopClient) GetSubscriptions() []string         { return nil }
+func (c *nopClient) SubscribePublic(string)             {}
+func (c *nopClient) SubscribePrivate(string)            {}
+func (c *nopClient) UnsubscribePublic(string)           {}
+func (c *nopClient) UnsubscribePrivate(string)          {}
+
+func benchmarkRouteMessage(b *testing.B, wildcards []string) {
+	h := NewHub(nil)
+	for i := 0; i < 100; i++ {
+		h.subscribePublic("abc.ticker", &Request{client: &nopClient{}})
+	}
+	for _, w := range wildcards {
+		h.subscribeWildcard(w, &Request{client: &nopClient{}})
+	}
+
+	event := &Event{Scope: "public", Stream: "abc", Type: "ticker", Topic: "abc.ticker", Body: []byte(`{"some":"data"}`)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.routeMessage(event)
+	}
+}
+
+func BenchmarkRouteMessageExact(b *testing.B) {
+	benchmarkRouteMessage(b, nil)
+}
+
+func BenchmarkRouteMessageWildcard(b *testing.B) {
+	benchmarkRouteMessage(b, []string{"abc.*", "xyz.*", "ethusd.ob-*"})
+}
+
+// recorderClient records every message sent to it.
+type recorderClient struct {
+	nopClient
+	auth     Auth
+	mutex    sync.Mutex
+	messages []string
+	streams  []string
+}
+
+func (c *recorderClient) GetSubscriptions() []string {
+	return append([]string{}, c.streams...)
+}
+
+func (c *recorderClient) SubscribePublic(s string) {
+	if !contains(c.streams, s) {
+		c.streams = append(c.streams, s)
+	}
+}
+
+func (c *recorderClient) SubscribePrivate(s string) {
+	c.SubscribePublic(s)
+}
+
+func (c *recorderClient) UnsubscribePublic(s string) {
+	streams := []string{}
+	for _, el := range c.streams {
+		if el != s {
+			streams = append(streams, el)
+		}
+	}
+	c.streams = streams
+}
+
+func (c *recorderClient) UnsubscribePrivate(s string) {
+	c.UnsubscribePublic(s)
+}
+
+func (c *recorderClient) Send(m string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messages = append(c.messages, m)
+	return true
+}
+
+func (c *recorderClient) GetAuth() Auth {
+	return c.auth
+}
+
+func (c *recorderClient) Messages() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.messages...)
+}
+
+func TestMessageHeader(t *testing.T) {
+	msg := &Message{Headers: []Header{
+		{Key: "snapshot", Value: []byte("true")},
+		{Key: "snapshot", Value: []byte("false")},
+	}}
+
+	v, ok := msg.Header("snapshot")
+	assert.True(t, ok)
+	assert.Equal(t, "true", string(v))
+	assert.True(t, isSnapshotMessage(msg))
+
+	_, ok = msg.Header("missing")
+	assert.False(t, ok)
+	assert.False(t, isSnapshotMessage(&Message{}))
+}
+
+func TestRouteMessageFanout(t *testing.T) {
+	h := NewHub(nil)
+	a, b := &recorderClient{}, &recorderClient{}
+	h.handleSubscribe(&Request{client: a, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	h.handleSubscribe(&Request{client: b, Request: message.Request{Streams: []string{"eurusd.trades", "eurusd.*"}}})
+
+	assert.Equal(t, 2, h.publicTopics()["eurusd.trades"].broadcast(&Event{Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades", Body: []byte(`{}`)}))
+	assert.Equal(t, 2, h.broadcastWildcard(&Event{Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades", Body: []byte(`{}`)}, h.publicTopics()["eurusd.trades"], h.wildcardsOf("eurusd.trades")))
+	assert.Equal(t, 1, h.broadcastWildcard(&Event{Scope: "public", Stream: "eurusd", Type: "ob-inc", Topic: "eurusd.ob-inc", Body: []byte(`{}`)}, nil, h.wildcardsOf("eurusd.ob-inc")))
+	assert.Empty(t, h.wildcardsOf("usdjpy.trades"), "topics without matching wildcard are broadcast by their topic")
+}
+
+func TestSubscribeAcknowledgement(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+
+	t.Run("lists every current subscription once", func(t *testing.T) {
+		c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "member"}}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "balance"}}})
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "eurusd.ob-inc", "balance"}}})
+		h.handleUnsubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+
+		assert.Equal(t, []string{
+			`{"success":{"message":"subscribed","streams":["eurusd.trades","balance"]}}`,
+			`{"success":{"message":"subscribed","streams":["eurusd.trades","balance","eurusd.ob-inc"]}}`,
+			`{"success":{"message":"unsubscribed","streams":["balance","eurusd.ob-inc"]}}`,
+		}, c.Messages())
+	})
+
+	t.Run("reports rejected streams", func(t *testing.T) {
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "balance", "admin.eurusd.events"}}})
+
+		assert.Equal(t, []string{
+			`{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"balance"}}`,
+			`{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"admin.eurusd.events"}}`,
+			`{"success":{"message":"subscribed","rejected":["balance","admin.eurusd.events"],"streams":["eurusd.trades"]}}`,
+		}, c.Messages())
+	})
+}
+
+func TestSubscribeTwice(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"trader"}})
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+	streams := []string{"eurusd.trades", "order", "finex.eurusd.orders"}
+
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "eurusd.trades"}}})
+
+	ack := subscribed(`"eurusd.trades","order","finex.eurusd.orders"`)
+	assert.Equal(t, []string{ack, ack, ack}, c.Messages())
+	assert.Len(t, h.publicTopics()["eurusd.trades"].clients, 1)
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":1}`)})
+	h.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{"id":2}`)})
+	assert.Equal(t, []string{
+		`{"eurusd.trades":{"price":"1.0"}}`,
+		`{"order":{"id":1}}`,
+		`{"eurusd.orders":{"id":2}}`,
+	}, c.Messages()[3:])
+
+	t.Run("replays the history once", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.HistoryDepth = 10
+
+		h := NewHub(nil, opts)
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+
+		c := &recorderClient{}
+		seq := uint64(1)
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "eurusd.trades"}, FromSeq: &seq}})
+		assert.Equal(t, []string{subscribed(`"eurusd.trades"`), `{"eurusd.trades":{"price":"1.0"}}`}, c.Messages())
+	})
+}
+
+func TestSubscribePartialRBAC(t *testing.T) {
+	h := NewHub(map[string][]string{
+		"admin": {"admin"},
+		"finex": {"trader", "admin"},
+	})
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{
+		"finex.eurusd.orders", "admin.eurusd.events", "eurusd.trades",
+	}}})
+
+	assert.Equal(t, []string{
+		`{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"admin.eurusd.events"}}`,
+		`{"success":{"message":"subscribed","rejected":["admin.eurusd.events"],"streams":["finex.eurusd.orders","eurusd.trades"]}}`,
+	}, c.Messages())
+	assert.Len(t, h.prefixedTopics()["finex"], 1)
+	assert.Empty(t, h.prefixedTopics()["admin"])
+
+	h.ReceiveMsg(&Message{Key: []byte("admin.eurusd.events"), Value: []byte(`{}`)})
+	h.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{"id":1}`)})
+	assert.Equal(t, `{"eurusd.orders":{"id":1}}`, c.Messages()[2])
+	assert.Len(t, c.Messages(), 3)
+}
+
+func TestSubscribeMinLevel(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MinLevels = map[string]int{"finex": 3}
+	h := NewHub(map[string][]string{"finex": {"trader"}}, opts)
+
+	t.Run("refuses an allowed role below the level", func(t *testing.T) {
+		c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader", Level: 2}}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"finex.eurusd.orders"}}})
+
+		assert.Equal(t, []string{
+			`{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"finex.eurusd.orders"}}`,
+			`{"success":{"message":"subscribed","rejected":["finex.eurusd.orders"],"streams":[]}}`,
+		}, c.Messages())
+	})
+
+	t.Run("subscribes an allowed role reaching the level", func(t *testing.T) {
+		c := &recorderClient{auth: Auth{UID: "UIDABC00002", Role: "trader", Level: 3}}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"finex.eurusd.orders"}}})
+
+		assert.Equal(t, []string{subscribed(`"finex.eurusd.orders"`)}, c.Messages())
+	})
+
+	t.Run("refuses a disallowed role above the level", func(t *testing.T) {
+		c := &recorderClient{auth: Auth{UID: "UIDABC00003", Role: "member", Level: 4}}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"finex.eurusd.orders"}}})
+
+		assert.Contains(t, c.Messages(), `{"success":{"message":"subscribed","rejected":["finex.eurusd.orders"],"streams":[]}}`)
+	})
+}
+
+func TestRequestAuth(t *testing.T) {
+	h := NewHub(nil)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("JwtUID", "UIDABC00001")
+	r.Header.Set("JwtRole", "trader")
+	r.Header.Set("JwtLevel", "3")
+	assert.Equal(t, Auth{UID: "UIDABC00001", Role: "trader", Level: 3}, h.requestAuth(r))
+
+	r.Header.Set("JwtLevel", "high")
+	assert.Equal(t, 0, h.requestAuth(r).Level)
+}
+
+func TestPrivateRouting(t *testing.T) {
+	h := NewHub(nil)
+	alice := &recorderClient{auth: Auth{UID: "UIDALICE001", Role: "member"}}
+	bob := &recorderClient{auth: Auth{UID: "UIDBOB00001", Role: "member"}}
+	h.handleSubscribe(&Request{client: alice, Request: message.Request{Streams: []string{"order", "balance"}}})
+	h.handleSubscribe(&Request{client: bob, Request: message.Request{Streams: []string{"order", "balance"}}})
+
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDBOB00001.order"), Value: []byte(`{"id":1}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDALICE001.balance"), Value: []byte(`{"eur":"10"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDCAROL01.order"), Value: []byte(`{"id":2}`)})
+
+	assert.Equal(t, []string{subscribed(`"order","balance"`), `{"balance":{"eur":"10"}}`}, alice.Messages())
+	assert.Equal(t, []string{subscribed(`"order","balance"`), `{"order":{"id":1}}`}, bob.Messages())
+
+	t.Run("never sends to another user registered on the topic", func(t *testing.T) {
+		h.privateTopics()["UIDBOB00001"]["order"].subscribe(alice)
+
+		h.ReceiveMsg(&Message{Key: []byte("private.UIDBOB00001.order"), Value: []byte(`{"id":3}`)})
+		assert.Equal(t, `{"order":{"id":3}}`, bob.Messages()[2])
+		assert.Len(t, alice.Messages(), 2)
+	})
+}
+
+func TestSourceTopic(t *testing.T) {
+	h := NewHub(nil)
+	assert.Equal(t, "rango.events", h.sourceTopic("rango.events"))
+
+	opts := DefaultHubOptions()
+	opts.SourceTopics = []string{"rango.events"}
+	h = NewHub(nil, opts)
+	assert.Equal(t, "rango.events", h.sourceTopic("rango.events"))
+	assert.Equal(t, "other", h.sourceTopic("unexpected"))
+}
+
+func TestReceiveMsgTopics(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.TopicScopes = map[string]string{"rango.private": "private"}
+	h := NewHub(nil, opts)
+
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001"}}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "balance"}}})
+
+	h.ReceiveMsg(&Message{Topic: "rango.public", Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Topic: "rango.private", Key: []byte("UIDABC00001.balance"), Value: []byte(`{"eur":"10"}`)})
+	h.ReceiveMsg(&Message{Topic: "rango.private", Key: []byte("UIDABC00002.balance"), Value: []byte(`{"eur":"20"}`)})
+
+	assert.Equal(t, []string{
+		subscribed(`"eurusd.trades","balance"`),
+		`{"eurusd.trades":{"price":"1.0"}}`,
+		`{"balance":{"eur":"10"}}`,
+	}, c.Messages())
+}
+
+func TestReceiveMsgUnroutable(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.SourceTopics = []string{"rango.events"}
+	h := NewHub(nil, opts)
+
+	c := &recorderClient{}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+
+	unknown := counterValue(t, "rango_unroutable_messages_total", "reason", "unknown_topic")
+	malformed := counterValue(t, "rango_unroutable_messages_total", "reason", "malformed_key")
+
+	h.ReceiveMsg(&Message{Topic: "rango.removed", Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Topic: "rango.events", Key: []byte("public.eurusd"), Value: []byte(`{"price":"2.0"}`)})
+	h.ReceiveMsg(&Message{Topic: "rango.events", Key: []byte("public..trades"), Value: []byte(`{"price":"3.0"}`)})
+	h.ReceiveMsg(&Message{Topic: "rango.events", Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"4.0"}`)})
+
+	assert.Equal(t, []string{subscribed(`"eurusd.trades"`), `{"eurusd.trades":{"price":"4.0"}}`}, c.Messages())
+	assert.Equal(t, unknown+1, counterValue(t, "rango_unroutable_messages_total", "reason", "unknown_topic"))
+	assert.Equal(t, malformed+2, counterValue(t, "rango_unroutable_messages_total", "reason", "malformed_key"))
+}
+
+func TestInjectMsg(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.SourceTopics = []string{"rango.events"}
+	opts.TopicScopes = map[string]string{"": "private"}
+	h := NewHub(nil, opts)
+
+	c := &recorderClient{}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"probe.ticks"}}})
+
+	h.InjectMsg(&Message{Key: []byte("public.probe.ticks"), Value: []byte(`{"at":1}`)})
+	h.InjectMsg(&Message{Key: []byte("public.probe"), Value: []byte(`{"at":2}`)})
+
+	assert.Equal(t, []string{subscribed(`"probe.ticks"`), `{"probe.ticks":{"at":1}}`}, c.Messages())
+	assert.True(t, h.LastMessageAt().IsZero(), "injected messages aren't upstream messages")
+}
+
+func TestHubDefaultStreams(t *testing.T) {
+	h := NewHub(nil)
+	assert.Equal(t, []string{"eurusd.trades"}, h.defaultStreams(Auth{UID: "UIDABC00001", Role: "admin"}, []string{"eurusd.trades"}))
+
+	opts := DefaultHubOptions()
+	opts.DefaultStreams = map[string][]string{
+		"admin":       {"global.tickers", "finex.eurusd.orders", ""},
+		anonymousRole: {"global.tickers"},
+	}
+	h = NewHub(nil, opts)
+	assert.Equal(t,
+		[]string{"eurusd.trades", "global.tickers", "finex.eurusd.orders"},
+		h.defaultStreams(Auth{UID: "UIDABC00001", Role: "admin"}, []string{"eurusd.trades", "global.tickers"}),
+	)
+	assert.Equal(t, []string{"global.tickers"}, h.defaultStreams(Auth{}, []string{}))
+	assert.Equal(t, []string{}, h.defaultStreams(Auth{UID: "UIDABC00001", Role: "member"}, []string{}))
+}
+
+func TestReceiveMsgPrefixes(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.PublicPrefixes = []string{"market"}
+	opts.PrivatePrefixes = []string{"user", "account"}
+	h := NewHub(map[string][]string{"finex": {"trader"}}, opts)
+
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{
+		"eurusd.trades", "balance", "order", "finex.eurusd.orders",
+	}}})
+
+	h.ReceiveMsg(&Message{Key: []byte("market.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("user.UIDABC00001.balance"), Value: []byte(`{"eur":"10"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("user.UIDABC00002.balance"), Value: []byte(`{"eur":"20"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("account.UIDABC00001.order"), Value: []byte(`{"id":1}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":2}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"2.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{"id":3}`)})
+
+	assert.Equal(t, []string{
+		subscribed(`"eurusd.trades","balance","order","finex.eurusd.orders"`),
+		`{"eurusd.trades":{"price":"1.0"}}`,
+		`{"balance":{"eur":"10"}}`,
+		`{"order":{"id":1}}`,
+		`{"order":{"id":2}}`,
+		`{"eurusd.trades":{"price":"2.0"}}`,
+		`{"eurusd.orders":{"id":3}}`,
+	}, c.Messages())
+}
+
+func TestUnsubscribeAll(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"trader"}})
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{
+		"eurusd.trades", "usdjpy.*", "balance", "finex.eurusd.orders",
+	}}})
+
+	h.handleUnsubscribe(&Request{client: c, Request: message.Request{Streams: []string{"*"}}})
+	assert.Equal(t, `{"success":{"message":"unsubscribed","streams":[]}}`, c.Messages()[1])
+	assert.Empty(t, c.GetSubscriptions())
+	assert.Empty(t, h.publicTopics())
+	assert.Empty(t, h.privateTopics())
+	assert.Empty(t, h.prefixedTopics())
+	assert.Empty(t, h.wildcardTopics)
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.balance"), Value: []byte(`{}`)})
+	h.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{}`)})
+	assert.Len(t, c.Messages(), 2, "no message is sent once unsubscribed")
+}
+
+// publicTopics returns the public topics of every shard.
+func (h *Hub) publicTopics() map[string]*Topic {
+	topics := map[string]*Topic{}
+	for _, s := range h.shards {
+		for t, topic := range s.public {
+			topics[t] = topic
+		}
+	}
+	return topics
+}
+
+// privateTopics returns the private topics of every shard.
+func (h *Hub) privateTopics() map[string]map[string]*Topic {
+	topics := map[string]map[string]*Topic{}
+	for _, s := range h.shards {
+		for uid, uTopics := range s.private {
+			topics[uid] = uTopics
+		}
+	}
+	return topics
+}
+
+// prefixedTopics returns the prefixed topics of every shard.
+func (h *Hub) prefixedTopics() map[string]map[string]*Topic {
+	topics := map[string]map[string]*Topic{}
+	for _, s := range h.shards {
+		for prefix, scope := range s.prefixed {
+			if topics[prefix] == nil {
+				topics[prefix] = map[string]*Topic{}
+			}
+			for t, topic := range scope {
+				topics[prefix][t] = topic
+			}
+		}
+	}
+	return topics
+}
+
+// snapshots returns the snapshots of every shard.
+func (h *Hub) snapshots() map[string]*snapshot {
+	snapshots := map[string]*snapshot{}
+	for _, s := range h.shards {
+		for t, snap := range s.snapshots {
+			snapshots[t] = snap
+		}
+	}
+	return snapshots
+}
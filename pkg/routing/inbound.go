@@ -0,0 +1,43 @@
+package routing
+
+import (
+	"sync/atomic"
+
+	"github.com/nusa-exchange/rango/pkg/metrics"
+)
+
+// Enqueue queues an upstream message for ListenInbound. While the queue is
+// full it blocks the source, or drops the message with the InboundDrop option.
+// Without inbound queue the message is dispatched right away.
+func (h *Hub) Enqueue(msg *Message) {
+	if h.inbound == nil {
+		h.ReceiveMsg(msg)
+		return
+	}
+
+	if h.inboundDrop {
+		select {
+		case h.inbound <- msg:
+		default:
+			atomic.AddInt64(&dropCounts.inbound, 1)
+			metrics.RecordInboundDropped()
+			return
+		}
+	} else {
+		h.inbound <- msg
+	}
+	metrics.RecordInboundQueueDepth(len(h.inbound))
+}
+
+// ListenInbound dispatches the queued upstream messages in order, it returns
+// right away without inbound queue.
+func (h *Hub) ListenInbound() {
+	if h.inbound == nil {
+		return
+	}
+
+	for msg := range h.inbound {
+		metrics.RecordInboundQueueDepth(len(h.inbound))
+		h.ReceiveMsg(msg)
+	}
+}
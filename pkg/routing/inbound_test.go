@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// inboundHub returns a hub queuing size upstream messages, dropping them when
+// full if drop, and a client subscribed to eurusd.trades.
+func inboundHub(size int, drop bool) (*Hub, *recorderClient) {
+	opts := DefaultHubOptions()
+	opts.InboundQueue, opts.InboundDrop = size, drop
+
+	h := NewHub(nil, opts)
+	c := &recorderClient{}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	return h, c
+}
+
+func trade(price int) *Message {
+	return &Message{Key: []byte("public.eurusd.trades"), Value: []byte(fmt.Sprintf(`{"price":"%d"}`, price))}
+}
+
+func gaugeValue(t *testing.T, name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestEnqueue(t *testing.T) {
+	t.Run("dispatches right away without queue", func(t *testing.T) {
+		h, c := inboundHub(0, false)
+		h.Enqueue(trade(1))
+		assert.Equal(t, []string{subscribed(`"eurusd.trades"`), `{"eurusd.trades":{"price":"1"}}`}, c.Messages())
+		h.ListenInbound()
+	})
+
+	t.Run("drops messages when full", func(t *testing.T) {
+		h, c := inboundHub(2, true)
+		dropped := counterValue(t, "rango_inbound_dropped_total", "", "")
+
+		for price := 1; price <= 3; price++ {
+			h.Enqueue(trade(price))
+		}
+		assert.Equal(t, dropped+1, counterValue(t, "rango_inbound_dropped_total", "", ""))
+		assert.Equal(t, float64(2), gaugeValue(t, "rango_inbound_queue_depth"))
+		assert.Len(t, c.Messages(), 1, "queued messages wait for the listener")
+
+		go h.ListenInbound()
+		require.Eventually(t, func() bool { return len(c.Messages()) == 3 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{`{"eurusd.trades":{"price":"1"}}`, `{"eurusd.trades":{"price":"2"}}`}, c.Messages()[1:])
+	})
+
+	t.Run("blocks the source when full", func(t *testing.T) {
+		h, c := inboundHub(1, false)
+		dropped := counterValue(t, "rango_inbound_dropped_total", "", "")
+
+		h.Enqueue(trade(1))
+		enqueued := make(chan struct{})
+		go func() {
+			h.Enqueue(trade(2))
+			close(enqueued)
+		}()
+
+		select {
+		case <-enqueued:
+			t.Fatal("enqueued in a full queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		go h.ListenInbound()
+		<-enqueued
+		require.Eventually(t, func() bool { return len(c.Messages()) == 3 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{`{"eurusd.trades":{"price":"1"}}`, `{"eurusd.trades":{"price":"2"}}`}, c.Messages()[1:])
+		assert.Equal(t, dropped, counterValue(t, "rango_inbound_dropped_total", "", ""))
+	})
+}
+
+func benchmarkEnqueue(b *testing.B, size int) {
+	h, _ := inboundHub(size, false)
+	for i := 0; i < 100; i++ {
+		h.handleSubscribe(&Request{client: &recorderClient{}, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	}
+	go h.ListenInbound()
+	msg := trade(1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Enqueue(msg)
+	}
+}
+
+func BenchmarkEnqueueSynchronous(b *testing.B) {
+	benchmarkEnqueue(b, 0)
+}
+
+func BenchmarkEnqueueQueued(b *testing.B) {
+	benchmarkEnqueue(b, 1024)
+}
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"math"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second.
+// A nil limiter allows everything.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := math.Max(1, math.Ceil(rate))
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Allow consumes a token, it returns false if the bucket is empty.
+func (l *rateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,39 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(5)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Allow(), "burst message %d", i)
+	}
+	assert.False(t, l.Allow(), "limiter should trip after the burst")
+
+	now = now.Add(200 * time.Millisecond)
+	assert.True(t, l.Allow(), "a token is refilled after 1/rate second")
+	assert.False(t, l.Allow())
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Allow(), "refill is capped to the burst")
+	}
+	assert.False(t, l.Allow())
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0)
+	assert.Nil(t, l)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, l.Allow())
+	}
+}
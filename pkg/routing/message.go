@@ -0,0 +1,29 @@
+package routing
+
+import "time"
+
+// Header is a key value pair attached to an upstream message.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is an upstream message received by the hub, independent of the
+// transport it was consumed from.
+type Message struct {
+	Topic     string    // topic or subject the message was received on
+	Key       []byte    // routing key, e.g. public.ethusdt.trades
+	Value     []byte    // event json body
+	Headers   []Header  // message headers, in order, keys may repeat
+	Timestamp time.Time // time the message was produced
+}
+
+// Header returns the value of the first header with the given key.
+func (m *Message) Header(key string) ([]byte, bool) {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
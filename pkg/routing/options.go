@@ -0,0 +1,325 @@
+package routing
+
+import (
+	"compress/flate"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HubOptions configure a hub and its connections, see NewHub. The options
+// requiring a positive value take their default when zero, see
+// DefaultHubOptions.
+type HubOptions struct {
+	// Messages buffered for a client before ClientOverflow applies.
+	ClientBuffer int
+
+	// Policy applied to the messages sent to a client with a full buffer,
+	// drop_oldest, drop_newest or disconnect.
+	ClientOverflow string
+
+	// Maximum connections of the hub, of an authenticated user and of an IP
+	// address without user, 0 disables the limit.
+	MaxConnections        int
+	MaxConnectionsPerUser int
+	MaxConnectionsPerIP   int
+
+	// Maximum messages per second and streams subscribed of authenticated
+	// connections, 0 disables the limit.
+	MessagesPerSec   float64
+	MaxSubscriptions int
+
+	// Limits of anonymous connections.
+	AnonymousMessagesPerSec   float64
+	AnonymousMaxSubscriptions int
+
+	// Rate limit violations and consecutive invalid messages after which a
+	// connection is closed, 0 never closes it.
+	MaxRateViolations  int
+	MaxInvalidMessages int
+
+	// Upstream messages queued for ListenInbound, 0 dispatches them right
+	// away, and whether they are dropped rather than blocking the source
+	// while the queue is full.
+	InboundQueue int
+	InboundDrop  bool
+
+	// Time connections are kept past the expiry of their token.
+	TokenExpiryGrace time.Duration
+
+	// Time connections are kept without subscription, 0 keeps them.
+	SubscribeGrace time.Duration
+
+	// Time given to the connections authenticating with their first frame.
+	AuthTimeout time.Duration
+
+	// Time after which connections are closed with codeReconnect for their
+	// client to reconnect, possibly to another replica, 0 disables the limit,
+	// and the fraction of it randomly cut from each connection to spread the
+	// reconnections of the connections opened together.
+	MaxConnectionLifetime    time.Duration
+	ConnectionLifetimeJitter float64
+
+	// Time allowed to write a message to the peer, the connection of clients
+	// not reading their messages is closed past it.
+	WriteTimeout time.Duration
+
+	// Interval of the pings sent to the peer, and consecutive pongs it may
+	// miss before being disconnected.
+	PingInterval   time.Duration
+	MaxMissedPongs int
+
+	// Maximum size of the frames read from the peer, larger frames close the
+	// connection with CloseMessageTooBig.
+	MaxFrameBytes int
+
+	// Sizes in bytes of the read and write buffers of the connections, larger
+	// messages are read and written in several chunks, and whether the write
+	// buffers are shared between the connections, a connection only holding
+	// one while writing a message.
+	ReadBufferSize  int
+	WriteBufferSize int
+	WriteBufferPool bool
+
+	// Compression level of permessage-deflate (see compress/flate), 0
+	// disables compression, and size in bytes under which messages are sent
+	// uncompressed.
+	CompressionLevel    int
+	CompressionMinBytes int
+
+	// Coalesce the JSON messages queued while the socket is backed up into a
+	// single frame holding a JSON array, of at most CoalesceMax messages.
+	Coalesce    bool
+	CoalesceMax int
+
+	// Hosts allowed in the Origin header of websocket requests, e.g.
+	// example.com or *.example.com, the host of the request when empty.
+	AllowedOrigins []string
+
+	// Delay batching the messages dropped for a client before notifying it
+	// with a backpressure event per stream, 0 disables the notices.
+	BackpressureInterval time.Duration
+
+	// Time a stream message may stay queued for a client, older messages are
+	// dropped by the write loop rather than flooding a client catching up
+	// with stale data, 0 disables the TTL. Conflated messages being the
+	// latest of their stream are never dropped.
+	MessageTTL time.Duration
+
+	// Time the subscriptions of a disconnected client can be resumed.
+	SessionTTL time.Duration
+
+	// Time a poll is held open waiting for messages, and time a polling
+	// session is kept without polls.
+	PollTimeout    time.Duration
+	PollSessionTTL time.Duration
+
+	// Number of shards of the subscriptions, streams are hashed to a shard so
+	// that dispatching to and subscribing to streams of different shards
+	// don't contend on a lock.
+	Shards int
+
+	// Messages retained by public and prefixed stream for the clients
+	// catching up with from_seq, 0 disables the history.
+	HistoryDepth int
+
+	// Maximum increments kept after a snapshot, the snapshot is dropped past
+	// it.
+	MaxSnapshotIncrements int
+
+	// Time a stream stays listed as active after its last message, and
+	// maximum number of active streams tracked.
+	ActiveStreamsTTL time.Duration
+	MaxActiveStreams int
+
+	// Maximum conditions of a subscription filter.
+	MaxFilterConditions int
+
+	// Log every subscription change for auditing.
+	AuditLog bool
+
+	// Prefixes of the message keys routed as public or private messages, in
+	// addition to public, global and private, e.g. user for
+	// user.UIDABC00001.balance. Other prefixes are routed to RBAC scopes.
+	PublicPrefixes  []string
+	PrivatePrefixes []string
+
+	// map[prefix -> minimum level] of the prefixed streams requiring a user
+	// level in addition to an allowed role.
+	MinLevels map[string]int
+
+	// Suffixes of the topics retaining their last snapshot, e.g. ob-inc
+	SnapshotSuffixes []string
+
+	// map[stream -> transform] of the streams whose payloads are transformed
+	// before being sent, e.g. eurusd.ob-inc sent with the ob-delta transform.
+	Transforms map[string]Transform
+
+	// Upstream topics consumed, messages of other topics are recorded as
+	// "other" in metrics and dropped as unroutable. Empty to route every topic.
+	SourceTopics []string
+
+	// map[upstream topic -> scope] of the topics bound to a scope, their
+	// message keys omit the scope, e.g. UIDABC00001.balance on a topic bound
+	// to private is routed as private.UIDABC00001.balance.
+	TopicScopes map[string]string
+
+	// map[role -> streams] subscribed by the connections of the role as they
+	// connect, anonymousRole for anonymous connections.
+	DefaultStreams map[string][]string
+
+	// Request headers carrying the UID, role and level of the user
+	// authenticated by the HTTP handler.
+	UIDHeader   string
+	RoleHeader  string
+	LevelHeader string
+
+	// Networks of the proxies trusted to forward the client IP address in the
+	// X-Forwarded-For or X-Real-IP headers, none by default.
+	TrustedProxies []*net.IPNet
+
+	// Subprotocol offered by browsers before their token, see
+	// SubprotocolToken, and selected when no other subprotocol is supported.
+	// Tokens aren't accepted as subprotocols when empty.
+	AuthSubprotocol string
+
+	// Version of the server advertised to clients in the hello message,
+	// the module version from the build info by default.
+	Version string
+}
+
+// DefaultHubOptions returns the default options of a hub.
+func DefaultHubOptions() HubOptions {
+	return HubOptions{
+		ClientBuffer:             256,
+		ClientOverflow:           string(overflowDisconnect),
+		MessagesPerSec:           10,
+		AnonymousMessagesPerSec:  10,
+		MaxInvalidMessages:       10,
+		TokenExpiryGrace:         10 * time.Second,
+		AuthTimeout:              5 * time.Second,
+		ConnectionLifetimeJitter: 0.1,
+		WriteTimeout:             10 * time.Second,
+		PingInterval:             54 * time.Second,
+		MaxMissedPongs:           1,
+		MaxFrameBytes:            64 * 1024,
+		ReadBufferSize:           1024,
+		WriteBufferSize:          1024,
+		WriteBufferPool:          true,
+		CompressionLevel:         flate.BestSpeed,
+		CompressionMinBytes:      512,
+		CoalesceMax:              64,
+		BackpressureInterval:     time.Second,
+		SessionTTL:               5 * time.Minute,
+		PollTimeout:              25 * time.Second,
+		PollSessionTTL:           time.Minute,
+		Shards:                   16,
+		MaxSnapshotIncrements:    1000,
+		ActiveStreamsTTL:         5 * time.Minute,
+		MaxActiveStreams:         1000,
+		MaxFilterConditions:      8,
+		UIDHeader:                DefaultUIDHeader,
+		RoleHeader:               DefaultRoleHeader,
+		LevelHeader:              DefaultLevelHeader,
+		Version:                  buildVersion(),
+	}
+}
+
+// withDefaults returns the options with the defaults in place of the zero
+// options requiring a value.
+func (o HubOptions) withDefaults() HubOptions {
+	d := DefaultHubOptions()
+	positive := func(v *int, def int) {
+		if *v <= 0 {
+			*v = def
+		}
+	}
+	positiveDuration := func(v *time.Duration, def time.Duration) {
+		if *v <= 0 {
+			*v = def
+		}
+	}
+	nonEmpty := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+
+	positive(&o.ClientBuffer, d.ClientBuffer)
+	nonEmpty(&o.ClientOverflow, d.ClientOverflow)
+	positiveDuration(&o.AuthTimeout, d.AuthTimeout)
+	positiveDuration(&o.WriteTimeout, d.WriteTimeout)
+	positiveDuration(&o.PingInterval, d.PingInterval)
+	positive(&o.MaxFrameBytes, d.MaxFrameBytes)
+	positive(&o.ReadBufferSize, d.ReadBufferSize)
+	positive(&o.WriteBufferSize, d.WriteBufferSize)
+	positive(&o.CoalesceMax, d.CoalesceMax)
+	positiveDuration(&o.SessionTTL, d.SessionTTL)
+	positiveDuration(&o.PollTimeout, d.PollTimeout)
+	positiveDuration(&o.PollSessionTTL, d.PollSessionTTL)
+	positive(&o.Shards, d.Shards)
+	positive(&o.MaxSnapshotIncrements, d.MaxSnapshotIncrements)
+	positiveDuration(&o.ActiveStreamsTTL, d.ActiveStreamsTTL)
+	positive(&o.MaxActiveStreams, d.MaxActiveStreams)
+	positive(&o.MaxFilterConditions, d.MaxFilterConditions)
+	nonEmpty(&o.UIDHeader, d.UIDHeader)
+	nonEmpty(&o.RoleHeader, d.RoleHeader)
+	nonEmpty(&o.LevelHeader, d.LevelHeader)
+	nonEmpty(&o.Version, d.Version)
+	return o
+}
+
+// Options returns the options of the hub, the defaults without hub.
+func (h *Hub) Options() HubOptions {
+	if h == nil {
+		return DefaultHubOptions()
+	}
+	return h.options
+}
+
+// overflow returns the overflow policy of the options, disconnect if invalid.
+func (o HubOptions) overflow() overflowPolicy {
+	switch p := overflowPolicy(o.ClientOverflow); p {
+	case overflowDropOldest, overflowDropNewest, overflowDisconnect:
+		return p
+	default:
+		return overflowDisconnect
+	}
+}
+
+// limitsFor returns the limits of a connection, authenticated when it has a
+// UID.
+func (o HubOptions) limitsFor(auth Auth) clientLimits {
+	if auth.UID == "" {
+		return clientLimits{messagesPerSec: o.AnonymousMessagesPerSec, maxSubscriptions: o.AnonymousMaxSubscriptions}
+	}
+	return clientLimits{messagesPerSec: o.MessagesPerSec, maxSubscriptions: o.MaxSubscriptions}
+}
+
+// pongWait returns the time allowed to read the next pong message from the
+// peer.
+func (o HubOptions) pongWait() time.Duration {
+	return o.PingInterval*time.Duration(o.MaxMissedPongs+1) + o.WriteTimeout
+}
+
+// connectionLifetime returns the jittered lifetime of a new connection, 0 if
+// unlimited.
+func (o HubOptions) connectionLifetime() time.Duration {
+	if o.MaxConnectionLifetime <= 0 {
+		return 0
+	}
+	jitter := time.Duration(rand.Float64() * o.ConnectionLifetimeJitter * float64(o.MaxConnectionLifetime))
+	if jitter >= o.MaxConnectionLifetime {
+		jitter = 0
+	}
+	return o.MaxConnectionLifetime - jitter
+}
+
+// validate logs the invalid options.
+func (o HubOptions) validate() {
+	if o.overflow() != overflowPolicy(o.ClientOverflow) {
+		log.Error().Msgf("Invalid client overflow policy %s, disconnecting slow clients", o.ClientOverflow)
+	}
+}
@@ -0,0 +1,91 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestDefaultHubOptions(t *testing.T) {
+	t.Setenv("RANGO_CLIENT_BUFFER", "1")
+	t.Setenv("RANGO_HUB_SHARDS", "1")
+
+	opts := DefaultHubOptions()
+	assert.Equal(t, 256, opts.ClientBuffer, "the environment is read by cmd/rango only")
+	assert.Equal(t, 16, opts.Shards)
+	assert.Equal(t, overflowDisconnect, opts.overflow())
+	assert.Equal(t, clientLimits{messagesPerSec: 10}, opts.limitsFor(Auth{UID: "UIDABC00001"}))
+	assert.Equal(t, clientLimits{messagesPerSec: 10}, opts.limitsFor(Auth{}))
+	assert.Equal(t, 2*54*time.Second+10*time.Second, opts.pongWait())
+	assert.Zero(t, opts.connectionLifetime())
+	assert.Equal(t, opts, NewHub(nil).Options())
+	assert.Len(t, NewHub(nil).shards, 16)
+
+	var hub *Hub
+	assert.Equal(t, opts, hub.Options(), "clients without hub use the defaults")
+}
+
+func TestNewHubOptions(t *testing.T) {
+	opts := HubOptions{
+		ClientBuffer:     1,
+		ClientOverflow:   "drop_newest",
+		MaxConnections:   2,
+		MessagesPerSec:   10,
+		InboundQueue:     4,
+		AuthTimeout:      time.Second,
+		TokenExpiryGrace: time.Second,
+		PublicPrefixes:   []string{"market"},
+		PrivatePrefixes:  []string{"user"},
+	}
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	assert.Equal(t, "drop_newest", hub.Options().ClientOverflow)
+	assert.Equal(t, 2, hub.MaxConnections())
+	assert.Equal(t, 4, cap(hub.inbound))
+	assert.Equal(t, []string{"market"}, hub.Options().PublicPrefixes)
+	assert.Equal(t, []string{"user"}, hub.Options().PrivatePrefixes)
+
+	defaults := DefaultHubOptions()
+	assert.Equal(t, defaults.PingInterval, hub.Options().PingInterval, "zero options requiring a value take their default")
+	assert.Len(t, hub.shards, defaults.Shards)
+	assert.Zero(t, hub.Options().MaxSubscriptions, "zero limits are kept")
+
+	t.Run("client buffer and overflow", func(t *testing.T) {
+		c := &Client{hub: hub, send: make(chan string, hub.Options().ClientBuffer), latest: map[string]string{}}
+		assert.True(t, c.Send("first"))
+		assert.False(t, c.Send("second"))
+		assert.Equal(t, "first", <-c.send)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		c := &Client{hub: hub, send: make(chan string, 10), pubSub: []string{}, privSub: []string{}}
+		hub.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+		assert.Equal(t, []string{"eurusd.trades"}, c.GetSubscriptions())
+		assert.Equal(t, clientLimits{messagesPerSec: 10}, hub.Options().limitsFor(Auth{UID: "UIDABC00001"}))
+	})
+
+	t.Run("invalid overflow policy", func(t *testing.T) {
+		assert.Equal(t, overflowDisconnect, HubOptions{ClientOverflow: "block"}.overflow())
+	})
+}
+
+func TestNewHubPartialOptions(t *testing.T) {
+	hub := NewHub(nil, HubOptions{MaxConnections: 100})
+	go hub.ListenWebsocketEvents()
+
+	conn, teardown := dial(t, hub, "/?stream=eurusd.trades")
+	defer teardown()
+
+	for i := 0; i < 3; i++ {
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"eurusd.trades":{"price":"1.0"}}`, string(msg))
+	}
+	assert.Equal(t, 1, hub.ClientsCount())
+}
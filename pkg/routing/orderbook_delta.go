@@ -0,0 +1,160 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// OrderbookDelta is the ob-delta transform of orderbook payloads, e.g. of the
+// ob-inc streams, sending the prices of each side as deltas from the previous
+// level rather than as strings repeating most of their digits.
+//
+// The asks and bids of the payload, lists of [price, amount] levels, are sent
+// as
+//
+//	{"scale":4,"prices":[12345,5,10],"amounts":["1.5","0.2","3"]}
+//
+// for the levels [["1.2345","1.5"],["1.2350","0.2"],["1.2360","3"]]. Prices
+// are integers in units of 10^-scale, the first one being the price of the
+// first level and the next ones the difference with the price of the previous
+// level. Amounts are kept as is, like the other fields of the payload.
+//
+// A side is sent unchanged unless all its prices are non negative decimals
+// with the same number of decimals, written without leading zeros or
+// exponent, so that the prices decoded are the strings published.
+type OrderbookDelta struct{}
+
+// orderbookSides are the fields of orderbook payloads holding price levels.
+var orderbookSides = []string{"asks", "bids"}
+
+// deltaSide is a side of an orderbook encoded by OrderbookDelta.
+type deltaSide struct {
+	Scale   int      `json:"scale"`
+	Prices  []int64  `json:"prices"`
+	Amounts []string `json:"amounts"`
+}
+
+// Encode returns the payload body with the prices of its sides delta encoded.
+func (OrderbookDelta) Encode(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, name := range orderbookSides {
+		var levels [][]string
+		if err := json.Unmarshal(fields[name], &levels); err != nil || len(levels) == 0 {
+			continue
+		}
+		side, ok := encodeSide(levels)
+		if !ok {
+			continue
+		}
+		raw, err := json.Marshal(side)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = raw
+	}
+
+	return json.Marshal(fields)
+}
+
+// Decode returns the payload encoded by Encode as published.
+func (OrderbookDelta) Decode(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, name := range orderbookSides {
+		raw, ok := fields[name]
+		if !ok || !strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+			continue
+		}
+		var side deltaSide
+		if err := json.Unmarshal(raw, &side); err != nil {
+			return nil, err
+		}
+		levels, err := decodeSide(side)
+		if err != nil {
+			return nil, err
+		}
+		if fields[name], err = json.Marshal(levels); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// encodeSide returns the levels delta encoded, false if they can't be.
+func encodeSide(levels [][]string) (deltaSide, bool) {
+	side := deltaSide{
+		Prices:  make([]int64, len(levels)),
+		Amounts: make([]string, len(levels)),
+	}
+
+	var previous int64
+	for i, level := range levels {
+		if len(level) != 2 {
+			return deltaSide{}, false
+		}
+		units, scale, ok := parseDecimal(level[0])
+		if !ok || i != 0 && scale != side.Scale {
+			return deltaSide{}, false
+		}
+		side.Scale = scale
+		side.Prices[i] = units - previous
+		side.Amounts[i] = level[1]
+		previous = units
+	}
+	return side, true
+}
+
+// decodeSide returns the levels of the delta encoded side.
+func decodeSide(side deltaSide) ([][]string, error) {
+	if len(side.Prices) != len(side.Amounts) || side.Scale < 0 {
+		return nil, errors.New("invalid orderbook delta")
+	}
+
+	levels := make([][]string, len(side.Prices))
+	var units int64
+	for i, delta := range side.Prices {
+		units += delta
+		if units < 0 {
+			return nil, errors.New("invalid orderbook delta")
+		}
+		levels[i] = []string{formatDecimal(units, side.Scale), side.Amounts[i]}
+	}
+	return levels, nil
+}
+
+// parseDecimal returns the decimal s in units of 10^-scale, scale being its
+// number of decimals, false unless s is formatted as formatDecimal does.
+func parseDecimal(s string) (int64, int, bool) {
+	digits, decimals := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		digits, decimals = s[:i], s[i+1:]
+	}
+
+	units, err := strconv.ParseInt(digits+decimals, 10, 64)
+	if err != nil || units < 0 || formatDecimal(units, len(decimals)) != s {
+		return 0, 0, false
+	}
+	return units, len(decimals), true
+}
+
+// formatDecimal returns the decimal of units of 10^-scale.
+func formatDecimal(units int64, scale int) string {
+	s := strconv.FormatInt(units, 10)
+	if scale == 0 {
+		return s
+	}
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	return s[:len(s)-scale] + "." + s[len(s)-scale:]
+}
@@ -0,0 +1,78 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderbookDelta(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		encoded string
+	}{
+		"both sides": {
+			`{"asks":[["1.2345","1.5"],["1.2350","0.2"],["1.2360","3"]],"bids":[["1.2340","2"],["1.2300","0.01"]],"sequence":42}`,
+			`{"asks":{"scale":4,"prices":[12345,5,10],"amounts":["1.5","0.2","3"]},"bids":{"scale":4,"prices":[12340,-40],"amounts":["2","0.01"]},"sequence":42}`,
+		},
+		"integer prices": {
+			`{"asks":[["100","1"],["101","2"]]}`,
+			`{"asks":{"scale":0,"prices":[100,1],"amounts":["1","2"]}}`,
+		},
+		"leading zero decimals": {
+			`{"bids":[["0.0012","5"],["0.0011","6"]]}`,
+			`{"bids":{"scale":4,"prices":[12,-1],"amounts":["5","6"]}}`,
+		},
+		"removed levels": {
+			`{"asks":[["1.10",""],["1.20","0"]]}`,
+			`{"asks":{"scale":2,"prices":[110,10],"amounts":["","0"]}}`,
+		},
+		"mixed scales kept as is": {
+			`{"asks":[["1.1","1"],["1.25","2"]],"bids":[["1.0","1"]]}`,
+			`{"asks":[["1.1","1"],["1.25","2"]],"bids":{"scale":1,"prices":[10],"amounts":["1"]}}`,
+		},
+		"non canonical prices kept as is": {
+			`{"asks":[["01.5","1"]],"bids":[["1e3","1"]]}`,
+			`{"asks":[["01.5","1"]],"bids":[["1e3","1"]]}`,
+		},
+		"single level kept as is": {
+			`{"asks":["1.5","1"],"bids":[]}`,
+			`{"asks":["1.5","1"],"bids":[]}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := OrderbookDelta{}.Encode([]byte(tt.body))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.encoded, string(encoded))
+
+			decoded, err := OrderbookDelta{}.Decode(encoded)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.body, string(decoded))
+		})
+	}
+
+	t.Run("rejects invalid payloads", func(t *testing.T) {
+		_, err := OrderbookDelta{}.Encode([]byte(`[1,2]`))
+		assert.Error(t, err)
+
+		_, err = OrderbookDelta{}.Decode([]byte(`{"asks":{"scale":2,"prices":[1,-2],"amounts":["1","2"]}}`))
+		assert.Error(t, err)
+	})
+}
+
+func TestFormatDecimal(t *testing.T) {
+	for s, units := range map[string]int64{"0": 0, "7": 7, "0.07": 7, "1.00": 100, "123.4": 1234} {
+		u, scale, ok := parseDecimal(s)
+		require.True(t, ok, s)
+		assert.Equal(t, units, u, s)
+		assert.Equal(t, s, formatDecimal(u, scale))
+	}
+
+	for _, s := range []string{"", ".5", "5.", "-1.5", "1,5", "007"} {
+		_, _, ok := parseDecimal(s)
+		assert.False(t, ok, s)
+	}
+}
@@ -0,0 +1,65 @@
+package routing
+
+import (
+	"sync/atomic"
+
+	"github.com/nusa-exchange/rango/pkg/metrics"
+)
+
+// PauseStream stops dispatching the messages of stream, they are dropped
+// until the stream is resumed while the subscriptions are kept.
+func (h *Hub) PauseStream(stream string) {
+	h.pausedMutex.Lock()
+	defer h.pausedMutex.Unlock()
+
+	if _, ok := h.paused[stream]; !ok {
+		h.paused[stream] = new(int64)
+	}
+}
+
+// ResumeStream dispatches the messages of stream again, it returns the
+// number of messages dropped while the stream was paused.
+func (h *Hub) ResumeStream(stream string) int64 {
+	h.pausedMutex.Lock()
+	defer h.pausedMutex.Unlock()
+
+	dropped, ok := h.paused[stream]
+	if !ok {
+		return 0
+	}
+	delete(h.paused, stream)
+	return atomic.LoadInt64(dropped)
+}
+
+// PausedStreams returns the paused streams and the number of messages
+// dropped since each was paused.
+func (h *Hub) PausedStreams() map[string]int64 {
+	h.pausedMutex.RLock()
+	defer h.pausedMutex.RUnlock()
+
+	streams := make(map[string]int64, len(h.paused))
+	for stream, dropped := range h.paused {
+		streams[stream] = atomic.LoadInt64(dropped)
+	}
+	return streams
+}
+
+// dropPaused returns true if the stream of msg is paused, counting the
+// message as dropped.
+func (h *Hub) dropPaused(msg *Event) bool {
+	h.pausedMutex.RLock()
+	defer h.pausedMutex.RUnlock()
+
+	if len(h.paused) == 0 {
+		return false
+	}
+
+	stream := msg.stream()
+	dropped, ok := h.paused[stream]
+	if !ok {
+		return false
+	}
+	atomic.AddInt64(dropped, 1)
+	metrics.RecordPausedMessage(stream)
+	return true
+}
@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestPauseStream(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"trader"}})
+	c := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "trader"}}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{
+		"eurusd.trades", "usdjpy.trades", "balance", "finex.eurusd.orders",
+	}}})
+
+	h.PauseStream("eurusd.trades")
+	h.PauseStream("balance")
+	h.PauseStream("finex.eurusd.orders")
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"2.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{"price":"3.0"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.balance"), Value: []byte(`{"eur":"10"}`)})
+	h.ReceiveMsg(&Message{Key: []byte("finex.eurusd.orders"), Value: []byte(`{"id":1}`)})
+
+	assert.Equal(t, []string{
+		subscribed(`"eurusd.trades","usdjpy.trades","balance","finex.eurusd.orders"`),
+		`{"usdjpy.trades":{"price":"3.0"}}`,
+	}, c.Messages(), "messages of paused streams are dropped")
+	assert.Equal(t, map[string]int64{"eurusd.trades": 2, "balance": 1, "finex.eurusd.orders": 1}, h.PausedStreams())
+	assert.Equal(t, []string{"eurusd.trades", "usdjpy.trades", "balance", "finex.eurusd.orders"}, c.GetSubscriptions())
+
+	assert.Equal(t, int64(2), h.ResumeStream("eurusd.trades"))
+	assert.Equal(t, int64(0), h.ResumeStream("eurusd.trades"), "resumed streams are not paused")
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"4.0"}`)})
+	assert.Equal(t, `{"eurusd.trades":{"price":"4.0"}}`, c.Messages()[2])
+	assert.Equal(t, map[string]int64{"balance": 1, "finex.eurusd.orders": 1}, h.PausedStreams())
+}
@@ -0,0 +1,326 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	msg "github.com/nusa-exchange/rango/pkg/message"
+	"github.com/nusa-exchange/rango/pkg/metrics"
+)
+
+// pollMessage is a message queued for a polling session.
+type pollMessage struct {
+	seq  uint64
+	data string
+}
+
+// pollResponse is the body of poll responses.
+type pollResponse struct {
+	Cursor   string            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// pollClient is a virtual client subscribed on behalf of a long polling
+// session, it queues messages until they are polled. The session expires
+// when not polled for the PollSessionTTL option of the hub.
+type pollClient struct {
+	hub  *Hub
+	id   string
+	Auth Auth
+
+	pubSub  []string
+	privSub []string
+
+	remoteAddr string
+	limits     clientLimits
+	connKey    string
+	protocol   int
+	combined   bool
+
+	mutex    sync.Mutex
+	messages []pollMessage
+	seq      uint64
+	notify   chan struct{}
+
+	timer   *time.Timer
+	expired sync.Once
+}
+
+// NewPollClient handles long polling requests. The first poll subscribes to
+// the stream query parameters, like for websockets, and starts a session.
+// Following polls pass the cursor returned by the previous one and are held
+// until messages newer than the cursor are queued or the PollTimeout option of
+// the hub elapses.
+func NewPollClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	auth := hub.requestAuth(r)
+
+	var client *pollClient
+	var seq uint64
+
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		client = newPollClient(hub, w, r, auth)
+		if client == nil {
+			return
+		}
+	} else {
+		id, s, err := parseCursor(cursor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hub.mutex.Lock()
+		client = hub.polls[id]
+		hub.mutex.Unlock()
+
+		if client == nil {
+			http.Error(w, "unknown or expired cursor", http.StatusGone)
+			return
+		}
+		if client.Auth.UID != auth.UID {
+			http.Error(w, "cursor of another user", http.StatusForbidden)
+			return
+		}
+		seq = s
+	}
+
+	client.timer.Reset(hub.options.PollSessionTTL)
+	messages, seq := client.poll(r, seq)
+	client.timer.Reset(hub.options.PollSessionTTL)
+
+	resp := pollResponse{
+		Cursor:   fmt.Sprintf("%s.%d", client.id, seq),
+		Messages: make([]json.RawMessage, len(messages)),
+	}
+	for i, m := range messages {
+		resp.Messages[i] = json.RawMessage(m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newPollClient starts a polling session, it writes the error response and
+// returns nil when the connection is refused.
+func newPollClient(hub *Hub, w http.ResponseWriter, r *http.Request, auth Auth) *pollClient {
+	protocol, err := parseProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	combined, err := parseCombined(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if !hub.reserveConnection() {
+		log.Warn().Msgf("Refusing connection, %d clients connected", hub.ClientsCount())
+		metrics.RecordHubConnectionRefused("max_connections")
+		w.Header().Set("Retry-After", strconv.Itoa(connectionsRetryAfter))
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer hub.releaseReservation()
+
+	ip := hub.clientIP(r)
+	key, ok := hub.acquireClientConnection(auth, ip, &log.Logger, refuseHTTP(w))
+	if !ok {
+		return nil
+	}
+
+	client := &pollClient{
+		hub:        hub,
+		id:         uuid.NewString(),
+		Auth:       auth,
+		pubSub:     []string{},
+		privSub:    []string{},
+		remoteAddr: ip,
+		limits:     hub.Options().limitsFor(auth),
+		connKey:    key,
+		protocol:   protocol,
+		combined:   combined,
+		notify:     make(chan struct{}),
+	}
+	client.timer = time.AfterFunc(hub.options.PollSessionTTL, client.expire)
+
+	log.Info().Msgf("New polling session %s (%s)", client.id, auth.UID)
+
+	hub.handleSubscribe(&Request{
+		client: client,
+		Request: msg.Request{
+			Streams: parseStreamsFromURI(r.RequestURI),
+		},
+	})
+
+	hub.mutex.Lock()
+	hub.polls[client.id] = client
+	hub.mutex.Unlock()
+
+	hub.register(client)
+	metrics.RecordHubClientNew()
+
+	return client
+}
+
+// parseCursor returns the session id and the sequence of a cursor.
+func parseCursor(cursor string) (string, uint64, error) {
+	i := strings.LastIndex(cursor, ".")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid cursor %s", cursor)
+	}
+	seq, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor %s", cursor)
+	}
+	return cursor[:i], seq, nil
+}
+
+// poll drops the messages up to seq and waits for newer ones, it returns them
+// with the sequence of the last one.
+func (c *pollClient) poll(r *http.Request, seq uint64) ([]string, uint64) {
+	timeout := time.NewTimer(c.hub.Options().PollTimeout)
+	defer timeout.Stop()
+
+	for {
+		c.mutex.Lock()
+		i := 0
+		for i < len(c.messages) && c.messages[i].seq <= seq {
+			i++
+		}
+		c.messages = c.messages[i:]
+
+		if len(c.messages) != 0 {
+			messages := make([]string, len(c.messages))
+			for i, m := range c.messages {
+				messages[i] = m.data
+			}
+			last := c.messages[len(c.messages)-1].seq
+			c.mutex.Unlock()
+			return messages, last
+		}
+		notify := c.notify
+		c.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-timeout.C:
+			return []string{}, seq
+		case <-r.Context().Done():
+			return []string{}, seq
+		}
+	}
+}
+
+// expire ends the session, unsubscribing the client.
+func (c *pollClient) expire() {
+	c.expired.Do(func() {
+		log.Debug().Msgf("Expiring polling session %s (%s)", c.id, c.Auth.UID)
+		c.timer.Stop()
+
+		c.hub.mutex.Lock()
+		delete(c.hub.polls, c.id)
+		c.hub.mutex.Unlock()
+
+		c.hub.Unregister <- c
+		c.hub.releaseConnection(c.connKey)
+		metrics.RecordHubClientClose()
+	})
+}
+
+// Send queues s until polled, applying ClientOverflow when ClientBuffer
+// messages are queued, the disconnect policy ends the session.
+func (c *pollClient) Send(s string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	opts := c.hub.Options()
+	if len(c.messages) >= opts.ClientBuffer {
+		switch opts.overflow() {
+		case overflowDropOldest:
+			c.messages = c.messages[1:]
+		case overflowDropNewest:
+			return false
+		default:
+			log.Warn().Msgf("Expiring slow polling session %s", c.id)
+			go c.expire()
+			return false
+		}
+		c.queue(s)
+		return false
+	}
+
+	c.queue(s)
+	return true
+}
+
+// queue appends s to the messages and wakes up the pending poll, the mutex
+// must be held.
+func (c *pollClient) queue(s string) {
+	c.seq++
+	c.messages = append(c.messages, pollMessage{seq: c.seq, data: s})
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// Close is a no-op, the session ends when it expires.
+func (c *pollClient) Close() {}
+
+// Disconnect expires the session.
+func (c *pollClient) Disconnect(code int, reason string) {
+	go c.expire()
+}
+
+func (c *pollClient) GetAuth() Auth {
+	return c.Auth
+}
+
+func (c *pollClient) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *pollClient) MaxSubscriptions() int {
+	return c.limits.maxSubscriptions
+}
+
+func (c *pollClient) Protocol() int {
+	return c.protocol
+}
+
+func (c *pollClient) Combined() bool {
+	return c.combined
+}
+
+func (c *pollClient) GetSubscriptions() []string {
+	subs := make([]string, 0, len(c.pubSub)+len(c.privSub))
+	return append(append(subs, c.pubSub...), c.privSub...)
+}
+
+func (c *pollClient) SubscribePublic(s string) {
+	if !contains(c.pubSub, s) {
+		c.pubSub = append(c.pubSub, s)
+	}
+}
+
+func (c *pollClient) SubscribePrivate(s string) {
+	if !contains(c.privSub, s) {
+		c.privSub = append(c.privSub, s)
+	}
+}
+
+func (c *pollClient) UnsubscribePublic(s string) {
+	c.pubSub = remove(c.pubSub, s)
+}
+
+func (c *pollClient) UnsubscribePrivate(s string) {
+	c.privSub = remove(c.privSub, s)
+}
@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// doPoll polls the hub at uri, it returns the response status and body.
+func doPoll(t *testing.T, hub *Hub, uri string, header http.Header) (int, pollResponse) {
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	for k, v := range header {
+		r.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	w := httptest.NewRecorder()
+
+	NewPollClient(hub, w, r)
+
+	var resp pollResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w.Code, resp
+}
+
+func TestPoll(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.PollTimeout = 200 * time.Millisecond
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+	header := http.Header{"JwtUID": {"UIDABC00001"}, "JwtRole": {"member"}}
+
+	code, first := doPoll(t, hub, "/poll?stream=eurusd.trades,order", header)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, first.Messages, 1)
+	assert.JSONEq(t, subscribed(`"eurusd.trades","order"`), string(first.Messages[0]))
+	assert.Equal(t, 1, hub.ClientsCount())
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+
+	code, second := doPoll(t, hub, "/poll?cursor="+first.Cursor, header)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, second.Messages, 1)
+	assert.JSONEq(t, `{"eurusd.trades":{"price":"1.1"}}`, string(second.Messages[0]))
+	assert.NotEqual(t, first.Cursor, second.Cursor)
+
+	t.Run("holds the poll until a message arrives", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			hub.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":1}`)})
+		}()
+
+		code, third := doPoll(t, hub, "/poll?cursor="+second.Cursor, header)
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, third.Messages, 1)
+		assert.JSONEq(t, `{"order":{"id":1}}`, string(third.Messages[0]))
+		second = third
+	})
+
+	t.Run("returns no messages on timeout", func(t *testing.T) {
+		code, resp := doPoll(t, hub, "/poll?cursor="+second.Cursor, header)
+		require.Equal(t, http.StatusOK, code)
+		assert.Empty(t, resp.Messages)
+		assert.Equal(t, second.Cursor, resp.Cursor)
+	})
+
+	t.Run("rejects cursors of another user", func(t *testing.T) {
+		code, _ := doPoll(t, hub, "/poll?cursor="+second.Cursor, http.Header{"JwtUID": {"UIDBOB00001"}})
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("rejects invalid cursors", func(t *testing.T) {
+		code, _ := doPoll(t, hub, "/poll?cursor=invalid", header)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hub.Shutdown(ctx))
+
+	code, _ = doPoll(t, hub, "/poll?cursor="+second.Cursor, header)
+	assert.Equal(t, http.StatusGone, code)
+}
+
+func TestPollSessionExpiry(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.PollSessionTTL = 20 * time.Millisecond
+
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	code, _ := doPoll(t, hub, "/poll?stream=eurusd.trades", http.Header{})
+	require.Equal(t, http.StatusOK, code)
+	assert.Eventually(t, func() bool { return hub.ClientsCount() == 0 }, time.Second, 5*time.Millisecond)
+	assert.NotContains(t, hub.publicTopics(), "eurusd.trades")
+}
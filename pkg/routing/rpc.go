@@ -0,0 +1,53 @@
+package routing
+
+import (
+	"encoding/json"
+
+	msg "github.com/nusa-exchange/rango/pkg/message"
+	"github.com/rs/zerolog/log"
+)
+
+// rpcMethod handles a JSON-RPC request of client and returns its result, a
+// *msg.RPCError is sent as is, other errors as internal errors.
+type rpcMethod func(h *Hub, client IClient, params json.RawMessage) (interface{}, error)
+
+// rpcMethods is the registry of JSON-RPC methods clients can call with
+// {"jsonrpc":"2.0","id":1,"method":"list_subscriptions"}. Methods run on the
+// hub goroutine, to add one implement rpcMethod and register it here.
+var rpcMethods = map[string]rpcMethod{
+	"list_subscriptions": rpcListSubscriptions,
+}
+
+// rpcListSubscriptions returns the streams the client is subscribed to.
+func rpcListSubscriptions(h *Hub, client IClient, params json.RawMessage) (interface{}, error) {
+	return client.GetSubscriptions(), nil
+}
+
+// handleRPC calls the method of a JSON-RPC request and responds to the client,
+// notifications without id get no response.
+func (h *Hub) handleRPC(req *Request) {
+	var result interface{}
+	var err error
+
+	method, ok := rpcMethods[req.Method]
+	if ok {
+		result, err = method(h, req.client, req.Params)
+	} else {
+		err = &msg.RPCError{Code: msg.RPCMethodNotFound, Message: "Method not found"}
+	}
+
+	if req.ID == nil {
+		return
+	}
+	reply(req.client, rpcResponseMust(req.ID, result, err))
+}
+
+func rpcResponseMust(id json.RawMessage, result interface{}, e error) string {
+	res, err := msg.PackRPCResponse(id, result, e)
+	if err != nil {
+		log.Panic().Msg("rpcResponseMust failed:" + err.Error())
+		panic(err.Error())
+	}
+
+	return string(res)
+}
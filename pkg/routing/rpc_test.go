@@ -0,0 +1,52 @@
+package routing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestRPC(t *testing.T) {
+	h := NewHub(nil)
+	c := &recorderClient{}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.trades", "eurusd.ob-inc"}}})
+
+	rpc := func(raw string) []string {
+		req, err := message.ParseRequest([]byte(raw))
+		assert.NoError(t, err)
+
+		before := len(c.Messages())
+		h.handleRequest(&Request{client: c, Request: req})
+		return c.Messages()[before:]
+	}
+
+	t.Run("list_subscriptions", func(t *testing.T) {
+		assert.Equal(t, []string{
+			`{"jsonrpc":"2.0","id":1,"result":["eurusd.trades","eurusd.ob-inc"]}`,
+		}, rpc(`{"jsonrpc":"2.0","id":1,"method":"list_subscriptions"}`))
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		assert.Equal(t, []string{
+			`{"jsonrpc":"2.0","id":"x","error":{"code":-32601,"message":"Method not found"}}`,
+		}, rpc(`{"jsonrpc":"2.0","id":"x","method":"drop_tables"}`))
+	})
+
+	t.Run("notifications get no response", func(t *testing.T) {
+		assert.Empty(t, rpc(`{"jsonrpc":"2.0","method":"list_subscriptions"}`))
+	})
+
+	t.Run("registered methods", func(t *testing.T) {
+		defer delete(rpcMethods, "echo")
+		rpcMethods["echo"] = func(h *Hub, client IClient, params json.RawMessage) (interface{}, error) {
+			return params, nil
+		}
+
+		assert.Equal(t, []string{
+			`{"jsonrpc":"2.0","id":2,"result":{"a":1}}`,
+		}, rpc(`{"jsonrpc":"2.0","id":2,"method":"echo","params":{"a":1}}`))
+	})
+}
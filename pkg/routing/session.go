@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errUnknownSession = errors.New("unknown or expired session")
+
+// sessionClient is implemented by clients with a resumable session.
+type sessionClient interface {
+	Session() string
+}
+
+// session holds the subscriptions of a connection, resumed by the next
+// connection of the user with a resume request.
+type session struct {
+	uid string
+
+	// Client of the session while connected, its subscriptions are saved in
+	// streams on disconnect.
+	client  IClient
+	streams []string
+	expires time.Time
+}
+
+// sessionStore keeps the sessions in memory until they expire, ttl after their
+// client disconnected.
+type sessionStore struct {
+	mutex     sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+	ttl       time.Duration
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session, 1000), ttl: ttl}
+}
+
+// open returns the token of a new session of client.
+func (s *sessionStore) open(client IClient) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.ttl {
+		for token, sess := range s.sessions {
+			if sess.client == nil && now.After(sess.expires) {
+				delete(s.sessions, token)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	token := uuid.NewString()
+	s.sessions[token] = &session{uid: client.GetAuth().UID, client: client}
+	return token
+}
+
+// close saves the subscriptions of the session client for the store ttl.
+func (s *sessionStore) close(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || sess.client == nil {
+		return
+	}
+	sess.streams = sess.client.GetSubscriptions()
+	sess.client = nil
+	sess.expires = time.Now().Add(s.ttl)
+}
+
+// take removes the session of token and returns its subscriptions, the
+// session must belong to the user of auth.
+func (s *sessionStore) take(token string, auth Auth) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || sess.uid != auth.UID {
+		return nil, errUnknownSession
+	}
+	if sess.client == nil && time.Now().After(sess.expires) {
+		delete(s.sessions, token)
+		return nil, errUnknownSession
+	}
+
+	delete(s.sessions, token)
+	if sess.client != nil {
+		return sess.client.GetSubscriptions(), nil
+	}
+	return sess.streams, nil
+}
+
+// handleResume subscribes the client to the streams of a previous session.
+func (h *Hub) handleResume(req *Request) {
+	streams, err := h.sessions.take(req.Session, req.client.GetAuth())
+	if err != nil {
+		reply(req.client, errorEvent(codeUnknownSession, err.Error(), nil))
+		return
+	}
+
+	req.Streams = streams
+	h.handleSubscribe(req)
+}
@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialSession connects a websocket client to a test server running hub, it
+// returns the session of the connection from the hello message.
+func dialSession(t *testing.T, s *httptest.Server, uri string) (*websocket.Conn, string) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+uri, nil)
+	require.NoError(t, err)
+
+	var msg hello
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.NotEmpty(t, msg.Session)
+
+	_, subscribed, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(subscribed), `"message":"subscribed"`)
+
+	return conn, msg.Session
+}
+
+func TestClientResume(t *testing.T) {
+	// listen returns a server of a hub resuming the sessions within ttl.
+	listen := func(ttl time.Duration) (*Hub, *httptest.Server) {
+		opts := DefaultHubOptions()
+		opts.SessionTTL = ttl
+		hub := NewHub(nil, opts)
+		go hub.ListenWebsocketEvents()
+
+		return hub, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			NewClient(hub, w, r)
+		}))
+	}
+
+	// disconnected returns the session of a closed connection subscribed to streams.
+	disconnected := func(hub *Hub, s *httptest.Server, uri string) string {
+		conn, session := dialSession(t, s, uri)
+		conn.Close()
+		require.Eventually(t, func() bool { return hub.ClientsCount() == 0 }, time.Second, time.Millisecond)
+		return session
+	}
+
+	resume := func(s *httptest.Server, session string) string {
+		conn, _ := dialSession(t, s, "/")
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"resume","session":"`+session+`"}`)))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	t.Run("within TTL", func(t *testing.T) {
+		hub, s := listen(time.Minute)
+		defer s.Close()
+		session := disconnected(hub, s, "/?stream=eurusd.trades&stream=usdjpy.trades")
+
+		assert.Equal(t, subscribed(`"eurusd.trades","usdjpy.trades"`), resume(s, session))
+		assert.Equal(t, `{"error":{"code":4008,"message":"unknown or expired session","name":"unknown_session"}}`, resume(s, session), "sessions are resumed once")
+	})
+
+	t.Run("after TTL", func(t *testing.T) {
+		hub, s := listen(10 * time.Millisecond)
+		defer s.Close()
+		session := disconnected(hub, s, "/?stream=eurusd.trades")
+		time.Sleep(20 * time.Millisecond)
+
+		assert.Equal(t, `{"error":{"code":4008,"message":"unknown or expired session","name":"unknown_session"}}`, resume(s, session))
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	store := newSessionStore(time.Minute)
+	client := &recorderClient{auth: Auth{UID: "UIDABC00001"}}
+	client.SubscribePublic("eurusd.trades")
+
+	t.Run("belongs to its user", func(t *testing.T) {
+		token := store.open(client)
+
+		_, err := store.take(token, Auth{UID: "UIDABC00002"})
+		assert.Equal(t, errUnknownSession, err)
+		_, err = store.take(token, Auth{})
+		assert.Equal(t, errUnknownSession, err)
+
+		streams, err := store.take(token, Auth{UID: "UIDABC00001"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"eurusd.trades"}, streams)
+	})
+
+	t.Run("saves the subscriptions on close", func(t *testing.T) {
+		token := store.open(client)
+		store.close(token)
+		client.UnsubscribePublic("eurusd.trades")
+
+		streams, err := store.take(token, Auth{UID: "UIDABC00001"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"eurusd.trades"}, streams)
+	})
+}
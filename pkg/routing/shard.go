@@ -0,0 +1,188 @@
+package routing
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// shard holds the topics and snapshots of the streams hashed to it, public
+// and prefixed streams by name and private streams by user.
+type shard struct {
+	mutex sync.Mutex
+
+	// map[topic -> *Topic] of public and global topics
+	public map[string]*Topic
+
+	// map[uid -> map[topic -> *Topic]]
+	private map[string]map[string]*Topic
+
+	// map[prefix -> map[topic -> *Topic]]
+	prefixed map[string]map[string]*Topic
+
+	// map[topic -> last snapshot and following increments]
+	snapshots map[string]*snapshot
+
+	// map[stream -> last messages] of public and prefixed streams
+	histories map[string]*history
+
+	// map[stream -> sequence of its last message] of public and prefixed streams
+	sequences map[string]uint64
+
+	// Messages retained by stream, increments kept after a snapshot and
+	// whether subscription changes are audited, see HubOptions.
+	historyDepth  int
+	maxIncrements int
+	auditLog      bool
+}
+
+func newShard(opts HubOptions) *shard {
+	return &shard{
+		public:        make(map[string]*Topic),
+		private:       make(map[string]map[string]*Topic),
+		prefixed:      make(map[string]map[string]*Topic),
+		snapshots:     make(map[string]*snapshot),
+		histories:     make(map[string]*history),
+		sequences:     make(map[string]uint64),
+		historyDepth:  opts.HistoryDepth,
+		maxIncrements: opts.MaxSnapshotIncrements,
+		auditLog:      opts.AuditLog,
+	}
+}
+
+// number assigns the next sequence of its public or prefixed stream to the
+// message, so that clients can detect the messages they missed. The shard of
+// the stream must be locked.
+func (s *shard) number(msg *Event) {
+	stream := msg.stream()
+	s.sequences[stream]++
+	msg.Seq = s.sequences[stream]
+}
+
+// newShards returns the Shards of opts, at least one.
+func newShards(opts HubOptions) []*shard {
+	n := opts.Shards
+	if n < 1 {
+		n = 1
+	}
+
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = newShard(opts)
+	}
+	return shards
+}
+
+// unsubscribeAll unsubscribes the client from the topics of the shard.
+func (s *shard) unsubscribeAll(client IClient) {
+	for t, topic := range s.public {
+		if topic.unsubscribe(client) {
+			recordUnsubscription(client, "public", t, s.auditLog)
+		}
+		if topic.len() == 0 {
+			delete(s.public, t)
+		}
+	}
+
+	for k, scope := range s.prefixed {
+		for t, topic := range scope {
+			if topic.unsubscribe(client) {
+				recordUnsubscription(client, "prefixed", k+"."+t, s.auditLog)
+			}
+			if topic.len() == 0 {
+				delete(scope, t)
+			}
+		}
+
+		if len(scope) == 0 {
+			delete(s.prefixed, k)
+		}
+	}
+
+	uid := client.GetAuth().UID
+	topics, ok := s.private[uid]
+	if !ok {
+		return
+	}
+
+	for t, topic := range topics {
+		if topic.unsubscribe(client) {
+			recordUnsubscription(client, "private", t, s.auditLog)
+		}
+		if topic.len() == 0 {
+			delete(topics, t)
+		}
+	}
+
+	if len(topics) == 0 {
+		delete(s.private, uid)
+	}
+}
+
+// shardIndex returns the index of the shard of key.
+func (h *Hub) shardIndex(key string) int {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return int(f.Sum32() % uint32(len(h.shards)))
+}
+
+// shardOf returns the shard of key, a public or prefixed stream or a UID.
+func (h *Hub) shardOf(key string) *shard {
+	return h.shards[h.shardIndex(key)]
+}
+
+// shardKey returns the key of the shard of stream t subscribed by client,
+// false for wildcard streams held apart.
+func shardKey(t string, client IClient) (string, bool) {
+	switch {
+	case isWildcardStream(t):
+		return "", false
+	case isPrivateStream(t):
+		return client.GetAuth().UID, true
+	default:
+		return t, true
+	}
+}
+
+// lockStreams locks the shards of the streams, in order to avoid deadlocks,
+// and the wildcard topics if needed. It returns the function unlocking them.
+func (h *Hub) lockStreams(streams []string, client IClient) func() {
+	indexes := []int{}
+	wildcard := false
+	for _, t := range streams {
+		key, ok := shardKey(t, client)
+		if !ok {
+			wildcard = true
+			continue
+		}
+		if i := h.shardIndex(key); !containsInt(indexes, i) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		h.shards[i].mutex.Lock()
+	}
+	if wildcard {
+		h.wildcardMutex.Lock()
+	}
+
+	return func() {
+		if wildcard {
+			h.wildcardMutex.Unlock()
+		}
+		for _, i := range indexes {
+			h.shards[i].mutex.Unlock()
+		}
+	}
+}
+
+func containsInt(list []int, el int) bool {
+	for _, l := range list {
+		if l == el {
+			return true
+		}
+	}
+	return false
+}
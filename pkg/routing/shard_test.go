@@ -0,0 +1,141 @@
+package routing
+
+import (
+	"fmt"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// countingClient counts the messages received, safe for concurrent use.
+type countingClient struct {
+	nopClient
+	auth     Auth
+	received int64
+}
+
+func (c *countingClient) Send(string) bool {
+	atomic.AddInt64(&c.received, 1)
+	return true
+}
+
+func (c *countingClient) GetAuth() Auth { return c.auth }
+
+func TestShardedRouting(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.Shards = 4
+
+	h := NewHub(map[string][]string{"finex": {"trader"}}, opts)
+	require.Len(t, h.shards, 4)
+
+	const markets = 20
+	clients := make([]*countingClient, markets)
+	var wg sync.WaitGroup
+	for i := range clients {
+		clients[i] = &countingClient{auth: Auth{UID: fmt.Sprintf("UID%08d", i), Role: "trader"}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			market := fmt.Sprintf("market%d", i)
+			h.handleSubscribe(&Request{client: clients[i], Request: message.Request{Streams: []string{
+				market + ".trades", "order", "finex." + market + ".orders",
+			}}})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			market := fmt.Sprintf("market%d", i)
+			h.ReceiveMsg(&Message{Key: []byte("public." + market + ".trades"), Value: []byte(`{}`)})
+			h.ReceiveMsg(&Message{Key: []byte("private." + clients[i].auth.UID + ".order"), Value: []byte(`{}`)})
+			h.ReceiveMsg(&Message{Key: []byte("finex." + market + ".orders"), Value: []byte(`{}`)})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		// The subscription acknowledgement and a message of each stream.
+		assert.Equal(t, int64(4), atomic.LoadInt64(&c.received))
+	}
+	assert.Len(t, h.publicTopics(), markets)
+	assert.Len(t, h.privateTopics(), markets)
+	assert.Len(t, h.prefixedTopics()["finex"], markets)
+
+	for _, c := range clients {
+		h.unsubscribeAll(c)
+	}
+	assert.Empty(t, h.publicTopics())
+	assert.Empty(t, h.privateTopics())
+	assert.Empty(t, h.prefixedTopics())
+}
+
+// mutexWait returns the total time goroutines spent waiting on mutexes,
+// zero when unsupported by the runtime.
+func mutexWait() float64 {
+	sample := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return sample[0].Value.Float64()
+}
+
+// benchmarkHubContention dispatches messages to streams while subscribing
+// and unsubscribing to others, from parallel goroutines.
+func benchmarkHubContention(b *testing.B, shards int) {
+	opts := DefaultHubOptions()
+	opts.Shards = shards
+	h := NewHub(nil, opts)
+
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = log.Logger.Level(zerolog.WarnLevel)
+
+	const markets = 64
+	streams := make([]string, markets)
+	events := make([]*Event, markets)
+	for i := range streams {
+		streams[i] = fmt.Sprintf("market%d.trades", i)
+		events[i] = &Event{Scope: "public", Stream: fmt.Sprintf("market%d", i), Type: "trades", Topic: streams[i], Body: []byte(`{}`)}
+		for j := 0; j < 10; j++ {
+			h.handleSubscribe(&Request{client: &benchClient{id: i*10 + j}, Request: message.Request{Streams: streams[i : i+1]}})
+		}
+	}
+
+	var goroutines int64
+	wait := mutexWait()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := int(atomic.AddInt64(&goroutines, 1))
+		c := &benchClient{id: -id}
+		for i := 0; pb.Next(); i++ {
+			n := (id*31 + i) % markets
+			if i%4 == 0 {
+				req := &Request{client: c, Request: message.Request{Streams: streams[n : n+1]}}
+				h.handleSubscribe(req)
+				h.handleUnsubscribe(req)
+				continue
+			}
+			h.routeMessage(events[n])
+		}
+	})
+	b.ReportMetric((mutexWait()-wait)*1e9/float64(b.N), "lock-wait-ns/op")
+}
+
+func BenchmarkHubContention(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkHubContention(b, shards)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package routing
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// snapshot holds the last snapshot of an incremental topic and the increments
+// received since, replayed to new subscribers so they can rebuild the state.
+type snapshot struct {
+	body       *envelopes
+	increments []*envelopes
+}
+
+func isSnapshotType(typ string) bool {
+	return strings.HasSuffix(typ, "-snap")
+}
+
+// retainsSnapshot returns true if snapshots are kept for the topic.
+func (h *Hub) retainsSnapshot(topic string) bool {
+	for _, suffix := range h.options.SnapshotSuffixes {
+		if suffix != "" && strings.HasSuffix(topic, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retain records a snapshot or an increment of the event topic.
+func (s *shard) retain(msg *Event) {
+	body, err := newEnvelopes(msg)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		return
+	}
+
+	if msg.Snapshot {
+		s.snapshots[msg.Topic] = &snapshot{body: body}
+		return
+	}
+
+	snap, ok := s.snapshots[msg.Topic]
+	if !ok {
+		return
+	}
+
+	if len(snap.increments) >= s.maxIncrements {
+		log.Warn().Msgf("Too many increments since last snapshot of %s", msg.Topic)
+		delete(s.snapshots, msg.Topic)
+		return
+	}
+	snap.increments = append(snap.increments, body)
+}
+
+// replaySnapshot sends the retained snapshot of topic and its increments to client.
+func (s *shard) replaySnapshot(topic string, client IClient) {
+	snap, ok := s.snapshots[topic]
+	if !ok {
+		return
+	}
+
+	send(client, topic, snap.body.of(client))
+	for _, inc := range snap.increments {
+		send(client, topic, inc.of(client))
+	}
+}
@@ -0,0 +1,84 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func subscribed(streams string) string {
+	return `{"success":{"message":"subscribed","streams":[` + streams + `]}}`
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Run("replays the snapshot and following increments", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.SnapshotSuffixes = []string{"ob-inc"}
+		h := NewHub(nil, opts)
+
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"seq":0}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"seq":1}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"seq":2}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"seq":3}`)})
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.ob-inc"}}})
+
+		assert.Equal(t, []string{
+			subscribed(`"eurusd.ob-inc"`),
+			`{"eurusd.ob-snap":{"seq":1}}`,
+			`{"eurusd.ob-inc":{"seq":2}}`,
+			`{"eurusd.ob-inc":{"seq":3}}`,
+		}, c.Messages())
+
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"seq":4}`)})
+		assert.Equal(t, `{"eurusd.ob-snap":{"seq":4}}`, c.Messages()[4])
+
+		late := &recorderClient{}
+		h.handleSubscribe(&Request{client: late, Request: message.Request{Streams: []string{"eurusd.ob-inc"}}})
+		assert.Equal(t, []string{subscribed(`"eurusd.ob-inc"`), `{"eurusd.ob-snap":{"seq":4}}`}, late.Messages())
+	})
+
+	t.Run("flags snapshots with a record header", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.SnapshotSuffixes = []string{"tickers"}
+		h := NewHub(nil, opts)
+
+		h.ReceiveMsg(&Message{
+			Key:     []byte("global.global.tickers"),
+			Value:   []byte(`{"eurusd":{}}`),
+			Headers: []Header{{Key: "snapshot", Value: []byte("true")}},
+		})
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"global.tickers"}}})
+		assert.Equal(t, []string{subscribed(`"global.tickers"`), `{"global.tickers":{"eurusd":{}}}`}, c.Messages())
+	})
+
+	t.Run("does not retain topics without configured suffix", func(t *testing.T) {
+		h := NewHub(nil)
+
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"seq":1}`)})
+		assert.Empty(t, h.snapshots())
+
+		c := &recorderClient{}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.ob-inc"}}})
+		assert.Equal(t, []string{subscribed(`"eurusd.ob-inc"`)}, c.Messages())
+	})
+
+	t.Run("drops the snapshot after too many increments", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.MaxSnapshotIncrements = 2
+		opts.SnapshotSuffixes = []string{"ob-inc"}
+
+		h := NewHub(nil, opts)
+
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"seq":1}`)})
+		for i := 0; i < 3; i++ {
+			h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{}`)})
+		}
+		assert.Empty(t, h.snapshots())
+	})
+}
@@ -0,0 +1,260 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	msg "github.com/nusa-exchange/rango/pkg/message"
+	"github.com/nusa-exchange/rango/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// SSEClient is a read only client receiving its streams as Server-Sent Events.
+// Events are numbered from the Last-Event-ID header when resuming, the retained
+// snapshots of the streams being replayed on subscribe like for websockets.
+type SSEClient struct {
+	hub  *Hub
+	Auth Auth
+
+	pubSub  []string
+	privSub []string
+
+	remoteAddr string
+	lastID     uint64
+
+	// Buffered channel of outbound messages.
+	send chan string
+
+	// Cancels the request, ending the event stream.
+	cancel context.CancelFunc
+
+	// Reason the event stream is ended for.
+	closeReason closeReason
+
+	limits   clientLimits
+	connKey  string
+	protocol int
+	combined bool
+}
+
+// NewSSEClient handles event stream requests, the streams are given with
+// stream query parameters like for websockets.
+func NewSSEClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	protocol, err := parseProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	combined, err := parseCombined(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !hub.reserveConnection() {
+		log.Warn().Msgf("Refusing connection, %d clients connected", hub.ClientsCount())
+		metrics.RecordHubConnectionRefused("max_connections")
+		w.Header().Set("Retry-After", strconv.Itoa(connectionsRetryAfter))
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	auth := hub.requestAuth(r)
+
+	ip := hub.clientIP(r)
+	key, ok := hub.acquireClientConnection(auth, ip, &log.Logger, refuseHTTP(w))
+	if !ok {
+		hub.releaseReservation()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	client := &SSEClient{
+		hub:        hub,
+		Auth:       auth,
+		pubSub:     []string{},
+		privSub:    []string{},
+		remoteAddr: ip,
+		send:       make(chan string, hub.Options().ClientBuffer),
+		cancel:     cancel,
+		limits:     hub.Options().limitsFor(auth),
+		connKey:    key,
+		protocol:   protocol,
+		combined:   combined,
+	}
+	if id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		client.lastID = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if client.Auth.UID == "" {
+		log.Info().Msgf("New anonymous event stream")
+	} else {
+		log.Info().Msgf("New authenticated event stream: %s", client.Auth.UID)
+	}
+
+	hub.handleSubscribe(&Request{
+		client: client,
+		Request: msg.Request{
+			Streams: parseStreamsFromURI(r.RequestURI),
+		},
+	})
+
+	// The stream is served until the request is done, the slot is released
+	// as soon as the client holds it.
+	hub.register(client)
+	hub.releaseReservation()
+	metrics.RecordHubClientNew()
+
+	defer func() {
+		reason := client.closeReason.get()
+		log.Debug().Str("reason", reason).Msgf("Closing event stream (%s)", client.Auth.UID)
+		hub.Unregister <- client
+		hub.releaseConnection(client.connKey)
+		metrics.RecordHubClientClose()
+		metrics.RecordDisconnect(reason)
+	}()
+
+	client.write(ctx, w, flusher)
+}
+
+// write writes queued messages as events until the request is done.
+func (c *SSEClient) write(ctx context.Context, w http.ResponseWriter, flusher http.Flusher) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-c.send:
+			c.lastID++
+			if _, err := io.WriteString(w, formatEvent(c.lastID, message)); err != nil {
+				c.closeReason.set(reasonWriteError)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// formatEvent returns an event with the given id and data.
+func formatEvent(id uint64, data string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\n", id)
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Send queues s without blocking, applying the ClientOverflow option when the
+// buffer is full, the disconnect policy ends the event stream.
+func (c *SSEClient) Send(s string) bool {
+	select {
+	case c.send <- s:
+		return true
+	default:
+	}
+
+	switch c.hub.Options().overflow() {
+	case overflowDropOldest:
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- s:
+		default:
+		}
+	case overflowDropNewest:
+	default:
+		log.Warn().Msg("Closing slow event stream")
+		metrics.RecordSlowClientDisconnect("overflow")
+		c.closeReason.set(reasonSlow)
+		c.cancel()
+	}
+	return false
+}
+
+// Close is a no-op, the event stream ends with its request.
+func (c *SSEClient) Close() {}
+
+// Disconnect ends the event stream, event streams have no close code.
+func (c *SSEClient) Disconnect(code int, reason string) {
+	c.closeReason.set(disconnectReason(code))
+	c.cancel()
+}
+
+func (c *SSEClient) GetAuth() Auth {
+	return c.Auth
+}
+
+func (c *SSEClient) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *SSEClient) MaxSubscriptions() int {
+	return c.limits.maxSubscriptions
+}
+
+func (c *SSEClient) Protocol() int {
+	return c.protocol
+}
+
+func (c *SSEClient) Combined() bool {
+	return c.combined
+}
+
+func (c *SSEClient) GetSubscriptions() []string {
+	subs := make([]string, 0, len(c.pubSub)+len(c.privSub))
+	return append(append(subs, c.pubSub...), c.privSub...)
+}
+
+func (c *SSEClient) SubscribePublic(s string) {
+	if !contains(c.pubSub, s) {
+		c.pubSub = append(c.pubSub, s)
+	}
+}
+
+func (c *SSEClient) SubscribePrivate(s string) {
+	if !contains(c.privSub, s) {
+		c.privSub = append(c.privSub, s)
+	}
+}
+
+func (c *SSEClient) UnsubscribePublic(s string) {
+	c.pubSub = remove(c.pubSub, s)
+}
+
+func (c *SSEClient) UnsubscribePrivate(s string) {
+	c.privSub = remove(c.privSub, s)
+}
+
+// remove returns list without el.
+func remove(list []string, el string) []string {
+	l := make([]string, 0, len(list))
+	for _, s := range list {
+		if s != el {
+			l = append(l, s)
+		}
+	}
+	return l
+}
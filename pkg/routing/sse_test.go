@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openSSE opens an event stream of hub with the given request headers.
+func openSSE(t *testing.T, hub *Hub, uri string, header http.Header) (*bufio.Reader, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewSSEClient(hub, w, r)
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+uri, nil)
+	require.NoError(t, err)
+	req.Header = header
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	return bufio.NewReader(resp.Body), func() {
+		resp.Body.Close()
+		s.Close()
+	}
+}
+
+// readEvent reads the next event, returning its id and data lines.
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	var id string
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return id, strings.Join(data, "\n")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	hub := NewHub(map[string][]string{"finex": {"trader"}})
+	go hub.ListenWebsocketEvents()
+
+	header := http.Header{"JwtUID": {"UIDABC00001"}, "JwtRole": {"member"}}
+	events, teardown := openSSE(t, hub, "/?stream=eurusd.trades,order,finex.eurusd.orders", header)
+	defer teardown()
+
+	id, data := readEvent(t, events)
+	assert.Equal(t, "1", id)
+	assert.Equal(t, `{"error":{"code":4002,"message":"restricted","name":"restricted_stream","stream":"finex.eurusd.orders"}}`, data)
+
+	id, data = readEvent(t, events)
+	assert.Equal(t, "2", id)
+	assert.Equal(t, `{"success":{"message":"subscribed","rejected":["finex.eurusd.orders"],"streams":["eurusd.trades","order"]}}`, data)
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.1"}`)})
+	hub.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":1}`)})
+
+	id, data = readEvent(t, events)
+	assert.Equal(t, "3", id)
+	assert.Equal(t, `{"eurusd.trades":{"price":"1.1"}}`, data)
+
+	_, data = readEvent(t, events)
+	assert.Equal(t, `{"order":{"id":1}}`, data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, hub.Shutdown(ctx))
+}
+
+func TestSSEResume(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.SnapshotSuffixes = []string{"ob-inc"}
+	hub := NewHub(nil, opts)
+	go hub.ListenWebsocketEvents()
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-snap"), Value: []byte(`{"asks":[]}`)})
+
+	events, teardown := openSSE(t, hub, "/?stream=eurusd.ob-inc", http.Header{"Last-Event-ID": {"41"}})
+	defer teardown()
+
+	id, _ := readEvent(t, events)
+	assert.Equal(t, "42", id)
+
+	id, data := readEvent(t, events)
+	assert.Equal(t, "43", id)
+	assert.Equal(t, `{"eurusd.ob-snap":{"asks":[]}}`, data)
+}
+
+func TestFormatEvent(t *testing.T) {
+	assert.Equal(t, "id: 7\ndata: {}\n\n", formatEvent(7, "{}"))
+	assert.Equal(t, "id: 8\ndata: a\ndata: b\n\n", formatEvent(8, "a\nb"))
+}
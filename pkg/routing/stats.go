@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"sort"
+	"strings"
+)
+
+// Stats is a snapshot of the hub state.
+type Stats struct {
+	Connections ConnectionStats `json:"connections"`
+
+	// Subscribers count of the streams with the most subscribers, private
+	// streams are counted for every user.
+	Streams map[string]int `json:"streams"`
+
+	// Number of subscribed streams, including the ones not listed.
+	StreamsCount int `json:"streams_count"`
+
+	// Users with the most connections.
+	TopUsers []UserConnections `json:"top_users"`
+}
+
+// ConnectionStats counts the connected clients, private clients being
+// authenticated.
+type ConnectionStats struct {
+	Total   int `json:"total"`
+	Public  int `json:"public"`
+	Private int `json:"private"`
+}
+
+type UserConnections struct {
+	UID         string `json:"uid"`
+	Connections int    `json:"connections"`
+}
+
+// Stats returns the state of the hub, listing at most maxStreams streams and
+// maxUsers users.
+func (h *Hub) Stats(maxStreams, maxUsers int) Stats {
+	stats := Stats{TopUsers: []UserConnections{}}
+
+	h.mutex.Lock()
+	for client := range h.clients {
+		if client.GetAuth().UID == "" {
+			stats.Connections.Public++
+		} else {
+			stats.Connections.Private++
+		}
+	}
+	stats.Connections.Total = len(h.clients)
+
+	for key, n := range h.connections {
+		if uid := strings.TrimPrefix(key, "uid:"); uid != key {
+			stats.TopUsers = append(stats.TopUsers, UserConnections{UID: uid, Connections: n})
+		}
+	}
+	h.mutex.Unlock()
+
+	sort.Slice(stats.TopUsers, func(i, j int) bool {
+		a, b := stats.TopUsers[i], stats.TopUsers[j]
+		return a.Connections > b.Connections || a.Connections == b.Connections && a.UID < b.UID
+	})
+	if len(stats.TopUsers) > maxUsers {
+		stats.TopUsers = stats.TopUsers[:maxUsers]
+	}
+
+	streams := h.subscribers()
+	stats.StreamsCount = len(streams)
+	stats.Streams = topStreams(streams, maxStreams)
+
+	return stats
+}
+
+// subscribers returns the subscribers count by stream.
+func (h *Hub) subscribers() map[string]int {
+	streams := make(map[string]int)
+
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		for t, topic := range s.public {
+			streams[t] += topic.len()
+		}
+		for _, topics := range s.private {
+			for t, topic := range topics {
+				streams[t] += topic.len()
+			}
+		}
+		for prefix, topics := range s.prefixed {
+			for t, topic := range topics {
+				streams[prefix+"."+t] += topic.len()
+			}
+		}
+		s.mutex.Unlock()
+	}
+
+	h.wildcardMutex.RLock()
+	for t, topic := range h.wildcardTopics {
+		streams[t] += topic.len()
+	}
+	h.wildcardMutex.RUnlock()
+
+	return streams
+}
+
+// topStreams returns the max streams with the most subscribers.
+func topStreams(streams map[string]int, max int) map[string]int {
+	if len(streams) <= max {
+		return streams
+	}
+
+	names := make([]string, 0, len(streams))
+	for stream := range streams {
+		names = append(names, stream)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := streams[names[i]], streams[names[j]]
+		return a > b || a == b && names[i] < names[j]
+	})
+
+	top := make(map[string]int, max)
+	for _, stream := range names[:max] {
+		top[stream] = streams[stream]
+	}
+	return top
+}
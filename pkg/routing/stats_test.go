@@ -0,0 +1,51 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestHubStats(t *testing.T) {
+	h := NewHub(map[string][]string{"finex": {"trader"}})
+
+	subscribe := func(auth Auth, streams ...string) {
+		c := &recorderClient{auth: auth}
+		h.register(c)
+		if auth.UID != "" {
+			h.acquireConnection("uid:"+auth.UID, 0)
+		}
+		h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: streams}})
+	}
+
+	subscribe(Auth{}, "eurusd.trades", "usdjpy.trades")
+	subscribe(Auth{}, "eurusd.trades", "eurusd.*")
+	subscribe(Auth{UID: "UIDABC00001", Role: "trader"}, "eurusd.trades", "balance", "finex.eurusd.orders")
+	subscribe(Auth{UID: "UIDABC00001", Role: "trader"}, "balance")
+	subscribe(Auth{UID: "UIDABC00002"}, "balance")
+
+	assert.Equal(t, Stats{
+		Connections: ConnectionStats{Total: 5, Public: 2, Private: 3},
+		Streams: map[string]int{
+			"eurusd.trades":       3,
+			"usdjpy.trades":       1,
+			"eurusd.*":            1,
+			"balance":             3,
+			"finex.eurusd.orders": 1,
+		},
+		StreamsCount: 5,
+		TopUsers: []UserConnections{
+			{UID: "UIDABC00001", Connections: 2},
+			{UID: "UIDABC00002", Connections: 1},
+		},
+	}, h.Stats(10, 10))
+
+	t.Run("bounds the listed streams and users", func(t *testing.T) {
+		stats := h.Stats(2, 1)
+		assert.Equal(t, map[string]int{"balance": 3, "eurusd.trades": 3}, stats.Streams)
+		assert.Equal(t, 5, stats.StreamsCount)
+		assert.Equal(t, []UserConnections{{UID: "UIDABC00001", Connections: 2}}, stats.TopUsers)
+	})
+}
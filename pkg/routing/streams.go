@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"sort"
+	"time"
+)
+
+type activeStream struct {
+	// RBAC prefix of prefixed streams, empty for public ones.
+	prefix string
+	seen   time.Time
+}
+
+// touchStream records traffic on stream.
+func (h *Hub) touchStream(stream, prefix string) {
+	h.streamsMutex.Lock()
+	defer h.streamsMutex.Unlock()
+
+	now := time.Now()
+	if _, ok := h.activeStreams[stream]; !ok && len(h.activeStreams) >= h.options.MaxActiveStreams {
+		h.evictStreams(now)
+	}
+	h.activeStreams[stream] = activeStream{prefix: prefix, seen: now}
+}
+
+// evictStreams removes the expired streams, or the least recently active one
+// when none expired.
+func (h *Hub) evictStreams(now time.Time) {
+	oldest := ""
+	for stream, s := range h.activeStreams {
+		if now.Sub(s.seen) > h.options.ActiveStreamsTTL {
+			delete(h.activeStreams, stream)
+			continue
+		}
+		if oldest == "" || s.seen.Before(h.activeStreams[oldest].seen) {
+			oldest = stream
+		}
+	}
+
+	if len(h.activeStreams) >= h.options.MaxActiveStreams {
+		delete(h.activeStreams, oldest)
+	}
+}
+
+// listStreams returns the sorted streams active within the TTL, prefixed
+// streams are only listed when permitted by the RBAC role of auth.
+func (h *Hub) listStreams(auth Auth) []string {
+	h.streamsMutex.Lock()
+	defer h.streamsMutex.Unlock()
+
+	now := time.Now()
+	streams := []string{}
+	for stream, s := range h.activeStreams {
+		if now.Sub(s.seen) > h.options.ActiveStreamsTTL {
+			continue
+		}
+		if s.prefix != "" && !h.premittedRBAC(s.prefix, auth) {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	return streams
+}
+
+func (h *Hub) handleStreams(req *Request) {
+	reply(req.client, responseMust(nil, map[string]interface{}{
+		"message": "streams",
+		"streams": h.listStreams(req.client.GetAuth()),
+	}))
+}
@@ -0,0 +1,58 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestStreams(t *testing.T) {
+	t.Run("lists streams with recent traffic", func(t *testing.T) {
+		h := NewHub(map[string][]string{"admin": {"admin"}})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("global.global.tickers"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("private.UIDABC00001.balance"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("admin.eurusd.events"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+
+		admin := &recorderClient{auth: Auth{UID: "UIDABC00001", Role: "admin"}}
+		h.handleRequest(&Request{client: admin, Request: message.Request{Method: "streams"}})
+		assert.Equal(t, []string{
+			`{"success":{"message":"streams","streams":["admin.eurusd.events","eurusd.trades","global.tickers"]}}`,
+		}, admin.Messages())
+
+		member := &recorderClient{auth: Auth{UID: "UIDABC00002", Role: "member"}}
+		h.handleRequest(&Request{client: member, Request: message.Request{Method: "streams"}})
+		assert.Equal(t, []string{
+			`{"success":{"message":"streams","streams":["eurusd.trades","global.tickers"]}}`,
+		}, member.Messages())
+	})
+
+	t.Run("expires streams after the TTL", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.ActiveStreamsTTL = time.Minute
+
+		h := NewHub(nil, opts)
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{}`)})
+		h.activeStreams["usdjpy.trades"] = activeStream{seen: time.Now().Add(-2 * time.Minute)}
+
+		assert.Equal(t, []string{"eurusd.trades"}, h.listStreams(Auth{}))
+	})
+
+	t.Run("evicts the least recently active streams", func(t *testing.T) {
+		opts := DefaultHubOptions()
+		opts.MaxActiveStreams = 2
+
+		h := NewHub(nil, opts)
+		h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)})
+		h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.trades"), Value: []byte(`{}`)})
+		h.activeStreams["eurusd.trades"] = activeStream{seen: time.Now().Add(-time.Second)}
+		h.ReceiveMsg(&Message{Key: []byte("public.gbpusd.trades"), Value: []byte(`{}`)})
+
+		assert.Equal(t, []string{"gbpusd.trades", "usdjpy.trades"}, h.listStreams(Auth{}))
+	})
+}
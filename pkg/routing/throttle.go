@@ -0,0 +1,156 @@
+package routing
+
+import (
+	"strings"
+	"time"
+)
+
+// throttlingClient is implemented by clients limiting the rate of the
+// messages of a stream on request, see max_updates_per_sec.
+type throttlingClient interface {
+	// SetThrottle sends at most one message of stream per interval, the
+	// latest, 0 removing the limit.
+	SetThrottle(stream string, interval time.Duration)
+}
+
+// throttleInterval returns the interval between the messages of a stream
+// limited to perSec messages per second, 0 if unlimited.
+func throttleInterval(perSec float64) time.Duration {
+	if perSec <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / perSec)
+}
+
+// setConflation sets whether only the latest message of the topic of stream
+// is sent to the client of req, as requested with conflate or implied by
+// max_updates_per_sec, and the rate the client receives them at.
+func setConflation(topic *Topic, stream string, req *Request) {
+	topic.setConflate(req.client, contains(req.Conflate, stream) || req.MaxUpdatesPerSec > 0)
+	if c, ok := req.client.(throttlingClient); ok {
+		c.SetThrottle(stream, throttleInterval(req.MaxUpdatesPerSec))
+	}
+}
+
+// throttle holds back the latest message of the throttled streams of a client
+// until their interval elapsed since the previous one, it is only used by the
+// write loop.
+type throttle struct {
+	// Time the last message of the streams was sent.
+	sent map[string]time.Time
+	// Streams held back, with the time their latest message may be sent.
+	pending map[string]time.Time
+	// Fires once the first pending stream may be sent, nil without pending
+	// streams.
+	timer *time.Timer
+}
+
+// C returns the channel the throttle fires on once a pending stream may be
+// sent, nil if none is pending.
+func (t *throttle) C() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// hold returns true if the latest message of stream must be held back at now,
+// the previous one being sent less than interval ago, the stream being then
+// pending. Otherwise the message is recorded as sent.
+func (t *throttle) hold(stream string, interval time.Duration, now time.Time) bool {
+	if interval <= 0 {
+		return false
+	}
+	if t.sent == nil {
+		t.sent = make(map[string]time.Time)
+		t.pending = make(map[string]time.Time)
+	}
+	if _, ok := t.pending[stream]; ok {
+		return true
+	}
+
+	at := t.sent[stream].Add(interval)
+	if !now.Before(at) {
+		t.sent[stream] = now
+		return false
+	}
+	t.pending[stream] = at
+	t.arm(now)
+	return true
+}
+
+// due returns the pending streams whose latest message may be sent at now,
+// recording them as sent.
+func (t *throttle) due(now time.Time) []string {
+	streams := []string{}
+	for stream, at := range t.pending {
+		if !now.Before(at) {
+			streams = append(streams, stream)
+			delete(t.pending, stream)
+			t.sent[stream] = now
+		}
+	}
+	t.arm(now)
+	return streams
+}
+
+// arm sets the timer to fire once the first pending stream may be sent.
+func (t *throttle) arm(now time.Time) {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	var first time.Time
+	for _, at := range t.pending {
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+	}
+	if !first.IsZero() {
+		t.timer = time.NewTimer(first.Sub(now))
+	}
+}
+
+// SetThrottle sends at most one message of stream per interval, the latest,
+// 0 removing the limit. Wildcard streams limit every stream they match.
+func (c *Client) SetThrottle(stream string, interval time.Duration) {
+	c.latestMutex.Lock()
+	defer c.latestMutex.Unlock()
+
+	if interval <= 0 {
+		delete(c.intervals, stream)
+		return
+	}
+	if c.intervals == nil {
+		c.intervals = make(map[string]time.Duration)
+	}
+	c.intervals[stream] = interval
+}
+
+// intervalOf returns the interval between the messages of stream, 0 if not
+// throttled.
+func (c *Client) intervalOf(stream string) time.Duration {
+	c.latestMutex.Lock()
+	defer c.latestMutex.Unlock()
+
+	if interval, ok := c.intervals[stream]; ok {
+		return interval
+	}
+	for pattern, interval := range c.intervals {
+		if strings.HasSuffix(pattern, "*") && matchWildcard(pattern, stream) {
+			return interval
+		}
+	}
+	return 0
+}
+
+// deliver returns the message to write for the queued message m, "" if there
+// is none or if the message of a throttled stream is held back, the write
+// loop sending its latest message once due.
+func (c *Client) deliver(m string, now time.Time) string {
+	if stream := strings.TrimPrefix(m, conflatedMarker); stream != m && c.throttle.hold(stream, c.intervalOf(stream), now) {
+		return ""
+	}
+	return c.takeLatest(m)
+}
@@ -0,0 +1,75 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	var th throttle
+	now := time.Now()
+
+	assert.False(t, th.hold("eurusd.tickers", 0, now), "unthrottled streams are never held")
+	assert.False(t, th.hold("eurusd.tickers", time.Second, now), "the first message is sent")
+	assert.Nil(t, th.C())
+
+	assert.True(t, th.hold("eurusd.tickers", time.Second, now.Add(100*time.Millisecond)))
+	assert.True(t, th.hold("eurusd.tickers", time.Second, now.Add(200*time.Millisecond)), "the stream stays pending")
+	assert.NotNil(t, th.C())
+
+	assert.Empty(t, th.due(now.Add(500*time.Millisecond)))
+	assert.Equal(t, []string{"eurusd.tickers"}, th.due(now.Add(time.Second)))
+	assert.Nil(t, th.C())
+
+	assert.True(t, th.hold("eurusd.tickers", time.Second, now.Add(1500*time.Millisecond)), "the interval restarts once sent")
+	assert.False(t, th.hold("usdjpy.tickers", time.Second, now.Add(1500*time.Millisecond)))
+}
+
+func TestThrottleInterval(t *testing.T) {
+	assert.Equal(t, time.Duration(0), throttleInterval(0))
+	assert.Equal(t, 100*time.Millisecond, throttleInterval(10))
+	assert.Equal(t, 2*time.Second, throttleInterval(0.5))
+}
+
+func TestClientThrottle(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.ListenWebsocketEvents()
+
+	full, teardown := dial(t, hub, "/?stream=eurusd.tickers")
+	defer teardown()
+	throttled, teardown := dial(t, hub, "/")
+	defer teardown()
+
+	require.NoError(t, throttled.WriteMessage(websocket.TextMessage, []byte(`{"event":"subscribe","streams":["eurusd.tickers"],"max_updates_per_sec":10}`)))
+	_, msg, err := throttled.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, subscribed(`"eurusd.tickers"`), string(msg))
+
+	ticker := func(i int) string { return fmt.Sprintf(`{"eurusd.tickers":{"last":"%d"}}`, i) }
+	for i := 1; i <= 50; i++ {
+		hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.tickers"), Value: []byte(fmt.Sprintf(`{"last":"%d"}`, i))})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	full.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 1; i <= 50; i++ {
+		_, msg, err := full.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, ticker(i), string(msg), "the full rate connection receives every message")
+	}
+
+	var received []string
+	throttled.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) == 0 || received[len(received)-1] != ticker(50) {
+		_, msg, err := throttled.ReadMessage()
+		require.NoError(t, err, "received %v", received)
+		received = append(received, string(msg))
+	}
+	assert.Equal(t, ticker(1), received[0])
+	assert.True(t, len(received) >= 4 && len(received) <= 12, "received %d messages: %v", len(received), received)
+}
@@ -1,15 +1,26 @@
 package routing
 
 import (
-	"encoding/json"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
 	msg "github.com/nusa-exchange/rango/pkg/message"
+	"github.com/nusa-exchange/rango/pkg/metrics"
 )
 
 type Topic struct {
 	hub     *Hub
 	clients map[IClient]struct{}
+
+	// Filters of the clients subscribed with one.
+	filters map[IClient]filter
+
+	// Clients only sent the latest message of the topic when falling behind.
+	conflated map[IClient]struct{}
+
+	// Sequence of the last message of private topics, restarting with the
+	// first subscription of the user.
+	seq uint64
 }
 
 func NewTopic(h *Hub) *Topic {
@@ -37,38 +48,135 @@ func contains(list []string, el string) bool {
 	return false
 }
 
+// unique returns the elements of list without their duplicates, in order.
+func unique(list []string) []string {
+	res := make([]string, 0, len(list))
+	for _, el := range list {
+		if !contains(res, el) {
+			res = append(res, el)
+		}
+	}
+	return res
+}
+
 func (t *Topic) len() int {
 	return len(t.clients)
 }
 
-func (t *Topic) broadcast(message *Event) {
-	var bodyMsg interface{}
-
-	if err := json.Unmarshal(message.Body, &bodyMsg); err != nil {
+// broadcast sends the message to every client of the topic, it returns the
+// number of clients reached.
+func (t *Topic) broadcast(message *Event) int {
+	env, err := newEnvelopes(message)
+	if err != nil {
 		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
-		return
+		return 0
 	}
 
-	body, err := json.Marshal(map[string]interface{}{
-		message.Topic: bodyMsg,
-	})
+	var fields map[string]interface{}
+	if len(t.filters) != 0 {
+		fields = decodeFields(message.Body)
+	}
 
+	sent := 0
+	for client := range t.clients {
+		if !t.accepts(client, fields) {
+			continue
+		}
+		t.send(client, message.stream(), env.of(client))
+		sent++
+	}
+	return sent
+}
+
+// broadcastPrivate sends the private message of uid only to clients
+// authenticated as uid, it returns the number of clients reached.
+func (t *Topic) broadcastPrivate(uid string, message *Event) int {
+	env, err := newEnvelopes(message)
 	if err != nil {
 		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
-		return
+		return 0
 	}
 
+	var fields map[string]interface{}
+	if len(t.filters) != 0 {
+		fields = decodeFields(message.Body)
+	}
+
+	sent := 0
 	for client := range t.clients {
-		client.Send(string(body))
+		if client.GetAuth().UID != uid {
+			loggerOf(client).Error().Msgf("Client %s subscribed to private topic %s of %s", client.GetAuth().UID, message.Topic, uid)
+			continue
+		}
+		if !t.accepts(client, fields) {
+			continue
+		}
+		t.send(client, message.Topic, env.of(client))
+		sent++
 	}
+	return sent
 }
 
-func (t *Topic) broadcastRaw(msg []byte) {
-	for client := range t.clients {
-		client.Send(string(msg))
+// expiringClient is implemented by clients dropping the stream messages queued
+// for longer than the MessageTTL option of their hub.
+type expiringClient interface {
+	// SendExpiring queues a message of a stream as Send does, to be dropped
+	// once stale. It returns false when the message was dropped.
+	SendExpiring(msg string) bool
+}
+
+// send sends a message of stream to client, recording it when dropped.
+func send(client IClient, stream, msg string) {
+	var queued bool
+	if c, ok := client.(expiringClient); ok {
+		queued = c.SendExpiring(msg)
+	} else {
+		queued = client.Send(msg)
+	}
+	if !queued {
+		dropped(client, stream)
+	}
+}
+
+// dropped records a message of stream dropped for client, notifying the
+// client when able.
+func dropped(client IClient, stream string) {
+	atomic.AddInt64(&dropCounts.buffer, 1)
+	metrics.RecordDroppedMessage(stream)
+	if c, ok := client.(backpressureClient); ok {
+		c.Dropped(stream)
+	}
+}
+
+// conflatingClient is implemented by clients able to replace a queued message.
+type conflatingClient interface {
+	// SendLatest queues a message of stream, replacing the message of stream
+	// still queued if any. It returns false when the message was dropped.
+	SendLatest(stream, msg string) bool
+}
+
+// sendLatest sends a message of stream to client, replacing the message of
+// stream not yet delivered to it.
+func sendLatest(client IClient, stream, msg string) {
+	c, ok := client.(conflatingClient)
+	if !ok {
+		send(client, stream, msg)
+		return
+	}
+	if !c.SendLatest(stream, msg) {
+		dropped(client, stream)
 	}
 }
 
+// send sends a message of stream to client, conflated if subscribed so.
+func (t *Topic) send(client IClient, stream, msg string) {
+	if t.conflates(client) {
+		sendLatest(client, stream, msg)
+		return
+	}
+	send(client, stream, msg)
+}
+
 func (t *Topic) subscribe(c IClient) bool {
 	if _, ok := t.clients[c]; ok {
 		return false
@@ -81,6 +189,44 @@ func (t *Topic) subscribe(c IClient) bool {
 func (t *Topic) unsubscribe(c IClient) bool {
 	_, ok := t.clients[c]
 	delete(t.clients, c)
+	delete(t.filters, c)
+	delete(t.conflated, c)
 
 	return ok
 }
+
+// setFilter sets the filter of the messages sent to c, nil removes it.
+func (t *Topic) setFilter(c IClient, f filter) {
+	if f == nil {
+		delete(t.filters, c)
+		return
+	}
+	if t.filters == nil {
+		t.filters = make(map[IClient]filter)
+	}
+	t.filters[c] = f
+}
+
+// setConflate sets whether only the latest message of the topic is sent to c.
+func (t *Topic) setConflate(c IClient, conflate bool) {
+	if !conflate {
+		delete(t.conflated, c)
+		return
+	}
+	if t.conflated == nil {
+		t.conflated = make(map[IClient]struct{})
+	}
+	t.conflated[c] = struct{}{}
+}
+
+// conflates returns true if only the latest message of the topic is sent to c.
+func (t *Topic) conflates(c IClient) bool {
+	_, ok := t.conflated[c]
+	return ok
+}
+
+// accepts returns true if the message payload fields pass the filter of c.
+func (t *Topic) accepts(c IClient, fields map[string]interface{}) bool {
+	f, ok := t.filters[c]
+	return !ok || f.match(fields)
+}
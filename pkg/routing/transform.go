@@ -0,0 +1,53 @@
+package routing
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Transform rewrites the payloads of the events of a stream before they are
+// sent to its subscribers, e.g. to encode them more compactly. Transforms are
+// opt-in, set by stream in the Transforms of the hub.
+type Transform interface {
+	// Encode returns the payload sent for the JSON payload body, it fails if
+	// body can't be transformed, the payload being sent as is.
+	Encode(body []byte) ([]byte, error)
+}
+
+// transforms are the transforms by name, the built-in ones and the ones added
+// with RegisterTransform.
+var transforms = map[string]Transform{
+	"ob-delta": OrderbookDelta{},
+}
+
+// RegisterTransform adds a transform to be found by name, it must be called
+// before the hub is started.
+func RegisterTransform(name string, t Transform) {
+	transforms[name] = t
+}
+
+// TransformNamed returns the transform registered as name.
+func TransformNamed(name string) (Transform, error) {
+	t, ok := transforms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %s", name)
+	}
+	return t, nil
+}
+
+// transform replaces the body of the event with its transform, if any is set
+// for its stream.
+func (h *Hub) transform(e *Event) {
+	t, ok := h.options.Transforms[e.stream()]
+	if !ok {
+		return
+	}
+
+	body, err := t.Encode(e.Body)
+	if err != nil {
+		log.Debug().Msgf("Sending %s untransformed: %s", e.stream(), err.Error())
+		return
+	}
+	e.Body = body
+}
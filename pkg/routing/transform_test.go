@@ -0,0 +1,46 @@
+package routing
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+// upperTransform sends payloads in upper case.
+type upperTransform struct{}
+
+func (upperTransform) Encode(body []byte) ([]byte, error) {
+	return bytes.ToUpper(body), nil
+}
+
+func TestTransforms(t *testing.T) {
+	RegisterTransform("upper", upperTransform{})
+	defer delete(transforms, "upper")
+
+	upper, err := TransformNamed("upper")
+	require.NoError(t, err)
+	delta, err := TransformNamed("ob-delta")
+	require.NoError(t, err)
+	_, err = TransformNamed("gzip")
+	assert.EqualError(t, err, "unknown transform gzip")
+
+	opts := DefaultHubOptions()
+	opts.Transforms = map[string]Transform{"eurusd.ob-inc": delta, "eurusd.trades": upper}
+	h := NewHub(nil, opts)
+	c := &recorderClient{}
+	h.handleSubscribe(&Request{client: c, Request: message.Request{Streams: []string{"eurusd.ob-inc", "eurusd.trades", "usdjpy.ob-inc"}}})
+
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.ob-inc"), Value: []byte(`{"asks":[["1.10","1"],["1.12","2"]]}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.usdjpy.ob-inc"), Value: []byte(`{"asks":[["1.10","1"],["1.12","2"]]}`)})
+	h.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"side":"buy"}`)})
+
+	assert.Equal(t, []string{
+		`{"eurusd.ob-inc":{"asks":{"amounts":["1","2"],"prices":[110,2],"scale":2}}}`,
+		`{"usdjpy.ob-inc":{"asks":[["1.10","1"],["1.12","2"]]}}`,
+		`{"eurusd.trades":{"SIDE":"BUY"}}`,
+	}, c.Messages()[1:])
+}
@@ -0,0 +1,35 @@
+package routing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of the queued messages stamped with their enqueue time, followed by
+// the time in unix nanoseconds as 16 hex digits, never starting a JSON or
+// msgpack message.
+const stampedMarker = "\x01"
+
+// stampLen is the length of the stamp preceding a stamped message.
+const stampLen = len(stampedMarker) + 16
+
+// stamp returns msg stamped with its enqueue time at.
+func stamp(msg string, at time.Time) string {
+	return stampedMarker + fmt.Sprintf("%016x", at.UnixNano()) + msg
+}
+
+// unstamp returns the queued message m without its stamp, and whether it is
+// still fresh at now, queued for at most ttl, 0 disabling the TTL. Messages
+// without stamp are always fresh.
+func unstamp(m string, now time.Time, ttl time.Duration) (string, bool) {
+	if !strings.HasPrefix(m, stampedMarker) || len(m) < stampLen {
+		return m, true
+	}
+	nanos, err := strconv.ParseUint(m[len(stampedMarker):stampLen], 16, 64)
+	if err != nil {
+		return m, true
+	}
+	return m[stampLen:], ttl <= 0 || now.Sub(time.Unix(0, int64(nanos))) <= ttl
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/message"
+)
+
+func TestStamp(t *testing.T) {
+	now := time.Now()
+	m, fresh := unstamp(stamp(`{"eurusd.trades":{}}`, now), now.Add(time.Second), time.Second)
+	assert.Equal(t, `{"eurusd.trades":{}}`, m)
+	assert.True(t, fresh)
+
+	m, fresh = unstamp(stamp(`{"eurusd.trades":{}}`, now), now.Add(2*time.Second), time.Second)
+	assert.Equal(t, `{"eurusd.trades":{}}`, m)
+	assert.False(t, fresh)
+
+	m, fresh = unstamp("pong", now, time.Second)
+	assert.Equal(t, "pong", m)
+	assert.True(t, fresh, "replies are not stamped")
+}
+
+func TestClientMessageTTL(t *testing.T) {
+	opts := DefaultHubOptions()
+	opts.MessageTTL = 100 * time.Millisecond
+	hub := NewHub(nil, opts)
+
+	client, conn, teardown := stalledClient(t, 10)
+	defer teardown()
+	client.hub = hub
+
+	hub.handleSubscribe(&Request{client: client, Request: message.Request{Streams: []string{"eurusd.trades"}}})
+	stale := counterValue(t, "rango_stale_messages_total", "", "")
+
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1"}`)})
+	time.Sleep(2 * opts.MessageTTL)
+	hub.ReceiveMsg(&Message{Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"2"}`)})
+
+	// The write loop starts late, as for a client catching up.
+	go client.write()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, subscribed(`"eurusd.trades"`), string(msg), "the subscription response is never stale")
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"eurusd.trades":{"price":"2"}}`, string(msg))
+	assert.Equal(t, stale+1, counterValue(t, "rango_stale_messages_total", "", ""))
+}
@@ -0,0 +1,256 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+const (
+	// Delay after the first failed fetch, doubled on every consecutive failure.
+	minFetchBackoff = 100 * time.Millisecond
+
+	// Maximum delay between failed fetches.
+	maxFetchBackoff = 30 * time.Second
+
+	// Consecutive failed fetches after which the consumer is unhealthy.
+	maxFetchFailures = 5
+)
+
+// CommitMode selects when consumed records are committed.
+type CommitMode string
+
+const (
+	// CommitImmediate commits each record once handled.
+	CommitImmediate CommitMode = "immediate"
+
+	// CommitBatched commits the records of a fetch once all are handled.
+	CommitBatched CommitMode = "batched"
+
+	// CommitLatest commits the last record of each partition in a fetch once
+	// all are handled.
+	CommitLatest CommitMode = "latest"
+)
+
+// ParseCommitMode returns the commit mode named s.
+func ParseCommitMode(s string) (CommitMode, error) {
+	switch m := CommitMode(s); m {
+	case CommitImmediate, CommitBatched, CommitLatest:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown commit mode %s", s)
+	}
+}
+
+// OffsetReset selects where consumers start when no offset was committed.
+type OffsetReset string
+
+const (
+	// OffsetEarliest starts from the first record retained.
+	OffsetEarliest OffsetReset = "earliest"
+
+	// OffsetLatest starts from the next record produced.
+	OffsetLatest OffsetReset = "latest"
+)
+
+// ParseOffsetReset returns the offset reset named s.
+func ParseOffsetReset(s string) (OffsetReset, error) {
+	switch r := OffsetReset(s); r {
+	case OffsetEarliest, OffsetLatest:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown offset reset %s", s)
+	}
+}
+
+// StartOffset returns the offset consumers start from, the first record
+// produced at or after start unless zero, the offset of reset otherwise.
+func StartOffset(reset OffsetReset, start time.Time) kgo.Offset {
+	switch {
+	case !start.IsZero():
+		return kgo.NewOffset().AfterMilli(start.UnixMilli())
+	case reset == OffsetEarliest:
+		return kgo.NewOffset().AtStart()
+	default:
+		return kgo.NewOffset().AtEnd()
+	}
+}
+
+// kafkaClient is the subset of *kgo.Client used by the source.
+type kafkaClient interface {
+	PollFetches(ctx context.Context) kgo.Fetches
+	CommitRecords(ctx context.Context, rs ...*kgo.Record) error
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// Kafka consumes records with a franz-go client, committing records once
+// handled according to its commit mode. Failed fetches are retried with an
+// exponential backoff.
+type Kafka struct {
+	client     kafkaClient
+	commitMode CommitMode
+	healthy    int32
+
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxFailures int
+}
+
+// NewKafka creates a source consuming records with client.
+func NewKafka(client *kgo.Client, mode CommitMode) *Kafka {
+	return newKafka(client, mode)
+}
+
+func newKafka(client kafkaClient, mode CommitMode) *Kafka {
+	return &Kafka{
+		client:      client,
+		commitMode:  mode,
+		minBackoff:  minFetchBackoff,
+		maxBackoff:  maxFetchBackoff,
+		maxFailures: maxFetchFailures,
+	}
+}
+
+// Healthy returns false while brokers can't be reached.
+func (k *Kafka) Healthy() bool {
+	return atomic.LoadInt32(&k.healthy) == 1
+}
+
+func (k *Kafka) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&k.healthy, v) != v {
+		if healthy {
+			log.Info().Msg("Kafka consumer is healthy")
+		} else {
+			log.Error().Msg("Kafka consumer is unhealthy")
+		}
+	}
+}
+
+// backoff returns the delay to wait after the given number of consecutive failures.
+func (k *Kafka) backoff(failures int) time.Duration {
+	d := k.minBackoff
+	for i := 1; i < failures && d < k.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > k.maxBackoff {
+		d = k.maxBackoff
+	}
+	return d
+}
+
+func (k *Kafka) Run(ctx context.Context, handle Handler) error {
+	defer k.client.Close()
+
+	k.setHealthy(k.client.Ping(ctx) == nil)
+
+	failures := 0
+	for {
+		fetches := k.client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		errs := fetches.Errors()
+		for i, fe := range errs {
+			log.Error().Msgf("Fetch error %d: %v", i, fe.Err)
+		}
+
+		if len(errs) != 0 && fetches.NumRecords() == 0 {
+			failures++
+			if failures >= k.maxFailures {
+				k.setHealthy(false)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(k.backoff(failures)):
+			}
+			continue
+		}
+
+		failures = 0
+		k.setHealthy(true)
+
+		k.handle(fetches.Records(), handle)
+	}
+}
+
+// handle dispatches the records of a fetch and commits them. Unless
+// committing immediately, the fetch is only committed once every record has
+// been handled, keeping at-least-once delivery.
+func (k *Kafka) handle(records []*kgo.Record, handle Handler) {
+	for _, r := range records {
+		handle(fromKafka(r))
+
+		if k.commitMode == CommitImmediate {
+			k.commit(r)
+		}
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	switch k.commitMode {
+	case CommitBatched:
+		k.commit(records...)
+	case CommitLatest:
+		k.commit(latestRecords(records)...)
+	}
+}
+
+// latestRecords returns the record with the highest offset of each partition.
+func latestRecords(records []*kgo.Record) []*kgo.Record {
+	type partition struct {
+		topic string
+		id    int32
+	}
+
+	latest := make(map[partition]int)
+	var rs []*kgo.Record
+	for _, r := range records {
+		p := partition{r.Topic, r.Partition}
+		i, ok := latest[p]
+		if !ok {
+			latest[p] = len(rs)
+			rs = append(rs, r)
+		} else if r.Offset > rs[i].Offset {
+			rs[i] = r
+		}
+	}
+	return rs
+}
+
+func (k *Kafka) commit(records ...*kgo.Record) {
+	if err := k.client.CommitRecords(context.Background(), records...); err != nil {
+		log.Error().Msgf("Commit failed: %s", err.Error())
+	}
+}
+
+func fromKafka(r *kgo.Record) *routing.Message {
+	headers := make([]routing.Header, len(r.Headers))
+	for i, h := range r.Headers {
+		headers[i] = routing.Header{Key: h.Key, Value: h.Value}
+	}
+
+	return &routing.Message{
+		Topic:     r.Topic,
+		Key:       r.Key,
+		Value:     r.Value,
+		Headers:   headers,
+		Timestamp: r.Timestamp,
+	}
+}
@@ -0,0 +1,76 @@
+package source
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// SASL mechanisms supported to authenticate with the brokers.
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// KafkaAuth configures how the client connects to the brokers, over TLS and
+// authenticated with a SASL mechanism when set.
+type KafkaAuth struct {
+	TLS       bool
+	Mechanism string
+	User      string
+	Password  string
+}
+
+// SASL returns the SASL mechanism authenticating the client, nil without
+// mechanism. Mechanism names are case insensitive.
+func (a KafkaAuth) SASL() (sasl.Mechanism, error) {
+	if a.Mechanism == "" {
+		if a.User != "" || a.Password != "" {
+			return nil, errors.New("SASL credentials given without mechanism")
+		}
+		return nil, nil
+	}
+	if a.User == "" || a.Password == "" {
+		return nil, fmt.Errorf("SASL mechanism %s requires a user and a password", a.Mechanism)
+	}
+
+	switch strings.ToUpper(a.Mechanism) {
+	case SASLPlain:
+		return plain.Auth{User: a.User, Pass: a.Password}.AsMechanism(), nil
+	case SASLScramSHA256:
+		return scram.Sha256(a.scramAuth), nil
+	case SASLScramSHA512:
+		return scram.Sha512(a.scramAuth), nil
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %s", a.Mechanism)
+	}
+}
+
+func (a KafkaAuth) scramAuth(context.Context) (scram.Auth, error) {
+	return scram.Auth{User: a.User, Pass: a.Password}, nil
+}
+
+// Opts returns the client options connecting to the brokers as configured.
+func (a KafkaAuth) Opts() ([]kgo.Opt, error) {
+	opts := []kgo.Opt{}
+	if a.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+
+	mechanism, err := a.SASL()
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	return opts, nil
+}
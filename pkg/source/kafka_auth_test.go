@@ -0,0 +1,56 @@
+package source
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaAuth(t *testing.T) {
+	tests := map[string]struct {
+		auth      KafkaAuth
+		mechanism string
+		opts      int
+		first     string
+	}{
+		"plaintext":     {KafkaAuth{}, "", 0, ""},
+		"tls":           {KafkaAuth{TLS: true}, "", 1, ""},
+		"plain":         {KafkaAuth{TLS: true, Mechanism: "plain", User: "rango", Password: "secret"}, SASLPlain, 2, "\x00rango\x00secret"},
+		"scram-sha-256": {KafkaAuth{TLS: true, Mechanism: "SCRAM-SHA-256", User: "rango", Password: "secret"}, SASLScramSHA256, 2, "n,,n=rango,r="},
+		"scram-sha-512": {KafkaAuth{Mechanism: "SCRAM-SHA-512", User: "rango", Password: "secret"}, SASLScramSHA512, 1, "n,,n=rango,r="},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts, err := tt.auth.Opts()
+			require.NoError(t, err)
+			assert.Len(t, opts, tt.opts)
+
+			mechanism, err := tt.auth.SASL()
+			require.NoError(t, err)
+			if tt.mechanism == "" {
+				assert.Nil(t, mechanism)
+				return
+			}
+			assert.Equal(t, tt.mechanism, mechanism.Name())
+
+			_, first, err := mechanism.Authenticate(context.Background(), "localhost:9092")
+			require.NoError(t, err)
+			assert.Contains(t, string(first), tt.first)
+		})
+	}
+
+	t.Run("misconfigured", func(t *testing.T) {
+		for _, auth := range []KafkaAuth{
+			{Mechanism: "GSSAPI", User: "rango", Password: "secret"},
+			{Mechanism: "PLAIN", User: "rango"},
+			{Mechanism: "SCRAM-SHA-256", Password: "secret"},
+			{User: "rango", Password: "secret"},
+		} {
+			_, err := auth.Opts()
+			assert.Error(t, err, auth.Mechanism)
+		}
+	})
+}
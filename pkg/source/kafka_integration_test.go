@@ -0,0 +1,60 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// TestKafkaOffsetReset consumes a seeded topic of the brokers listed in
+// KAFKA_TEST_BROKERS from the earliest and latest offsets.
+func TestKafkaOffsetReset(t *testing.T) {
+	brokers := os.Getenv("KAFKA_TEST_BROKERS")
+	if brokers == "" {
+		t.Skip("KAFKA_TEST_BROKERS not set")
+	}
+	seeds := kgo.SeedBrokers(strings.Split(brokers, ",")...)
+	topic := fmt.Sprintf("rango.test.%d", time.Now().UnixNano())
+
+	producer, err := kgo.NewClient(seeds, kgo.AllowAutoTopicCreation(), kgo.DefaultProduceTopic(topic))
+	require.NoError(t, err)
+	defer producer.Close()
+
+	produce := func(key string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, producer.ProduceSync(ctx, &kgo.Record{Key: []byte(key), Value: []byte(`{}`)}).FirstErr())
+	}
+	produce("public.eurusd.seeded")
+
+	// consume returns the keys of the records polled within timeout.
+	consume := func(client *kgo.Client, timeout time.Duration) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		keys := []string{}
+		for _, r := range client.PollFetches(ctx).Records() {
+			keys = append(keys, string(r.Key))
+		}
+		return keys
+	}
+
+	earliest, err := kgo.NewClient(seeds, kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(StartOffset(OffsetEarliest, time.Time{})))
+	require.NoError(t, err)
+	defer earliest.Close()
+	require.Equal(t, []string{"public.eurusd.seeded"}, consume(earliest, 10*time.Second))
+
+	latest, err := kgo.NewClient(seeds, kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(StartOffset(OffsetLatest, time.Time{})))
+	require.NoError(t, err)
+	defer latest.Close()
+	require.Empty(t, consume(latest, 2*time.Second))
+
+	produce("public.eurusd.live")
+	require.Equal(t, []string{"public.eurusd.live"}, consume(latest, 10*time.Second))
+}
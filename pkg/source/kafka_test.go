@@ -0,0 +1,256 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+func TestFromKafka(t *testing.T) {
+	ts := time.Unix(1588000798, 0)
+	msg := fromKafka(&kgo.Record{
+		Topic: "rango.events",
+		Key:   []byte("public.eurusd.trades"),
+		Value: []byte(`{"price":"1.0"}`),
+		Headers: []kgo.RecordHeader{
+			{Key: "snapshot", Value: []byte("true")},
+			{Key: "trace", Value: []byte("a")},
+			{Key: "trace", Value: []byte("b")},
+		},
+		Timestamp: ts,
+	})
+
+	assert.Equal(t, &routing.Message{
+		Topic: "rango.events",
+		Key:   []byte("public.eurusd.trades"),
+		Value: []byte(`{"price":"1.0"}`),
+		Headers: []routing.Header{
+			{Key: "snapshot", Value: []byte("true")},
+			{Key: "trace", Value: []byte("a")},
+			{Key: "trace", Value: []byte("b")},
+		},
+		Timestamp: ts,
+	}, msg)
+
+	v, ok := msg.Header("trace")
+	assert.True(t, ok)
+	assert.Equal(t, "a", string(v))
+
+	assert.Empty(t, fromKafka(&kgo.Record{Key: []byte("public.eurusd.trades")}).Headers)
+}
+
+// fakeKafka replays scripted fetches, then blocks until the context is done.
+type fakeKafka struct {
+	fetches   chan kgo.Fetches
+	commits   chan *kgo.Record
+	pingError error
+}
+
+func (f *fakeKafka) PollFetches(ctx context.Context) kgo.Fetches {
+	select {
+	case fs := <-f.fetches:
+		return fs
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (f *fakeKafka) CommitRecords(ctx context.Context, rs ...*kgo.Record) error {
+	for _, r := range rs {
+		f.commits <- r
+	}
+	return nil
+}
+
+func (f *fakeKafka) Ping(ctx context.Context) error { return f.pingError }
+func (f *fakeKafka) Close()                         {}
+
+func failedFetch() kgo.Fetches {
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "rango.events",
+		Partitions: []kgo.FetchPartition{{Err: errors.New("broker unreachable")}},
+	}}}}
+}
+
+func recordFetch(r *kgo.Record) kgo.Fetches {
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "rango.events",
+		Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{r}}},
+	}}}}
+}
+
+func TestKafkaBackoff(t *testing.T) {
+	k := newKafka(nil, CommitImmediate)
+	assert.Equal(t, 100*time.Millisecond, k.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, k.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, k.backoff(4))
+	assert.Equal(t, 30*time.Second, k.backoff(20))
+}
+
+func TestKafkaHealth(t *testing.T) {
+	client := &fakeKafka{
+		fetches:   make(chan kgo.Fetches),
+		commits:   make(chan *kgo.Record, 1),
+		pingError: errors.New("broker unreachable"),
+	}
+	k := newKafka(client, CommitImmediate)
+	k.minBackoff, k.maxBackoff, k.maxFailures = time.Millisecond, 5*time.Millisecond, 3
+
+	handled := make(chan *routing.Message, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- k.Run(ctx, func(m *routing.Message) { handled <- m })
+	}()
+
+	for i := 0; i < 3; i++ {
+		client.fetches <- failedFetch()
+	}
+	assert.Eventually(t, func() bool { return !k.Healthy() }, time.Second, time.Millisecond)
+
+	record := &kgo.Record{Key: []byte("public.eurusd.trades"), Value: []byte(`{}`)}
+	client.fetches <- recordFetch(record)
+
+	assert.Equal(t, "public.eurusd.trades", string((<-handled).Key))
+	assert.Equal(t, record, <-client.commits)
+	assert.True(t, k.Healthy())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// countingKafka counts the commits, each taking a round trip to a goroutine.
+type countingKafka struct {
+	kafkaClient
+	commits   int
+	committed int
+	broker    chan chan struct{}
+}
+
+func newCountingKafka() *countingKafka {
+	c := &countingKafka{broker: make(chan chan struct{})}
+	go func() {
+		for ack := range c.broker {
+			close(ack)
+		}
+	}()
+	return c
+}
+
+func (c *countingKafka) CommitRecords(ctx context.Context, rs ...*kgo.Record) error {
+	ack := make(chan struct{})
+	c.broker <- ack
+	<-ack
+
+	c.commits++
+	c.committed += len(rs)
+	return nil
+}
+
+func records(n int) []*kgo.Record {
+	rs := make([]*kgo.Record, n)
+	for i := range rs {
+		rs[i] = &kgo.Record{Topic: "rango.events", Key: []byte("public.eurusd.trades"), Value: []byte(`{}`), Offset: int64(i)}
+	}
+	return rs
+}
+
+func TestKafkaCommitMode(t *testing.T) {
+	tests := map[CommitMode]struct{ commits, committed int }{
+		CommitImmediate: {3, 3},
+		CommitBatched:   {1, 3},
+		CommitLatest:    {1, 1},
+	}
+
+	for mode, tt := range tests {
+		t.Run(string(mode), func(t *testing.T) {
+			client := newCountingKafka()
+			defer close(client.broker)
+
+			handled := 0
+			newKafka(client, mode).handle(records(3), func(*routing.Message) { handled++ })
+
+			assert.Equal(t, 3, handled)
+			assert.Equal(t, tt.commits, client.commits)
+			assert.Equal(t, tt.committed, client.committed)
+		})
+	}
+}
+
+func TestLatestRecords(t *testing.T) {
+	rs := []*kgo.Record{
+		{Topic: "rango.events", Partition: 0, Offset: 4},
+		{Topic: "rango.events", Partition: 1, Offset: 2},
+		{Topic: "rango.events", Partition: 0, Offset: 5},
+		{Topic: "rango.private", Partition: 0, Offset: 1},
+		{Topic: "rango.events", Partition: 1, Offset: 3},
+	}
+
+	assert.Equal(t, []*kgo.Record{rs[2], rs[4], rs[3]}, latestRecords(rs))
+	assert.Empty(t, latestRecords(nil))
+}
+
+func TestParseCommitMode(t *testing.T) {
+	mode, err := ParseCommitMode("batched")
+	assert.NoError(t, err)
+	assert.Equal(t, CommitBatched, mode)
+
+	mode, err = ParseCommitMode("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, CommitLatest, mode)
+
+	_, err = ParseCommitMode("never")
+	assert.Error(t, err)
+}
+
+func TestParseOffsetReset(t *testing.T) {
+	reset, err := ParseOffsetReset("earliest")
+	assert.NoError(t, err)
+	assert.Equal(t, OffsetEarliest, reset)
+
+	reset, err = ParseOffsetReset("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, OffsetLatest, reset)
+
+	_, err = ParseOffsetReset("middle")
+	assert.Error(t, err)
+}
+
+func TestStartOffset(t *testing.T) {
+	start := time.Unix(1588000798, 0)
+	assert.Equal(t, kgo.NewOffset().AtStart(), StartOffset(OffsetEarliest, time.Time{}))
+	assert.Equal(t, kgo.NewOffset().AtEnd(), StartOffset(OffsetLatest, time.Time{}))
+	assert.Equal(t, kgo.NewOffset().AfterMilli(1588000798000), StartOffset(OffsetEarliest, start))
+}
+
+func benchmarkKafkaCommit(b *testing.B, mode CommitMode) {
+	client := newCountingKafka()
+	defer close(client.broker)
+	k := newKafka(client, mode)
+	rs := records(100)
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		k.handle(rs, func(*routing.Message) {})
+	}
+	b.ReportMetric(float64(b.N*len(rs))/time.Since(start).Seconds(), "records/s")
+}
+
+func BenchmarkKafkaCommitImmediate(b *testing.B) {
+	benchmarkKafkaCommit(b, CommitImmediate)
+}
+
+func BenchmarkKafkaCommitBatched(b *testing.B) {
+	benchmarkKafkaCommit(b, CommitBatched)
+}
+
+func BenchmarkKafkaCommitLatest(b *testing.B) {
+	benchmarkKafkaCommit(b, CommitLatest)
+}
@@ -0,0 +1,64 @@
+package source
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// NATS subscribes to a subject, the routing key of a record is the subject
+// of the message without the subscription prefix:
+// subscribing to rango.events.> routes rango.events.public.ethusdt.trades as public.ethusdt.trades.
+// Messages published to JetStream streams are received as well.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATS creates a source subscribing to subject on conn.
+func NewNATS(conn *nats.Conn, subject string) *NATS {
+	return &NATS{conn: conn, subject: subject}
+}
+
+func (n *NATS) Healthy() bool {
+	return n.conn.IsConnected()
+}
+
+func (n *NATS) Run(ctx context.Context, handle Handler) error {
+	defer n.conn.Close()
+
+	prefix := strings.TrimSuffix(strings.TrimSuffix(n.subject, ">"), "*")
+	topic := strings.TrimSuffix(prefix, ".")
+
+	sub, err := n.conn.Subscribe(n.subject, func(m *nats.Msg) {
+		handle(fromNATS(topic, prefix, m))
+	})
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	return sub.Unsubscribe()
+}
+
+func fromNATS(topic, prefix string, m *nats.Msg) *routing.Message {
+	headers := []routing.Header{}
+	for k, values := range m.Header {
+		for _, v := range values {
+			headers = append(headers, routing.Header{Key: k, Value: []byte(v)})
+		}
+	}
+
+	return &routing.Message{
+		Topic:     topic,
+		Key:       []byte(strings.TrimPrefix(m.Subject, prefix)),
+		Value:     m.Data,
+		Headers:   headers,
+		Timestamp: time.Now(),
+	}
+}
@@ -0,0 +1,57 @@
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+func TestNATS(t *testing.T) {
+	server := test.RunRandClientPortServer()
+	defer server.Shutdown()
+
+	conn, err := nats.Connect(server.ClientURL())
+	require.NoError(t, err)
+
+	records := make(chan *routing.Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewNATS(conn, "rango.events.>").Run(ctx, func(r *routing.Message) {
+			records <- r
+		})
+	}()
+
+	publisher, err := nats.Connect(server.ClientURL())
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	msg := nats.NewMsg("rango.events.public.eurusd.trades")
+	msg.Data = []byte(`{"price":"1.0"}`)
+	msg.Header.Set("snapshot", "true")
+
+	require.Eventually(t, func() bool {
+		require.NoError(t, publisher.PublishMsg(msg))
+		select {
+		case r := <-records:
+			assert.Equal(t, "rango.events", r.Topic)
+			assert.Equal(t, "public.eurusd.trades", string(r.Key))
+			assert.Equal(t, `{"price":"1.0"}`, string(r.Value))
+			assert.Equal(t, []routing.Header{{Key: "snapshot", Value: []byte("true")}}, r.Headers)
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.True(t, conn.IsClosed())
+}
@@ -0,0 +1,71 @@
+package source
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// Redis subscribes to Pub/Sub channel patterns, the routing key of a record
+// is the name of the channel it was published to, e.g. public.ethusdt.trades.
+type Redis struct {
+	client   *redis.Client
+	channels []string
+}
+
+// NewRedis creates a source subscribing to the channel patterns on client.
+func NewRedis(client *redis.Client, channels []string) *Redis {
+	return &Redis{client: client, channels: channels}
+}
+
+// Time allowed to ping redis when checking health.
+const redisPingTimeout = time.Second
+
+func (r *Redis) Healthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+
+	return r.client.Ping(ctx).Err() == nil
+}
+
+func (r *Redis) Run(ctx context.Context, handle Handler) error {
+	defer r.client.Close()
+
+	pubsub := r.client.PSubscribe(ctx, r.channels...)
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			handle(fromRedis(m))
+		}
+	}
+}
+
+func fromRedis(m *redis.Message) *routing.Message {
+	topic := m.Pattern
+	if topic == "" {
+		topic = m.Channel
+	}
+
+	return &routing.Message{
+		Topic:     topic,
+		Key:       []byte(m.Channel),
+		Value:     []byte(m.Payload),
+		Timestamp: time.Now(),
+	}
+}
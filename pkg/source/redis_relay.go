@@ -0,0 +1,69 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// RedisRelay relays messages between instances over a Redis Pub/Sub channel,
+// messages being published as JSON with their topic, headers and timestamp.
+type RedisRelay struct {
+	client  *redis.Client
+	channel string
+}
+
+// NewRedisRelay creates a relay publishing to and subscribing to channel on
+// client.
+func NewRedisRelay(client *redis.Client, channel string) *RedisRelay {
+	return &RedisRelay{client: client, channel: channel}
+}
+
+func (r *RedisRelay) Publish(ctx context.Context, msg *routing.Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel, b).Err()
+}
+
+func (r *RedisRelay) Healthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+
+	return r.client.Ping(ctx).Err() == nil
+}
+
+func (r *RedisRelay) Run(ctx context.Context, handle Handler) error {
+	defer r.client.Close()
+
+	pubsub := r.client.Subscribe(ctx, r.channel)
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			msg := &routing.Message{}
+			if err := json.Unmarshal([]byte(m.Payload), msg); err != nil {
+				log.Error().Msgf("Invalid relayed message: %s", err.Error())
+				continue
+			}
+			handle(msg)
+		}
+	}
+}
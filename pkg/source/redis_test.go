@@ -0,0 +1,60 @@
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	records := make(chan *routing.Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewRedis(client, []string{"public.*", "private.*"}).Run(ctx, func(r *routing.Message) {
+			records <- r
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		return server.PubSubNumPat() == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	server.Publish("public.eurusd.trades", `{"price":"1.0"}`)
+	server.Publish("private.UIDABC00001.order", `{"id":1}`)
+	server.Publish("other.eurusd.trades", `{}`)
+
+	r := <-records
+	assert.Equal(t, "public.*", r.Topic)
+	assert.Equal(t, "public.eurusd.trades", string(r.Key))
+	assert.Equal(t, `{"price":"1.0"}`, string(r.Value))
+
+	r = <-records
+	assert.Equal(t, "private.*", r.Topic)
+	assert.Equal(t, "private.UIDABC00001.order", string(r.Key))
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Empty(t, records)
+}
+
+func TestRedisHealthy(t *testing.T) {
+	server := miniredis.RunT(t)
+	src := NewRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}), []string{"public.*"})
+
+	assert.True(t, src.Healthy())
+
+	server.Close()
+	assert.False(t, src.Healthy())
+}
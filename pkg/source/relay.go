@@ -0,0 +1,75 @@
+package source
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// Relay re-broadcasts messages between the instances of rango.
+//
+// Instances consuming Kafka with a random consumer group each receive every
+// message, which they fan out to their own clients, but every instance reads
+// the whole feed. Instances sharing a stable consumer group split the
+// partitions between them instead, and relay the messages of their partitions
+// to every instance, themselves included, so that each still fans out every
+// message to its clients.
+type Relay interface {
+	// Publish re-broadcasts msg to every instance.
+	Publish(ctx context.Context, msg *routing.Message) error
+
+	// Run delivers the messages published by every instance.
+	Source
+}
+
+// relayed consumes a source relaying its messages to every instance.
+type relayed struct {
+	src   Source
+	relay Relay
+}
+
+// Relayed returns a source consuming src, each message of src being published
+// to relay, and delivering the messages relayed by every instance.
+func Relayed(src Source, relay Relay) Source {
+	return &relayed{src: src, relay: relay}
+}
+
+// Run runs the source and the relay until ctx is done or either fails, the
+// error of the first one failing being returned.
+func (r *relayed) Run(ctx context.Context, handle Handler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		err  error
+	)
+	run := func(f func() error) {
+		defer wg.Done()
+		if e := f(); e != nil {
+			once.Do(func() { err = e })
+		}
+		cancel()
+	}
+
+	wg.Add(2)
+	go run(func() error { return r.relay.Run(ctx, handle) })
+	go run(func() error {
+		return r.src.Run(ctx, func(msg *routing.Message) {
+			if err := r.relay.Publish(ctx, msg); err != nil {
+				log.Error().Str("key", string(msg.Key)).Msgf("Failed to relay message: %s", err.Error())
+			}
+		})
+	})
+	wg.Wait()
+
+	return err
+}
+
+func (r *relayed) Healthy() bool {
+	return r.src.Healthy() && r.relay.Healthy()
+}
@@ -0,0 +1,128 @@
+package source
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// partitionSource delivers the messages of the partitions assigned to an
+// instance sharing a consumer group.
+type partitionSource struct {
+	start    chan struct{}
+	messages []*routing.Message
+}
+
+func (s *partitionSource) Run(ctx context.Context, handle Handler) error {
+	select {
+	case <-s.start:
+	case <-ctx.Done():
+		return nil
+	}
+	for _, msg := range s.messages {
+		handle(msg)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (s *partitionSource) Healthy() bool { return true }
+
+// instance collects the messages delivered to the hub of an instance.
+type instance struct {
+	mutex    sync.Mutex
+	received []string
+}
+
+func (i *instance) handle(msg *routing.Message) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.received = append(i.received, string(msg.Key)+" "+string(msg.Value))
+}
+
+func (i *instance) Received() []string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([]string{}, i.received...)
+}
+
+func TestRelayed(t *testing.T) {
+	server := miniredis.RunT(t)
+	start := make(chan struct{})
+
+	ts := time.Unix(1588000798, 0).UTC()
+	partitions := [][]*routing.Message{
+		{{Topic: "rango.events", Key: []byte("public.eurusd.trades"), Value: []byte(`{"price":"1.0"}`), Timestamp: ts}},
+		{{Topic: "rango.events", Key: []byte("private.UIDABC00001.order"), Value: []byte(`{"id":1}`), Headers: []routing.Header{{Key: "snapshot", Value: []byte("true")}}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	instances := make([]*instance, len(partitions))
+	done := make(chan error, len(partitions))
+	for n, messages := range partitions {
+		instances[n] = &instance{}
+		relay := NewRedisRelay(redis.NewClient(&redis.Options{Addr: server.Addr()}), "rango.relay")
+		src := Relayed(&partitionSource{start: start, messages: messages}, relay)
+		assert.True(t, src.Healthy())
+
+		go func(i *instance) { done <- src.Run(ctx, i.handle) }(instances[n])
+	}
+
+	require.Eventually(t, func() bool {
+		return server.PubSubNumSub("rango.relay")["rango.relay"] == len(partitions)
+	}, 2*time.Second, 10*time.Millisecond)
+	close(start)
+
+	for n, i := range instances {
+		require.Eventually(t, func() bool { return len(i.Received()) == 2 }, 2*time.Second, 10*time.Millisecond, "instance %d", n)
+		assert.ElementsMatch(t, []string{
+			`public.eurusd.trades {"price":"1.0"}`,
+			`private.UIDABC00001.order {"id":1}`,
+		}, i.Received())
+	}
+
+	cancel()
+	for range partitions {
+		assert.NoError(t, <-done)
+	}
+}
+
+func TestRedisRelay(t *testing.T) {
+	server := miniredis.RunT(t)
+	relay := NewRedisRelay(redis.NewClient(&redis.Options{Addr: server.Addr()}), "rango.relay")
+
+	records := make(chan *routing.Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- relay.Run(ctx, func(r *routing.Message) { records <- r })
+	}()
+
+	require.Eventually(t, func() bool {
+		return server.PubSubNumSub("rango.relay")["rango.relay"] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	msg := &routing.Message{
+		Topic:     "rango.private",
+		Key:       []byte("UIDABC00001.order"),
+		Value:     []byte(`{"id":1}`),
+		Headers:   []routing.Header{{Key: "trace", Value: []byte("a")}},
+		Timestamp: time.Unix(1588000798, 0).UTC(),
+	}
+	require.NoError(t, relay.Publish(ctx, msg))
+	server.Publish("rango.relay", "not json")
+
+	assert.Equal(t, msg, <-records)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Empty(t, records)
+}
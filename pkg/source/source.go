@@ -0,0 +1,21 @@
+// Package source provides the upstream message sources feeding the hub.
+package source
+
+import (
+	"context"
+
+	"github.com/nusa-exchange/rango/pkg/routing"
+)
+
+// Handler is called for every message received by a source.
+type Handler func(*routing.Message)
+
+// Source delivers upstream messages to a handler.
+type Source interface {
+	// Run delivers messages to handle until ctx is done, then releases its
+	// resources and returns.
+	Run(ctx context.Context, handle Handler) error
+
+	// Healthy returns true while the source is connected to its upstream.
+	Healthy() bool
+}